@@ -2,9 +2,11 @@ package cli
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"net/http"
@@ -22,6 +24,7 @@ import (
 	"oadin/console"
 	"oadin/internal/api"
 	"oadin/internal/api/dto"
+	"oadin/internal/convert"
 	"oadin/internal/datastore"
 	"oadin/internal/datastore/jsonds"
 	jsondsTemplate "oadin/internal/datastore/jsonds/data"
@@ -116,6 +119,13 @@ func NewCommand() *cobra.Command {
 		// Export/Import
 		NewExportServiceCommand(),
 		NewImportServiceCommand(),
+
+		// Flavors
+		NewFlavorCommand(),
+		NewDebugCommand(),
+
+		// Tasks
+		NewPsCommand(),
 	)
 
 	return cmds
@@ -273,7 +283,8 @@ func Run(ctx context.Context) error {
 	}
 
 	// start
-	schedule.StartScheduler("basic")
+	schedule.StartScheduler(config.GlobalOadinEnvironment.Scheduler)
+	oadinServer.Batches.Resume(ctx)
 
 	// Inject the router
 	api.InjectRouter(oadinServer)
@@ -297,6 +308,11 @@ func Run(ctx context.Context) error {
 	// create a cancel context
 	ctx, cancel := context.WithCancel(ctx)
 
+	// reload the flavors when the user flavor files change
+	if err := schedule.WatchAPIFlavors(ctx, config.GlobalOadinEnvironment.RootDir); err != nil {
+		slog.Error("[Run] Failed to watch user flavors, reload them by hand", "error", err)
+	}
+
 	// create error chan
 	errChan := make(chan error, 2)
 
@@ -801,6 +817,63 @@ func NewListProvidersCommand() *cobra.Command {
 	return listModelCmd
 }
 
+func NewPsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "ps",
+		Short: "List the service tasks waiting and running",
+		Long:  `List the service tasks waiting and running in the scheduler, the running ones first.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			resp := dto.ListTasksResponse{}
+
+			c := config.NewOadinClient()
+			routerPath := fmt.Sprintf("/oadin/%s/tasks", version.OadinVersion)
+
+			err := c.Client.Do(context.Background(), http.MethodGet, routerPath, nil, &resp)
+			if err != nil {
+				fmt.Printf("\rGet task list failed: %s", err.Error())
+				return
+			}
+
+			fmt.Printf("%-8s %-10s %-10s %-25s %-20s %-8s %-9s %-7s %-10s %-10s %s\n",
+				"ID", "SERVICE", "FLAVOR", "PROVIDER", "MODEL", "STATE", "PRIORITY", "STREAM", "QUEUED", "RUNNING", "CLIENT") // 表头
+
+			now := time.Now()
+			for _, t := range resp.Data {
+				queued, running := now.Sub(t.EnqueuedAt).Round(time.Second).String(), "-"
+				if t.StartedAt != nil {
+					queued = t.StartedAt.Sub(t.EnqueuedAt).Round(time.Millisecond).String()
+					running = now.Sub(*t.StartedAt).Round(time.Second).String()
+				}
+				state := t.State
+				if t.Cancelled {
+					state = "cancelling"
+				}
+				provider, model := t.ServiceProvider, t.Model
+				if provider == "" {
+					provider = "-"
+				}
+				if model == "" {
+					model = "-"
+				}
+
+				fmt.Printf("%-8d %-10s %-10s %-25s %-20s %-8s %-9d %-7t %-10s %-10s %s\n",
+					t.ID,
+					t.Service,
+					t.Flavor,
+					provider,
+					model,
+					state,
+					t.Priority,
+					t.Stream,
+					queued,
+					running,
+					t.UserAgent,
+				)
+			}
+		},
+	}
+}
+
 func installServiceProviderHandler(configFile string) error {
 	if configFile == "" {
 		return fmt.Errorf("configuration file is required")
@@ -914,7 +987,7 @@ func InstallServiceHandler(cmd *cobra.Command, args []string) {
 				fmt.Println("Error: auth_key is required when auth_type is not none")
 				return
 			}
-			if flavorName != types.FlavorTencent && flavorName != types.FlavorDeepSeek && flavorName != types.FlavorOllama && flavorName != types.FlavorOpenAI {
+			if flavorName != types.FlavorTencent && flavorName != types.FlavorDeepSeek && flavorName != types.FlavorOllama && flavorName != types.FlavorOpenAI && flavorName != types.FlavorAnthropic && flavorName != types.FlavorGemini {
 				fmt.Printf("\rInvalid flavor: %s", flavorName)
 				return
 			}
@@ -1316,6 +1389,188 @@ func NewImportServiceCommand() *cobra.Command {
 	return cmd
 }
 
+func NewFlavorCommand() *cobra.Command {
+	flavorCmd := &cobra.Command{
+		Use:   "flavor",
+		Short: "Manage API flavors",
+	}
+	flavorCmd.AddCommand(NewValidateFlavorCommand())
+
+	return flavorCmd
+}
+
+func NewValidateFlavorCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "validate <file_path>",
+		Short: "Validate a flavor file",
+		Long: "Validate a flavor file before putting it into the flavors directory under the oadin data dir. " +
+			"The flavor is named after the file, e.g. my_gateway.yaml defines the flavor my_gateway.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("please provide a flavor file path")
+			}
+			filePath := args[0]
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return fmt.Errorf("failed to read file: %w", err)
+			}
+			if err := convert.InitConverters(); err != nil {
+				return err
+			}
+			flavor := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+			errs := schedule.ValidateFlavorDef(flavor, data)
+			for _, e := range errs {
+				if e.Line > 0 {
+					fmt.Printf("%s:%d: %s\n", filePath, e.Line, e.Message)
+				} else {
+					fmt.Printf("%s: %s\n", filePath, e.Message)
+				}
+			}
+			if len(errs) > 0 {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("flavor %s is invalid, %d problem(s) found", flavor, len(errs))
+			}
+			fmt.Printf("Flavor %s is valid\n", flavor)
+			return nil
+		},
+	}
+	return cmd
+}
+
+func NewDebugCommand() *cobra.Command {
+	debugCmd := &cobra.Command{
+		Use:   "debug",
+		Short: "Debug tools",
+	}
+	debugCmd.AddCommand(NewDebugConvertCommand())
+
+	return debugCmd
+}
+
+func NewDebugConvertCommand() *cobra.Command {
+	var (
+		req     dto.DebugConvertRequest
+		file    string
+		ctxArgs []string
+		headers []string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "convert",
+		Short: "Show how a body is converted between two flavors",
+		Long: "Convert a request or response body between two flavors on the running oadin server, " +
+			"printing the output of every pipeline step and the body in the oadin format in between.",
+		Example: "  oadin debug convert --from openai --to ollama --service chat -f request.json\n" +
+			"  echo '{...}' | oadin debug convert --from ollama --to openai --conversion response -f - --ctx stream=false",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var (
+				data []byte
+				err  error
+			)
+			if file == "-" {
+				data, err = io.ReadAll(os.Stdin)
+			} else {
+				data, err = os.ReadFile(file)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read body: %w", err)
+			}
+			if json.Valid(data) {
+				req.Body = data
+			} else if req.Body, err = json.Marshal(string(data)); err != nil {
+				return err
+			}
+			if req.Headers, err = parseKeyValues(headers); err != nil {
+				return err
+			}
+			ctxValues, err := parseKeyValues(ctxArgs)
+			if err != nil {
+				return err
+			}
+			req.Ctx = make(map[string]any, len(ctxValues))
+			for k, v := range ctxValues {
+				// stream=true is given to the converters as a bool, like the server does
+				var value any
+				if err := json.Unmarshal([]byte(v), &value); err != nil {
+					value = v
+				}
+				req.Ctx[k] = value
+			}
+
+			var resp dto.DebugConvertResponse
+			c := config.NewOadinClient()
+			routerPath := fmt.Sprintf("/oadin/%s/debug/convert", version.OadinVersion)
+			if err := c.Client.Do(context.Background(), http.MethodPost, routerPath, req, &resp); err != nil {
+				return err
+			}
+
+			for _, step := range resp.Data.Steps {
+				fmt.Printf("==> %s %s step %d (%s)\n", step.Flavor, step.Conversion, step.Step, step.Converter)
+				switch {
+				case step.Error != "":
+					fmt.Printf("error: %s\n", step.Error)
+				case step.Dropped:
+					fmt.Println("dropped")
+				default:
+					printDebugBody(step.Body)
+				}
+			}
+			if len(resp.Data.Oadin) > 0 {
+				fmt.Println("==> oadin")
+				printDebugBody(resp.Data.Oadin)
+			}
+			if resp.Data.Error != "" {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("conversion failed: %s", resp.Data.Error)
+			}
+			fmt.Printf("==> %s\n", req.ToFlavor)
+			printDebugBody(resp.Data.Output)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&req.FromFlavor, "from", "", "Flavor to convert from, e.g: openai (required)")
+	cmd.Flags().StringVar(&req.ToFlavor, "to", "", "Flavor to convert to, e.g: ollama (required)")
+	cmd.Flags().StringVarP(&req.Service, "service", "s", "chat", "Name of the service, e.g: chat/embed")
+	cmd.Flags().StringVarP(&req.Conversion, "conversion", "c", "request", "What to convert: request/response/stream_response")
+	cmd.Flags().StringVarP(&file, "file", "f", "", "File of the body to convert, - for stdin (required)")
+	cmd.Flags().StringArrayVar(&ctxArgs, "ctx", nil, "Convert context given to the converters as key=value, e.g: model=qwen2.5 or stream=true")
+	cmd.Flags().StringArrayVar(&headers, "header", nil, "Header of the body as key=value")
+	for _, flag := range []string{"from", "to", "file"} {
+		if err := cmd.MarkFlagRequired(flag); err != nil {
+			slog.Error("Error: --" + flag + " is required")
+		}
+	}
+
+	return cmd
+}
+
+func parseKeyValues(pairs []string) (map[string]string, error) {
+	values := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("expect key=value but got %q", pair)
+		}
+		values[k] = v
+	}
+	return values, nil
+}
+
+func printDebugBody(body json.RawMessage) {
+	var text string
+	if err := json.Unmarshal(body, &text); err == nil {
+		fmt.Println(text)
+		return
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, body, "", "  "); err != nil {
+		fmt.Println(string(body))
+		return
+	}
+	fmt.Println(buf.String())
+}
+
 func NewExportServiceCommand() *cobra.Command {
 	var service, serviceProvider, model string
 	exportCmd := &cobra.Command{
@@ -1419,7 +1674,10 @@ func ListenModelEngineHealth() {
 		ServiceSource: types.ServiceSourceLocal,
 	}
 
-	OllamaEngine := provider.GetModelEngine(types.FlavorOllama)
+	engines := map[string]provider.ModelServiceProvider{
+		types.FlavorOllama:  provider.GetModelEngine(types.FlavorOllama),
+		types.FlavorWhisper: provider.GetModelEngine(types.FlavorWhisper),
+	}
 
 	for {
 		list, err := ds.List(context.Background(), sp, &datastore.ListOptions{Page: 0, PageSize: 100})
@@ -1441,19 +1699,23 @@ func ListenModelEngineHealth() {
 			engineList = append(engineList, sp.Flavor)
 		}
 		for _, engineName := range engineList {
-			if engineName == types.FlavorOllama {
-				operateStatus := OllamaEngine.GetOperateStatus()
+			if engine, ok := engines[engineName]; ok {
+				operateStatus := engine.GetOperateStatus()
 				if operateStatus == 0 {
 					continue
 				}
-				err := OllamaEngine.HealthCheck()
+				err := engine.HealthCheck()
 				if err != nil {
-					err = OllamaEngine.InitEnv()
+					// an engine that isn't installed, e.g. whisper without its server, has nothing to restart
+					if e, ok := engine.(interface{ Installed() bool }); ok && !e.Installed() {
+						continue
+					}
+					err = engine.InitEnv()
 					if err != nil {
 						slog.Error("[Engine health]Setting env error: ", err.Error())
 						continue
 					}
-					err := OllamaEngine.StartEngine()
+					err := engine.StartEngine()
 					if err != nil {
 						continue
 					}
@@ -24,20 +24,32 @@ import (
 var GlobalOadinEnvironment *OadinEnvironment
 
 type OadinEnvironment struct {
-	ApiHost           string // host
-	Datastore         string // path to the datastore
-	DatastoreType     string // type of the datastore
-	Verbose           string // debug, info or warn
-	RootDir           string // root directory for all assets such as config files
-	WorkDir           string // current work directory
-	APIVersion        string // version of this core app layer (gateway etc.)
-	SpecVersion       string // version of the core specification this app layer supports
-	UpdateDir         string // Installation package storage path
-	LogDir            string // logs dir
-	LogHTTP           string // path to the http log
-	LogLevel          string // log level
-	LogFileExpireDays int    // log file expiration time
-	ConsoleLog        string // oadin server console log path
+	ApiHost           string        // host
+	Datastore         string        // path to the datastore
+	DatastoreType     string        // type of the datastore
+	Verbose           string        // debug, info or warn
+	RootDir           string        // root directory for all assets such as config files
+	WorkDir           string        // current work directory
+	APIVersion        string        // version of this core app layer (gateway etc.)
+	SpecVersion       string        // version of the core specification this app layer supports
+	UpdateDir         string        // Installation package storage path
+	LogDir            string        // logs dir
+	LogHTTP           string        // path to the http log
+	LogLevel          string        // log level
+	LogFileExpireDays int           // log file expiration time
+	ConsoleLog        string        // oadin server console log path
+	RecordFixtures    string        // dir to record the exchanges with service providers as flavor fixtures, empty to disable
+	Scheduler         string        // basic or priority
+	ServiceSlots      string        // tasks a service runs at once, e.g. chat=4,embed=2
+	ProviderSlots     string        // tasks a service provider runs at once, e.g. local_ollama_chat=1
+	LocalSlots        int           // tasks a local service provider not in ProviderSlots runs at once, 0 for no limit
+	PriorityKeys      string        // priority of the requests carrying an api key, e.g. sk-nightly=low,sk-app=high
+	FailoverAttempts  int           // runs of a request under a failover hybrid policy, counting the first
+	FailoverBackoff   time.Duration // wait before the first failover, doubled for each one after
+	BreakerFailures   int           // consecutive failures that open the circuit breaker of a service provider, 0 to disable
+	BreakerCooldown   time.Duration // time an open circuit breaker skips its service provider before a probe
+	ContextThreshold  int           // estimated prompt tokens over which the context_length hybrid policy goes remote, 0 for the context window only
+	RaceDelay         time.Duration // wait for the first token of the local service provider before the race hybrid policy runs the remote one too
 }
 
 var (
@@ -116,6 +128,13 @@ func NewOadinEnvironment() *OadinEnvironment {
 			APIVersion:        version.OadinVersion,
 			SpecVersion:       version.OadinVersion,
 			ConsoleLog:        "console.log",
+			Scheduler:         "basic",
+			LocalSlots:        4,
+			FailoverAttempts:  2,
+			FailoverBackoff:   500 * time.Millisecond,
+			BreakerFailures:   5,
+			BreakerCooldown:   30 * time.Second,
+			RaceDelay:         2 * time.Second,
 		}
 		cwd, err := os.Getwd()
 		if err != nil {
@@ -186,6 +205,18 @@ func (s *OadinEnvironment) Flags() *FlagSets {
 	fs.StringVar(&s.WorkDir, "work-dir", s.WorkDir, "Work directory")
 	fs.StringVar(&s.APIVersion, "app-layer-version", s.APIVersion, "API layer version")
 	fs.StringVar(&s.SpecVersion, "spec-version", s.SpecVersion, "Specification version")
+	fs.StringVar(&s.RecordFixtures, "record-fixtures", s.RecordFixtures, "Record the exchanges with service providers into this directory as flavor conformance fixtures")
+	fs.StringVar(&s.Scheduler, "scheduler", s.Scheduler, "Service scheduler, basic or priority")
+	fs.StringVar(&s.ServiceSlots, "service-slots", s.ServiceSlots, "Tasks a service runs at once with the priority scheduler, e.g. chat=4,embed=2")
+	fs.StringVar(&s.ProviderSlots, "provider-slots", s.ProviderSlots, "Tasks a service provider runs at once with the priority scheduler, e.g. local_ollama_chat=1")
+	fs.IntVar(&s.LocalSlots, "local-slots", s.LocalSlots, "Tasks a local service provider runs at once unless set by --provider-slots, 0 for no limit")
+	fs.StringVar(&s.PriorityKeys, "priority-keys", s.PriorityKeys, "Priority of the requests carrying an api key, e.g. sk-nightly=low,sk-app=high")
+	fs.IntVar(&s.FailoverAttempts, "failover-attempts", s.FailoverAttempts, "Runs of a request under the local_then_remote or remote_then_local hybrid policy, counting the first")
+	fs.DurationVar(&s.FailoverBackoff, "failover-backoff", s.FailoverBackoff, "Wait before the first failover, doubled for each one after")
+	fs.IntVar(&s.BreakerFailures, "breaker-failures", s.BreakerFailures, "Consecutive failures that open the circuit breaker of a service provider, 0 to disable")
+	fs.DurationVar(&s.BreakerCooldown, "breaker-cooldown", s.BreakerCooldown, "Time an open circuit breaker skips its service provider before it lets a probe request through")
+	fs.IntVar(&s.ContextThreshold, "context-threshold", s.ContextThreshold, "Estimated prompt tokens over which the context_length hybrid policy runs a request remote, 0 to go by the context window of the local provider only")
+	fs.DurationVar(&s.RaceDelay, "race-delay", s.RaceDelay, "Wait for the first token of the local service provider before the race hybrid policy sends the request to the remote one too")
 	return fss
 }
 
@@ -19,6 +19,10 @@ type OadinCoreServer struct {
 	MCP             server.MCPServer
 	System          server.System
 	Playground      server.Playground
+	Responses       server.Responses
+	Batches         server.Batches
+	Tasks           server.Tasks
+	Debug           server.Debug
 	DataStore       datastore.Datastore
 }
 
@@ -54,5 +58,9 @@ func (t *OadinCoreServer) Register() {
 	t.MCP = server.NewMCPServer()
 	t.System = server.NewSystemImpl()
 	t.Playground = server.NewPlayground()
+	t.Responses = server.NewResponses()
+	t.Batches = server.NewBatches()
+	t.Tasks = server.NewTasks()
+	t.Debug = server.NewDebug()
 	t.DataStore = datastore.GetDefaultDatastore()
 }
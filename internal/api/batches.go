@@ -0,0 +1,131 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"oadin/internal/types"
+	"oadin/internal/utils/bcode"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxBatchFileSize = 200 << 20
+
+func (t *OadinCoreServer) CreateBatchFile(c *gin.Context) {
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		openaiError(c, bcode.ErrBatchesBadRequest.SetMessage("file is required"))
+		return
+	}
+	defer file.Close()
+	if header.Size > maxBatchFileSize {
+		openaiError(c, bcode.ErrBatchesBadRequest.SetMessage("file size exceeds the maximum limit of 200MB"))
+		return
+	}
+	created, err := t.Batches.CreateFile(c.Request.Context(), header.Filename, c.PostForm("purpose"), file)
+	if err != nil {
+		openaiError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, created.Object())
+}
+
+func (t *OadinCoreServer) ListBatchFiles(c *gin.Context) {
+	files, err := t.Batches.ListFiles(c.Request.Context(), c.Query("purpose"))
+	if err != nil {
+		openaiError(c, err)
+		return
+	}
+	data := make([]*types.FileObject, 0, len(files))
+	for _, f := range files {
+		data = append(data, f.Object())
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data})
+}
+
+func (t *OadinCoreServer) GetBatchFile(c *gin.Context) {
+	file, err := t.Batches.GetFile(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		openaiError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, file.Object())
+}
+
+func (t *OadinCoreServer) GetBatchFileContent(c *gin.Context) {
+	file, err := t.Batches.GetFile(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		openaiError(c, err)
+		return
+	}
+	c.Header("Content-Type", "application/jsonl")
+	c.File(file.Path)
+}
+
+func (t *OadinCoreServer) DeleteBatchFile(c *gin.Context) {
+	id := c.Param("id")
+	if err := t.Batches.DeleteFile(c.Request.Context(), id); err != nil {
+		openaiError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "file", "deleted": true})
+}
+
+func (t *OadinCoreServer) CreateBatch(c *gin.Context) {
+	request := new(types.CreateBatchRequest)
+	if err := c.ShouldBindJSON(request); err != nil {
+		openaiError(c, bcode.ErrBatchesBadRequest.SetMessage(err.Error()))
+		return
+	}
+	batch, err := t.Batches.CreateBatch(c.Request.Context(), request)
+	if err != nil {
+		openaiError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batch.Object())
+}
+
+func (t *OadinCoreServer) ListBatches(c *gin.Context) {
+	limit := 20
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 100 {
+			openaiError(c, bcode.ErrBatchesBadRequest.SetMessage("limit must be between 1 and 100"))
+			return
+		}
+		limit = n
+	}
+	batches, hasMore, err := t.Batches.ListBatches(c.Request.Context(), c.Query("after"), limit)
+	if err != nil {
+		openaiError(c, err)
+		return
+	}
+	data := make([]*types.BatchObject, 0, len(batches))
+	for _, b := range batches {
+		data = append(data, b.Object())
+	}
+	var firstID, lastID *string
+	if len(data) > 0 {
+		firstID, lastID = &data[0].ID, &data[len(data)-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data, "first_id": firstID, "last_id": lastID, "has_more": hasMore})
+}
+
+func (t *OadinCoreServer) GetBatch(c *gin.Context) {
+	batch, err := t.Batches.GetBatch(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		openaiError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batch.Object())
+}
+
+func (t *OadinCoreServer) CancelBatch(c *gin.Context) {
+	batch, err := t.Batches.CancelBatch(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		openaiError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batch.Object())
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"net/http"
+
+	"oadin/internal/api/dto"
+	"oadin/internal/utils/bcode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DebugConvert 调试 flavor 之间的转换
+func (t *OadinCoreServer) DebugConvert(c *gin.Context) {
+	request := new(dto.DebugConvertRequest)
+	if err := c.ShouldBindJSON(request); err != nil {
+		bcode.ReturnError(c, bcode.ErrFlavorBadRequest)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		bcode.ReturnError(c, err)
+		return
+	}
+
+	resp, err := t.Debug.Convert(c.Request.Context(), request)
+	if err != nil {
+		bcode.ReturnError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
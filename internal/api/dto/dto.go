@@ -1,6 +1,7 @@
 package dto
 
 import (
+	"encoding/json"
 	"time"
 
 	"oadin/internal/types"
@@ -287,6 +288,7 @@ type RecommendModelData struct {
 	Think               bool      `json:"think" default:"false"`
 	ThinkSwitch         bool      `json:"think_switch" default:"false"`
 	Tools               bool      `json:"tools" default:"false"`
+	Vision              bool      `json:"vision" default:"false"`
 	Context             float32   `json:"context" default:"0"`
 	CreatedAt           time.Time `json:"created_at"`
 }
@@ -397,6 +399,25 @@ type ServiceProvider struct {
 	Status        int       `json:"status"`
 	CreatedAt     time.Time `json:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at"`
+
+	Queue   *types.ProviderQueueStats  `json:"queue,omitempty"` // tasks in the scheduler, with the priority scheduler
+	Breaker types.ProviderBreakerState `json:"breaker"`
+	Usage   *types.ProviderTokenUsage  `json:"usage,omitempty"` // tokens of the requests run since the server started
+	Latency *types.ProviderLatency     `json:"latency,omitempty"`
+}
+
+type GetServiceProvidersHealthResponse struct {
+	bcode.Bcode
+	Data []ServiceProviderHealth `json:"data"`
+}
+
+// ServiceProviderHealth a service provider is healthy unless its circuit breaker is open
+type ServiceProviderHealth struct {
+	ProviderName  string                     `json:"provider_name"`
+	ServiceName   string                     `json:"service_name"`
+	ServiceSource string                     `json:"service_source"`
+	Healthy       bool                       `json:"healthy"`
+	Breaker       types.ProviderBreakerState `json:"breaker"`
 }
 
 type GetPathDiskSizeInfoRequest struct {
@@ -436,3 +457,61 @@ type ProxyRequest struct {
 type FeedbackRequest struct {
 	Feedback string `json:"feedback" validate:"required"`
 }
+
+type FlavorReloadResult struct {
+	Flavor string `json:"flavor"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ReloadFlavorsResponse struct {
+	bcode.Bcode
+	Data []FlavorReloadResult `json:"data"`
+}
+
+// DebugConvertRequest body is the JSON to convert, or a JSON string holding the
+// raw text, e.g. one event of an event stream
+type DebugConvertRequest struct {
+	FromFlavor string            `json:"from_flavor" validate:"required"`
+	ToFlavor   string            `json:"to_flavor" validate:"required"`
+	Service    string            `json:"service" validate:"required"`
+	Conversion string            `json:"conversion" validate:"required,oneof=request response stream_response"`
+	Body       json.RawMessage   `json:"body" validate:"required"`
+	Headers    map[string]string `json:"headers"`
+	Ctx        map[string]any    `json:"ctx"`
+}
+
+// DebugConvertStep bodies in the debug responses are JSON if they are valid
+// JSON, otherwise a string of the raw text
+type DebugConvertStep struct {
+	Flavor     string              `json:"flavor"`
+	Conversion string              `json:"conversion"`
+	Step       int                 `json:"step"`
+	Converter  string              `json:"converter"`
+	Body       json.RawMessage     `json:"body,omitempty"`
+	Header     map[string][]string `json:"header,omitempty"`
+	Dropped    bool                `json:"dropped,omitempty"`
+	Error      string              `json:"error,omitempty"`
+}
+
+type DebugConvertData struct {
+	Oadin        json.RawMessage     `json:"oadin,omitempty"`
+	Output       json.RawMessage     `json:"output,omitempty"`
+	OutputHeader map[string][]string `json:"output_header,omitempty"`
+	Steps        []DebugConvertStep  `json:"steps"`
+	Error        string              `json:"error,omitempty"`
+}
+
+type DebugConvertResponse struct {
+	bcode.Bcode
+	Data DebugConvertData `json:"data"`
+}
+
+type ListTasksResponse struct {
+	bcode.Bcode
+	Data []types.TaskInfo `json:"data"`
+}
+
+type CancelTaskResponse struct {
+	bcode.Bcode
+}
@@ -40,6 +40,7 @@ type SendMessageRequest struct {
 	Content   string       `json:"content"`
 	Tools     []types.Tool `json:"tools,omitempty"`
 	McpIds    []string     `json:"mcpIds,omitempty"`
+	ImageIds  []string     `json:"imageIds,omitempty"` // 附带的图片，上传的png/jpg文件ID
 }
 
 // 发送消息响应
@@ -61,6 +62,7 @@ type Message struct {
 	ModelName     string              `json:"modelName,omitempty"`
 	TotalDuration int64               `json:"totalDuration,omitempty"`
 	ToolCalls     []types.ToolMessage `json:"toolCalls,omitempty"`
+	ImageIds      []string            `json:"imageIds,omitempty"`
 }
 
 // 获取会话消息请求
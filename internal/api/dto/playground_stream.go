@@ -33,4 +33,5 @@ type SendStreamMessageRequest struct {
 	ToolGroupID string       `json:"toolGroupID,omitempty"` // 关联的消息ID
 	McpIds      []string     `json:"mcpIds,omitempty"`
 	Tools       []types.Tool `json:"tools,omitempty"`
+	ImageIds    []string     `json:"imageIds,omitempty"` // 附带的图片，上传的png/jpg文件ID
 }
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"oadin/internal/types"
+	"oadin/internal/utils/bcode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openaiError errors of the openai style apis are sent back the way openai does
+func openaiError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	code := "server_error"
+	errType := "server_error"
+	var bc *bcode.Bcode
+	if errors.As(err, &bc) {
+		status = int(bc.HTTPCode)
+	}
+	if status < http.StatusInternalServerError {
+		errType = "invalid_request_error"
+		code = ""
+		if status == http.StatusNotFound {
+			code = "not_found"
+		}
+	}
+	c.JSON(status, gin.H{"error": gin.H{"message": err.Error(), "type": errType, "code": code}})
+}
+
+func (t *OadinCoreServer) CreateResponse(c *gin.Context) {
+	request := new(types.ResponsesRequest)
+	if err := c.ShouldBindJSON(request); err != nil {
+		openaiError(c, bcode.ErrResponsesBadRequest.SetMessage(err.Error()))
+		return
+	}
+	if request.Model == "" {
+		openaiError(c, bcode.ErrResponsesBadRequest.SetMessage("model is required"))
+		return
+	}
+	ctx := c.Request.Context()
+
+	if !request.Stream {
+		response, err := t.Responses.CreateResponse(ctx, request)
+		if err != nil {
+			openaiError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	events, err := t.Responses.CreateResponseStream(ctx, request)
+	if err != nil {
+		openaiError(c, err)
+		return
+	}
+	w := c.Writer
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		openaiError(c, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	for event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		flusher.Flush()
+	}
+}
+
+func (t *OadinCoreServer) GetResponse(c *gin.Context) {
+	response, err := t.Responses.GetResponse(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		openaiError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (t *OadinCoreServer) DeleteResponse(c *gin.Context) {
+	id := c.Param("id")
+	if err := t.Responses.DeleteResponse(c.Request.Context(), id); err != nil {
+		openaiError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "response", "deleted": true})
+}
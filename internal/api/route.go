@@ -34,6 +34,26 @@ func InjectRouter(e *OadinCoreServer) {
 
 	r := e.Router.Group("/oadin/" + version.OadinVersion)
 
+	// openai responses api, served on top of the chat service
+	for _, g := range []gin.IRoutes{e.Router, r.Group("/api_flavors/" + types.FlavorOpenAI)} {
+		g.Handle(http.MethodPost, "/v1/responses", e.CreateResponse)
+		g.Handle(http.MethodGet, "/v1/responses/:id", e.GetResponse)
+		g.Handle(http.MethodDelete, "/v1/responses/:id", e.DeleteResponse)
+	}
+
+	// openai files and batch apis, batches are run in the background through the scheduler
+	for _, g := range []gin.IRoutes{e.Router, r.Group("/api_flavors/" + types.FlavorOpenAI)} {
+		g.Handle(http.MethodPost, "/v1/files", e.CreateBatchFile)
+		g.Handle(http.MethodGet, "/v1/files", e.ListBatchFiles)
+		g.Handle(http.MethodGet, "/v1/files/:id", e.GetBatchFile)
+		g.Handle(http.MethodDelete, "/v1/files/:id", e.DeleteBatchFile)
+		g.Handle(http.MethodGet, "/v1/files/:id/content", e.GetBatchFileContent)
+		g.Handle(http.MethodPost, "/v1/batches", e.CreateBatch)
+		g.Handle(http.MethodGet, "/v1/batches", e.ListBatches)
+		g.Handle(http.MethodGet, "/v1/batches/:id", e.GetBatch)
+		g.Handle(http.MethodPost, "/v1/batches/:id/cancel", e.CancelBatch)
+	}
+
 	// service import / export
 	r.Handle(http.MethodPost, "/service/export", e.ExportService)
 	r.Handle(http.MethodPost, "/service/import", e.ImportService)
@@ -45,6 +65,7 @@ func InjectRouter(e *OadinCoreServer) {
 
 	r.Handle(http.MethodGet, "/service_provider", e.GetServiceProviders)
 	r.Handle(http.MethodGet, "/service_provider/detail", e.GetServiceProvider)
+	r.Handle(http.MethodGet, "/service_provider/health", e.GetServiceProvidersHealth)
 	r.Handle(http.MethodPost, "/service_provider", e.CreateServiceProvider)
 	r.Handle(http.MethodPut, "/service_provider", e.UpdateServiceProvider)
 	r.Handle(http.MethodDelete, "/service_provider", e.DeleteServiceProvider)
@@ -82,6 +103,14 @@ func InjectRouter(e *OadinCoreServer) {
 	mcpApi.POST("/client/getTools", e.ClientGetTools)
 	mcpApi.POST("/client/runTool", e.ClientRunTool)
 
+	// flavors
+	r.Handle(http.MethodPost, "/flavor/reload", e.ReloadFlavors)
+	r.Handle(http.MethodPost, "/debug/convert", e.DebugConvert)
+
+	// service tasks in the scheduler
+	r.Handle(http.MethodGet, "/tasks", e.ListTasks)
+	r.Handle(http.MethodDelete, "/tasks/:id", e.CancelTask)
+
 	// Apis related to system
 	systemApi := r.Group("system")
 
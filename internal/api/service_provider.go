@@ -124,3 +124,13 @@ func (t *OadinCoreServer) GetServiceProviders(c *gin.Context) {
 
 	c.JSON(http.StatusOK, resp)
 }
+
+func (t *OadinCoreServer) GetServiceProvidersHealth(c *gin.Context) {
+	resp, err := t.ServiceProvider.GetServiceProvidersHealth(c.Request.Context())
+	if err != nil {
+		bcode.ReturnError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
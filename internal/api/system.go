@@ -90,3 +90,15 @@ func (t *OadinCoreServer) SystemSettings(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 
 }
+
+// ReloadFlavors 重新加载 API flavor 定义
+func (t *OadinCoreServer) ReloadFlavors(c *gin.Context) {
+	res, err := t.System.ReloadFlavors(c.Request.Context())
+	if err != nil {
+		slog.Error("Failed to reload flavors", "error", err)
+		bcode.ReturnError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"oadin/internal/utils/bcode"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (t *OadinCoreServer) ListTasks(c *gin.Context) {
+	resp, err := t.Tasks.ListTasks(c.Request.Context())
+	if err != nil {
+		bcode.ReturnError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (t *OadinCoreServer) CancelTask(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		bcode.ReturnError(c, bcode.ErrTaskBadRequest.SetMessage("invalid task id"))
+		return
+	}
+
+	resp, err := t.Tasks.CancelTask(c.Request.Context(), id)
+	if err != nil {
+		bcode.ReturnError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -11,10 +11,12 @@ import (
 	"log/slog"
 	"net/http"
 	"regexp"
+	"strings"
 
 	"oadin/internal/types"
 
 	jsonata "github.com/blues/jsonata-go"
+	"github.com/blues/jsonata-go/jtypes"
 )
 
 type ConvertContext map[string]any
@@ -26,14 +28,39 @@ type Converter interface {
 	IsReusable() bool
 }
 
+// StreamConverter A converter keeping state across the chunks of one stream
+// response, e.g. to merge or split chunks. Unlike a Converter it is never shared,
+// a new one is created for every stream. It may give back no chunk, one or many
+// for each chunk, and what it still holds when the stream ends is given back by Flush
+type StreamConverter interface {
+	ConvertChunk(types.HTTPContent, ConvertContext) ([]types.HTTPContent, error)
+	Flush(ConvertContext) ([]types.HTTPContent, error)
+}
+
 var converterFactories map[string]func(any) (Converter, error) = make(map[string]func(any) (Converter, error))
 
+var streamConverterFactories map[string]func(any) (StreamConverter, error) = make(map[string]func(any) (StreamConverter, error))
+
 func RegisterConverter(name string, factory func(any) (Converter, error)) {
 	slog.Debug("[Converter] Register converters", "converter", name)
 	converterFactories[name] = factory
 }
 
+func RegisterStreamConverter(name string, factory func(any) (StreamConverter, error)) {
+	slog.Debug("[Converter] Register stream converters", "converter", name)
+	streamConverterFactories[name] = factory
+}
+
+// CreateConverter A stream converter is created as a Converter as well, which
+// converts a single chunk as a whole stream
 func CreateConverter(name string, config any) (Converter, error) {
+	if factory, ok := streamConverterFactories[name]; ok {
+		c, err := factory(config)
+		if err != nil {
+			return nil, err
+		}
+		return &singleChunkConverter{name: name, c: c}, nil
+	}
 	factory, ok := converterFactories[name]
 	if !ok {
 		return nil, fmt.Errorf("[Converter] Unknown type of converter to create: %s with config  %+v", name, config)
@@ -41,11 +68,30 @@ func CreateConverter(name string, config any) (Converter, error) {
 	return factory(config)
 }
 
+func CreateStreamConverter(name string, config any) (StreamConverter, error) {
+	if factory, ok := streamConverterFactories[name]; ok {
+		return factory(config)
+	}
+	c, err := CreateConverter(name, config)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkByChunkConverter{c}, nil
+}
+
 func InitConverters() error {
 	RegisterConverter("jsonata", NewJsonataConverter)
 	RegisterConverter("header", NewHeaderConverter)
 	RegisterConverter("action_if", NewActionBasedOnPattern)
-	return nil
+	RegisterConverter("event_stream", NewEventStreamConverter)
+	RegisterConverter("gotemplate", NewGoTemplateConverter)
+	RegisterConverter("jsonpatch", NewJSONPatchConverter)
+	RegisterConverter("multipart_to_json", NewMultipartToJSONConverter)
+	RegisterConverter("json_to_multipart", NewJSONToMultipartConverter)
+	RegisterConverter("binary_to_json", NewBinaryToJSONConverter)
+	RegisterConverter("json_to_binary", NewJSONToBinaryConverter)
+	RegisterStreamConverter("merge_tool_calls", NewToolCallsMerger)
+	return jsonata.RegisterExts(jsonataExts)
 }
 
 //------------------------------------------------------------
@@ -77,8 +123,16 @@ func NewConverterPipeline(config []types.ConversionStepDef) (*ConverterPipeline,
 }
 
 func (p *ConverterPipeline) Convert(content types.HTTPContent, ctx ConvertContext) (types.HTTPContent, error) {
+	return p.ConvertWithTrace(content, ctx, nil)
+}
+
+// StepTrace is given what every step of a pipeline gives back, to debug conversions
+type StepTrace func(step int, def types.ConversionStepDef, output types.HTTPContent, err error)
+
+func (p *ConverterPipeline) ConvertWithTrace(content types.HTTPContent, ctx ConvertContext, trace StepTrace) (types.HTTPContent, error) {
+	steps := p.steps
 	if !p.IsReusable() { // need to replace the step which is not reusable
-		steps := make([]Converter, len(p.steps))
+		steps = make([]Converter, len(p.steps))
 		for i, step := range p.steps {
 			if !step.IsReusable() {
 				c, err := CreateConverter(p.config[i].Converter, p.config[i].Config)
@@ -90,12 +144,14 @@ func (p *ConverterPipeline) Convert(content types.HTTPContent, ctx ConvertContex
 				steps[i] = step
 			}
 		}
-		p.steps = steps
 	}
-	for _, step := range p.steps {
+	for i, step := range steps {
 		// NOTE: we cannot use := below, otherwise content will be redeclared and outside content will not be updated
 		var err error
 		content, err = step.Convert(content, ctx)
+		if trace != nil {
+			trace(i, p.config[i], content, err)
+		}
 		if err != nil {
 			return types.HTTPContent{}, err
 		}
@@ -107,6 +163,126 @@ func (p *ConverterPipeline) IsReusable() bool {
 	return p.isReusable
 }
 
+// NewStream creates the pipeline to convert the chunks of one stream response.
+// The reusable steps are shared with the pipeline, only the others are created
+// again for the stream
+func (p *ConverterPipeline) NewStream() (*StreamConverterPipeline, error) {
+	steps := make([]StreamConverter, len(p.config))
+	for i, step := range p.config {
+		if p.steps[i].IsReusable() {
+			steps[i] = &chunkByChunkConverter{p.steps[i]}
+			continue
+		}
+		c, err := CreateStreamConverter(step.Converter, step.Config)
+		if err != nil {
+			return nil, err
+		}
+		steps[i] = c
+	}
+	return &StreamConverterPipeline{steps}, nil
+}
+
+//------------------------------------------------------------
+
+// StreamConverterPipeline Itself is a StreamConverter, every chunk given back by a
+// step goes through the next steps
+type StreamConverterPipeline struct {
+	steps []StreamConverter
+}
+
+func (p *StreamConverterPipeline) ConvertChunk(content types.HTTPContent, ctx ConvertContext) ([]types.HTTPContent, error) {
+	chunks := []types.HTTPContent{content}
+	for _, step := range p.steps {
+		var err error
+		chunks, err = convertChunks(step, chunks, ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return chunks, nil
+}
+
+func (p *StreamConverterPipeline) Flush(ctx ConvertContext) ([]types.HTTPContent, error) {
+	var chunks []types.HTTPContent
+	for _, step := range p.steps {
+		// what the steps before flushed still goes through this step before it is flushed
+		converted, err := convertChunks(step, chunks, ctx)
+		if err != nil {
+			return nil, err
+		}
+		flushed, err := step.Flush(ctx)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(converted, flushed...)
+	}
+	return chunks, nil
+}
+
+func convertChunks(c StreamConverter, chunks []types.HTTPContent, ctx ConvertContext) ([]types.HTTPContent, error) {
+	var converted []types.HTTPContent
+	for _, chunk := range chunks {
+		res, err := c.ConvertChunk(chunk, ctx)
+		if err != nil {
+			return nil, err
+		}
+		converted = append(converted, res...)
+	}
+	return converted, nil
+}
+
+// chunkByChunkConverter A Converter in a stream, one chunk in and one out, or
+// none if it is dropped
+type chunkByChunkConverter struct {
+	c Converter
+}
+
+func (c *chunkByChunkConverter) ConvertChunk(content types.HTTPContent, ctx ConvertContext) ([]types.HTTPContent, error) {
+	res, err := c.c.Convert(content, ctx)
+	if types.IsDropAction(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []types.HTTPContent{res}, nil
+}
+
+func (c *chunkByChunkConverter) Flush(ctx ConvertContext) ([]types.HTTPContent, error) {
+	return nil, nil
+}
+
+// singleChunkConverter A StreamConverter outside of a stream, the content is
+// converted as a stream of one chunk
+type singleChunkConverter struct {
+	name string
+	c    StreamConverter
+}
+
+func (c *singleChunkConverter) IsReusable() bool {
+	return false
+}
+
+func (c *singleChunkConverter) Convert(content types.HTTPContent, ctx ConvertContext) (types.HTTPContent, error) {
+	chunks, err := c.c.ConvertChunk(content, ctx)
+	if err != nil {
+		return types.HTTPContent{}, err
+	}
+	flushed, err := c.c.Flush(ctx)
+	if err != nil {
+		return types.HTTPContent{}, err
+	}
+	chunks = append(chunks, flushed...)
+	switch len(chunks) {
+	case 0:
+		return types.HTTPContent{}, &types.DropAction{}
+	case 1:
+		return chunks[0], nil
+	default:
+		return types.HTTPContent{}, fmt.Errorf("[Converter] %s gave back %d chunks, it can only be used in stream conversions", c.name, len(chunks))
+	}
+}
+
 //------------------------------------------------------------
 
 // ActionBasedOnPattern Sometimes we detect that the content need to be drop or ignored
@@ -172,6 +348,67 @@ func (a *ActionBasedOnPattern) Convert(content types.HTTPContent, ctx ConvertCon
 
 //------------------------------------------------------------
 
+// jsonataExts functions available to all jsonata expressions besides the builtin ones
+var jsonataExts = map[string]jsonata.Extension{
+	// $jsonParse(str) decodes a JSON encoded string, e.g. the arguments of an
+	// openai tool call. Anything else, or a string which is not valid JSON, is
+	// returned as is
+	"jsonParse": {
+		Func:             jsonParse,
+		UndefinedHandler: jtypes.ArgUndefined(0),
+	},
+	// $imageData(image) gives {"media_type", "data"} of an image given as a data
+	// URL or as base64, for the flavors which only take the base64 of an image.
+	// An http(s) URL gives undefined
+	"imageData": {
+		Func:             imageData,
+		UndefinedHandler: jtypes.ArgUndefined(0),
+	},
+	// $imageURL(data[, media_type]) gives the data URL of a base64 image, the
+	// media type is told from the data if not given. A URL is returned as is
+	"imageURL": {
+		Func:             imageURL,
+		UndefinedHandler: jtypes.ArgUndefined(0),
+	},
+}
+
+func imageData(image string) (map[string]any, error) {
+	if strings.HasPrefix(image, "data:") {
+		meta, data, ok := strings.Cut(strings.TrimPrefix(image, "data:"), ",")
+		if !ok {
+			return nil, fmt.Errorf("invalid data url")
+		}
+		mediaType, _, _ := strings.Cut(meta, ";")
+		if mediaType == "" {
+			mediaType = types.ImageMediaType(data)
+		}
+		return map[string]any{"media_type": mediaType, "data": data}, nil
+	}
+	if types.IsImageURL(image) {
+		return nil, nil
+	}
+	return map[string]any{"media_type": types.ImageMediaType(image), "data": image}, nil
+}
+
+func imageURL(data string, mediaType jtypes.OptionalString) string {
+	if mediaType.IsSet() && !types.IsImageURL(data) {
+		return "data:" + mediaType.String + ";base64," + data
+	}
+	return types.ImageDataURL(data)
+}
+
+func jsonParse(value interface{}) (interface{}, error) {
+	s, ok := value.(string)
+	if !ok {
+		return value, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return value, nil
+	}
+	return v, nil
+}
+
 type JsonataConverter struct {
 	Expression string
 	compiled   *jsonata.Expr
@@ -184,7 +421,7 @@ func NewJsonataConverter(config any) (Converter, error) {
 	}
 	compiled, err := jsonata.Compile(expression)
 	if err != nil {
-		return nil, fmt.Errorf("[Jsonata Converter] Failed to compile expression: %s with error: %s", expression, err.Error())
+		return nil, fmt.Errorf("[Jsonata Converter] Failed to compile expression: %s with error: %w", expression, err)
 	}
 
 	return &JsonataConverter{expression, compiled}, nil
@@ -258,3 +495,218 @@ func (c *HeaderConverter) Convert(content types.HTTPContent, ctx ConvertContext)
 	}
 	return types.HTTPContent{Body: content.Body, Header: header}, nil
 }
+
+//------------------------------------------------------------
+
+// EventStreamConverter Some flavors (e.g. anthropic) send typed server-sent events,
+// i.e. every data: field is preceded by an event: field naming the payload type.
+// It takes a JSON object, or a JSON array to send several events in one chunk,
+// and frames each element as an event named by its EventField
+// An empty array is dropped, so a chunk can be silently consumed
+type EventStreamConverter struct {
+	EventField string `json:"event_field"`
+}
+
+func NewEventStreamConverter(config any) (Converter, error) {
+	j, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("[EventStream Converter] Failed to marshal config: %s", err.Error())
+	}
+	var c EventStreamConverter
+	err = json.Unmarshal(j, &c)
+	if err != nil {
+		return nil, fmt.Errorf("[EventStream Converter] Failed to unmarshal config: %s", err.Error())
+	}
+	if c.EventField == "" {
+		c.EventField = "type"
+	}
+	return &c, nil
+}
+
+func (c *EventStreamConverter) IsReusable() bool {
+	return true
+}
+
+func (c *EventStreamConverter) Convert(content types.HTTPContent, ctx ConvertContext) (types.HTTPContent, error) {
+	var events []json.RawMessage
+	body := bytes.TrimSpace(content.Body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		if err := json.Unmarshal(body, &events); err != nil {
+			return types.HTTPContent{}, fmt.Errorf("[EventStream Converter] Failed to unmarshal events: %s", err.Error())
+		}
+	} else {
+		events = []json.RawMessage{body}
+	}
+	if len(events) == 0 {
+		return types.HTTPContent{}, &types.DropAction{}
+	}
+
+	frames := make([][]byte, 0, len(events))
+	for _, event := range events {
+		var fields map[string]any
+		if err := json.Unmarshal(event, &fields); err != nil {
+			return types.HTTPContent{}, fmt.Errorf("[EventStream Converter] Event is not a JSON object: %s", string(event))
+		}
+		name, _ := fields[c.EventField].(string)
+		var frame bytes.Buffer
+		if name != "" {
+			frame.WriteString("event: " + name + "\n")
+		}
+		frame.WriteString("data: ")
+		frame.Write(event)
+		frames = append(frames, frame.Bytes())
+	}
+	return types.HTTPContent{Body: bytes.Join(frames, []byte("\n\n")), Header: content.Header}, nil
+}
+
+//------------------------------------------------------------
+
+// ToolCallsMerger Works on oadin chat stream chunks. Flavors like openai send a
+// tool call in pieces: the first delta has its index, id and name, the following
+// ones only the index and a fragment of the JSON encoded arguments. Oadin sends
+// complete tool calls instead, so the pieces are collected and the merged calls,
+// with the arguments decoded, go out with the chunk that finishes the message,
+// or in a chunk of their own if the stream ends without one.
+// Chunks only carrying pieces of tool calls are dropped
+type ToolCallsMerger struct {
+	calls []map[string]any
+	args  []*strings.Builder
+}
+
+func NewToolCallsMerger(config any) (StreamConverter, error) {
+	return &ToolCallsMerger{}, nil
+}
+
+func (c *ToolCallsMerger) ConvertChunk(content types.HTTPContent, ctx ConvertContext) ([]types.HTTPContent, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content.Body))
+	decoder.UseNumber()
+	var chunk map[string]any
+	if err := decoder.Decode(&chunk); err != nil {
+		return nil, fmt.Errorf("[MergeToolCalls Converter] Failed to unmarshal chunk: %s", err.Error())
+	}
+
+	message, _ := chunk["message"].(map[string]any)
+	pieces, _ := message["tool_calls"].([]any)
+	for _, piece := range pieces {
+		if call, ok := piece.(map[string]any); ok {
+			c.add(call)
+		}
+	}
+	finishReason, _ := chunk["finish_reason"].(string)
+	finished, _ := chunk["finished"].(bool)
+	if finishReason == "" && !finished {
+		if message == nil || len(pieces) == 0 {
+			return []types.HTTPContent{content}, nil
+		}
+		delete(message, "tool_calls")
+		text, _ := message["content"].(string)
+		thinking, _ := message["thinking"].(string)
+		if text == "" && thinking == "" {
+			return nil, nil
+		}
+	} else if len(c.calls) > 0 {
+		if message == nil {
+			message = map[string]any{"content": ""}
+			chunk["message"] = message
+		}
+		c.finish(chunk, message, ctx)
+	} else if len(pieces) == 0 {
+		return []types.HTTPContent{content}, nil
+	}
+
+	body, err := json.Marshal(chunk)
+	if err != nil {
+		return nil, fmt.Errorf("[MergeToolCalls Converter] Failed to marshal chunk: %s", err.Error())
+	}
+	return []types.HTTPContent{{Body: body, Header: content.Header}}, nil
+}
+
+func (c *ToolCallsMerger) Flush(ctx ConvertContext) ([]types.HTTPContent, error) {
+	if len(c.calls) == 0 {
+		return nil, nil
+	}
+	message := map[string]any{"content": ""}
+	chunk := map[string]any{"id": ctx["id"], "message": message, "finished": true}
+	c.finish(chunk, message, ctx)
+	body, err := json.Marshal(chunk)
+	if err != nil {
+		return nil, fmt.Errorf("[MergeToolCalls Converter] Failed to marshal chunk: %s", err.Error())
+	}
+	return []types.HTTPContent{{Body: body, Header: http.Header{"Content-Type": []string{"application/json"}}}}, nil
+}
+
+// finish puts the merged calls in the message of the chunk finishing the stream
+func (c *ToolCallsMerger) finish(chunk, message map[string]any, ctx ConvertContext) {
+	if _, ok := message["role"]; !ok {
+		message["role"] = "assistant"
+	}
+	id, _ := ctx["id"].(string)
+	message["tool_calls"] = c.merged(id)
+	if reason, _ := chunk["finish_reason"].(string); reason == "" || reason == "stop" {
+		chunk["finish_reason"] = "tool_calls"
+	}
+	c.calls, c.args = nil, nil
+}
+
+// add merges a piece into the call with the same index, or the same id if it
+// has no index. A piece matching no call starts a new one
+func (c *ToolCallsMerger) add(piece map[string]any) {
+	index, hasIndex := piece["index"]
+	id, _ := piece["id"].(string)
+	i := -1
+	for j, call := range c.calls {
+		if (hasIndex && call["index"] == index) || (!hasIndex && id != "" && call["id"] == id) {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		c.calls = append(c.calls, map[string]any{"function": map[string]any{}})
+		c.args = append(c.args, &strings.Builder{})
+		i = len(c.calls) - 1
+	}
+	call := c.calls[i]
+	for k, v := range piece {
+		if k != "function" && v != nil && v != "" {
+			call[k] = v
+		}
+	}
+	function, _ := piece["function"].(map[string]any)
+	for k, v := range function {
+		switch {
+		case k == "arguments":
+			if fragment, ok := v.(string); ok {
+				c.args[i].WriteString(fragment)
+			} else {
+				call["function"].(map[string]any)[k] = v
+				c.args[i].Reset()
+			}
+		case v != nil && v != "":
+			call["function"].(map[string]any)[k] = v
+		}
+	}
+}
+
+// merged the collected calls with their arguments decoded, calls without an
+// id get one made from the given id
+func (c *ToolCallsMerger) merged(id string) []any {
+	calls := make([]any, 0, len(c.calls))
+	for i, call := range c.calls {
+		function := call["function"].(map[string]any)
+		if c.args[i].Len() > 0 {
+			arguments, _ := jsonParse(c.args[i].String())
+			function["arguments"] = arguments
+		} else if _, ok := function["arguments"]; !ok {
+			function["arguments"] = map[string]any{}
+		}
+		if _, ok := call["id"]; !ok {
+			call["id"] = fmt.Sprintf("call_%s_%d", id, i)
+		}
+		if _, ok := call["type"]; !ok {
+			call["type"] = "function"
+		}
+		delete(call, "index")
+		calls = append(calls, call)
+	}
+	return calls
+}
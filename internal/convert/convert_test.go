@@ -0,0 +1,33 @@
+package convert
+
+import (
+	"testing"
+
+	"oadin/internal/types"
+)
+
+func TestNewStreamReusesSteps(t *testing.T) {
+	RegisterConverter("jsonpatch", NewJSONPatchConverter)
+	RegisterStreamConverter("merge_tool_calls", NewToolCallsMerger)
+	p, err := NewConverterPipeline([]types.ConversionStepDef{
+		{Converter: "jsonpatch", Config: []any{map[string]any{"op": "add", "path": "/x", "value": 1}}},
+		{Converter: "merge_tool_calls"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, err := p.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := p.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := s1.steps[0].(*chunkByChunkConverter); !ok || c.c != p.steps[0] {
+		t.Errorf("the jsonpatch step of the stream is %T, want the one of the pipeline", s1.steps[0])
+	}
+	if s1.steps[1] == s2.steps[1] {
+		t.Error("two streams share the merge_tool_calls step, want one each")
+	}
+}
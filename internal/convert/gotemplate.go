@@ -0,0 +1,416 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"oadin/internal/types"
+
+	"github.com/google/uuid"
+)
+
+// GoTemplateConverter renders the body with a go text/template. The template is
+// given the body decoded from JSON as .Body (the raw string if it isn't JSON),
+// the convert context as .Ctx and the headers as .Header, and may use the
+// helpers in templateFuncs, named after their sprig counterparts. An output of
+// only white space drops the content, e.g. a chunk of a stream
+type GoTemplateConverter struct {
+	Template string
+	compiled *template.Template
+}
+
+type templateData struct {
+	Body   any
+	Ctx    ConvertContext
+	Header http.Header
+}
+
+func NewGoTemplateConverter(config any) (Converter, error) {
+	text, ok := config.(string)
+	if !ok {
+		return nil, fmt.Errorf("[GoTemplate Converter] Expect string to create converter but got: %#v", config)
+	}
+	compiled, err := template.New("gotemplate").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("[GoTemplate Converter] Failed to parse template: %w", err)
+	}
+	return &GoTemplateConverter{text, compiled}, nil
+}
+
+func (c *GoTemplateConverter) IsReusable() bool {
+	return true
+}
+
+func (c *GoTemplateConverter) Convert(content types.HTTPContent, ctx ConvertContext) (types.HTTPContent, error) {
+	data := templateData{Ctx: ctx, Header: content.Header}
+	if ctx == nil {
+		data.Ctx = ConvertContext{}
+	}
+	body, err := decodeJSON(content.Body)
+	if err != nil {
+		data.Body = string(content.Body)
+	} else {
+		data.Body = body
+	}
+	var buf bytes.Buffer
+	if err := c.compiled.Execute(&buf, data); err != nil {
+		return types.HTTPContent{}, fmt.Errorf("[GoTemplate Converter] Failed to render template: %w", err)
+	}
+	if len(bytes.TrimSpace(buf.Bytes())) == 0 {
+		return types.HTTPContent{}, &types.DropAction{}
+	}
+	return types.HTTPContent{Body: buf.Bytes(), Header: content.Header}, nil
+}
+
+// decodeJSON numbers are kept as json.Number so large integers stay exact
+func decodeJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	return v, nil
+}
+
+// encodeJSON unlike json.Marshal it leaves <, > and & alone
+func encodeJSON(v any, indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+//------------------------------------------------------------
+
+var templateFuncs = template.FuncMap{
+	// json
+	"toJson": func(v any) (string, error) {
+		b, err := encodeJSON(v, "")
+		return string(b), err
+	},
+	"toPrettyJson": func(v any) (string, error) {
+		b, err := encodeJSON(v, "  ")
+		return string(b), err
+	},
+	"fromJson": func(s string) (any, error) { return decodeJSON([]byte(s)) },
+
+	// defaults
+	"default": func(d any, given ...any) any {
+		if len(given) == 0 || isEmpty(given[0]) {
+			return d
+		}
+		return given[0]
+	},
+	"empty": isEmpty,
+	"coalesce": func(values ...any) any {
+		for _, v := range values {
+			if !isEmpty(v) {
+				return v
+			}
+		}
+		return nil
+	},
+	"ternary": func(yes, no any, cond bool) any {
+		if cond {
+			return yes
+		}
+		return no
+	},
+	"required": func(message string, v any) (any, error) {
+		if v == nil {
+			return nil, errors.New(message)
+		}
+		return v, nil
+	},
+
+	// strings
+	"toString":   toString,
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"splitList":  func(sep, s string) []any { return toAnyList(strings.Split(s, sep)) },
+	"join": func(sep string, list any) string {
+		var parts []string
+		for _, v := range toList(list) {
+			parts = append(parts, toString(v))
+		}
+		return strings.Join(parts, sep)
+	},
+	"quote": func(v any) string { return strconv.Quote(toString(v)) },
+	"b64enc": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"b64dec": func(s string) (string, error) {
+		b, err := base64.StdEncoding.DecodeString(s)
+		return string(b), err
+	},
+
+	// lists and dicts
+	"list": func(values ...any) []any { return values },
+	"first": func(list any) any {
+		if l := toList(list); len(l) > 0 {
+			return l[0]
+		}
+		return nil
+	},
+	"last": func(list any) any {
+		if l := toList(list); len(l) > 0 {
+			return l[len(l)-1]
+		}
+		return nil
+	},
+	"append": func(list any, v any) []any {
+		return append(append([]any(nil), toList(list)...), v)
+	},
+	"dict": func(pairs ...any) (map[string]any, error) {
+		if len(pairs)%2 != 0 {
+			return nil, errors.New("dict expects pairs of keys and values")
+		}
+		d := make(map[string]any, len(pairs)/2)
+		for i := 0; i < len(pairs); i += 2 {
+			d[toString(pairs[i])] = pairs[i+1]
+		}
+		return d, nil
+	},
+	"set": func(d map[string]any, key string, v any) map[string]any {
+		d[key] = v
+		return d
+	},
+	"unset": func(d map[string]any, key string) map[string]any {
+		delete(d, key)
+		return d
+	},
+	"get": func(d map[string]any, key string) any { return d[key] },
+	"hasKey": func(d map[string]any, key string) bool {
+		_, ok := d[key]
+		return ok
+	},
+	"keys": func(d map[string]any) []any {
+		keys := make([]string, 0, len(d))
+		for k := range d {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return toAnyList(keys)
+	},
+	"pick": func(d map[string]any, keys ...string) map[string]any {
+		picked := make(map[string]any)
+		for _, k := range keys {
+			if v, ok := d[k]; ok {
+				picked[k] = v
+			}
+		}
+		return picked
+	},
+	"omit": func(d map[string]any, keys ...string) map[string]any {
+		omitted := make(map[string]any, len(d))
+		for k, v := range d {
+			omitted[k] = v
+		}
+		for _, k := range keys {
+			delete(omitted, k)
+		}
+		return omitted
+	},
+
+	// numbers, integers stay integers unless a float is involved
+	"int":     toInt,
+	"float64": toNumber,
+	"add":     arithmetic(func(a, b float64) float64 { return a + b }),
+	"sub":     arithmetic(func(a, b float64) float64 { return a - b }),
+	"mul":     arithmetic(func(a, b float64) float64 { return a * b }),
+	"div": func(a, b any) (any, error) {
+		x, err := toNumber(a)
+		if err != nil {
+			return nil, err
+		}
+		y, err := toNumber(b)
+		if err != nil {
+			return nil, err
+		}
+		if y == 0 {
+			return nil, errors.New("division by zero")
+		}
+		if !isFloat(a) && !isFloat(b) {
+			return int64(x / y), nil
+		}
+		return x / y, nil
+	},
+	"max": arithmetic(math.Max),
+	"min": arithmetic(math.Min),
+
+	// misc
+	"now":    time.Now,
+	"uuidv4": func() string { return uuid.NewString() },
+}
+
+func isEmpty(v any) bool {
+	if v == nil {
+		return true
+	}
+	if n, ok := v.(json.Number); ok {
+		f, err := n.Float64()
+		return err == nil && f == 0
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return rv.IsNil()
+	default:
+		return rv.IsZero()
+	}
+}
+
+func toString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func toList(v any) []any {
+	if v == nil {
+		return nil
+	}
+	if l, ok := v.([]any); ok {
+		return l
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return []any{v}
+	}
+	l := make([]any, rv.Len())
+	for i := range l {
+		l[i] = rv.Index(i).Interface()
+	}
+	return l
+}
+
+func toAnyList(s []string) []any {
+	l := make([]any, len(s))
+	for i, v := range s {
+		l[i] = v
+	}
+	return l
+}
+
+func toNumber(v any) (float64, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case nil:
+		return 0, nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+// toInt an integer read as one, so that ids and counts past 2^53 stay exact,
+// only a float is truncated
+func toInt(v any) (int64, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+	case string:
+		if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), nil
+	}
+	f, err := toNumber(v)
+	return int64(f), err
+}
+
+func isInteger(f float64) bool {
+	return f == math.Trunc(f) && !math.IsInf(f, 0)
+}
+
+// arithmetic applies op to two numbers of any kind, the result is an int64 if
+// it is a whole number and neither operand was a float
+func arithmetic(op func(a, b float64) float64) func(a, b any) (any, error) {
+	return func(a, b any) (any, error) {
+		x, err := toNumber(a)
+		if err != nil {
+			return nil, err
+		}
+		y, err := toNumber(b)
+		if err != nil {
+			return nil, err
+		}
+		r := op(x, y)
+		if isInteger(r) && !isFloat(a) && !isFloat(b) {
+			return int64(r), nil
+		}
+		return r, nil
+	}
+}
+
+func isFloat(v any) bool {
+	switch v := v.(type) {
+	case float32, float64:
+		return true
+	case json.Number:
+		return strings.ContainsAny(string(v), ".eE")
+	case string:
+		return strings.ContainsAny(v, ".eE")
+	}
+	return false
+}
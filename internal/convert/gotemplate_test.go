@@ -0,0 +1,106 @@
+package convert
+
+import (
+	"net/http"
+	"testing"
+
+	"oadin/internal/types"
+)
+
+func TestGoTemplateConverter(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		body     string
+		ctx      ConvertContext
+		want     string
+		wantDrop bool
+		wantErr  bool
+	}{
+		{
+			name:     "fields and context",
+			template: `{"model":{{ toJson .Ctx.model }},"prompt":{{ get (last .Body.messages) "content" | toJson }},"stream":{{ .Ctx.stream }}}`,
+			body:     `{"model":"ignored","messages":[{"role":"system","content":"be brief"},{"role":"user","content":"<hi> & bye"}]}`,
+			ctx:      ConvertContext{"model": "qwen2.5", "stream": true},
+			want:     `{"model":"qwen2.5","prompt":"<hi> & bye","stream":true}`,
+		},
+		{
+			name:     "large integers stay exact",
+			template: `{{ toJson (set .Body "max_tokens" (add .Body.max_tokens 1)) }}`,
+			body:     `{"id":12345678901234567890,"max_tokens":1023}`,
+			want:     `{"id":12345678901234567890,"max_tokens":1024}`,
+		},
+		{
+			name:     "defaults",
+			template: `{{ default 0.7 .Body.temperature }} {{ default 0.7 .Body.top_p }} {{ coalesce .Body.a .Body.b "c" }} {{ ternary "yes" "no" (hasKey .Body "top_p") }}`,
+			body:     `{"top_p":0.9,"a":""}`,
+			want:     `0.7 0.9 c yes`,
+		},
+		{
+			name:     "strings and lists",
+			template: `{{ .Body.name | trimPrefix "models/" | upper }} {{ splitList "," .Body.tags | join "|" }} {{ pick .Body "name" | keys | toJson }} {{ omit .Body "name" | keys | toJson }}`,
+			body:     `{"name":"models/gemini","tags":"a,b,c"}`,
+			want:     `GEMINI a|b|c ["name"] ["tags"]`,
+		},
+		{
+			name:     "dict and arithmetic",
+			template: `{{ toJson (dict "sum" (add 1 2) "ratio" (div 3 2) "half" (div 3.0 2) "n" (int "42")) }}`,
+			body:     `{}`,
+			want:     `{"half":1.5,"n":42,"ratio":1,"sum":3}`,
+		},
+		{
+			name:     "int keeps large integers",
+			template: `{{ int .Body.id }} {{ int "9007199254740993" }} {{ int .Body.score }}`,
+			body:     `{"id":9007199254740993,"score":2.7}`,
+			want:     `9007199254740993 9007199254740993 2`,
+		},
+		{
+			name:     "not json body",
+			template: `data: {{ .Body }}`,
+			body:     `[DONE]`,
+			want:     `data: [DONE]`,
+		},
+		{
+			name:     "empty output drops the content",
+			template: `{{ if .Body.choices }}{{ toJson .Body }}{{ end }}`,
+			body:     `{"choices":[]}`,
+			wantDrop: true,
+		},
+		{
+			name:     "required",
+			template: `{{ required "model is required" .Body.model }}`,
+			body:     `{}`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewGoTemplateConverter(tt.template)
+			if err != nil {
+				t.Fatalf("NewGoTemplateConverter() error = %v", err)
+			}
+			content := types.HTTPContent{Body: []byte(tt.body), Header: http.Header{}}
+			got, err := c.Convert(content, tt.ctx)
+			if tt.wantDrop {
+				if !types.IsDropAction(err) {
+					t.Fatalf("Convert() = %s, %v, want a drop action", got.Body, err)
+				}
+				return
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Convert() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && string(got.Body) != tt.want {
+				t.Errorf("Convert() = %s, want %s", got.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewGoTemplateConverter(t *testing.T) {
+	for _, config := range []any{`{{ .Body `, `{{ nosuchfunc }}`, map[string]any{"template": "x"}} {
+		if _, err := NewGoTemplateConverter(config); err == nil {
+			t.Errorf("NewGoTemplateConverter(%v) expects an error", config)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"oadin/internal/types"
+)
+
+// JSONPatchConverter patches the JSON body. The config is either a list of
+// RFC 6902 operations, e.g.
+//
+//   - {op: replace, path: /stream, value: false}
+//   - {op: remove, path: /options/seed}
+//
+// or an object, which is applied as an RFC 7386 merge patch, i.e. its fields
+// are merged into the body and fields set to null are removed
+type JSONPatchConverter struct {
+	operations []patchOperation
+	merge      any
+}
+
+type patchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	From  string `json:"from"`
+	Value any    `json:"value"`
+	path  []string
+	from  []string
+}
+
+func NewJSONPatchConverter(config any) (Converter, error) {
+	j, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("[JSONPatch Converter] Failed to marshal config: %s", err.Error())
+	}
+	patch, err := decodeJSON(j)
+	if err != nil {
+		return nil, fmt.Errorf("[JSONPatch Converter] Failed to unmarshal config: %s", err.Error())
+	}
+	switch patch.(type) {
+	case map[string]any:
+		return &JSONPatchConverter{merge: patch}, nil
+	case []any:
+	default:
+		return nil, fmt.Errorf("[JSONPatch Converter] Expect a list of operations or an object to merge but got: %#v", config)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(j))
+	decoder.UseNumber()
+	var operations []patchOperation
+	if err := decoder.Decode(&operations); err != nil {
+		return nil, fmt.Errorf("[JSONPatch Converter] Failed to unmarshal operations: %s", err.Error())
+	}
+	// value may be null, so tell a missing value by the raw operations
+	raw := patch.([]any)
+	for i := range operations {
+		o := &operations[i]
+		fields, _ := raw[i].(map[string]any)
+		_, hasValue := fields["value"]
+		switch o.Op {
+		case "add", "replace", "test":
+			if !hasValue {
+				return nil, fmt.Errorf("[JSONPatch Converter] Operation %d (%s %s) has no value", i, o.Op, o.Path)
+			}
+		case "move", "copy":
+			if _, ok := fields["from"]; !ok {
+				return nil, fmt.Errorf("[JSONPatch Converter] Operation %d (%s %s) has no from", i, o.Op, o.Path)
+			}
+			if o.from, err = parsePointer(o.From); err != nil {
+				return nil, fmt.Errorf("[JSONPatch Converter] Operation %d: %s", i, err.Error())
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("[JSONPatch Converter] Operation %d has unknown op %q", i, o.Op)
+		}
+		if _, ok := fields["path"]; !ok {
+			return nil, fmt.Errorf("[JSONPatch Converter] Operation %d (%s) has no path", i, o.Op)
+		}
+		if o.path, err = parsePointer(o.Path); err != nil {
+			return nil, fmt.Errorf("[JSONPatch Converter] Operation %d: %s", i, err.Error())
+		}
+		if o.Op == "move" && isProperPrefix(o.from, o.path) {
+			return nil, fmt.Errorf("[JSONPatch Converter] Operation %d can't move %s into itself", i, o.From)
+		}
+	}
+	return &JSONPatchConverter{operations: operations}, nil
+}
+
+func (c *JSONPatchConverter) IsReusable() bool {
+	return true
+}
+
+func (c *JSONPatchConverter) Convert(content types.HTTPContent, ctx ConvertContext) (types.HTTPContent, error) {
+	doc, err := decodeJSON(content.Body)
+	if err != nil {
+		return types.HTTPContent{}, fmt.Errorf("[JSONPatch Converter] Body is not JSON: %s", err.Error())
+	}
+	if c.merge != nil {
+		doc = mergePatch(doc, c.merge)
+	}
+	for i, o := range c.operations {
+		doc, err = o.apply(doc)
+		if err != nil {
+			return types.HTTPContent{}, fmt.Errorf("[JSONPatch Converter] Operation %d (%s %s) failed: %s", i, o.Op, o.Path, err.Error())
+		}
+	}
+	body, err := encodeJSON(doc, "")
+	if err != nil {
+		return types.HTTPContent{}, fmt.Errorf("[JSONPatch Converter] Failed to marshal body: %s", err.Error())
+	}
+	return types.HTTPContent{Body: body, Header: content.Header}, nil
+}
+
+// mergePatch RFC 7386
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return deepCopy(patch)
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+func (o patchOperation) apply(doc any) (any, error) {
+	switch o.Op {
+	case "add":
+		return addValue(doc, o.path, deepCopy(o.Value))
+	case "remove":
+		return removeValue(doc, o.path)
+	case "replace":
+		if _, err := getValue(doc, o.path); err != nil {
+			return nil, err
+		}
+		return setValue(doc, o.path, deepCopy(o.Value))
+	case "move":
+		v, err := getValue(doc, o.from)
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = removeValue(doc, o.from); err != nil {
+			return nil, err
+		}
+		return addValue(doc, o.path, v)
+	case "copy":
+		v, err := getValue(doc, o.from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, o.path, deepCopy(v))
+	case "test":
+		v, err := getValue(doc, o.path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(v, o.Value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", o.Op)
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isProperPrefix(prefix, tokens []string) bool {
+	if len(prefix) >= len(tokens) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != tokens[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	last := length - 1
+	if allowEnd {
+		last = length
+	}
+	if i > last {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func getValue(doc any, tokens []string) (any, error) {
+	for _, t := range tokens {
+		switch d := doc.(type) {
+		case map[string]any:
+			v, ok := d[t]
+			if !ok {
+				return nil, fmt.Errorf("%q not found", t)
+			}
+			doc = v
+		case []any:
+			i, err := arrayIndex(t, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("%q not found", t)
+		}
+	}
+	return doc, nil
+}
+
+// setValue replaces the value at tokens, whose parent must exist
+func setValue(doc any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return updateParent(doc, tokens, func(parent any, last string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			p[last] = value
+			return p, nil
+		case []any:
+			i, err := arrayIndex(last, len(p), false)
+			if err != nil {
+				return nil, err
+			}
+			p[i] = value
+			return p, nil
+		}
+		return nil, fmt.Errorf("%q not found", last)
+	})
+}
+
+func addValue(doc any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return updateParent(doc, tokens, func(parent any, last string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			p[last] = value
+			return p, nil
+		case []any:
+			i, err := arrayIndex(last, len(p), true)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		}
+		return nil, fmt.Errorf("%q not found", last)
+	})
+}
+
+func removeValue(doc any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("can't remove the whole document")
+	}
+	return updateParent(doc, tokens, func(parent any, last string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			if _, ok := p[last]; !ok {
+				return nil, fmt.Errorf("%q not found", last)
+			}
+			delete(p, last)
+			return p, nil
+		case []any:
+			i, err := arrayIndex(last, len(p), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(p[:i:i], p[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%q not found", last)
+	})
+}
+
+// updateParent changes the parent of the value at tokens, which must not be
+// empty, with update and puts the changed parent back, as inserting into an
+// array gives a new slice
+func updateParent(doc any, tokens []string, update func(parent any, last string) (any, error)) (any, error) {
+	parentTokens, last := tokens[:len(tokens)-1], tokens[len(tokens)-1]
+	parent, err := getValue(doc, parentTokens)
+	if err != nil {
+		return nil, err
+	}
+	parent, err = update(parent, last)
+	if err != nil {
+		return nil, err
+	}
+	if len(parentTokens) == 0 {
+		return parent, nil
+	}
+	return setValue(doc, parentTokens, parent)
+}
+
+func deepCopy(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(v))
+		for k, e := range v {
+			c[k] = deepCopy(e)
+		}
+		return c
+	case []any:
+		c := make([]any, len(v))
+		for i, e := range v {
+			c[i] = deepCopy(e)
+		}
+		return c
+	}
+	return v
+}
+
+// jsonEqual compares decoded JSON values, numbers by their value
+func jsonEqual(a, b any) bool {
+	switch a := a.(type) {
+	case json.Number:
+		n, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, err1 := a.Float64()
+		y, err2 := n.Float64()
+		return err1 == nil && err2 == nil && x == y
+	case map[string]any:
+		m, ok := b.(map[string]any)
+		if !ok || len(a) != len(m) {
+			return false
+		}
+		for k, v := range a {
+			w, ok := m[k]
+			if !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		l, ok := b.([]any)
+		if !ok || len(a) != len(l) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], l[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,127 @@
+package convert
+
+import (
+	"net/http"
+	"testing"
+
+	"oadin/internal/types"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestJSONPatchConverter(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string // as written in a flavor file
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "add replace remove",
+			config: `
+- {op: add, path: /options, value: {num_ctx: 4096}}
+- {op: replace, path: /stream, value: false}
+- {op: remove, path: /seed}`,
+			body: `{"model":"m","stream":true,"seed":1}`,
+			want: `{"model":"m","options":{"num_ctx":4096},"stream":false}`,
+		},
+		{
+			name: "arrays",
+			config: `
+- {op: add, path: /messages/0, value: {role: system, content: be brief}}
+- {op: add, path: /messages/-, value: {role: user, content: bye}}
+- {op: remove, path: /stop/1}`,
+			body: `{"messages":[{"role":"user","content":"hi"}],"stop":["a","b","c"]}`,
+			want: `{"messages":[{"content":"be brief","role":"system"},{"content":"hi","role":"user"},{"content":"bye","role":"user"}],"stop":["a","c"]}`,
+		},
+		{
+			name: "move copy and escaped pointers",
+			config: `
+- {op: move, from: /max_tokens, path: /options/num_predict}
+- {op: copy, from: /a~1b, path: /c~0d}`,
+			body: `{"max_tokens":12345678901234567890,"options":{},"a/b":[1]}`,
+			want: `{"a/b":[1],"c~d":[1],"options":{"num_predict":12345678901234567890}}`,
+		},
+		{
+			name: "test passes",
+			config: `
+- {op: test, path: /n, value: 1.0}
+- {op: replace, path: "", value: {ok: true}}`,
+			body: `{"n":1}`,
+			want: `{"ok":true}`,
+		},
+		{
+			name:    "test fails",
+			config:  `[{op: test, path: /model, value: other}]`,
+			body:    `{"model":"m"}`,
+			wantErr: true,
+		},
+		{
+			name:    "replace of a missing field fails",
+			config:  `[{op: replace, path: /missing, value: 1}]`,
+			body:    `{}`,
+			wantErr: true,
+		},
+		{
+			name:    "array index out of range",
+			config:  `[{op: add, path: /a/3, value: 1}]`,
+			body:    `{"a":[0]}`,
+			wantErr: true,
+		},
+		{
+			name: "merge patch",
+			config: `
+stream: false
+seed: null
+options: {temperature: 0.2, top_k: null}`,
+			body: `{"stream":true,"seed":7,"options":{"top_k":40,"top_p":0.9},"text":"<b>&</b>"}`,
+			want: `{"options":{"temperature":0.2,"top_p":0.9},"stream":false,"text":"<b>&</b>"}`,
+		},
+		{
+			name:    "not json body",
+			config:  `{stream: false}`,
+			body:    `[DONE]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config any
+			if err := yaml.Unmarshal([]byte(tt.config), &config); err != nil {
+				t.Fatal(err)
+			}
+			c, err := NewJSONPatchConverter(config)
+			if err != nil {
+				t.Fatalf("NewJSONPatchConverter() error = %v", err)
+			}
+			content := types.HTTPContent{Body: []byte(tt.body), Header: http.Header{}}
+			got, err := c.Convert(content, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Convert() = %s, error = %v, wantErr %v", got.Body, err, tt.wantErr)
+			}
+			if err == nil && string(got.Body) != tt.want {
+				t.Errorf("Convert() = %s, want %s", got.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewJSONPatchConverter(t *testing.T) {
+	for _, config := range []string{
+		`[{op: add, path: /a}]`,
+		`[{op: frobnicate, path: /a}]`,
+		`[{op: copy, path: /a}]`,
+		`[{op: remove, path: a}]`,
+		`[{op: move, from: /a, path: /a/b}]`,
+		`just a string`,
+	} {
+		var c any
+		if err := yaml.Unmarshal([]byte(config), &c); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewJSONPatchConverter(c); err == nil {
+			t.Errorf("NewJSONPatchConverter(%s) expects an error", config)
+		}
+	}
+}
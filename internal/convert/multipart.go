@@ -0,0 +1,395 @@
+package convert
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"oadin/internal/types"
+)
+
+// The converters here turn bodies which are not JSON, i.e. multipart forms and
+// binary data like audio, into JSON and back, so the fields can be changed by
+// the JSON converters in between, e.g.
+//
+//   - converter: multipart_to_json
+//   - converter: jsonata
+//     config: '$merge([$, {"model": $model}])'
+//   - converter: json_to_multipart
+//
+// A file is given in JSON as {"filename": ..., "content_type": ..., "size": ...}
+// with either "data", its content in base64, or "path", the file it is spooled
+// to. The forms of service requests come spooled, see SpooledFormContentType.
+// A path is only read inside the spool dir of the request, given to the
+// converters as SpoolDirKey in the context, as the JSON comes from the client
+
+// SpooledFormContentType the content type of a multipart form which is given
+// as the JSON of its fields, with the files spooled, instead of the form itself.
+// It is sent out as a multipart form unless it is converted to something else
+const SpooledFormContentType = "application/vnd.oadin.form+json"
+
+// SpoolDirKey the key of the spool dir of the request in the ConvertContext
+const SpoolDirKey = "spool_dir"
+
+// SpoolFile writes the content of r to a new file in spoolDir, or keeps it
+// inline as base64 data if spoolDir is empty, and gives it as a file in JSON
+func SpoolFile(spoolDir, filename, contentType string, r io.Reader) (map[string]any, error) {
+	file := map[string]any{
+		"filename":     filename,
+		"content_type": contentType,
+	}
+	if spoolDir == "" {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		file["data"] = base64.StdEncoding.EncodeToString(data)
+		file["size"] = len(data)
+		return file, nil
+	}
+	f, err := os.CreateTemp(spoolDir, "part-*"+filepath.Ext(filepath.Base(filename)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return nil, err
+	}
+	file["path"] = f.Name()
+	file["size"] = size
+	return file, nil
+}
+
+// fileData the content of a file given in JSON, false if it is not a file
+func fileData(v map[string]any, ctx ConvertContext) ([]byte, bool, error) {
+	if data, ok := v["data"].(string); ok {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, true, fmt.Errorf("data is not base64: %s", err.Error())
+		}
+		return decoded, true, nil
+	}
+	if path, ok := v["path"].(string); ok {
+		if !spooled(path, ctx) {
+			return nil, true, fmt.Errorf("file %s is not spooled for the request", path)
+		}
+		data, err := os.ReadFile(path)
+		return data, true, err
+	}
+	return nil, false, nil
+}
+
+// spooled whether path is a file in the spool dir of the request
+func spooled(path string, ctx ConvertContext) bool {
+	spoolDir, _ := ctx[SpoolDirKey].(string)
+	if spoolDir == "" || !filepath.IsAbs(path) {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Clean(spoolDir), filepath.Clean(path))
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// ParseMultipart the fields of a multipart form as multipart_to_json gives
+// them, a field given more than once is a list. The files are spooled to
+// spoolDir, or kept inline if it is empty
+func ParseMultipart(r io.Reader, contentType string, spoolDir string) (map[string]any, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, fmt.Errorf("not a multipart body: %s", contentType)
+	}
+	reader := multipart.NewReader(r, params["boundary"])
+	fields := make(map[string]any)
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+		var value any
+		if part.FileName() != "" {
+			value, err = SpoolFile(spoolDir, part.FileName(), part.Header.Get("Content-Type"), part)
+		} else {
+			var data []byte
+			data, err = io.ReadAll(part)
+			value = string(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch v := fields[name].(type) {
+		case nil:
+			fields[name] = value
+		case []any:
+			fields[name] = append(v, value)
+		default:
+			fields[name] = []any{v, value}
+		}
+	}
+}
+
+// inlineFiles gives the spooled files in fields their data, for providers
+// which take files as base64 in JSON
+func inlineFiles(fields map[string]any, ctx ConvertContext) error {
+	for _, value := range fields {
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, v := range values {
+			file, ok := v.(map[string]any)
+			if !ok || file["data"] != nil {
+				continue
+			}
+			data, isFile, err := fileData(file, ctx)
+			if err != nil {
+				return err
+			}
+			if isFile {
+				file["data"] = base64.StdEncoding.EncodeToString(data)
+			}
+		}
+	}
+	return nil
+}
+
+// MultipartToJSONConverter a spooled form is JSON already and is taken as it
+// is. With inline_files set the spooled files get their data
+type MultipartToJSONConverter struct {
+	InlineFiles bool `json:"inline_files"`
+}
+
+func NewMultipartToJSONConverter(config any) (Converter, error) {
+	c := &MultipartToJSONConverter{}
+	if config == nil {
+		return c, nil
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("[MultipartToJSON Converter] Invalid config %+v: %s", config, err.Error())
+	}
+	return c, nil
+}
+
+func (c *MultipartToJSONConverter) IsReusable() bool {
+	return true
+}
+
+func (c *MultipartToJSONConverter) Convert(content types.HTTPContent, ctx ConvertContext) (types.HTTPContent, error) {
+	contentType := content.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var fields map[string]any
+	var err error
+	if mediaType == SpooledFormContentType {
+		err = json.Unmarshal(content.Body, &fields)
+	} else {
+		fields, err = ParseMultipart(bytes.NewReader(content.Body), contentType, "")
+	}
+	if err != nil {
+		return types.HTTPContent{}, fmt.Errorf("[MultipartToJSON Converter] Failed to parse body: %s", err.Error())
+	}
+	if c.InlineFiles {
+		if err := inlineFiles(fields, ctx); err != nil {
+			return types.HTTPContent{}, fmt.Errorf("[MultipartToJSON Converter] Failed to read file: %s", err.Error())
+		}
+	}
+	body, err := encodeJSON(fields, "")
+	if err != nil {
+		return types.HTTPContent{}, fmt.Errorf("[MultipartToJSON Converter] Failed to marshal body: %s", err.Error())
+	}
+	return types.HTTPContent{Body: body, Header: withContentType(content.Header, "application/json")}, nil
+}
+
+// JSONToMultipartConverter the fields of the JSON object go to the form in the
+// order of their names, lists are given as repeated fields and null is left
+// out. The boundary is made of the body so the same body gives the same form
+type JSONToMultipartConverter struct{}
+
+func NewJSONToMultipartConverter(config any) (Converter, error) {
+	return &JSONToMultipartConverter{}, nil
+}
+
+func (c *JSONToMultipartConverter) IsReusable() bool {
+	return true
+}
+
+func (c *JSONToMultipartConverter) Convert(content types.HTTPContent, ctx ConvertContext) (types.HTTPContent, error) {
+	doc, err := decodeJSON(content.Body)
+	if err != nil {
+		return types.HTTPContent{}, fmt.Errorf("[JSONToMultipart Converter] Body is not JSON: %s", err.Error())
+	}
+	fields, ok := doc.(map[string]any)
+	if !ok {
+		return types.HTTPContent{}, fmt.Errorf("[JSONToMultipart Converter] Expect a JSON object but got: %s", content.Body)
+	}
+	sum := sha256.Sum256(content.Body)
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	if err := writer.SetBoundary("oadin" + hex.EncodeToString(sum[:12])); err != nil {
+		return types.HTTPContent{}, err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values, ok := fields[name].([]any)
+		if !ok {
+			values = []any{fields[name]}
+		}
+		for _, value := range values {
+			if err := writeFormValue(writer, name, value, ctx); err != nil {
+				return types.HTTPContent{}, fmt.Errorf("[JSONToMultipart Converter] Failed to write field %s: %s", name, err.Error())
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return types.HTTPContent{}, err
+	}
+	return types.HTTPContent{Body: buf.Bytes(), Header: withContentType(content.Header, writer.FormDataContentType())}, nil
+}
+
+func writeFormValue(writer *multipart.Writer, name string, value any, ctx ConvertContext) error {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return writer.WriteField(name, v)
+	case map[string]any:
+		decoded, isFile, err := fileData(v, ctx)
+		if err != nil {
+			return err
+		}
+		if !isFile {
+			// not a file, send the object as JSON text
+			b, err := encodeJSON(v, "")
+			if err != nil {
+				return err
+			}
+			return writer.WriteField(name, string(b))
+		}
+		filename, _ := v["filename"].(string)
+		if filename == "" {
+			filename = name
+		}
+		contentType, _ := v["content_type"].(string)
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(name), escapeQuotes(filename)))
+		header.Set("Content-Type", contentType)
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		_, err = part.Write(decoded)
+		return err
+	case []any:
+		b, err := encodeJSON(v, "")
+		if err != nil {
+			return err
+		}
+		return writer.WriteField(name, string(b))
+	default:
+		// numbers and booleans
+		return writer.WriteField(name, fmt.Sprint(v))
+	}
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// BinaryToJSONConverter gives the body as {"content_type": ..., "data": <base64>}
+type BinaryToJSONConverter struct{}
+
+func NewBinaryToJSONConverter(config any) (Converter, error) {
+	return &BinaryToJSONConverter{}, nil
+}
+
+func (c *BinaryToJSONConverter) IsReusable() bool {
+	return true
+}
+
+func (c *BinaryToJSONConverter) Convert(content types.HTTPContent, ctx ConvertContext) (types.HTTPContent, error) {
+	body, err := json.Marshal(map[string]any{
+		"content_type": content.Header.Get("Content-Type"),
+		"data":         base64.StdEncoding.EncodeToString(content.Body),
+	})
+	if err != nil {
+		return types.HTTPContent{}, fmt.Errorf("[BinaryToJSON Converter] Failed to marshal body: %s", err.Error())
+	}
+	return types.HTTPContent{Body: body, Header: withContentType(content.Header, "application/json")}, nil
+}
+
+// JSONToBinaryConverter takes the body from {"content_type": ..., "data": <base64>},
+// or "path" instead of "data", the content type is detected from the data if it
+// is not given
+type JSONToBinaryConverter struct{}
+
+func NewJSONToBinaryConverter(config any) (Converter, error) {
+	return &JSONToBinaryConverter{}, nil
+}
+
+func (c *JSONToBinaryConverter) IsReusable() bool {
+	return true
+}
+
+func (c *JSONToBinaryConverter) Convert(content types.HTTPContent, ctx ConvertContext) (types.HTTPContent, error) {
+	var v map[string]any
+	if err := json.Unmarshal(content.Body, &v); err != nil {
+		return types.HTTPContent{}, fmt.Errorf("[JSONToBinary Converter] Body is not JSON: %s", err.Error())
+	}
+	body, isFile, err := fileData(v, ctx)
+	if err != nil {
+		return types.HTTPContent{}, fmt.Errorf("[JSONToBinary Converter] Failed to read data: %s", err.Error())
+	}
+	if !isFile {
+		return types.HTTPContent{}, fmt.Errorf("[JSONToBinary Converter] No data in body: %s", content.Body)
+	}
+	contentType, _ := v["content_type"].(string)
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return types.HTTPContent{Body: body, Header: withContentType(content.Header, contentType)}, nil
+}
+
+// withContentType a copy of header with the content type changed
+func withContentType(header http.Header, contentType string) http.Header {
+	h := header.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	h.Set("Content-Type", contentType)
+	h.Del("Content-Length")
+	return h
+}
@@ -0,0 +1,139 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"oadin/internal/types"
+)
+
+func TestMultipartJSONRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	_ = writer.WriteField("model", "whisper-1")
+	_ = writer.WriteField("timestamp_granularities[]", "word")
+	_ = writer.WriteField("timestamp_granularities[]", "segment")
+	part, _ := writer.CreateFormFile("file", "hello.wav")
+	_, _ = part.Write([]byte("RIFF\x00\x01WAVE"))
+	_ = writer.Close()
+	header := http.Header{"Content-Type": {writer.FormDataContentType()}}
+
+	toJSON, _ := NewMultipartToJSONConverter(nil)
+	got, err := toJSON.Convert(types.HTTPContent{Body: buf.Bytes(), Header: header}, nil)
+	if err != nil {
+		t.Fatalf("multipart_to_json error = %v", err)
+	}
+	want := `{"file":{"content_type":"application/octet-stream","data":"UklGRgABV0FWRQ==","filename":"hello.wav","size":10},"model":"whisper-1","timestamp_granularities[]":["word","segment"]}`
+	if string(got.Body) != want {
+		t.Fatalf("multipart_to_json = %s, want %s", got.Body, want)
+	}
+
+	toMultipart, _ := NewJSONToMultipartConverter(nil)
+	form, err := toMultipart.Convert(got, nil)
+	if err != nil {
+		t.Fatalf("json_to_multipart error = %v", err)
+	}
+	again, err := toMultipart.Convert(got, nil)
+	if err != nil || !bytes.Equal(form.Body, again.Body) {
+		t.Errorf("json_to_multipart is expected to give the same form for the same body")
+	}
+	back, err := toJSON.Convert(form, nil)
+	if err != nil {
+		t.Fatalf("multipart_to_json error = %v", err)
+	}
+	if string(back.Body) != want {
+		t.Errorf("round trip = %s, want %s", back.Body, want)
+	}
+}
+
+func TestBinaryJSONRoundTrip(t *testing.T) {
+	audio := []byte("ID3\x03\x00\x00\x00\x00\x00\x00\xff\xfb")
+	header := http.Header{"Content-Type": {"audio/mpeg"}}
+
+	toJSON, _ := NewBinaryToJSONConverter(nil)
+	got, err := toJSON.Convert(types.HTTPContent{Body: audio, Header: header}, nil)
+	if err != nil {
+		t.Fatalf("binary_to_json error = %v", err)
+	}
+	toBinary, _ := NewJSONToBinaryConverter(nil)
+	back, err := toBinary.Convert(got, nil)
+	if err != nil {
+		t.Fatalf("json_to_binary error = %v", err)
+	}
+	if !bytes.Equal(back.Body, audio) || back.Header.Get("Content-Type") != "audio/mpeg" {
+		t.Errorf("round trip = %q (%s), want %q (audio/mpeg)", back.Body, back.Header.Get("Content-Type"), audio)
+	}
+	if _, err := toBinary.Convert(types.HTTPContent{Body: []byte(`{"error":"no audio"}`)}, nil); err == nil {
+		t.Errorf("json_to_binary expects an error without data")
+	}
+}
+
+func TestSpooledFileRefs(t *testing.T) {
+	dir := t.TempDir()
+	file, err := SpoolFile(dir, "hello.wav", "audio/wav", strings.NewReader("RIFF\x00\x01WAVE"))
+	if err != nil {
+		t.Fatalf("SpoolFile error = %v", err)
+	}
+	if path, _ := file["path"].(string); filepath.Dir(path) != dir || file["data"] != nil {
+		t.Fatalf("SpoolFile = %v, want a file in %s", file, dir)
+	}
+	body, _ := json.Marshal(map[string]any{"model": "whisper-1", "file": file})
+	header := http.Header{"Content-Type": {SpooledFormContentType}}
+	ctx := ConvertContext{SpoolDirKey: dir}
+
+	toMultipart, _ := NewJSONToMultipartConverter(nil)
+	form, err := toMultipart.Convert(types.HTTPContent{Body: body, Header: header}, ctx)
+	if err != nil {
+		t.Fatalf("json_to_multipart error = %v", err)
+	}
+	fields, err := ParseMultipart(bytes.NewReader(form.Body), form.Header.Get("Content-Type"), "")
+	if err != nil {
+		t.Fatalf("ParseMultipart error = %v", err)
+	}
+	if got := fields["file"].(map[string]any)["data"]; got != "UklGRgABV0FWRQ==" {
+		t.Errorf("file data = %v, want the spooled content", got)
+	}
+
+	inline, _ := NewMultipartToJSONConverter(map[string]any{"inline_files": true})
+	got, err := inline.Convert(types.HTTPContent{Body: body, Header: header}, ctx)
+	if err != nil {
+		t.Fatalf("multipart_to_json error = %v", err)
+	}
+	if !strings.Contains(string(got.Body), `"data":"UklGRgABV0FWRQ=="`) {
+		t.Errorf("multipart_to_json with inline_files = %s, want the file data", got.Body)
+	}
+}
+
+func TestFileOutsideSpoolRejected(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Content-Type": {SpooledFormContentType}}
+	toMultipart, _ := NewJSONToMultipartConverter(nil)
+	inline, _ := NewMultipartToJSONConverter(map[string]any{"inline_files": true})
+	for _, path := range []string{secret, filepath.Join(dir, "..", filepath.Base(filepath.Dir(secret)), "secret.txt"), dir, "secret.txt"} {
+		body, _ := json.Marshal(map[string]any{"file": map[string]any{"filename": "a.wav", "path": path}})
+		content := types.HTTPContent{Body: body, Header: header}
+		for _, ctx := range []ConvertContext{nil, {SpoolDirKey: dir}} {
+			if form, err := toMultipart.Convert(content, ctx); err == nil || bytes.Contains(form.Body, []byte("secret")) {
+				t.Errorf("json_to_multipart reads %s with spool dir %v", path, ctx[SpoolDirKey])
+			}
+			if got, err := inline.Convert(content, ctx); err == nil || bytes.Contains(got.Body, []byte("c2VjcmV0")) {
+				t.Errorf("multipart_to_json reads %s with spool dir %v", path, ctx[SpoolDirKey])
+			}
+		}
+	}
+	// a client can't give its own form as JSON
+	body, _ := json.Marshal(map[string]any{"file": map[string]any{"path": secret}})
+	if _, err := inline.Convert(types.HTTPContent{Body: body, Header: http.Header{"Content-Type": {"application/json"}}}, nil); err == nil {
+		t.Error("multipart_to_json takes a JSON body as a form")
+	}
+}
@@ -67,6 +67,9 @@ func (ds *SQLite) Init() error {
 		&types.File{},
 		&types.FileChunk{},
 		&types.ToolMessage{},
+		&types.ResponseState{},
+		&types.BatchFile{},
+		&types.Batch{},
 	); err != nil {
 		return fmt.Errorf("failed to initialize database tables: %v", err)
 	}
@@ -110,11 +113,34 @@ func (ds *SQLite) insertInitialData() error {
 			Name:         "text_to_image",
 			HybridPolicy: "always_remote",
 			Status:       1,
+		}, &types.Service{
+			Name:         "rerank",
+			HybridPolicy: "default",
+			Status:       1,
+		}, &types.Service{
+			Name:         "speech_to_text",
+			HybridPolicy: "default",
+			Status:       1,
+		}, &types.Service{
+			Name:         "text_to_speech",
+			HybridPolicy: "always_remote",
+			Status:       1,
 		})
 
 		if err := ds.db.CreateInBatches(initService, len(initService)).Error; err != nil {
 			return fmt.Errorf("failed to create initial service: %v", err)
 		}
+	} else {
+		// services added after the first release are missing from existing databases
+		for _, service := range []*types.Service{
+			{Name: "rerank", HybridPolicy: "default", Status: 1},
+			{Name: "speech_to_text", HybridPolicy: "default", Status: 1},
+			{Name: "text_to_speech", HybridPolicy: "always_remote", Status: 1},
+		} {
+			if err := ds.db.Where(&types.Service{Name: service.Name}).FirstOrCreate(service).Error; err != nil {
+				return fmt.Errorf("failed to create service %s: %v", service.Name, err)
+			}
+		}
 	}
 	if servicesProviderCount == 0 {
 		var serviceProviders []*types.ServiceProvider
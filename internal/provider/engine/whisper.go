@@ -0,0 +1,395 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"oadin/internal/types"
+	"oadin/internal/utils"
+	"oadin/internal/utils/client"
+)
+
+// WhisperOperateStatus whisper.cpp server serves the speech_to_text service,
+// it loads one ggml model which is given when the server starts
+var WhisperOperateStatus = 1
+
+const (
+	whisperModelURL    = "https://huggingface.co/ggerganov/whisper.cpp/resolve/main/ggml-%s.bin"
+	whisperDownloadURL = "https://github.com/ggml-org/whisper.cpp/releases/download/v1.7.6/whisper-bin-x64.zip"
+)
+
+var whisperModelName = regexp.MustCompile(`^[a-z0-9][a-z0-9.\-]*$`)
+
+type WhisperProvider struct {
+	EngineConfig *types.EngineRecommendConfig
+}
+
+func NewWhisperProvider(config *types.EngineRecommendConfig) *WhisperProvider {
+	if config != nil {
+		return &WhisperProvider{
+			EngineConfig: config,
+		}
+	}
+	whisperProvider := new(WhisperProvider)
+	whisperProvider.EngineConfig = whisperProvider.GetConfig()
+	if whisperProvider.EngineConfig == nil {
+		return nil
+	}
+	return whisperProvider
+}
+
+func (w *WhisperProvider) GetOperateStatus() int {
+	return WhisperOperateStatus
+}
+
+func (w *WhisperProvider) SetOperateStatus(status int) {
+	WhisperOperateStatus = status
+	slog.Info("Whisper operate status set to", "status", WhisperOperateStatus)
+}
+
+func (w *WhisperProvider) GetDefaultClient() *client.Client {
+	// default host
+	host := "127.0.0.1:16678"
+	if w.EngineConfig.Host != "" {
+		host = w.EngineConfig.Host
+	}
+
+	// default scheme
+	scheme := "http"
+	if w.EngineConfig.Scheme == "https" {
+		scheme = "https"
+	}
+
+	return client.NewClient(&url.URL{
+		Scheme: scheme,
+		Host:   host,
+	}, http.DefaultClient)
+}
+
+func (w *WhisperProvider) GetConfig() *types.EngineRecommendConfig {
+	if w.EngineConfig != nil {
+		return w.EngineConfig
+	}
+
+	downloadPath, err := utils.GetDownloadDir()
+	if err != nil {
+		slog.Error("Get download dir failed", "error", err)
+		return nil
+	}
+	dataDir, err := utils.GetOadinDataDir()
+	if err != nil {
+		slog.Error("Get Oadin data dir failed", "error", err)
+		return nil
+	}
+
+	enginePath := fmt.Sprintf("%s/%s", dataDir, "engine/whisper")
+	execFile := "whisper-server"
+	execPath := fmt.Sprintf("%s/%s", enginePath, "bin")
+	downloadUrl := ""
+	switch runtime.GOOS {
+	case "windows":
+		execFile = "whisper-server.exe"
+		execPath = fmt.Sprintf("%s/%s", enginePath, "Release")
+		downloadUrl = whisperDownloadURL
+	case "linux", "darwin":
+		// no prebuilt server for these systems, use the one on PATH or in bin
+		if p, err := exec.LookPath(execFile); err == nil {
+			execPath = filepath.Dir(p)
+		}
+	default:
+		return nil
+	}
+
+	return &types.EngineRecommendConfig{
+		Host:           "127.0.0.1:16678",
+		Origin:         "127.0.0.1",
+		Scheme:         "http",
+		EnginePath:     enginePath,
+		RecommendModel: "base",
+		DownloadUrl:    downloadUrl,
+		DownloadPath:   downloadPath,
+		ExecPath:       execPath,
+		ExecFile:       execFile,
+	}
+}
+
+func (w *WhisperProvider) modelDir() string {
+	return filepath.Join(w.EngineConfig.EnginePath, "models")
+}
+
+func (w *WhisperProvider) modelFile(name string) string {
+	return filepath.Join(w.modelDir(), fmt.Sprintf("ggml-%s.bin", name))
+}
+
+func (w *WhisperProvider) pidFile() (string, error) {
+	rootPath, err := utils.GetOadinDataDir()
+	if err != nil {
+		return "", fmt.Errorf("failed get oadin dir: %v", err)
+	}
+	return fmt.Sprintf("%s/whisper.pid", rootPath), nil
+}
+
+func (w *WhisperProvider) InstallEngine() error {
+	if w.EngineConfig.DownloadUrl == "" {
+		return fmt.Errorf("no whisper server build for %s, install whisper.cpp and put whisper-server on PATH or in %s", runtime.GOOS, w.EngineConfig.ExecPath)
+	}
+	file, err := utils.DownloadFile(w.EngineConfig.DownloadUrl, w.EngineConfig.DownloadPath)
+	if err != nil {
+		return fmt.Errorf("failed to download whisper: %v, url: %v", err, w.EngineConfig.DownloadUrl)
+	}
+
+	slog.Info("[Install Engine] start install whisper...")
+	if err := os.MkdirAll(w.EngineConfig.EnginePath, 0o755); err != nil {
+		return err
+	}
+	unzipCmd := exec.Command("tar", "-xf", file, "-C", w.EngineConfig.EnginePath)
+	if err := unzipCmd.Run(); err != nil {
+		return fmt.Errorf("failed to unzip file: %v", err)
+	}
+
+	slog.Info("[Install Engine] whisper install completed")
+	return nil
+}
+
+// Installed tells whether there is a whisper server to start
+func (w *WhisperProvider) Installed() bool {
+	info, err := os.Stat(filepath.Join(w.EngineConfig.ExecPath, w.EngineConfig.ExecFile))
+	return err == nil && !info.IsDir()
+}
+
+func (w *WhisperProvider) InitEnv() error {
+	return os.MkdirAll(w.modelDir(), 0o755)
+}
+
+// StartEngine starts the server with the recommended model, or the first model
+// there is, the recommended model is pulled first if there is no model at all
+func (w *WhisperProvider) StartEngine() error {
+	if !w.Installed() {
+		return fmt.Errorf("whisper server is not installed, put %s on PATH or in %s", w.EngineConfig.ExecFile, w.EngineConfig.ExecPath)
+	}
+	models, err := w.ListModels(context.Background())
+	if err != nil {
+		return err
+	}
+	model := ""
+	for _, m := range models.Models {
+		if model == "" || m.Name == w.EngineConfig.RecommendModel {
+			model = m.Name
+		}
+	}
+	if model == "" {
+		model = w.EngineConfig.RecommendModel
+		if _, err := w.PullModel(context.Background(), &types.PullModelRequest{Model: model}, nil); err != nil {
+			return err
+		}
+	}
+
+	host, port, err := splitHostPort(w.EngineConfig.Host)
+	if err != nil {
+		return err
+	}
+	execFile := filepath.Join(w.EngineConfig.ExecPath, w.EngineConfig.ExecFile)
+	cmd := exec.Command(execFile, "-m", w.modelFile(model), "--host", host, "--port", port)
+	if runtime.GOOS == "windows" {
+		utils.SetCmdSysProcAttr(cmd)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start whisper: %v", err)
+	}
+
+	pidFile, err := w.pidFile()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(pidFile, []byte(fmt.Sprintf("%d", cmd.Process.Pid)), 0o644); err != nil {
+		return fmt.Errorf("failed to write pid file: %v", err)
+	}
+
+	go func() {
+		cmd.Wait()
+	}()
+
+	return nil
+}
+
+func (w *WhisperProvider) StopEngine() error {
+	pidFile, err := w.pidFile()
+	if err != nil {
+		return err
+	}
+	pidData, err := os.ReadFile(pidFile)
+	if err != nil {
+		return fmt.Errorf("failed to read pid file: %v", err)
+	}
+	pid, err := strconv.Atoi(string(pidData))
+	if err != nil {
+		return fmt.Errorf("invalid pid format: %v", err)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("failed to find process: %v", err)
+	}
+	if err := process.Kill(); err != nil {
+		return fmt.Errorf("failed to kill process: %v", err)
+	}
+	if err := os.Remove(pidFile); err != nil {
+		return fmt.Errorf("failed to remove pid file: %v", err)
+	}
+	return nil
+}
+
+// HealthCheck whisper server has no health api, it is up once it answers
+func (w *WhisperProvider) HealthCheck() error {
+	scheme := "http"
+	if w.EngineConfig.Scheme == "https" {
+		scheme = "https"
+	}
+	c := http.Client{Timeout: 3 * time.Second}
+	resp, err := c.Get(fmt.Sprintf("%s://%s/", scheme, w.EngineConfig.Host))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("whisper server returns %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *WhisperProvider) GetVersion(ctx context.Context, resp *types.EngineVersionResponse) (*types.EngineVersionResponse, error) {
+	return &types.EngineVersionResponse{
+		Version: "1.7.6",
+	}, nil
+}
+
+// PullModel downloads the ggml model of the name, e.g. base or large-v3-turbo
+func (w *WhisperProvider) PullModel(ctx context.Context, req *types.PullModelRequest, fn types.PullProgressFunc) (*types.ProgressResponse, error) {
+	name := strings.ToLower(req.Model)
+	if name == "" {
+		name = strings.ToLower(req.Name)
+	}
+	if !whisperModelName.MatchString(name) {
+		return nil, fmt.Errorf("invalid whisper model name: %s", req.Model)
+	}
+	if err := os.MkdirAll(w.modelDir(), 0o755); err != nil {
+		return nil, err
+	}
+	if fn != nil {
+		_ = fn(types.ProgressResponse{Status: "pulling " + name})
+	}
+	if _, err := utils.DownloadFileContext(ctx, fmt.Sprintf(whisperModelURL, name), w.modelDir()); err != nil {
+		slog.Error("Pull whisper model failed : " + err.Error())
+		return nil, err
+	}
+	resp := &types.ProgressResponse{Status: "success"}
+	if fn != nil {
+		_ = fn(*resp)
+	}
+	return resp, nil
+}
+
+func (w *WhisperProvider) PullModelStream(ctx context.Context, req *types.PullModelRequest) (chan []byte, chan error) {
+	dataCh := make(chan []byte, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(dataCh)
+		defer close(errCh)
+		if _, err := w.PullModel(ctx, req, nil); err != nil {
+			errCh <- err
+			return
+		}
+		dataCh <- []byte(`{"status":"success"}`)
+	}()
+	return dataCh, errCh
+}
+
+func (w *WhisperProvider) DeleteModel(ctx context.Context, req *types.DeleteRequest) error {
+	name := strings.ToLower(req.Model)
+	if !whisperModelName.MatchString(name) {
+		return fmt.Errorf("invalid whisper model name: %s", req.Model)
+	}
+	if err := os.Remove(w.modelFile(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListModels the ggml-<name>.bin files in the model dir
+func (w *WhisperProvider) ListModels(ctx context.Context) (*types.ListResponse, error) {
+	lr := &types.ListResponse{}
+	entries, err := os.ReadDir(w.modelDir())
+	if os.IsNotExist(err) {
+		return lr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, "ggml-") || !strings.HasSuffix(name, ".bin") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		model := strings.TrimSuffix(strings.TrimPrefix(name, "ggml-"), ".bin")
+		lr.Models = append(lr.Models, types.ListModelResponse{
+			Name:       model,
+			Model:      model,
+			ModifiedAt: info.ModTime(),
+			Size:       info.Size(),
+		})
+	}
+	return lr, nil
+}
+
+func (w *WhisperProvider) CopyModel(ctx context.Context, req *types.CopyModelRequest) error {
+	return fmt.Errorf("WhisperProvider does not implement CopyModel")
+}
+
+func (w *WhisperProvider) GetRunModels(ctx context.Context) (*types.ListResponse, error) {
+	return &types.ListResponse{}, nil
+}
+
+func (w *WhisperProvider) UnloadModel(ctx context.Context, req *types.UnloadModelRequest) error {
+	return nil
+}
+
+func (w *WhisperProvider) Chat(ctx context.Context, req *types.ChatRequest) (*types.ChatResponse, error) {
+	return nil, fmt.Errorf("WhisperProvider does not implement Chat")
+}
+
+func (w *WhisperProvider) ChatStream(ctx context.Context, req *types.ChatRequest) (chan *types.ChatResponse, chan error) {
+	resp := make(chan *types.ChatResponse)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(resp)
+		defer close(errc)
+		errc <- fmt.Errorf("WhisperProvider does not implement ChatStream")
+	}()
+	return resp, errc
+}
+
+func (w *WhisperProvider) GenerateEmbedding(ctx context.Context, req *types.EmbeddingRequest) (*types.EmbeddingResponse, error) {
+	return nil, fmt.Errorf("WhisperProvider does not implement GenerateEmbedding")
+}
+
+func splitHostPort(hostport string) (string, string, error) {
+	host, port, found := strings.Cut(hostport, ":")
+	if !found || host == "" || port == "" {
+		return "", "", fmt.Errorf("invalid whisper host: %s", hostport)
+	}
+	return host, port, nil
+}
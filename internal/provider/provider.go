@@ -42,6 +42,8 @@ func GetModelEngine(engineName string) ModelServiceProvider {
 		provider = engine.NewOllamaProvider(nil)
 	case "openvino":
 		provider = engine.NewOpenvinoProvider(nil)
+	case "whisper":
+		provider = engine.NewWhisperProvider(nil)
 	default:
 		provider = engine.NewOllamaProvider(nil)
 	}
@@ -0,0 +1,241 @@
+package schedule
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"oadin/config"
+	"oadin/internal/types"
+)
+
+const (
+	breakerWindow     = 20  // recent requests the error rate is of
+	breakerMinSamples = 10  // requests needed before the error rate opens a breaker
+	breakerErrorRate  = 0.5 // error rate that opens a breaker
+	breakerProbes     = 1   // requests a half-open breaker lets through at once
+)
+
+// breakerPolicy the consecutive failures that open a breaker, 0 for none, and
+// how long it stays open
+func breakerPolicy() (int, time.Duration) {
+	env := config.GlobalOadinEnvironment
+	if env == nil {
+		return 5, 30 * time.Second
+	}
+	return env.BreakerFailures, env.BreakerCooldown
+}
+
+// breaker the circuit breaker of a service provider. It opens when the
+// provider keeps failing, skipped by dispatch for a cooldown, then half-opens
+// to let a probe through, which closes it again or opens it for another cooldown
+type breaker struct {
+	state    string
+	failures int    // consecutive
+	outcomes []bool // the recent requests, true for a failure
+	next     int
+	openedAt time.Time
+	probing  int
+}
+
+func (b *breaker) errorRate() float64 {
+	if len(b.outcomes) == 0 {
+		return 0
+	}
+	failed := 0
+	for _, f := range b.outcomes {
+		if f {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(b.outcomes))
+}
+
+func (b *breaker) add(failed bool) {
+	if len(b.outcomes) < breakerWindow {
+		b.outcomes = append(b.outcomes, failed)
+		return
+	}
+	b.outcomes[b.next] = failed
+	b.next = (b.next + 1) % breakerWindow
+}
+
+func (b *breaker) open(now time.Time) {
+	b.state = types.BreakerOpen
+	b.openedAt = now
+}
+
+func (b *breaker) reset() {
+	b.state = types.BreakerClosed
+	b.failures = 0
+	b.outcomes, b.next = nil, 0
+}
+
+type breakerSet struct {
+	mu       sync.Mutex
+	breakers map[string]*breaker // by provider name
+}
+
+var breakers = &breakerSet{breakers: map[string]*breaker{}}
+
+// get must be called with mu held
+func (bs *breakerSet) get(provider string) *breaker {
+	b, ok := bs.breakers[provider]
+	if !ok {
+		b = &breaker{state: types.BreakerClosed}
+		bs.breakers[provider] = b
+	}
+	return b
+}
+
+// blocked tells whether dispatch should skip the provider, its breaker is
+// open and still cooling down. A breaker through the cooldown half-opens here
+func (bs *breakerSet) blocked(provider string) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.breakers[provider]
+	if !ok || b.state != types.BreakerOpen {
+		return false
+	}
+	if _, cooldown := breakerPolicy(); time.Since(b.openedAt) < cooldown {
+		return true
+	}
+	b.state = types.BreakerHalfOpen
+	b.probing = 0
+	slog.Info("[Schedule] Circuit breaker half-opens", "service_provider", provider)
+	return false
+}
+
+// isOpen tells whether the breaker of the provider is open, whether or not
+// through its cooldown. Unlike blocked it doesn't half-open it
+func (bs *breakerSet) isOpen(provider string) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.breakers[provider]
+	return ok && b.state == types.BreakerOpen
+}
+
+// coolingDown tells whether the breaker of the provider is open and still
+// cooling down, the same as blocked but it doesn't half-open it
+func (bs *breakerSet) coolingDown(provider string) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.breakers[provider]
+	if !ok || b.state != types.BreakerOpen {
+		return false
+	}
+	_, cooldown := breakerPolicy()
+	return time.Since(b.openedAt) < cooldown
+}
+
+// admit tells whether a task may start on the provider now, a half-open
+// breaker only lets the probes through
+func (bs *breakerSet) admit(provider string) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.breakers[provider]
+	return !ok || b.state != types.BreakerHalfOpen || b.probing < breakerProbes
+}
+
+// begin is called when a task starts on the provider
+func (bs *breakerSet) begin(provider string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if b, ok := bs.breakers[provider]; ok && b.state == types.BreakerHalfOpen {
+		b.probing++
+	}
+}
+
+// end is called when a task started on the provider is cancelled, it frees
+// the probe it may have been without telling anything of the provider
+func (bs *breakerSet) end(provider string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if b, ok := bs.breakers[provider]; ok && b.state == types.BreakerHalfOpen {
+		b.probing = max(0, b.probing-1)
+	}
+}
+
+// record is called when a task has run on the provider, failed tells whether
+// the provider failed it rather than the request
+func (bs *breakerSet) record(provider string, failed bool) {
+	threshold, _ := breakerPolicy()
+	if threshold <= 0 {
+		return
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b := bs.get(provider)
+	b.add(failed)
+	if failed {
+		b.failures++
+	} else {
+		b.failures = 0
+	}
+	switch b.state {
+	case types.BreakerHalfOpen:
+		b.probing = max(0, b.probing-1)
+		if failed {
+			slog.Warn("[Schedule] Circuit breaker opens again after a failed probe", "service_provider", provider)
+			b.open(time.Now())
+		} else {
+			slog.Info("[Schedule] Circuit breaker closes", "service_provider", provider)
+			b.reset()
+		}
+	case types.BreakerClosed:
+		if b.failures >= threshold || (len(b.outcomes) >= breakerMinSamples && b.errorRate() >= breakerErrorRate) {
+			slog.Warn("[Schedule] Circuit breaker opens", "service_provider", provider,
+				"consecutive_failures", b.failures, "error_rate", b.errorRate())
+			b.open(time.Now())
+		}
+	}
+}
+
+// retryAfter how long until the breaker of the provider lets a probe through
+func (bs *breakerSet) retryAfter(provider string) time.Duration {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.breakers[provider]
+	if !ok || b.state != types.BreakerOpen {
+		return 0
+	}
+	_, cooldown := breakerPolicy()
+	return max(0, cooldown-time.Since(b.openedAt))
+}
+
+// breakerError refuses a task whose provider is skipped and has no alternative
+func breakerError(provider string) *types.HTTPErrorResponse {
+	err := httpError(http.StatusServiceUnavailable, fmt.Sprintf("service provider %s is unavailable, its circuit breaker is open", provider))
+	retryAfter := int(math.Ceil(breakers.retryAfter(provider).Seconds()))
+	err.Header.Set("Retry-After", strconv.Itoa(max(1, retryAfter)))
+	return err
+}
+
+// BreakerStates the circuit breakers of the service providers that have run
+// tasks, by provider name. The others are closed
+func BreakerStates() map[string]types.ProviderBreakerState {
+	_, cooldown := breakerPolicy()
+	breakers.mu.Lock()
+	defer breakers.mu.Unlock()
+	states := make(map[string]types.ProviderBreakerState, len(breakers.breakers))
+	for provider, b := range breakers.breakers {
+		state := types.ProviderBreakerState{
+			State:               b.state,
+			ConsecutiveFailures: b.failures,
+			ErrorRate:           math.Round(b.errorRate()*100) / 100,
+			Requests:            len(b.outcomes),
+		}
+		if b.state != types.BreakerClosed {
+			state.OpenedAt = b.openedAt.Unix()
+		}
+		if b.state == types.BreakerOpen {
+			state.RetryAt = b.openedAt.Add(cooldown).Unix()
+		}
+		states[provider] = state
+	}
+	return states
+}
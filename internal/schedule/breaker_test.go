@@ -0,0 +1,112 @@
+package schedule
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"oadin/config"
+	"oadin/internal/types"
+)
+
+func TestBreaker(t *testing.T) {
+	env := config.GlobalOadinEnvironment
+	defer func() { config.GlobalOadinEnvironment = env }()
+	config.GlobalOadinEnvironment = nil // the default policy, 5 failures
+	bs := &breakerSet{breakers: map[string]*breaker{}}
+	const provider = "remote_openai_chat"
+	for range 4 {
+		bs.record(provider, true)
+	}
+	if bs.blocked(provider) {
+		t.Fatal("blocked after 4 failures")
+	}
+	bs.record(provider, true)
+	if !bs.blocked(provider) {
+		t.Fatal("not blocked after 5 failures")
+	}
+
+	// through the cooldown it half-opens for one probe
+	bs.breakers[provider].openedAt = time.Now().Add(-time.Minute)
+	if bs.blocked(provider) || !bs.admit(provider) {
+		t.Fatal("half-open breaker refuses the probe")
+	}
+	bs.begin(provider)
+	if bs.admit(provider) {
+		t.Error("half-open breaker admits a second probe")
+	}
+	// a cancelled probe tells nothing, the next task is the probe
+	bs.end(provider)
+	if !bs.admit(provider) || bs.breakers[provider].state != types.BreakerHalfOpen {
+		t.Fatal("half-open breaker refuses the probe after a cancelled one")
+	}
+	bs.begin(provider)
+	bs.record(provider, false)
+	if state := bs.breakers[provider].state; state != types.BreakerClosed {
+		t.Fatalf("state after a good probe = %s, want closed", state)
+	}
+
+	// every other request failing opens it by the error rate
+	for i := range breakerMinSamples {
+		bs.record(provider, i%2 == 0)
+	}
+	if !bs.blocked(provider) {
+		t.Errorf("not blocked with error rate %.2f", bs.breakers[provider].errorRate())
+	}
+}
+
+func TestBasicSchedulerHalfOpen(t *testing.T) {
+	initTestFlavors(t)
+	env := *config.GlobalOadinEnvironment
+	oldBreakers, oldScheduler := breakers, scheduler
+	defer func() {
+		*config.GlobalOadinEnvironment = env
+		breakers, scheduler = oldBreakers, oldScheduler
+	}()
+	config.GlobalOadinEnvironment.FailoverAttempts = 1
+	config.GlobalOadinEnvironment.BreakerFailures = 5
+	config.GlobalOadinEnvironment.BreakerCooldown = time.Minute
+
+	local, remote := newRaceProvider("local"), newRaceProvider("remote")
+	defer local.Close()
+	defer remote.Close()
+	local.reset(300 * time.Millisecond)
+	setupRaceProviders(t, local.URL, remote.URL)
+	// the breaker of the local provider is through its cooldown
+	breakers = &breakerSet{breakers: map[string]*breaker{
+		"race_local": {state: types.BreakerOpen, openedAt: time.Now().Add(-2 * time.Minute)},
+	}}
+
+	ss := NewBasicServiceScheduler()
+	ss.Start()
+	scheduler = ss
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	var chs []chan *types.ServiceResult
+	for range 2 {
+		_, ch := ss.Enqueue(&types.ServiceRequest{FromFlavor: "openai", Service: types.ServiceChat, Model: "m",
+			HybridPolicy: types.HybridPolicyLocal, HTTP: types.HTTPContent{Header: header,
+				Body: []byte(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`)}})
+		chs = append(chs, ch)
+	}
+	if !waitFor(func() bool { return local.calls.Load() == 1 }) {
+		t.Fatal("the probe doesn't run")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if calls := local.calls.Load(); calls != 1 {
+		t.Errorf("the half-open provider runs %d tasks while its probe is out, want 1", calls)
+	}
+	for _, ch := range chs {
+		for r := range ch {
+			if r.Error != nil {
+				t.Errorf("task failed with %v", r.Error)
+			}
+		}
+	}
+	if calls := local.calls.Load(); calls != 2 {
+		t.Errorf("the provider runs %d tasks, want 2 once the probe closed its breaker", calls)
+	}
+	if state := BreakerStates()["race_local"].State; state != types.BreakerClosed {
+		t.Errorf("state after a good probe = %s, want closed", state)
+	}
+}
@@ -0,0 +1,134 @@
+package schedule
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"oadin/internal/convert"
+	"oadin/internal/provider/template"
+	"oadin/internal/types"
+)
+
+// conformanceGolden what a fixture is converted to in the six directions, the
+// from_oadin ones convert what the to_oadin ones gave back. A failed conversion
+// is kept as {"error": "..."} so it shows up in the diff as well
+type conformanceGolden struct {
+	RequestToOadin          json.RawMessage   `json:"request_to_oadin,omitempty"`
+	RequestFromOadin        json.RawMessage   `json:"request_from_oadin,omitempty"`
+	ResponseToOadin         json.RawMessage   `json:"response_to_oadin,omitempty"`
+	ResponseFromOadin       json.RawMessage   `json:"response_from_oadin,omitempty"`
+	StreamResponseToOadin   []json.RawMessage `json:"stream_response_to_oadin,omitempty"`
+	StreamResponseFromOadin []json.RawMessage `json:"stream_response_from_oadin,omitempty"`
+}
+
+// TestFlavorConformance replays the fixtures in testdata/conformance/<flavor>/<service>
+// through ConvertBetweenFlavors between the flavor and oadin and compares the
+// results with testdata/conformance/golden. Every embedded flavor needs fixtures,
+// which are recorded by `oadin server start --record-fixtures <dir>` into the
+// same layout. Run with -update to regenerate the golden files
+func TestFlavorConformance(t *testing.T) {
+	initTestFlavors(t)
+	oadin, err := GetAPIFlavor("oadin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := template.FlavorTemplateFs.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".yaml")
+		if !ok || name == "oadin" {
+			continue
+		}
+		fixtures, err := filepath.Glob(filepath.Join("testdata", "conformance", name, "*", "*.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fixtures) == 0 {
+			t.Errorf("flavor %s has no conformance fixtures in testdata/conformance/%s", name, name)
+			continue
+		}
+		sort.Strings(fixtures)
+		for _, path := range fixtures {
+			rel, _ := filepath.Rel(filepath.Join("testdata", "conformance"), path)
+			t.Run(strings.TrimSuffix(filepath.ToSlash(rel), ".json"), func(t *testing.T) {
+				var fixture FlavorFixture
+				unmarshal(t, readFile(t, path), &fixture)
+				flavor, err := GetAPIFlavor(fixture.Flavor)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ctx := convert.ConvertContext{"id": "test"}
+				for k, v := range fixture.Ctx {
+					ctx[k] = v
+				}
+				replay := func(conv string, chunks [][]byte) (toOadin, fromOadin []json.RawMessage) {
+					converted, err := convertContents(flavor, oadin, fixture.Service, conv, chunks, ctx)
+					if err != nil {
+						t.Logf("%s_to_oadin: %v", conv, err)
+						return []json.RawMessage{conformanceError(err)}, nil
+					}
+					toOadin = goldenChunks(converted)
+					back, err := convertContents(oadin, flavor, fixture.Service, conv, converted, ctx)
+					if err != nil {
+						t.Logf("%s_from_oadin: %v", conv, err)
+						return toOadin, []json.RawMessage{conformanceError(err)}
+					}
+					return toOadin, goldenChunks(back)
+				}
+				// replayBody the same for a body with its content type, which
+				// goes along with the body through the conversions
+				replayBody := func(conv string, body json.RawMessage, contentType string) (toOadin, fromOadin json.RawMessage) {
+					if contentType == "" {
+						contentType = "application/json"
+					}
+					content := types.HTTPContent{Body: FixtureBodyBytes(body), Header: http.Header{"Content-Type": {contentType}}}
+					converted, err := ConvertBetweenFlavors(flavor, oadin, fixture.Service, conv, content, ctx)
+					if err != nil {
+						t.Logf("%s_to_oadin: %v", conv, err)
+						return conformanceError(err), nil
+					}
+					back, err := ConvertBetweenFlavors(oadin, flavor, fixture.Service, conv, converted, ctx)
+					if err != nil {
+						t.Logf("%s_from_oadin: %v", conv, err)
+						return first(goldenChunks([][]byte{converted.Body})), conformanceError(err)
+					}
+					return first(goldenChunks([][]byte{converted.Body})), first(goldenChunks([][]byte{back.Body}))
+				}
+
+				var golden conformanceGolden
+				if len(fixture.Request) > 0 {
+					golden.RequestToOadin, golden.RequestFromOadin = replayBody("request", fixture.Request, fixture.RequestContentType)
+				}
+				if len(fixture.Response) > 0 {
+					golden.ResponseToOadin, golden.ResponseFromOadin = replayBody("response", fixture.Response, fixture.ResponseContentType)
+				}
+				if len(fixture.StreamResponse) > 0 {
+					chunks := make([][]byte, 0, len(fixture.StreamResponse))
+					for _, chunk := range fixture.StreamResponse {
+						chunks = append(chunks, FixtureBodyBytes(chunk))
+					}
+					golden.StreamResponseToOadin, golden.StreamResponseFromOadin = replay("stream_response", chunks)
+				}
+				compareGoldenJSON(t, filepath.Join("testdata", "conformance", "golden", rel), golden)
+			})
+		}
+	}
+}
+
+func conformanceError(err error) json.RawMessage {
+	b, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return b
+}
+
+func first(values []json.RawMessage) json.RawMessage {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
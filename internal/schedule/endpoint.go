@@ -0,0 +1,208 @@
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Some APIs carry request parameters in the url path instead of the body, e.g.
+// gemini's "POST /v1beta/models/{model}:generateContent". gin can't route on a
+// placeholder followed by a literal inside one path segment, so endpoints with
+// {name} placeholders are matched by a regexp built from the path.
+
+// EndpointParams are the request parameters taken from the endpoint itself
+type EndpointParams struct {
+	Model  string // value of the {model} placeholder
+	Stream bool   // the endpoint always answers in stream mode
+}
+
+type endpointParamsKey struct{}
+
+func withEndpointParams(r *http.Request, params EndpointParams) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), endpointParamsKey{}, params))
+}
+
+func endpointParamsFromRequest(r *http.Request) (EndpointParams, bool) {
+	params, ok := r.Context().Value(endpointParamsKey{}).(EndpointParams)
+	return params, ok
+}
+
+var placeholderRegex = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+func isTemplatePath(path string) bool {
+	return placeholderRegex.MatchString(path)
+}
+
+// compileTemplatePath returns the static prefix (ending with "/") of a templated
+// path and the regexp matching the full path
+func compileTemplatePath(path string) (string, *regexp.Regexp, error) {
+	loc := placeholderRegex.FindStringIndex(path)
+	if loc == nil {
+		return "", nil, fmt.Errorf("no placeholder in path %s", path)
+	}
+	prefix := path[:strings.LastIndex(path[:loc[0]], "/")+1]
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	last := 0
+	for _, m := range placeholderRegex.FindAllStringSubmatchIndex(path, -1) {
+		sb.WriteString(regexp.QuoteMeta(path[last:m[0]]))
+		sb.WriteString("(?P<" + path[m[2]:m[3]] + ">[^/]+)")
+		last = m[1]
+	}
+	sb.WriteString(regexp.QuoteMeta(path[last:]))
+	sb.WriteString("$")
+	pattern, err := regexp.Compile(sb.String())
+	if err != nil {
+		return "", nil, err
+	}
+	return prefix, pattern, nil
+}
+
+// flavorRoute a route of a flavor, pattern is nil unless the path has placeholders
+type flavorRoute struct {
+	method  string
+	path    string
+	pattern *regexp.Regexp
+	stream  bool
+	handler gin.HandlerFunc
+}
+
+func (r *flavorRoute) serve(c *gin.Context, m []string) {
+	params := EndpointParams{Stream: r.stream}
+	if r.pattern != nil {
+		if i := r.pattern.SubexpIndex("model"); i > 0 {
+			params.Model = m[i]
+		}
+	}
+	if params != (EndpointParams{}) {
+		c.Request = withEndpointParams(c.Request, params)
+	}
+	// gin has already set 404 before calling the NoRoute handlers
+	c.Status(http.StatusOK)
+	r.handler(c)
+}
+
+// routeTable the flavor routes of a gateway. They are not installed into gin,
+// whose routes can't be changed once it serves, but looked up by the NoRoute
+// handler, so a reload of the flavors can add, change or remove them
+type routeTable struct {
+	mu        sync.RWMutex
+	byFlavor  map[string][]*flavorRoute
+	static    map[string]*flavorRoute // by method and path
+	templates []*flavorRoute
+}
+
+var (
+	routeTablesMu sync.Mutex
+	routeTables   = make(map[*gin.Engine]*routeTable)
+)
+
+func getRouteTable(gateway *gin.Engine) *routeTable {
+	routeTablesMu.Lock()
+	defer routeTablesMu.Unlock()
+	rt, exists := routeTables[gateway]
+	if !exists {
+		rt = &routeTable{byFlavor: make(map[string][]*flavorRoute), static: make(map[string]*flavorRoute)}
+		routeTables[gateway] = rt
+		gateway.NoRoute(rt.serve)
+	}
+	return rt
+}
+
+// allRouteTables route tables of all gateways flavors have been installed on
+func allRouteTables() []*routeTable {
+	routeTablesMu.Lock()
+	defer routeTablesMu.Unlock()
+	tables := make([]*routeTable, 0, len(routeTables))
+	for _, rt := range routeTables {
+		tables = append(tables, rt)
+	}
+	return tables
+}
+
+// newFlavorRoute a route for method and path, templated or not
+func newFlavorRoute(method, path string, stream bool, handler gin.HandlerFunc) (*flavorRoute, error) {
+	route := &flavorRoute{method: method, path: path, stream: stream, handler: handler}
+	if isTemplatePath(path) {
+		_, pattern, err := compileTemplatePath(path)
+		if err != nil {
+			return nil, err
+		}
+		route.pattern = pattern
+	}
+	return route, nil
+}
+
+// setRoutes replaces the routes of a flavor, no routes removes the flavor
+func (rt *routeTable) setRoutes(flavor string, routes []*flavorRoute) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if len(routes) == 0 {
+		delete(rt.byFlavor, flavor)
+	} else {
+		rt.byFlavor[flavor] = routes
+	}
+
+	flavors := make([]string, 0, len(rt.byFlavor))
+	for name := range rt.byFlavor {
+		flavors = append(flavors, name)
+	}
+	sort.Strings(flavors)
+	static := make(map[string]*flavorRoute)
+	owners := make(map[string]string)
+	var templates []*flavorRoute
+	for _, name := range flavors {
+		for _, route := range rt.byFlavor[name] {
+			if route.pattern != nil {
+				templates = append(templates, route)
+				continue
+			}
+			key := route.method + " " + route.path
+			if owner, exists := owners[key]; exists {
+				if owner != name {
+					slog.Warn("[Flavor] Route is defined by more than one flavor", "route", key, "used", owner, "ignored", name)
+				}
+				continue
+			}
+			static[key] = route
+			owners[key] = name
+		}
+	}
+	rt.static = static
+	rt.templates = templates
+}
+
+func (rt *routeTable) lookup(method, path string) (*flavorRoute, []string) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	if route, exists := rt.static[method+" "+path]; exists {
+		return route, nil
+	}
+	for _, route := range rt.templates {
+		if route.method != method {
+			continue
+		}
+		if m := route.pattern.FindStringSubmatch(path); m != nil {
+			return route, m
+		}
+	}
+	return nil, nil
+}
+
+func (rt *routeTable) serve(c *gin.Context) {
+	route, m := rt.lookup(c.Request.Method, c.Request.URL.Path)
+	if route == nil {
+		http.NotFound(c.Writer, c.Request)
+		return
+	}
+	route.serve(c, m)
+}
@@ -0,0 +1,117 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"oadin/config"
+	"oadin/internal/datastore"
+	"oadin/internal/types"
+)
+
+const maxFailoverBackoff = 30 * time.Second
+
+// failoverPolicy tells whether the hybrid policy fails over to the other side
+func failoverPolicy(policy string) bool {
+	return policy == types.HybridPolicyLocalThenRemote || policy == types.HybridPolicyRemoteThenLocal
+}
+
+// failoverAttempts the runs of a task, counting the first, and the backoff
+// before the first failover
+func failoverAttempts() (int, time.Duration) {
+	env := config.GlobalOadinEnvironment
+	if env == nil {
+		return 2, 500 * time.Millisecond
+	}
+	return env.FailoverAttempts, env.FailoverBackoff
+}
+
+// failoverBackoff doubles the backoff for each failover after the first
+func failoverBackoff(base time.Duration, attempts int) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff < maxFailoverBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxFailoverBackoff)
+}
+
+func otherLocation(location string) string {
+	if location == types.ServiceSourceRemote {
+		return types.ServiceSourceLocal
+	}
+	return types.ServiceSourceRemote
+}
+
+// retryable tells whether a run failed because of the service provider, i.e.
+// it could not be reached, timed out or had a server error, rather than
+// because of the request
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var httpErr *types.HTTPErrorResponse
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// canFailover tells whether a failed task may run again on the other side. It
+// is called by the goroutine running the task. Once a result, e.g. the first
+// chunk of a stream, has gone back to the client it is too late
+func (ss *BasicServiceScheduler) canFailover(task *ServiceTask, err error) bool {
+	if !failoverPolicy(task.Request.HybridPolicy) || task.sent || task.Target == nil || task.Target.EmbedRerank || task.Context().Err() != nil {
+		return false
+	}
+	if attempts, _ := failoverAttempts(); task.Schedule.Attempts+1 >= attempts {
+		return false
+	}
+	if !retryable(err) {
+		return false
+	}
+	service := &types.Service{Name: task.Request.Service}
+	if err := datastore.GetDefaultDatastore().Get(context.Background(), service); err != nil {
+		return false
+	}
+	if otherLocation(task.Target.Location) == types.ServiceSourceRemote {
+		return service.RemoteProvider != ""
+	}
+	return service.LocalProvider != ""
+}
+
+// onTaskFailover puts the task back to wait, it runs on the other side once
+// through its backoff
+func (ss *BasicServiceScheduler) onTaskFailover(task *ServiceTask, err error) {
+	_, base := failoverAttempts()
+	ss.removeFromList(task)
+	task.Schedule.IsRunning = false
+	task.Schedule.Queued = false
+	task.Schedule.Attempts++
+	task.Schedule.Location = otherLocation(task.Target.Location)
+	backoff := failoverBackoff(base, task.Schedule.Attempts)
+	task.Schedule.NotBefore = time.Now().Add(backoff)
+	slog.Warn("[Schedule] Task fails over to the other side", "taskid", task.Schedule.Id, "error", err,
+		"from", task.Target.ServiceProvider.ProviderName, "to", task.Schedule.Location,
+		"attempts", task.Schedule.Attempts, "backoff", backoff)
+	ss.addToList(task, "waiting")
+	time.AfterFunc(backoff, func() {
+		ss.ChEvent <- &ServiceTaskEvent{Type: ServiceTaskWakeup}
+	})
+}
+
+// hasModel tells whether the service provider has the model ready to run
+func hasModel(ds datastore.Datastore, providerName string, model string) bool {
+	m := &types.Model{ProviderName: providerName, ModelName: model}
+	if err := ds.Get(context.Background(), m); err != nil {
+		return false
+	}
+	return m.Status == "downloaded"
+}
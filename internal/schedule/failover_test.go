@@ -0,0 +1,41 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"oadin/internal/types"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"server error", &types.HTTPErrorResponse{StatusCode: http.StatusBadGateway}, true},
+		{"client error", &types.HTTPErrorResponse{StatusCode: http.StatusBadRequest}, false},
+		{"stream cut", fmt.Errorf("read chunk: %w", io.ErrUnexpectedEOF), true},
+		{"conversion", errors.New("[Service] Failed to convert request"), false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFailoverBackoff(t *testing.T) {
+	base := 500 * time.Millisecond
+	for attempts, want := range map[int]time.Duration{1: base, 2: time.Second, 3: 2 * time.Second, 10: maxFailoverBackoff} {
+		if got := failoverBackoff(base, attempts); got != want {
+			t.Errorf("failoverBackoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
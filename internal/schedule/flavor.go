@@ -11,12 +11,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"oadin/config"
@@ -51,20 +56,39 @@ type APIFlavor interface {
 	ConvertResponseFromOadin(service string, content types.HTTPContent, ctx convert.ConvertContext) (types.HTTPContent, error)
 	ConvertStreamResponseToOadin(service string, content types.HTTPContent, ctx convert.ConvertContext) (types.HTTPContent, error)
 	ConvertStreamResponseFromOadin(service string, content types.HTTPContent, ctx convert.ConvertContext) (types.HTTPContent, error)
+
+	// NewStreamConverter A stream response is converted by a converter created
+	// for that stream alone, as it may keep state across the chunks
+	NewStreamConverter(service string, conversion string) (convert.StreamConverter, error)
 }
 
+// flavorsMu guards the flavors and their definitions, a reload swaps them while
+// requests are served. A flavor is never changed once registered, so a task
+// keeps converting with the flavors it got when it started
+var flavorsMu sync.RWMutex
+
 var allFlavors = make(map[string]APIFlavor)
 
 func RegisterAPIFlavor(f APIFlavor) {
+	flavorsMu.Lock()
+	defer flavorsMu.Unlock()
 	allFlavors[f.Name()] = f
 }
 
 func AllAPIFlavors() map[string]APIFlavor {
-	return allFlavors
+	flavorsMu.RLock()
+	defer flavorsMu.RUnlock()
+	flavors := make(map[string]APIFlavor, len(allFlavors))
+	for name, f := range allFlavors {
+		flavors[name] = f
+	}
+	return flavors
 }
 
 func GetAPIFlavor(name string) (APIFlavor, error) {
+	flavorsMu.RLock()
 	flavor, ok := allFlavors[name]
+	flavorsMu.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("[Flavor] API Flavor %s not found", name)
 	}
@@ -85,9 +109,11 @@ type ModelSelector struct {
 }
 type FlavorServiceDef struct {
 	Endpoints               []string            `yaml:"endpoints"`
+	StreamEndpoints         []string            `yaml:"stream_endpoints"` // endpoints which always answer in stream mode
 	InstallRawRoutes        bool                `yaml:"install_raw_routes"`
 	DefaultModel            string              `yaml:"default_model"`
 	RequestUrl              string              `yaml:"url"`
+	RequestStreamUrl        string              `yaml:"stream_url"` // url in stream mode, the end where it differs from url is swapped in the url of the provider
 	RequestExtraUrl         string              `yaml:"extra_url"`
 	AuthType                string              `yaml:"auth_type"`
 	AuthApplyUrl            string              `yaml:"auth_apply_url"`
@@ -152,27 +178,98 @@ func (f *FlavorDef) getConversionDef(service, conversion string) *FlavorConversi
 	return nil
 }
 
+// UserFlavorDir flavors defined by users are read from this directory under the
+// root dir, a file there replaces the embedded flavor of the same name
+const UserFlavorDir = "flavors"
+
+func userFlavorFile(flavor, rootDir string) string {
+	return filepath.Join(rootDir, UserFlavorDir, flavor+".yaml")
+}
+
 func LoadFlavorDef(flavor, rootDir string) (FlavorDef, error) {
+	data, err := os.ReadFile(userFlavorFile(flavor, rootDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err = template.FlavorTemplateFs.ReadFile(flavor + ".yaml")
+	}
+	if err != nil {
+		return FlavorDef{}, err
+	}
+	return parseFlavorDef(flavor, data)
+}
+
+func loadEmbeddedFlavorDef(flavor string) (FlavorDef, error) {
 	data, err := template.FlavorTemplateFs.ReadFile(flavor + ".yaml")
 	if err != nil {
 		return FlavorDef{}, err
 	}
+	return parseFlavorDef(flavor, data)
+}
+
+// parseFlavorDef goes through the same checks as a flavor file put into the
+// user flavor dir, see ValidateFlavorDef
+func parseFlavorDef(flavor string, data []byte) (FlavorDef, error) {
+	if errs := ValidateFlavorDef(flavor, data); len(errs) > 0 {
+		messages := make([]string, 0, len(errs))
+		for _, e := range errs {
+			messages = append(messages, e.Error())
+		}
+		return FlavorDef{}, fmt.Errorf("invalid flavor %s: %s", flavor, strings.Join(messages, "; "))
+	}
 	var def FlavorDef
-	err = yaml.Unmarshal(data, &def)
-	if err != nil {
+	if err := yaml.Unmarshal(data, &def); err != nil {
 		return FlavorDef{}, err
 	}
-	if def.Name != flavor {
-		return FlavorDef{}, fmt.Errorf("flavor name %s does not match file name %s", def.Name, flavor)
+	return def, nil
+}
+
+// validEndpoint endpoints are given as "<method> <path>"
+func validEndpoint(endpoint string) bool {
+	parts := strings.SplitN(strings.TrimSpace(endpoint), " ", 2)
+	return len(parts) == 2 && strings.TrimSpace(parts[1]) != ""
+}
+
+// flavorNames names of the embedded flavors and of the ones in the user flavor
+// dir, and which of them come from the user flavor dir
+func flavorNames(rootDir string) ([]string, map[string]bool, error) {
+	var names []string
+	embedded := make(map[string]bool)
+	files, err := template.FlavorTemplateFs.ReadDir(".")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".yaml" {
+			name := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+			names = append(names, name)
+			embedded[name] = true
+		}
 	}
-	return def, err
+
+	userFlavors := make(map[string]bool)
+	files, err = os.ReadDir(filepath.Join(rootDir, UserFlavorDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".yaml" {
+			name := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+			userFlavors[name] = true
+			if !embedded[name] {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, userFlavors, nil
 }
 
 var allFlavorDefs = make(map[string]FlavorDef)
 
 func GetFlavorDef(flavor string) FlavorDef {
-	// Force reload so changes in flavor config files take effect on the fly
-	if _, exists := allFlavorDefs[flavor]; !exists {
+	flavorsMu.RLock()
+	def, exists := allFlavorDefs[flavor]
+	flavorsMu.RUnlock()
+	if !exists {
 		def, err := LoadFlavorDef(flavor, config.GlobalOadinEnvironment.RootDir)
 		if err != nil {
 			slog.Error("[Init] Failed to load flavor config", "flavor", flavor, "error", err)
@@ -180,9 +277,12 @@ func GetFlavorDef(flavor string) FlavorDef {
 			// Directly panic without recovering
 			panic(err)
 		}
+		flavorsMu.Lock()
 		allFlavorDefs[flavor] = def
+		flavorsMu.Unlock()
+		return def
 	}
-	return allFlavorDefs[flavor]
+	return def
 }
 
 //------------------------------------------------------------
@@ -192,25 +292,155 @@ func InitAPIFlavors() error {
 	if err != nil {
 		return err
 	}
-	files, err := template.FlavorTemplateFs.ReadDir(".")
+	rootDir := config.GlobalOadinEnvironment.RootDir
+	names, userFlavors, err := flavorNames(rootDir)
 	if err != nil {
 		return err
 	}
 
-	for _, file := range files {
-		if !file.IsDir() && filepath.Ext(file.Name()) == ".yaml" {
-			baseName := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
-			flavor, err := NewConfigBasedAPIFlavor(GetFlavorDef(baseName))
-			if err != nil {
-				slog.Error("[Flavor] Failed to create API Flavor", "flavor", baseName, "error", err)
-				return err
+	for _, name := range names {
+		def, err := LoadFlavorDef(name, rootDir)
+		var flavor *ConfigBasedAPIFlavor
+		if err == nil {
+			flavor, err = NewConfigBasedAPIFlavor(def)
+		}
+		if err == nil && userFlavors[name] {
+			slog.Info("[Flavor] Loaded user defined flavor", "flavor", name, "file", userFlavorFile(name, rootDir))
+		}
+		if err != nil && userFlavors[name] {
+			// a broken user file must not keep the gateway from starting, fall
+			// back to the embedded flavor if there is one
+			slog.Error("[Flavor] Invalid user defined flavor, ignored", "flavor", name,
+				"file", userFlavorFile(name, rootDir), "error", err)
+			def, err = loadEmbeddedFlavorDef(name)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err == nil {
+				flavor, err = NewConfigBasedAPIFlavor(def)
 			}
-			RegisterAPIFlavor(flavor)
 		}
+		if err != nil {
+			slog.Error("[Flavor] Failed to create API Flavor", "flavor", name, "error", err)
+			return err
+		}
+		flavorsMu.Lock()
+		allFlavorDefs[name] = def
+		flavorsMu.Unlock()
+		RegisterAPIFlavor(flavor)
 	}
 	return nil
 }
 
+// FlavorReloadResult what a reload did to a flavor
+type FlavorReloadResult struct {
+	Flavor string `json:"flavor"`
+	Status string `json:"status"` // added, reloaded, unchanged, removed or failed
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	FlavorReloadAdded     = "added"
+	FlavorReloadReloaded  = "reloaded"
+	FlavorReloadUnchanged = "unchanged"
+	FlavorReloadRemoved   = "removed"
+	FlavorReloadFailed    = "failed"
+)
+
+var reloadMu sync.Mutex
+
+// ReloadAPIFlavors loads the flavor files again and swaps the flavors which
+// changed, together with their routes on every gateway they are installed on.
+// A flavor which fails to load is left as it is. Tasks already running go on
+// with the flavors they started with
+func ReloadAPIFlavors() []FlavorReloadResult {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	rootDir := config.GlobalOadinEnvironment.RootDir
+	names, _, err := flavorNames(rootDir)
+	if err != nil {
+		slog.Error("[Flavor] Failed to list flavors", "error", err)
+		return []FlavorReloadResult{{Status: FlavorReloadFailed, Error: err.Error()}}
+	}
+
+	var results []FlavorReloadResult
+	loaded := make(map[string]bool)
+	for _, name := range names {
+		loaded[name] = true
+		result := FlavorReloadResult{Flavor: name}
+		flavorsMu.RLock()
+		current, exists := allFlavorDefs[name]
+		flavorsMu.RUnlock()
+
+		def, err := LoadFlavorDef(name, rootDir)
+		var flavor *ConfigBasedAPIFlavor
+		switch {
+		case err == nil && exists && reflect.DeepEqual(def, current):
+			result.Status = FlavorReloadUnchanged
+		case err == nil:
+			flavor, err = NewConfigBasedAPIFlavor(def)
+		}
+		if err != nil {
+			slog.Error("[Flavor] Failed to reload flavor", "flavor", name, "error", err)
+			result.Status, result.Error = FlavorReloadFailed, err.Error()
+		}
+		if flavor != nil {
+			swapAPIFlavor(name, flavor)
+			result.Status = FlavorReloadReloaded
+			if !exists {
+				result.Status = FlavorReloadAdded
+			}
+			slog.Info("[Flavor] Reloaded flavor", "flavor", name, "status", result.Status)
+		}
+		results = append(results, result)
+	}
+
+	// flavors whose user file is gone and which are not embedded, flavors
+	// registered by code are left alone
+	flavors := AllAPIFlavors()
+	for _, name := range sortedKeys(flavors) {
+		if _, ok := flavors[name].(*ConfigBasedAPIFlavor); ok && !loaded[name] {
+			swapAPIFlavor(name, nil)
+			slog.Info("[Flavor] Removed flavor", "flavor", name)
+			results = append(results, FlavorReloadResult{Flavor: name, Status: FlavorReloadRemoved})
+		}
+	}
+	return results
+}
+
+// swapAPIFlavor replaces a flavor or removes it if nil
+func swapAPIFlavor(name string, flavor *ConfigBasedAPIFlavor) {
+	flavorsMu.Lock()
+	if flavor == nil {
+		delete(allFlavors, name)
+		delete(allFlavorDefs, name)
+		delete(FlavorServiceDefaultInfoMap, name)
+	} else {
+		allFlavors[name] = flavor
+		allFlavorDefs[name] = flavor.Config
+		FlavorServiceDefaultInfoMap[name] = serviceDefaultInfo(flavor.Config)
+	}
+	flavorsMu.Unlock()
+
+	for _, rt := range allRouteTables() {
+		var routes []*flavorRoute
+		if flavor != nil {
+			routes = flavor.routes()
+		}
+		rt.setRoutes(name, routes)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // ------------------------------------------------------------
 
 type ConfigBasedAPIFlavor struct {
@@ -219,41 +449,24 @@ type ConfigBasedAPIFlavor struct {
 }
 
 func NewConfigBasedAPIFlavor(config FlavorDef) (*ConfigBasedAPIFlavor, error) {
-	flavor := ConfigBasedAPIFlavor{
-		Config: config,
-	}
-	err := flavor.reloadConfig()
-	if err != nil {
-		return nil, err
-	}
-	return &flavor, nil
-}
-
-// We need to do reload here instead of replace the entire pointer of ConfigBasedAPIFlavor
-// This is because we don't want to break the existing routes which are already installed
-// with the Handler using the old pointer to ConfigBasedAPIFlavor
-// So we can only update most of the internal states of ConfigBasedAPIFlavor
-// NOTE: as stated, the routes etc. defined in the ConfigBasedAPIFlavor are not updated
-func (f *ConfigBasedAPIFlavor) reloadConfig() error {
-	// Reload the config if needed
-	f.Config = GetFlavorDef(f.Config.Name)
-	// rebuild the pipelines
+	// build the pipelines
 	pipelines := make(map[string]map[string]*convert.ConverterPipeline)
-	for service := range f.Config.Services {
+	for service := range config.Services {
 		pipelines[service] = make(map[string]*convert.ConverterPipeline)
 		for _, conv := range allConversions {
 			// nil PipelineDef means empty []ConversionStepDef, it still creates a pipeline but
 			// its steps are empty slice too
-			p, err := convert.NewConverterPipeline(f.Config.getConversionDef(service, conv).Conversion)
+			p, err := convert.NewConverterPipeline(config.getConversionDef(service, conv).Conversion)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			pipelines[service][conv] = p
 		}
 	}
-	f.converterPipelines = pipelines
-	// PPrint(">>> Rebuilt Converter Pipelines", f.converterPipelines)
-	return nil
+	return &ConfigBasedAPIFlavor{
+		Config:             config,
+		converterPipelines: pipelines,
+	}, nil
 }
 
 func (f *ConfigBasedAPIFlavor) GetConverterPipeline(service, conv string) *convert.ConverterPipeline {
@@ -265,43 +478,61 @@ func (f *ConfigBasedAPIFlavor) Name() string {
 	return f.Config.Name
 }
 
+// InstallRoutes the routes go to the route table of the gateway, so a reload
+// of the flavor can change them later
 func (f *ConfigBasedAPIFlavor) InstallRoutes(gateway *gin.Engine, options *config.OadinEnvironment) {
+	getRouteTable(gateway).setRoutes(f.Name(), f.routes())
+	slog.Info("[Flavor] Installed routes", "flavor", f.Name())
+}
+
+func (f *ConfigBasedAPIFlavor) routes() []*flavorRoute {
 	vSpec := version.OadinVersion
-	for service, serviceDef := range f.Config.Services {
+	var routes []*flavorRoute
+	add := func(service, method, path string, stream bool) {
+		route, err := newFlavorRoute(method, path, stream, makeServiceRequestHandler(f.Name(), service))
+		if err != nil {
+			slog.Error("[Flavor] Invalid endpoint path", "flavor", f.Name(), "path", path, "error", err)
+			return
+		}
+		routes = append(routes, route)
+		slog.Debug("[Flavor] Added route", "flavor", f.Name(), "service", service, "route", method+" "+path)
+	}
+	for _, service := range sortedKeys(f.Config.Services) {
+		serviceDef := f.Config.Services[service]
+		endpoints := make(map[string]bool)
 		for _, endpoint := range serviceDef.Endpoints {
-			parts := strings.SplitN(endpoint, " ", 2)
-			endpoint = strings.TrimSpace(endpoint)
+			endpoints[endpoint] = false
+		}
+		for _, endpoint := range serviceDef.StreamEndpoints {
+			endpoints[endpoint] = true
+		}
+		for _, endpoint := range sortedKeys(endpoints) {
+			stream := endpoints[endpoint]
+			parts := strings.SplitN(strings.TrimSpace(endpoint), " ", 2)
 			if len(parts) != 2 {
+				// checked when the flavor is loaded
 				slog.Error("[Flavor] Invalid endpoint format", "endpoint", endpoint)
-				panic("[Flavor] Invalid endpoint format: " + endpoint)
+				continue
 			}
-			method := parts[0]
-			path := parts[1]
-			method = strings.TrimSpace(method)
-			path = strings.TrimSpace(path)
+			method := strings.TrimSpace(parts[0])
+			path := strings.TrimSpace(parts[1])
 			if !strings.HasPrefix(path, "/") {
 				path = "/" + path
 			}
-			handler := makeServiceRequestHandler(f, service)
 
 			// raw routes which doesn't have any oadin prefix
 			if serviceDef.InstallRawRoutes {
-				gateway.Handle(method, path, handler)
-				slog.Debug("[Flavor] Installed raw route", "flavor", f.Name(), "service", service, "route", method+" "+path)
+				add(service, method, path, stream)
 			}
 			// flavor routes in api_flavors or directly under services
 			if f.Name() != "oadin" {
-				oadinPath := "/oadin/" + vSpec + "/api_flavors/" + f.Name() + path
-				gateway.Handle(method, oadinPath, handler)
-				slog.Debug("[Flavor] Installed flavor route", "flavor", f.Name(), "service", service, "route", method+" "+oadinPath)
+				add(service, method, "/oadin/"+vSpec+"/api_flavors/"+f.Name()+path, stream)
 			} else {
-				oadinPath := "/oadin/" + vSpec + "/services" + path
-				gateway.Handle(method, oadinPath, makeServiceRequestHandler(f, service))
-				slog.Debug("[Flavor] Installed oadin route", "flavor", f.Name(), "service", service, "route", method+" "+oadinPath)
+				add(service, method, "/oadin/"+vSpec+"/services"+path, stream)
 			}
 		}
-		slog.Info("[Flavor] Installed routes", "flavor", f.Name(), "service", service)
 	}
+	return routes
 }
 
 func (f *ConfigBasedAPIFlavor) GetStreamResponseProlog(service string) []string {
@@ -342,16 +573,25 @@ func (f *ConfigBasedAPIFlavor) ConvertStreamResponseFromOadin(service string, co
 	return f.Convert(service, "stream_response_from_oadin", content, ctx)
 }
 
-func makeServiceRequestHandler(flavor APIFlavor, service string) func(c *gin.Context) {
+func (f *ConfigBasedAPIFlavor) NewStreamConverter(service, conversion string) (convert.StreamConverter, error) {
+	return f.GetConverterPipeline(service, conversion).NewStream()
+}
+
+func makeServiceRequestHandler(flavor string, service string) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		slog.Info("[Handler] Invoking service", "flavor", flavor.Name(), "service", service)
-		event.SysEvents.Notify("start_session", []string{flavor.Name(), service})
+		slog.Info("[Handler] Invoking service", "flavor", flavor, "service", service)
+		event.SysEvents.Notify("start_session", []string{flavor, service})
 
 		w := c.Writer
 
-		taskid, ch, err := InvokeService(flavor.Name(), service, c.Request)
+		taskid, ch, err := InvokeService(flavor, service, c.Request)
 		if err != nil {
-			slog.Error("[Handler] Failed to invoke service", "flavor", flavor.Name(), "service", service, "error", err)
+			slog.Error("[Handler] Failed to invoke service", "flavor", flavor, "service", service, "error", err)
+			var httpErr *types.HTTPErrorResponse
+			if errors.As(err, &httpErr) {
+				(&types.ServiceResult{Type: types.ServiceResultFailed, Error: httpErr}).WriteBack(w)
+				return
+			}
 			http.NotFound(w, c.Request)
 			return
 		}
@@ -374,6 +614,8 @@ func makeServiceRequestHandler(flavor APIFlavor, service string) func(c *gin.Con
 		for {
 			select {
 			case <-closenotifier.CloseNotify():
+				// the task is cancelled with the context of the request, keep
+				// draining until it closes the channel
 				slog.Warn("[Handler] Client connection disconnected", "taskid", taskid)
 				isHTTPCompleted = true
 			case data, ok := <-ch:
@@ -394,7 +636,7 @@ func makeServiceRequestHandler(flavor APIFlavor, service string) func(c *gin.Con
 				flusher.Flush()
 			}
 		}
-		event.SysEvents.Notify("end_session", []string{flavor.Name(), service})
+		event.SysEvents.Notify("end_session", []string{flavor, service})
 	}
 }
 
@@ -434,43 +676,142 @@ func ConvertBetweenFlavors(from, to APIFlavor, service string, conv string, cont
 	return content, nil
 }
 
+// StreamConversion converts the chunks of one stream response between two flavors,
+// the same way as ConvertBetweenFlavors but with the stream converters of the flavors
+type StreamConversion struct {
+	toOadin   convert.StreamConverter // nil if from oadin
+	fromOadin convert.StreamConverter // nil if to oadin
+	notify    bool
+	ctx       convert.ConvertContext
+}
+
+func NewStreamConversion(from, to APIFlavor, service string, ctx convert.ConvertContext) (*StreamConversion, error) {
+	c := &StreamConversion{ctx: ctx, notify: from.Name() != "oadin" && to.Name() != "oadin"}
+	if from.Name() == to.Name() {
+		return c, nil
+	}
+	var err error
+	if from.Name() != "oadin" {
+		c.toOadin, err = from.NewStreamConverter(service, "stream_response_to_oadin")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if to.Name() != "oadin" {
+		c.fromOadin, err = to.NewStreamConverter(service, "stream_response_from_oadin")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Convert gives back no chunk, one or many for the chunk
+func (c *StreamConversion) Convert(content types.HTTPContent) ([]types.HTTPContent, error) {
+	if c.toOadin == nil && c.fromOadin == nil {
+		return []types.HTTPContent{content}, nil
+	}
+	// need conversion, content-length may change
+	content.Header.Del("Content-Length")
+	chunks := []types.HTTPContent{content}
+	if c.toOadin != nil {
+		var err error
+		chunks, err = c.toOadin.ConvertChunk(content, c.ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.convertFromOadin(chunks)
+}
+
+// Flush gives back what the converters still hold at the end of the stream
+func (c *StreamConversion) Flush() ([]types.HTTPContent, error) {
+	var chunks []types.HTTPContent
+	if c.toOadin != nil {
+		var err error
+		chunks, err = c.toOadin.Flush(c.ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	chunks, err := c.convertFromOadin(chunks)
+	if err != nil {
+		return nil, err
+	}
+	if c.fromOadin != nil {
+		flushed, err := c.fromOadin.Flush(c.ctx)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, flushed...)
+	}
+	return chunks, nil
+}
+
+func (c *StreamConversion) convertFromOadin(chunks []types.HTTPContent) ([]types.HTTPContent, error) {
+	if c.notify {
+		for _, chunk := range chunks {
+			event.SysEvents.NotifyHTTPResponse("response_converted_to_oadin", -1, chunk.Header, chunk.Body)
+		}
+	}
+	if c.fromOadin == nil {
+		return chunks, nil
+	}
+	var converted []types.HTTPContent
+	for _, chunk := range chunks {
+		res, err := c.fromOadin.ConvertChunk(chunk, c.ctx)
+		if err != nil {
+			return nil, err
+		}
+		converted = append(converted, res...)
+	}
+	return converted, nil
+}
+
 type ServiceDefaultInfo struct {
-	Endpoints       []string `json:"endpoints"`
-	DefaultModel    string   `json:"default_model"`
-	RequestUrl      string   `json:"url"`
-	RequestExtraUrl string   `json:"request_extra_url"`
-	AuthType        string   `json:"auth_type"`
-	RequestSegments int      `json:"request_segments"`
-	ExtraHeaders    string   `json:"extra_headers"`
-	SupportModels   []string `json:"support_models"`
-	AuthApplyUrl    string   `json:"auth_apply_url"`
+	Endpoints        []string `json:"endpoints"`
+	DefaultModel     string   `json:"default_model"`
+	RequestUrl       string   `json:"url"`
+	RequestStreamUrl string   `json:"stream_url"`
+	RequestExtraUrl  string   `json:"request_extra_url"`
+	AuthType         string   `json:"auth_type"`
+	RequestSegments  int      `json:"request_segments"`
+	ExtraHeaders     string   `json:"extra_headers"`
+	SupportModels    []string `json:"support_models"`
+	AuthApplyUrl     string   `json:"auth_apply_url"`
 }
 
 var FlavorServiceDefaultInfoMap = make(map[string]map[string]ServiceDefaultInfo)
 
 func InitProviderDefaultModelTemplate(flavor APIFlavor) {
-	def, err := LoadFlavorDef(flavor.Name(), "/")
-	if err != nil {
-		slog.Error("[Provider]Failed to load file", "provider_name", flavor, "error", err.Error())
-	}
+	info := serviceDefaultInfo(GetFlavorDef(flavor.Name()))
+	flavorsMu.Lock()
+	FlavorServiceDefaultInfoMap[flavor.Name()] = info
+	flavorsMu.Unlock()
+}
+
+func serviceDefaultInfo(def FlavorDef) map[string]ServiceDefaultInfo {
 	ServiceDefaultInfoMap := make(map[string]ServiceDefaultInfo)
 	for service, serviceDef := range def.Services {
 		ServiceDefaultInfoMap[service] = ServiceDefaultInfo{
-			Endpoints:       serviceDef.Endpoints,
-			DefaultModel:    serviceDef.DefaultModel,
-			RequestUrl:      serviceDef.RequestUrl,
-			RequestExtraUrl: serviceDef.RequestExtraUrl,
-			RequestSegments: serviceDef.RequestSegments,
-			AuthType:        serviceDef.AuthType,
-			ExtraHeaders:    serviceDef.ExtraHeaders,
-			SupportModels:   serviceDef.SupportModels,
-			AuthApplyUrl:    serviceDef.AuthApplyUrl,
+			Endpoints:        serviceDef.Endpoints,
+			DefaultModel:     serviceDef.DefaultModel,
+			RequestUrl:       serviceDef.RequestUrl,
+			RequestStreamUrl: serviceDef.RequestStreamUrl,
+			RequestExtraUrl:  serviceDef.RequestExtraUrl,
+			RequestSegments:  serviceDef.RequestSegments,
+			AuthType:         serviceDef.AuthType,
+			ExtraHeaders:     serviceDef.ExtraHeaders,
+			SupportModels:    serviceDef.SupportModels,
+			AuthApplyUrl:     serviceDef.AuthApplyUrl,
 		}
 	}
-	FlavorServiceDefaultInfoMap[flavor.Name()] = ServiceDefaultInfoMap
+	return ServiceDefaultInfoMap
 }
 
 func GetProviderServiceDefaultInfo(flavor string, service string) ServiceDefaultInfo {
+	flavorsMu.RLock()
+	defer flavorsMu.RUnlock()
 	serviceDefaultInfo := FlavorServiceDefaultInfoMap[flavor][service]
 	return serviceDefaultInfo
 }
@@ -563,6 +904,9 @@ func TencentSignGenerate(p SignParams, req *http.Request) error {
 	return nil
 }
 
+// AnthropicAPIVersion is sent if the service provider's extra headers don't pin one
+const AnthropicAPIVersion = "2023-06-01"
+
 type SignAuthInfo struct {
 	SecretId  string `json:"secret_id"`
 	SecretKey string `json:"secret_key"`
@@ -580,6 +924,19 @@ type APIKEYAuthenticator struct {
 	Req      http.Request
 }
 
+// AnthropicAPIKeyAuthenticator anthropic expects the api key in x-api-key
+// instead of the bearer token used by openai compatible providers
+type AnthropicAPIKeyAuthenticator struct {
+	AuthInfo string        `json:"auth_info"`
+	Req      *http.Request `json:"request"`
+}
+
+// GeminiAPIKeyAuthenticator gemini expects the api key in x-goog-api-key
+type GeminiAPIKeyAuthenticator struct {
+	AuthInfo string        `json:"auth_info"`
+	Req      *http.Request `json:"request"`
+}
+
 type TencentSignAuthenticator struct {
 	AuthInfo     string                `json:"auth_info"`
 	Req          *http.Request         `json:"request"`
@@ -611,6 +968,29 @@ func (a *APIKEYAuthenticator) Authenticate() error {
 	return nil
 }
 
+func (a *AnthropicAPIKeyAuthenticator) Authenticate() error {
+	var authInfoData ApiKeyAuthInfo
+	err := json.Unmarshal([]byte(a.AuthInfo), &authInfoData)
+	if err != nil {
+		return err
+	}
+	a.Req.Header.Set("x-api-key", authInfoData.ApiKey)
+	if a.Req.Header.Get("anthropic-version") == "" {
+		a.Req.Header.Set("anthropic-version", AnthropicAPIVersion)
+	}
+	return nil
+}
+
+func (a *GeminiAPIKeyAuthenticator) Authenticate() error {
+	var authInfoData ApiKeyAuthInfo
+	err := json.Unmarshal([]byte(a.AuthInfo), &authInfoData)
+	if err != nil {
+		return err
+	}
+	a.Req.Header.Set("x-goog-api-key", authInfoData.ApiKey)
+	return nil
+}
+
 func (s *TencentSignAuthenticator) Authenticate() error {
 	var authInfoData SignAuthInfo
 	err := json.Unmarshal([]byte(s.AuthInfo), &authInfoData)
@@ -747,9 +1127,22 @@ func ChooseProviderAuthenticator(p *AuthenticatorParams) Authenticator {
 			}
 		}
 	} else if p.ProviderInfo.AuthType == types.AuthTypeApiKey {
-		authenticator = &APIKEYAuthenticator{
-			AuthInfo: p.ProviderInfo.AuthKey,
-			Req:      *p.Request,
+		switch p.ProviderInfo.Flavor {
+		case types.FlavorAnthropic:
+			authenticator = &AnthropicAPIKeyAuthenticator{
+				AuthInfo: p.ProviderInfo.AuthKey,
+				Req:      p.Request,
+			}
+		case types.FlavorGemini:
+			authenticator = &GeminiAPIKeyAuthenticator{
+				AuthInfo: p.ProviderInfo.AuthKey,
+				Req:      p.Request,
+			}
+		default:
+			authenticator = &APIKEYAuthenticator{
+				AuthInfo: p.ProviderInfo.AuthKey,
+				Req:      *p.Request,
+			}
 		}
 	} else if p.ProviderInfo.AuthType == types.AuthTypeCredentials {
 		authenticator = &CredentialsAuthenticator{
@@ -0,0 +1,97 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+
+	"oadin/internal/convert"
+	"oadin/internal/types"
+)
+
+// ConversionStepTrace what one step of a flavor conversion pipeline gave back
+type ConversionStepTrace struct {
+	Flavor     string
+	Conversion string // e.g. request_to_oadin
+	Step       int
+	Converter  string
+	Output     types.HTTPContent
+	Dropped    bool
+	Err        error
+}
+
+// ConversionTrace what ConvertBetweenFlavors does, step by step. Oadin is the
+// content in the oadin format, nil if it isn't reached or no conversion is needed
+type ConversionTrace struct {
+	Oadin  *types.HTTPContent
+	Output types.HTTPContent
+	Steps  []ConversionStepTrace
+}
+
+var ErrServiceNotSupported = errors.New("service not supported by the flavor")
+
+type converterPipelineFlavor interface {
+	GetConverterPipeline(service, conv string) *convert.ConverterPipeline
+}
+
+// TraceConversion converts content the same way as ConvertBetweenFlavors and
+// records the output of every step on the way. conv is request, response or
+// stream_response, a chunk of a stream response is converted as a stream of
+// one chunk. The trace is returned along with the error of a failed step
+func TraceConversion(from, to APIFlavor, service string, conv string, content types.HTTPContent, ctx convert.ConvertContext) (*ConversionTrace, error) {
+	switch conv {
+	case "request", "response", "stream_response":
+	default:
+		return nil, fmt.Errorf("[Flavor] Unknown conversion %q, expect request, response or stream_response", conv)
+	}
+	trace := &ConversionTrace{Output: content}
+	if from.Name() == to.Name() {
+		return trace, nil
+	}
+	content.Header = content.Header.Clone()
+	content.Header.Del("Content-Length")
+
+	var err error
+	if from.Name() != "oadin" {
+		content, err = trace.convert(from, service, conv+"_to_oadin", content, ctx)
+		if err != nil {
+			return trace, err
+		}
+	}
+	oadin := content
+	trace.Oadin = &oadin
+	if to.Name() != "oadin" {
+		content, err = trace.convert(to, service, conv+"_from_oadin", content, ctx)
+		if err != nil {
+			return trace, err
+		}
+	}
+	trace.Output = content
+	return trace, nil
+}
+
+func (t *ConversionTrace) convert(flavor APIFlavor, service, conv string, content types.HTTPContent, ctx convert.ConvertContext) (types.HTTPContent, error) {
+	f, ok := flavor.(converterPipelineFlavor)
+	if !ok {
+		// not built from a flavor file, so the steps are unknown
+		output, err := flavor.Convert(service, conv, content, ctx)
+		t.addStep(flavor.Name(), conv, 0, "", output, err)
+		return output, err
+	}
+	pipeline := f.GetConverterPipeline(service, conv)
+	if pipeline == nil {
+		return types.HTTPContent{}, fmt.Errorf("[Flavor] %s of flavor %s: %w", service, flavor.Name(), ErrServiceNotSupported)
+	}
+	return pipeline.ConvertWithTrace(content, ctx, func(step int, def types.ConversionStepDef, output types.HTTPContent, err error) {
+		t.addStep(flavor.Name(), conv, step, def.Converter, output, err)
+	})
+}
+
+func (t *ConversionTrace) addStep(flavor, conv string, step int, converter string, output types.HTTPContent, err error) {
+	s := ConversionStepTrace{Flavor: flavor, Conversion: conv, Step: step, Converter: converter, Output: output}
+	if types.IsDropAction(err) {
+		s.Dropped = true
+	} else {
+		s.Err = err
+	}
+	t.Steps = append(t.Steps, s)
+}
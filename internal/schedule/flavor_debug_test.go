@@ -0,0 +1,59 @@
+package schedule
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+
+	"oadin/internal/convert"
+	"oadin/internal/types"
+)
+
+func TestTraceConversion(t *testing.T) {
+	initTestFlavors(t)
+	openai, err := GetAPIFlavor("openai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ollama, err := GetAPIFlavor("ollama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"model":"qwen2.5","messages":[{"role":"user","content":"hi"}],"stream":false}`)
+	newContent := func() types.HTTPContent {
+		return types.HTTPContent{Body: body, Header: http.Header{"Content-Type": {"application/json"}}}
+	}
+	ctx := convert.ConvertContext{"stream": false}
+
+	want, err := ConvertBetweenFlavors(openai, ollama, "chat", "request", newContent(), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace, err := TraceConversion(openai, ollama, "chat", "request", newContent(), ctx)
+	if err != nil {
+		t.Fatalf("TraceConversion() error = %v", err)
+	}
+	if !bytes.Equal(trace.Output.Body, want.Body) {
+		t.Errorf("output = %s, want %s", trace.Output.Body, want.Body)
+	}
+	if trace.Oadin == nil || len(trace.Steps) == 0 {
+		t.Fatalf("trace has no oadin body or steps: %+v", trace)
+	}
+	last := trace.Steps[len(trace.Steps)-1]
+	if last.Flavor != "ollama" || last.Conversion != "request_from_oadin" || !bytes.Equal(last.Output.Body, want.Body) {
+		t.Errorf("last step = %s %s %s", last.Flavor, last.Conversion, last.Output.Body)
+	}
+	for _, s := range trace.Steps {
+		if s.Converter == "" || s.Err != nil {
+			t.Errorf("step %+v", s)
+		}
+	}
+
+	if _, err := TraceConversion(openai, ollama, "no_such_service", "request", newContent(), ctx); !errors.Is(err, ErrServiceNotSupported) {
+		t.Errorf("TraceConversion() of an unknown service error = %v", err)
+	}
+	if _, err := TraceConversion(openai, ollama, "chat", "request_to_oadin", newContent(), ctx); err == nil {
+		t.Errorf("TraceConversion() expects an error for an unknown conversion")
+	}
+}
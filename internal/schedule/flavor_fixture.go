@@ -0,0 +1,115 @@
+package schedule
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"oadin/config"
+	"oadin/internal/convert"
+	"oadin/internal/types"
+)
+
+// FlavorFixture an exchange with a service provider in its flavor, recorded by
+// `oadin server start --record-fixtures <dir>` and replayed by the flavor
+// conformance test. Bodies are kept as JSON if they are valid JSON, otherwise
+// as a string of the raw text, see FixtureBody. The content type is kept for
+// bodies which are not JSON, e.g. a multipart form needs its boundary
+type FlavorFixture struct {
+	Flavor              string                 `json:"flavor"`
+	Service             string                 `json:"service"`
+	Ctx                 convert.ConvertContext `json:"ctx,omitempty"`
+	RequestContentType  string                 `json:"request_content_type,omitempty"`
+	Request             json.RawMessage        `json:"request,omitempty"`
+	ResponseContentType string                 `json:"response_content_type,omitempty"`
+	Response            json.RawMessage        `json:"response,omitempty"`
+	StreamResponse      []json.RawMessage      `json:"stream_response,omitempty"`
+}
+
+func FixtureBody(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, body); err == nil {
+			return buf.Bytes()
+		}
+	}
+	text, _ := json.Marshal(string(body))
+	return text
+}
+
+// FixtureBodyBytes gives back the body FixtureBody was given
+func FixtureBodyBytes(body json.RawMessage) []byte {
+	var text string
+	if err := json.Unmarshal(body, &text); err == nil {
+		return []byte(text)
+	}
+	return body
+}
+
+// fixtureRecorder records one exchange of a task, a nil recorder records nothing
+type fixtureRecorder struct {
+	path    string
+	fixture FlavorFixture
+}
+
+func newFixtureRecorder(flavor, service string, taskID uint64, ctx convert.ConvertContext) *fixtureRecorder {
+	if config.GlobalOadinEnvironment == nil || config.GlobalOadinEnvironment.RecordFixtures == "" {
+		return nil
+	}
+	name := fmt.Sprintf("%s-%d.json", time.Now().Format("20060102-150405"), taskID)
+	return &fixtureRecorder{
+		path:    filepath.Join(config.GlobalOadinEnvironment.RecordFixtures, flavor, service, name),
+		fixture: FlavorFixture{Flavor: flavor, Service: service, Ctx: ctx},
+	}
+}
+
+func (r *fixtureRecorder) request(content types.HTTPContent) {
+	if r != nil && len(content.Body) > 0 {
+		r.fixture.Request = FixtureBody(content.Body)
+		r.fixture.RequestContentType = fixtureContentType(content)
+	}
+}
+
+func (r *fixtureRecorder) response(content types.HTTPContent) {
+	if r != nil {
+		r.fixture.Response = FixtureBody(content.Body)
+		r.fixture.ResponseContentType = fixtureContentType(content)
+	}
+}
+
+// fixtureContentType the content type of a body which is not JSON
+func fixtureContentType(content types.HTTPContent) string {
+	if content.Header == nil || json.Valid(content.Body) {
+		return ""
+	}
+	return content.Header.Get("Content-Type")
+}
+
+func (r *fixtureRecorder) chunk(body []byte) {
+	if r != nil && len(bytes.TrimSpace(body)) > 0 {
+		r.fixture.StreamResponse = append(r.fixture.StreamResponse, FixtureBody(bytes.TrimSpace(body)))
+	}
+}
+
+// save failing to record doesn't fail the task
+func (r *fixtureRecorder) save() {
+	if r == nil {
+		return
+	}
+	data, err := json.MarshalIndent(r.fixture, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(r.path), 0o750)
+	}
+	if err == nil {
+		err = os.WriteFile(r.path, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		slog.Warn("[Service] Failed to record flavor fixture", "path", r.path, "error", err)
+		return
+	}
+	slog.Info("[Service] Recorded flavor fixture", "path", r.path)
+}
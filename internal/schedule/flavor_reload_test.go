@@ -0,0 +1,116 @@
+package schedule
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"oadin/config"
+	"oadin/version"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReloadAPIFlavors(t *testing.T) {
+	initTestFlavors(t)
+	rootDir := config.GlobalOadinEnvironment.RootDir
+	config.GlobalOadinEnvironment.RootDir = t.TempDir()
+	defer func() {
+		config.GlobalOadinEnvironment.RootDir = rootDir
+		ReloadAPIFlavors()
+	}()
+
+	gateway := gin.New()
+	for _, flavor := range AllAPIFlavors() {
+		flavor.InstallRoutes(gateway, config.GlobalOadinEnvironment)
+	}
+	table := getRouteTable(gateway)
+	prefix := "/oadin/" + version.OadinVersion + "/api_flavors/gateway"
+
+	writeFlavorFile := func(data string) {
+		t.Helper()
+		dir := filepath.Join(config.GlobalOadinEnvironment.RootDir, UserFlavorDir)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "gateway.yaml"), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFlavor := func(endpoint string) {
+		t.Helper()
+		writeFlavorFile("version: \"0.1\"\nname: gateway\nservices:\n  chat:\n    endpoints: [\"" + endpoint + "\"]\n")
+	}
+	statusOf := func(results []FlavorReloadResult, flavor string) string {
+		for _, r := range results {
+			if r.Flavor == flavor {
+				return r.Status
+			}
+		}
+		return ""
+	}
+
+	writeFlavor("POST /v1/chat/completions")
+	results := ReloadAPIFlavors()
+	if got := statusOf(results, "gateway"); got != FlavorReloadAdded {
+		t.Fatalf("status of the new flavor = %q, want %q (%+v)", got, FlavorReloadAdded, results)
+	}
+	if got := statusOf(results, "openai"); got != FlavorReloadUnchanged {
+		t.Errorf("status of openai = %q, want %q", got, FlavorReloadUnchanged)
+	}
+	if route, _ := table.lookup("POST", prefix+"/v1/chat/completions"); route == nil {
+		t.Errorf("route of the new flavor is not installed")
+	}
+	snapshot, err := GetAPIFlavor("gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFlavor("POST /v2/chat")
+	if got := statusOf(ReloadAPIFlavors(), "gateway"); got != FlavorReloadReloaded {
+		t.Errorf("status of the changed flavor = %q, want %q", got, FlavorReloadReloaded)
+	}
+	if route, _ := table.lookup("POST", prefix+"/v1/chat/completions"); route != nil {
+		t.Errorf("removed endpoint is still routed")
+	}
+	if route, _ := table.lookup("POST", prefix+"/v2/chat"); route == nil {
+		t.Errorf("added endpoint is not routed")
+	}
+	if endpoints := snapshot.(*ConfigBasedAPIFlavor).Config.Services["chat"].Endpoints; endpoints[0] != "POST /v1/chat/completions" {
+		t.Errorf("flavor taken before the reload changed to %v", endpoints)
+	}
+
+	writeFlavor("POST/v3/chat")
+	if got := statusOf(ReloadAPIFlavors(), "gateway"); got != FlavorReloadFailed {
+		t.Errorf("status of the broken flavor = %q, want %q", got, FlavorReloadFailed)
+	}
+	if route, _ := table.lookup("POST", prefix+"/v2/chat"); route == nil {
+		t.Errorf("broken flavor file replaced the working flavor")
+	}
+	// the same checks as oadin flavor validate
+	for _, data := range []string{
+		"version: \"0.1\"\nname: gateway\nservices:\n  chat:\n    endpoint: [\"POST /v3/chat\"]\n",
+		"version: \"0.1\"\nname: gateway\nservices:\n  chitchat:\n    endpoints: [\"POST /v3/chat\"]\n",
+	} {
+		writeFlavorFile(data)
+		if got := statusOf(ReloadAPIFlavors(), "gateway"); got != FlavorReloadFailed {
+			t.Errorf("status of the invalid flavor %q = %q, want %q", data, got, FlavorReloadFailed)
+		}
+	}
+	if route, _ := table.lookup("POST", prefix+"/v2/chat"); route == nil {
+		t.Errorf("invalid flavor file replaced the working flavor")
+	}
+
+	if err := os.Remove(filepath.Join(config.GlobalOadinEnvironment.RootDir, UserFlavorDir, "gateway.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(ReloadAPIFlavors(), "gateway"); got != FlavorReloadRemoved {
+		t.Errorf("status of the deleted flavor = %q, want %q", got, FlavorReloadRemoved)
+	}
+	if _, err := GetAPIFlavor("gateway"); err == nil {
+		t.Errorf("deleted flavor is still registered")
+	}
+	if route, _ := table.lookup("POST", prefix+"/v2/chat"); route != nil {
+		t.Errorf("route of the deleted flavor is still installed")
+	}
+}
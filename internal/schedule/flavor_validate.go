@@ -0,0 +1,157 @@
+package schedule
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"oadin/internal/convert"
+	"oadin/internal/types"
+	"oadin/internal/utils"
+
+	"github.com/blues/jsonata-go/jparse"
+	"gopkg.in/yaml.v3"
+)
+
+// FlavorDefError a problem found in a flavor file, Line is 0 if it cannot be told
+type FlavorDefError struct {
+	Line    int
+	Message string
+}
+
+func (e FlavorDefError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ValidateFlavorDef checks a flavor file before it is put into the user flavor
+// dir: it must load as the flavor of the given name, only define supported
+// services, and every step of its conversions must be created, which compiles
+// the jsonata expressions. The converters must have been initialized
+func ValidateFlavorDef(flavor string, data []byte) []FlavorDefError {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return yamlErrors(err)
+	}
+	if len(root.Content) == 0 {
+		return []FlavorDefError{{Message: "empty flavor file"}}
+	}
+	doc := root.Content[0]
+
+	var errs []FlavorDefError
+	var def FlavorDef
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&def); err != nil {
+		errs = append(errs, yamlErrors(err)...)
+	}
+	if name := mappingValue(doc, "name"); name == nil {
+		errs = append(errs, FlavorDefError{Line: doc.Line, Message: "name is missing"})
+	} else if name.Value != flavor {
+		errs = append(errs, FlavorDefError{Line: name.Line, Message: fmt.Sprintf("flavor name %s does not match file name %s", name.Value, flavor)})
+	}
+
+	services := mappingValue(doc, "services")
+	if services == nil || len(services.Content) == 0 {
+		errs = append(errs, FlavorDefError{Line: doc.Line, Message: "no services defined"})
+		return errs
+	}
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		key, serviceDef := services.Content[i], services.Content[i+1]
+		service := key.Value
+		if !utils.Contains(types.SupportService, service) {
+			errs = append(errs, FlavorDefError{Line: key.Line, Message: fmt.Sprintf("unsupported service %s, expect one of %s", service, strings.Join(types.SupportService, ", "))})
+		}
+		for _, field := range []string{"endpoints", "stream_endpoints"} {
+			if endpoints := mappingValue(serviceDef, field); endpoints != nil {
+				for _, endpoint := range endpoints.Content {
+					if !validEndpoint(endpoint.Value) {
+						errs = append(errs, FlavorDefError{Line: endpoint.Line, Message: fmt.Sprintf("invalid endpoint format %q of service %s, expect \"<method> <path>\"", endpoint.Value, service)})
+					}
+				}
+			}
+		}
+		for _, conv := range allConversions {
+			steps := mappingValue(mappingValue(serviceDef, conv), "conversion")
+			if steps == nil {
+				continue
+			}
+			for _, step := range steps.Content {
+				errs = append(errs, validateConversionStep(service, conv, step)...)
+			}
+		}
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	return errs
+}
+
+func validateConversionStep(service, conv string, step *yaml.Node) []FlavorDefError {
+	var def types.ConversionStepDef
+	if err := step.Decode(&def); err != nil {
+		return yamlErrors(err)
+	}
+	_, err := convert.CreateConverter(def.Converter, def.Config)
+	if err == nil {
+		return nil
+	}
+	line, message := step.Line, err.Error()
+	var parseErr *jparse.Error
+	if errors.As(err, &parseErr) {
+		if config := mappingValue(step, "config"); config != nil {
+			line = expressionLine(config, parseErr.Position)
+		}
+		message = "jsonata: " + parseErr.Error()
+	}
+	return []FlavorDefError{{Line: line, Message: fmt.Sprintf("%s of service %s, converter %s: %s", conv, service, def.Converter, message)}}
+}
+
+// expressionLine the line in the file of the given offset in an expression
+func expressionLine(node *yaml.Node, offset int) int {
+	line := node.Line
+	if node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		line++ // the expression starts below the | or >
+	}
+	if offset > len(node.Value) {
+		offset = len(node.Value)
+	}
+	return line + strings.Count(node.Value[:offset], "\n")
+}
+
+// mappingValue the value of a key in a mapping node, nil if there is none
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+var yamlLinePattern = regexp.MustCompile(`line (\d+): (.*)`)
+
+func yamlErrors(err error) []FlavorDefError {
+	messages := []string{err.Error()}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+	errs := make([]FlavorDefError, 0, len(messages))
+	for _, message := range messages {
+		if m := yamlLinePattern.FindStringSubmatch(message); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			errs = append(errs, FlavorDefError{Line: line, Message: m[2]})
+			continue
+		}
+		errs = append(errs, FlavorDefError{Message: message})
+	}
+	return errs
+}
@@ -0,0 +1,78 @@
+package schedule
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateFlavorDef(t *testing.T) {
+	initTestFlavors(t)
+	tests := []struct {
+		name  string
+		data  string
+		lines []int
+	}{
+		{
+			name: "valid",
+			data: `version: "0.1"
+name: gateway
+services:
+  chat:
+    endpoints: ["POST /v1/chat/completions"]
+    request_to_oadin:
+      conversion:
+        - converter: jsonata
+          config: |
+            {
+              "model": model,
+              "messages": messages
+            }
+`,
+		},
+		{
+			name: "wrong name and unknown field",
+			data: `version: "0.1"
+name: other
+service: {}
+services:
+  chat:
+    endpoints: ["POST /v1/chat/completions"]
+`,
+			lines: []int{2, 3},
+		},
+		{
+			name: "bad services and conversions",
+			data: `version: "0.1"
+name: gateway
+services:
+  chat:
+    endpoints: ["POST/v1/chat/completions"]
+    request_to_oadin:
+      conversion:
+        - converter: jsonata
+          config: |
+            {
+              "model": model,
+              "messages": messages[
+            }
+  speech:
+    response_to_oadin:
+      conversion:
+        - converter: unknown
+`,
+			lines: []int{5, 13, 14, 17},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := ValidateFlavorDef("gateway", []byte(tt.data))
+			var lines []int
+			for _, err := range errs {
+				lines = append(lines, err.Line)
+			}
+			if !reflect.DeepEqual(lines, tt.lines) {
+				t.Errorf("ValidateFlavorDef() errors = %v, want them on lines %v", errs, tt.lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package schedule
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// flavorReloadDelay editors write a file in several steps, so a reload waits for
+// the changes to settle
+const flavorReloadDelay = 500 * time.Millisecond
+
+// WatchAPIFlavors reloads the flavors whenever a file in the user flavor dir
+// changes, until ctx is done
+func WatchAPIFlavors(ctx context.Context, rootDir string) error {
+	dir := filepath.Join(rootDir, UserFlavorDir)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return err
+	}
+	slog.Info("[Flavor] Watching user flavor dir", "dir", dir)
+
+	go func() {
+		defer watcher.Close()
+		timer := time.NewTimer(flavorReloadDelay)
+		timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Ext(e.Name) != ".yaml" || e.Op == fsnotify.Chmod {
+					continue
+				}
+				slog.Debug("[Flavor] User flavor file changed", "file", e.Name, "op", e.Op.String())
+				timer.Reset(flavorReloadDelay)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("[Flavor] Failed to watch user flavor dir", "dir", dir, "error", err)
+			case <-timer.C:
+				for _, result := range ReloadAPIFlavors() {
+					if result.Status == FlavorReloadFailed {
+						slog.Error("[Flavor] Flavor not reloaded", "flavor", result.Flavor, "error", result.Error)
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,273 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"oadin/internal/datastore"
+	"oadin/internal/types"
+)
+
+// latencyWeight the weight of a new request in the averages
+const latencyWeight = 0.2
+
+// exploreTimeout how long a provider that hasn't run a request yet waits for
+// the one sent to learn how fast it is, before another one is sent
+const exploreTimeout = 2 * time.Minute
+
+// runTiming the timing of a run of a task on its service provider
+type runTiming struct {
+	start  time.Time // the request is sent
+	first  time.Time // the first token, or the response if not a stream, is back
+	chunks int
+}
+
+// firstToken marks a chunk with something in it back, the first one is the
+// first token
+func (rt *runTiming) firstToken() {
+	if rt.first.IsZero() {
+		rt.first = time.Now()
+	}
+	rt.chunks++
+}
+
+func average(avg float64, v float64, n int64) float64 {
+	if n <= 1 {
+		return v
+	}
+	return avg + (v-avg)*latencyWeight
+}
+
+// latencyEntry the latency of a service provider or one of its models
+type latencyEntry struct {
+	types.LatencyStats
+	tpsRequests int64 // that told their tokens per second
+}
+
+func (le *latencyEntry) add(ttft time.Duration, tps float64) {
+	le.Requests++
+	le.TTFTMs = average(le.TTFTMs, float64(ttft.Milliseconds()), le.Requests)
+	if tps > 0 {
+		le.tpsRequests++
+		le.TokensPerSecond = average(le.TokensPerSecond, tps, le.tpsRequests)
+	}
+}
+
+func (le *latencyEntry) rounded() types.LatencyStats {
+	stats := le.LatencyStats
+	stats.TTFTMs = math.Round(stats.TTFTMs)
+	stats.TokensPerSecond = math.Round(stats.TokensPerSecond*10) / 10
+	return stats
+}
+
+type providerLatency struct {
+	all    latencyEntry
+	models map[string]*latencyEntry
+}
+
+type latencySet struct {
+	mu        sync.Mutex
+	providers map[string]*providerLatency
+	exploring map[string]time.Time // when a request was sent to learn how fast a provider is, by provider name
+}
+
+var latencies = &latencySet{providers: map[string]*providerLatency{}, exploring: map[string]time.Time{}}
+
+// explore tells whether to send a request to a provider that hasn't run one
+// yet, one at a time
+func (ls *latencySet) explore(provider string) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	at, ok := ls.exploring[provider]
+	return !ok || time.Since(at) > exploreTimeout
+}
+
+func (ls *latencySet) exploreStarted(provider string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.exploring[provider] = time.Now()
+}
+
+// record the latency of a task that ran to the end on a provider. The tokens
+// per second go by the completion tokens it reported, or else by the chunks
+// of a stream
+func (ls *latencySet) record(task *ServiceTask, timing *runTiming, usage *tokenUsage) {
+	if task.Target == nil || task.Target.ServiceProvider == nil || timing.first.IsZero() {
+		return
+	}
+	now := time.Now()
+	ttft := timing.first.Sub(timing.start)
+	tokens := usage.completion
+	if tokens == 0 && timing.chunks > 1 {
+		tokens = timing.chunks
+	}
+	// a response not streamed has its tokens all at once, they took the whole run
+	generating := now.Sub(timing.first)
+	if !task.Target.Stream {
+		generating = now.Sub(timing.start)
+	}
+	tps := 0.0
+	if tokens > 0 && generating > 0 {
+		tps = float64(tokens) / generating.Seconds()
+	}
+	provider, model := task.Target.ServiceProvider.ProviderName, task.Target.Model
+	slog.Debug("[Service] Latency", "taskid", task.Schedule.Id, "service_provider", provider, "model", model,
+		"ttft", ttft, "tokens_per_second", tps)
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	p, ok := ls.providers[provider]
+	if !ok {
+		p = &providerLatency{models: map[string]*latencyEntry{}}
+		ls.providers[provider] = p
+	}
+	delete(ls.exploring, provider)
+	p.all.add(ttft, tps)
+	m, ok := p.models[model]
+	if !ok {
+		m = &latencyEntry{}
+		p.models[model] = m
+	}
+	m.add(ttft, tps)
+}
+
+// get the latency of a model of the provider, or of the provider if the model
+// hasn't run yet. ok is false if neither has
+func (ls *latencySet) get(provider string, model string) (types.LatencyStats, bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	p, ok := ls.providers[provider]
+	if !ok {
+		return types.LatencyStats{}, false
+	}
+	if m, ok := p.models[model]; ok {
+		return m.LatencyStats, true
+	}
+	return p.all.LatencyStats, true
+}
+
+// Latencies the latency of each service provider that has run tasks, by
+// provider name
+func Latencies() map[string]types.ProviderLatency {
+	latencies.mu.Lock()
+	defer latencies.mu.Unlock()
+	result := make(map[string]types.ProviderLatency, len(latencies.providers))
+	for provider, p := range latencies.providers {
+		pl := types.ProviderLatency{LatencyStats: p.all.rounded(), Models: make(map[string]types.LatencyStats, len(p.models))}
+		for model, m := range p.models {
+			pl.Models[model] = m.rounded()
+		}
+		result[provider] = pl
+	}
+	return result
+}
+
+// routeCandidate a service provider the fastest or cheapest policy may pick
+type routeCandidate struct {
+	provider   *types.ServiceProvider
+	properties *types.ServiceProviderProperties
+	latency    types.LatencyStats
+	measured   bool
+	explore    bool // to learn how fast it is, it goes first
+}
+
+// seconds the expected time of the request on the candidate
+func (c *routeCandidate) seconds(completion float64) float64 {
+	s := c.latency.TTFTMs / 1000
+	if c.latency.TokensPerSecond > 0 {
+		s += completion / c.latency.TokensPerSecond
+	}
+	return s
+}
+
+// routeCandidates the service providers of the service that can run the
+// request now: available, with the model asked for, and not skipped by their
+// circuit breaker
+func routeCandidates(ds datastore.Datastore, task *ServiceTask) []*routeCandidate {
+	list, err := ds.List(context.Background(), &types.ServiceProvider{ServiceName: task.Request.Service}, &datastore.ListOptions{Page: 0, PageSize: 100})
+	if err != nil {
+		return nil
+	}
+	var candidates []*routeCandidate
+	for _, v := range list {
+		sp := v.(*types.ServiceProvider)
+		if sp.Status != 1 || breakers.coolingDown(sp.ProviderName) {
+			continue
+		}
+		if task.Request.Model != "" && !hasModel(ds, sp.ProviderName, task.Request.Model) {
+			continue
+		}
+		properties := &types.ServiceProviderProperties{}
+		if err := json.Unmarshal([]byte(sp.Properties), properties); err != nil {
+			continue
+		}
+		c := &routeCandidate{provider: sp, properties: properties}
+		c.latency, c.measured = latencies.get(sp.ProviderName, task.Request.Model)
+		c.explore = !c.measured && latencies.explore(sp.ProviderName)
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
+
+// routeProvider picks the service provider the fastest or cheapest policy runs
+// the request on, nil if none can. A provider that hasn't run a request yet
+// goes first to learn how fast it is, one request at a time, the others wait
+// for that one behind the providers already measured. The cheapest one by the
+// prices in the properties goes by the estimated prompt and the average
+// completion so far, the fastest one on a tie
+func routeProvider(ds datastore.Datastore, task *ServiceTask) *types.ServiceProvider {
+	candidates := routeCandidates(ds, task)
+	if len(candidates) == 0 {
+		return nil
+	}
+	return pickRoute(task, candidates).provider
+}
+
+func pickRoute(task *ServiceTask, candidates []*routeCandidate) *routeCandidate {
+	completion := averageCompletion()
+	cost := func(c *routeCandidate) float64 {
+		return c.properties.Cost(task.Request.Model, task.promptTokens(), int(completion))
+	}
+	better := func(c, best *routeCandidate) bool {
+		if task.Request.HybridPolicy == types.HybridPolicyCheapest && cost(c) != cost(best) {
+			return cost(c) < cost(best)
+		}
+		if c.explore != best.explore {
+			return c.explore
+		}
+		if c.measured != best.measured {
+			return c.measured
+		}
+		return c.seconds(completion) < best.seconds(completion)
+	}
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if better(c, best) {
+			best = c
+		}
+	}
+	if best.explore {
+		latencies.exploreStarted(best.provider.ProviderName)
+	}
+	slog.Info("[Schedule] Service provider picked by the hybrid policy", "taskid", task.Schedule.Id,
+		"hybrid_policy", task.Request.HybridPolicy, "service_provider", best.provider.ProviderName,
+		"candidates", len(candidates), "explore", best.explore, "ttft_ms", best.latency.TTFTMs, "tokens_per_second", best.latency.TokensPerSecond)
+	return best
+}
+
+// averageCompletion the completion tokens of a request so far, over every
+// service provider
+func averageCompletion() float64 {
+	var requests, tokens int64
+	for _, u := range TokenUsage() {
+		requests += u.Requests
+		tokens += u.CompletionTokens
+	}
+	if requests == 0 {
+		return 0
+	}
+	return math.Round(float64(tokens) / float64(requests))
+}
@@ -0,0 +1,72 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"oadin/internal/types"
+)
+
+func TestLatencyRecord(t *testing.T) {
+	ls := &latencySet{providers: map[string]*providerLatency{}}
+	task := &ServiceTask{Target: &types.ServiceTarget{Model: "qwen3", Stream: true,
+		ServiceProvider: &types.ServiceProvider{ProviderName: "local_ollama_chat"}}}
+	if _, ok := ls.get("local_ollama_chat", "qwen3"); ok {
+		t.Fatal("latency of a provider that hasn't run")
+	}
+	start := time.Now().Add(-2 * time.Second)
+	ls.record(task, &runTiming{start: start, first: start.Add(500 * time.Millisecond), chunks: 30}, &tokenUsage{})
+	got, ok := ls.get("local_ollama_chat", "qwen3")
+	if !ok || got.Requests != 1 || got.TTFTMs != 500 || got.TokensPerSecond < 19 || got.TokensPerSecond > 21 {
+		t.Errorf("latency = %+v", got)
+	}
+	ls.record(task, &runTiming{start: start, first: start.Add(1500 * time.Millisecond), chunks: 1}, &tokenUsage{completion: 50})
+	got, _ = ls.get("local_ollama_chat", "qwen3")
+	if got.Requests != 2 || got.TTFTMs != 700 || got.TokensPerSecond < 35 || got.TokensPerSecond > 37 {
+		t.Errorf("latency = %+v, want the averages moved a fifth of the way", got)
+	}
+	if other, ok := ls.get("local_ollama_chat", "llama3"); !ok || other.Requests != 2 {
+		t.Errorf("a model that hasn't run = %+v, want the provider's", other)
+	}
+}
+
+func TestProviderCost(t *testing.T) {
+	p := &types.ServiceProviderProperties{Price: types.TokenPrice{Input: 1, Output: 2},
+		ModelPrices: map[string]types.TokenPrice{"gpt-4o": {Input: 5, Output: 15}}}
+	if got := p.Cost("gpt-4o-mini", 1000, 500); got != 0.002 {
+		t.Errorf("cost = %v, want 0.002", got)
+	}
+	if got := p.Cost("gpt-4o", 1000, 500); got != 0.0125 {
+		t.Errorf("cost = %v, want 0.0125", got)
+	}
+}
+
+func TestPickRoute(t *testing.T) {
+	candidate := func(name string, ttftMs float64, price float64) *routeCandidate {
+		c := &routeCandidate{provider: &types.ServiceProvider{ProviderName: name},
+			properties: &types.ServiceProviderProperties{Price: types.TokenPrice{Input: price, Output: price}}}
+		if ttftMs > 0 {
+			c.latency, c.measured = types.LatencyStats{Requests: 1, TTFTMs: ttftMs}, true
+		}
+		c.explore = !c.measured && latencies.explore(name)
+		return c
+	}
+	task := &ServiceTask{Request: &types.ServiceRequest{HybridPolicy: types.HybridPolicyFastest,
+		HTTP: types.HTTPContent{Body: []byte(`{"messages":[{"role":"user","content":"hello"}]}`)}}}
+	latencies.mu.Lock()
+	delete(latencies.exploring, "pick_new")
+	latencies.mu.Unlock()
+	pick := func() string {
+		return pickRoute(task, []*routeCandidate{candidate("pick_slow", 900, 0), candidate("pick_fast", 100, 1), candidate("pick_new", 0, 0)}).provider.ProviderName
+	}
+	if got := pick(); got != "pick_new" {
+		t.Errorf("first pick = %s, want the provider not measured yet", got)
+	}
+	if got := pick(); got != "pick_fast" {
+		t.Errorf("pick while exploring = %s, want the fastest measured", got)
+	}
+	task.Request.HybridPolicy = types.HybridPolicyCheapest
+	if got := pick(); got != "pick_slow" {
+		t.Errorf("cheapest pick = %s, want the fastest of the free ones", got)
+	}
+}
@@ -0,0 +1,413 @@
+package schedule
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"oadin/config"
+	"oadin/internal/types"
+)
+
+// PriorityHeader lets a client ask for the priority of its request,
+// low, normal, high or a number, higher runs first
+const PriorityHeader = "X-Oadin-Priority"
+
+// SchedulePolicy the slots and the priorities the priority scheduler goes by
+type SchedulePolicy struct {
+	ServiceSlots  map[string]int // tasks a service runs at once, by service name
+	ProviderSlots map[string]int // tasks a service provider runs at once, by provider name
+	LocalSlots    int            // for the local service providers not in ProviderSlots, 0 for no limit
+	PriorityKeys  map[string]int // priority of the requests by the api key they carry
+}
+
+func NewSchedulePolicy(env *config.OadinEnvironment) *SchedulePolicy {
+	policy := &SchedulePolicy{
+		ServiceSlots:  map[string]int{},
+		ProviderSlots: map[string]int{},
+		PriorityKeys:  map[string]int{},
+	}
+	if env == nil {
+		return policy
+	}
+	policy.LocalSlots = env.LocalSlots
+	for name, value := range parsePairs(env.ServiceSlots) {
+		if n, err := strconv.Atoi(value); err == nil {
+			policy.ServiceSlots[name] = n
+		} else {
+			slog.Warn("[Schedule] Invalid service slots", "service", name, "slots", value)
+		}
+	}
+	for name, value := range parsePairs(env.ProviderSlots) {
+		if n, err := strconv.Atoi(value); err == nil {
+			policy.ProviderSlots[name] = n
+		} else {
+			slog.Warn("[Schedule] Invalid provider slots", "service_provider", name, "slots", value)
+		}
+	}
+	for key, value := range parsePairs(env.PriorityKeys) {
+		if priority, ok := parsePriority(value); ok {
+			policy.PriorityKeys[key] = priority
+		} else {
+			slog.Warn("[Schedule] Invalid priority of api key", "priority", value)
+		}
+	}
+	return policy
+}
+
+// parsePairs parses a comma separated list of name=value
+func parsePairs(s string) map[string]string {
+	pairs := map[string]string{}
+	for _, item := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if ok && name != "" {
+			pairs[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	return pairs
+}
+
+func parsePriority(s string) (int, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "low":
+		return types.PriorityLow, true
+	case "normal":
+		return types.PriorityNormal, true
+	case "high":
+		return types.PriorityHigh, true
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	return n, err == nil
+}
+
+// requestPriority the priority of a request to a service. The policy of the
+// api key it carries goes first, a client can't raise itself above that. The
+// header only goes from low to high, the api keys may go beyond
+func requestPriority(request *http.Request) int {
+	if ps, ok := scheduler.(*PriorityServiceScheduler); ok {
+		if priority, ok := ps.Policy.PriorityKeys[requestAPIKey(request)]; ok {
+			return priority
+		}
+	}
+	if priority, ok := parsePriority(request.Header.Get(PriorityHeader)); ok {
+		return min(max(priority, types.PriorityLow), types.PriorityHigh)
+	}
+	return types.PriorityNormal
+}
+
+func requestAPIKey(request *http.Request) string {
+	if auth := request.Header.Get("Authorization"); auth != "" {
+		if key, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(key)
+		}
+	}
+	if key := request.Header.Get("x-api-key"); key != "" {
+		return key
+	}
+	return request.Header.Get("x-goog-api-key")
+}
+
+// serviceSlots tasks the service may run at once, 0 for no limit
+func (p *SchedulePolicy) serviceSlots(service string) int {
+	return p.ServiceSlots[service]
+}
+
+// providerLimits the tasks the service provider of the target may run at once
+// and may have waiting for a slot, 0 for no limit. The properties of the
+// provider go first, then the flags. A target without a provider, e.g. rerank
+// on embeddings, has no limit, what it runs on is scheduled as tasks of their own
+func (p *SchedulePolicy) providerLimits(target *types.ServiceTarget) (slots int, queue int) {
+	if target.ServiceProvider == nil {
+		return 0, 0
+	}
+	properties := &types.ServiceProviderProperties{}
+	if target.ServiceProvider.Properties != "" {
+		_ = json.Unmarshal([]byte(target.ServiceProvider.Properties), properties)
+	}
+	if properties.MaxConcurrency > 0 {
+		return properties.MaxConcurrency, properties.MaxQueue
+	}
+	if n, ok := p.ProviderSlots[target.ServiceProvider.ProviderName]; ok {
+		return n, properties.MaxQueue
+	}
+	if target.Location == types.ServiceSourceLocal {
+		return p.LocalSlots, properties.MaxQueue
+	}
+	return 0, properties.MaxQueue
+}
+
+// PriorityServiceScheduler runs the waiting tasks by priority, then in the
+// order they were enqueued, each once its service and its service provider
+// have a free slot. The others wait for a running task to complete
+type PriorityServiceScheduler struct {
+	*BasicServiceScheduler
+}
+
+func NewPriorityServiceScheduler(policy *SchedulePolicy) *PriorityServiceScheduler {
+	ps := &PriorityServiceScheduler{BasicServiceScheduler: NewBasicServiceScheduler()}
+	ps.Policy = policy
+	return ps
+}
+
+func (ps *PriorityServiceScheduler) Start() {
+	slog.Info("[Init] Start priority service scheduler ...", "service_slots", ps.Policy.ServiceSlots,
+		"provider_slots", ps.Policy.ProviderSlots, "local_slots", ps.Policy.LocalSlots)
+	go func() {
+		for taskEvent := range ps.ChEvent {
+			task := taskEvent.Task
+			switch taskEvent.Type {
+			case ServiceTaskEnqueue:
+				ps.onTaskEnqueue(task)
+			case ServiceTaskDone:
+				ps.onTaskDone(task)
+				ps.recordRun(task)
+			case ServiceTaskFailed:
+				ps.onTaskFailed(task, taskEvent.Error)
+				ps.recordRun(task)
+			case ServiceTaskFailover:
+				ps.onTaskFailover(task, taskEvent.Error)
+			case ServiceTaskCancel:
+				ps.onTaskCancel(task)
+			case ServiceTaskInspect:
+				taskEvent.Inspect()
+			}
+			ps.schedule()
+		}
+	}()
+}
+
+// slotUsage the slots taken by the running tasks
+type slotUsage struct {
+	services  map[string]int
+	providers map[string]int
+}
+
+func (u *slotUsage) take(task *ServiceTask, target *types.ServiceTarget) {
+	u.services[task.Request.Service]++
+	if target.ServiceProvider != nil {
+		u.providers[target.ServiceProvider.ProviderName]++
+	}
+}
+
+func (ss *BasicServiceScheduler) usage() *slotUsage {
+	u := &slotUsage{services: map[string]int{}, providers: map[string]int{}}
+	for e := ss.RunningList.Front(); e != nil; e = e.Next() {
+		task := e.Value.(*ServiceTask)
+		u.take(task, task.Target)
+	}
+	return u
+}
+
+func (ss *BasicServiceScheduler) hasSlot(u *slotUsage, task *ServiceTask, target *types.ServiceTarget) bool {
+	if n := ss.Policy.serviceSlots(task.Request.Service); n > 0 && u.services[task.Request.Service] >= n {
+		return false
+	}
+	if n, _ := ss.Policy.providerLimits(target); n > 0 && u.providers[target.ServiceProvider.ProviderName] >= n {
+		return false
+	}
+	// a half-open breaker runs its probe before the others
+	if target.ServiceProvider != nil && !breakers.admit(target.ServiceProvider.ProviderName) {
+		return false
+	}
+	return true
+}
+
+// waiting the waiting tasks in the order they should run
+func (ps *PriorityServiceScheduler) waiting() []*ServiceTask {
+	tasks := make([]*ServiceTask, 0, ps.WaitingList.Len())
+	for e := ps.WaitingList.Front(); e != nil; e = e.Next() {
+		tasks = append(tasks, e.Value.(*ServiceTask))
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		if tasks[i].Request.Priority != tasks[j].Request.Priority {
+			return tasks[i].Request.Priority > tasks[j].Request.Priority
+		}
+		return tasks[i].Schedule.Id < tasks[j].Schedule.Id
+	})
+	return tasks
+}
+
+// this is invoked by schedule goroutine
+func (ps *PriorityServiceScheduler) schedule() {
+	ps.scheduleTasks(ps.waiting())
+}
+
+// scheduleTasks starts the tasks, in the order given, that have a free slot.
+// The others wait in the queue of their service provider, or are refused
+// when it is full
+func (ss *BasicServiceScheduler) scheduleTasks(tasks []*ServiceTask) {
+	type candidate struct {
+		task   *ServiceTask
+		target *types.ServiceTarget
+	}
+	var candidates []candidate
+	for _, task := range tasks {
+		if task.Schedule.NotBefore.After(time.Now()) {
+			continue
+		}
+		// a task waiting for a slot keeps where it was dispatched to, unless the
+		// breaker of its provider has opened since
+		target := task.dispatched
+		if target == nil || (target.ServiceProvider != nil && breakers.isOpen(target.ServiceProvider.ProviderName)) {
+			var err error
+			target, err = ss.dispatch(task)
+			if err != nil {
+				task.Ch <- &types.ServiceResult{Type: types.ServiceResultFailed, TaskId: task.Schedule.Id, Error: err}
+				ss.onTaskFailed(task, err)
+				continue
+			}
+			task.dispatched = target
+		}
+		candidates = append(candidates, candidate{task, target})
+	}
+	// the tasks admitted to the queue keep their place, only new ones are refused
+	queued := map[string]int{}
+	for _, c := range candidates {
+		if c.task.Schedule.Queued && c.target.ServiceProvider != nil {
+			queued[c.target.ServiceProvider.ProviderName]++
+		}
+	}
+
+	u := ss.usage()
+	limits := map[string][2]int{}
+	for _, c := range candidates {
+		task, target := c.task, c.target
+		slots, maxQueue := ss.Policy.providerLimits(target)
+		provider := ""
+		if target.ServiceProvider != nil {
+			provider = target.ServiceProvider.ProviderName
+			limits[provider] = [2]int{slots, maxQueue}
+		}
+		if ss.hasSlot(u, task, target) {
+			if task.Schedule.Queued {
+				queued[provider]--
+			}
+			u.take(task, target)
+			ss.recordWait(task, target)
+			ss.start(task, target)
+			continue
+		}
+		if task.Schedule.Queued {
+			continue
+		}
+		if provider != "" && maxQueue > 0 && queued[provider] >= maxQueue {
+			ss.reject(task, provider, slots, queued[provider])
+			continue
+		}
+		slog.Debug("[Schedule] Task waits for a slot", "taskid", task.Schedule.Id, "priority", task.Request.Priority,
+			"service", task.Request.Service, "service_provider", provider)
+		task.Schedule.Queued = true
+		if provider != "" {
+			queued[provider]++
+		}
+	}
+	ss.recordUsage(u, queued, limits)
+}
+
+// reject refuses a task when the queue of its service provider is full, the
+// client is told when to retry from how long the provider takes to run a task
+func (ss *BasicServiceScheduler) reject(task *ServiceTask, provider string, slots int, queued int) {
+	ss.statsMu.Lock()
+	stats := ss.providerStats(provider)
+	stats.Rejected++
+	avgRun := time.Duration(stats.AvgRunMs) * time.Millisecond
+	ss.statsMu.Unlock()
+
+	if slots < 1 {
+		slots = 1
+	}
+	retryAfter := int(math.Ceil((avgRun * time.Duration(queued+1) / time.Duration(slots)).Seconds()))
+	retryAfter = max(1, min(retryAfter, 300))
+	slog.Warn("[Schedule] Queue of the service provider is full, task refused", "taskid", task.Schedule.Id,
+		"service_provider", provider, "queued", queued, "retry_after", retryAfter)
+	err := httpError(http.StatusTooManyRequests, fmt.Sprintf("service provider %s is busy, %d requests queued", provider, queued))
+	err.Header.Set("Retry-After", strconv.Itoa(retryAfter))
+	task.Ch <- &types.ServiceResult{Type: types.ServiceResultFailed, TaskId: task.Schedule.Id, Error: err}
+	ss.onTaskFailed(task, err)
+}
+
+// providerStats must be called with statsMu held
+func (ss *BasicServiceScheduler) providerStats(provider string) *types.ProviderQueueStats {
+	stats, ok := ss.stats[provider]
+	if !ok {
+		stats = &types.ProviderQueueStats{}
+		ss.stats[provider] = stats
+	}
+	return stats
+}
+
+// movingAverage gives the latest sample a fifth of the weight
+func movingAverage(avg int64, sample time.Duration) int64 {
+	if avg == 0 {
+		return sample.Milliseconds()
+	}
+	return avg + (sample.Milliseconds()-avg)/5
+}
+
+func (ss *BasicServiceScheduler) recordWait(task *ServiceTask, target *types.ServiceTarget) {
+	if target.ServiceProvider == nil {
+		return
+	}
+	ss.statsMu.Lock()
+	defer ss.statsMu.Unlock()
+	stats := ss.providerStats(target.ServiceProvider.ProviderName)
+	stats.AvgWaitMs = movingAverage(stats.AvgWaitMs, time.Since(task.Schedule.TimeEnqueue))
+}
+
+func (ss *BasicServiceScheduler) recordRun(task *ServiceTask) {
+	if !task.Schedule.IsRunning || task.Schedule.Cancelled || task.Target == nil || task.Target.ServiceProvider == nil {
+		return
+	}
+	ss.statsMu.Lock()
+	defer ss.statsMu.Unlock()
+	stats := ss.providerStats(task.Target.ServiceProvider.ProviderName)
+	stats.AvgRunMs = movingAverage(stats.AvgRunMs, task.Schedule.TimeComplete.Sub(task.Schedule.TimeRun))
+}
+
+// recordUsage the limits are those of the providers the waiting tasks go to
+func (ss *BasicServiceScheduler) recordUsage(u *slotUsage, queued map[string]int, limits map[string][2]int) {
+	ss.statsMu.Lock()
+	defer ss.statsMu.Unlock()
+	for _, stats := range ss.stats {
+		stats.Running, stats.Queued = 0, 0
+	}
+	for provider, l := range limits {
+		stats := ss.providerStats(provider)
+		stats.MaxConcurrency, stats.MaxQueue = l[0], l[1]
+	}
+	for provider, n := range u.providers {
+		ss.providerStats(provider).Running = n
+	}
+	for provider, n := range queued {
+		if provider != "" {
+			ss.providerStats(provider).Queued = n
+		}
+	}
+}
+
+// QueueStats the tasks of each service provider in the scheduler, by provider
+// name
+func QueueStats() map[string]types.ProviderQueueStats {
+	var ss *BasicServiceScheduler
+	switch s := scheduler.(type) {
+	case *BasicServiceScheduler:
+		ss = s
+	case *PriorityServiceScheduler:
+		ss = s.BasicServiceScheduler
+	default:
+		return nil
+	}
+	ss.statsMu.Lock()
+	defer ss.statsMu.Unlock()
+	stats := make(map[string]types.ProviderQueueStats, len(ss.stats))
+	for provider, s := range ss.stats {
+		stats[provider] = *s
+	}
+	return stats
+}
@@ -0,0 +1,214 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+
+	"oadin/config"
+	"oadin/internal/types"
+)
+
+func TestPrioritySchedulerOrderAndSlots(t *testing.T) {
+	ps := NewPriorityServiceScheduler(NewSchedulePolicy(&config.OadinEnvironment{
+		ServiceSlots:  "embed=2",
+		ProviderSlots: "remote_openai_chat=1",
+		LocalSlots:    1,
+	}))
+	enqueue := func(id uint64, priority int) *ServiceTask {
+		task := &ServiceTask{Request: &types.ServiceRequest{Service: types.ServiceChat, Priority: priority}}
+		task.Schedule.Id = id
+		ps.addToList(task, "waiting")
+		return task
+	}
+	enqueue(1, types.PriorityLow)
+	enqueue(2, types.PriorityNormal)
+	enqueue(3, types.PriorityHigh)
+	enqueue(4, types.PriorityNormal)
+	var order []uint64
+	for _, task := range ps.waiting() {
+		order = append(order, task.Schedule.Id)
+	}
+	if want := []uint64{3, 2, 4, 1}; !slices.Equal(order, want) {
+		t.Errorf("waiting order = %v, want %v", order, want)
+	}
+
+	local := &types.ServiceTarget{Location: types.ServiceSourceLocal, ServiceProvider: &types.ServiceProvider{ProviderName: "local_ollama_chat"}}
+	remote := &types.ServiceTarget{Location: types.ServiceSourceRemote, ServiceProvider: &types.ServiceProvider{ProviderName: "remote_deepseek_chat"}}
+	limited := &types.ServiceTarget{Location: types.ServiceSourceRemote, ServiceProvider: &types.ServiceProvider{ProviderName: "remote_openai_chat"}}
+	embedRerank := &types.ServiceTarget{Location: types.ServiceSourceLocal, EmbedRerank: true}
+	chat := &ServiceTask{Request: &types.ServiceRequest{Service: types.ServiceChat}}
+	embed := &ServiceTask{Request: &types.ServiceRequest{Service: types.ServiceEmbed}}
+	rerank := &ServiceTask{Request: &types.ServiceRequest{Service: types.ServiceRerank}}
+
+	u := &slotUsage{services: map[string]int{}, providers: map[string]int{}}
+	u.take(chat, local)
+	u.take(chat, limited)
+	u.take(rerank, embedRerank)
+	u.take(embed, remote)
+	u.take(embed, remote)
+	if ps.hasSlot(u, chat, local) {
+		t.Error("a local provider with its slot taken has a slot")
+	}
+	if ps.hasSlot(u, chat, limited) {
+		t.Error("a provider with its slots set and taken has a slot")
+	}
+	if !ps.hasSlot(u, chat, remote) {
+		t.Error("a remote provider without slots set has no slot")
+	}
+	if ps.hasSlot(u, embed, &types.ServiceTarget{Location: types.ServiceSourceRemote, ServiceProvider: &types.ServiceProvider{ProviderName: "remote_aliyun_embed"}}) {
+		t.Error("a service with its slots taken has a slot")
+	}
+	if !ps.hasSlot(u, rerank, embedRerank) {
+		t.Error("rerank on embeddings waits for a provider slot")
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	old := scheduler
+	defer func() { scheduler = old }()
+	scheduler = NewPriorityServiceScheduler(NewSchedulePolicy(&config.OadinEnvironment{PriorityKeys: "sk-nightly=low, sk-app=20"}))
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"default", nil, types.PriorityNormal},
+		{"header", map[string]string{PriorityHeader: "high"}, types.PriorityHigh},
+		{"header number", map[string]string{PriorityHeader: "-3"}, -3},
+		{"header over high", map[string]string{PriorityHeader: "1000"}, types.PriorityHigh},
+		{"header under low", map[string]string{PriorityHeader: "-1000"}, types.PriorityLow},
+		{"invalid header", map[string]string{PriorityHeader: "urgent"}, types.PriorityNormal},
+		{"api key", map[string]string{"Authorization": "Bearer sk-app"}, 20},
+		{"api key over header", map[string]string{"Authorization": "Bearer sk-nightly", PriorityHeader: "high"}, types.PriorityLow},
+		{"unknown api key", map[string]string{"x-api-key": "sk-other", PriorityHeader: "low"}, types.PriorityLow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			for k, v := range tt.header {
+				request.Header.Set(k, v)
+			}
+			if got := requestPriority(request); got != tt.want {
+				t.Errorf("requestPriority() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProviderLimitsAndReject(t *testing.T) {
+	ps := NewPriorityServiceScheduler(NewSchedulePolicy(&config.OadinEnvironment{ProviderSlots: "local_ollama_chat=2", LocalSlots: 4}))
+	target := func(name, location, properties string) *types.ServiceTarget {
+		return &types.ServiceTarget{Location: location, ServiceProvider: &types.ServiceProvider{ProviderName: name, Properties: properties}}
+	}
+	tests := []struct {
+		target          *types.ServiceTarget
+		slots, maxQueue int
+	}{
+		{target("local_ollama_chat", types.ServiceSourceLocal, `{"max_concurrency":1,"max_queue":8}`), 1, 8},
+		{target("local_ollama_chat", types.ServiceSourceLocal, `{"max_queue":8}`), 2, 8},
+		{target("local_ollama_embed", types.ServiceSourceLocal, ""), 4, 0},
+		{target("remote_openai_chat", types.ServiceSourceRemote, `{}`), 0, 0},
+	}
+	for _, tt := range tests {
+		if slots, maxQueue := ps.Policy.providerLimits(tt.target); slots != tt.slots || maxQueue != tt.maxQueue {
+			t.Errorf("providerLimits(%s %s) = %d, %d, want %d, %d", tt.target.ServiceProvider.ProviderName,
+				tt.target.ServiceProvider.Properties, slots, maxQueue, tt.slots, tt.maxQueue)
+		}
+	}
+
+	ps.stats["local_ollama_chat"] = &types.ProviderQueueStats{AvgRunMs: 3000}
+	task := &ServiceTask{Request: &types.ServiceRequest{Service: types.ServiceChat}, Ch: make(chan *types.ServiceResult, 1)}
+	ps.addToList(task, "waiting")
+	ps.reject(task, "local_ollama_chat", 2, 3)
+	result := <-task.Ch
+	httpErr, ok := result.Error.(*types.HTTPErrorResponse)
+	if !ok || httpErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("rejected with %v", result.Error)
+	}
+	// 4 tasks of 3s on 2 slots
+	if got := httpErr.Header.Get("Retry-After"); got != "6" {
+		t.Errorf("Retry-After = %s, want 6", got)
+	}
+	if ps.stats["local_ollama_chat"].Rejected != 1 {
+		t.Errorf("rejected = %d, want 1", ps.stats["local_ollama_chat"].Rejected)
+	}
+}
+
+func TestCancelWaitingTask(t *testing.T) {
+	ps := NewPriorityServiceScheduler(NewSchedulePolicy(nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	_, ch := ps.Enqueue(&types.ServiceRequest{Service: types.ServiceChat, Context: ctx})
+	task := (<-ps.ChEvent).Task
+	ps.onTaskEnqueue(task)
+	cancel()
+	event := <-ps.ChEvent
+	if event.Type != ServiceTaskCancel || event.Task != task {
+		t.Fatalf("event = %v, want the cancel of the task", event.Type)
+	}
+	ps.onTaskCancel(task)
+	result := <-ch
+	if result.Type != types.ServiceResultFailed || !errors.Is(result.Error, context.Canceled) {
+		t.Errorf("result = %s", result)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("channel not closed")
+	}
+	if !task.Schedule.Cancelled || ps.WaitingList.Len() != 0 {
+		t.Errorf("cancelled = %v, waiting = %d", task.Schedule.Cancelled, ps.WaitingList.Len())
+	}
+}
+
+func TestWaitingTaskKeepsItsDispatch(t *testing.T) {
+	ps := NewPriorityServiceScheduler(NewSchedulePolicy(&config.OadinEnvironment{LocalSlots: 1}))
+	local := &types.ServiceTarget{Location: types.ServiceSourceLocal, ServiceProvider: &types.ServiceProvider{ProviderName: "local_ollama_chat"}}
+	running := &ServiceTask{Request: &types.ServiceRequest{Service: types.ServiceChat}, Target: local}
+	running.Schedule.Id, running.Schedule.IsRunning = 1, true
+	ps.addToList(running, "running")
+	// dispatch would go to the datastore, there is none here
+	waiting := &ServiceTask{Request: &types.ServiceRequest{Service: types.ServiceChat}, dispatched: local}
+	waiting.Schedule.Id = 2
+	ps.addToList(waiting, "waiting")
+	for range 3 {
+		ps.schedule()
+	}
+	if waiting.Schedule.IsRunning || !waiting.Schedule.Queued || waiting.dispatched != local {
+		t.Errorf("waiting task = %+v", waiting.Schedule)
+	}
+}
+
+func TestBasicSchedulerLimits(t *testing.T) {
+	ss := NewBasicServiceScheduler()
+	limited := &types.ServiceTarget{Location: types.ServiceSourceRemote, ServiceProvider: &types.ServiceProvider{
+		ProviderName: "remote_openai_chat", Properties: `{"max_concurrency":1,"max_queue":1}`}}
+	running := &ServiceTask{Request: &types.ServiceRequest{Service: types.ServiceChat}, Target: limited}
+	running.Schedule.Id, running.Schedule.IsRunning = 1, true
+	ss.addToList(running, "running")
+	// dispatch would go to the datastore, there is none here
+	var waiting []*ServiceTask
+	for id := range uint64(2) {
+		task := &ServiceTask{Request: &types.ServiceRequest{Service: types.ServiceChat}, Ch: make(chan *types.ServiceResult, 1), dispatched: limited}
+		task.Schedule.Id = id + 2
+		ss.addToList(task, "waiting")
+		waiting = append(waiting, task)
+	}
+	ss.schedule()
+
+	if task := waiting[0]; task.Schedule.IsRunning || !task.Schedule.Queued {
+		t.Errorf("task over max_concurrency = %+v, want it queued", task.Schedule)
+	}
+	select {
+	case result := <-waiting[1].Ch:
+		if httpErr, ok := result.Error.(*types.HTTPErrorResponse); !ok || httpErr.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("task over max_queue refused with %v", result.Error)
+		}
+	default:
+		t.Error("task over max_queue is not refused")
+	}
+	if stats := ss.stats["remote_openai_chat"]; stats == nil || stats.Running != 1 || stats.Queued != 1 || stats.Rejected != 1 {
+		t.Errorf("queue stats = %+v", stats)
+	}
+}
@@ -0,0 +1,163 @@
+package schedule
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"oadin/config"
+	"oadin/internal/datastore"
+	"oadin/internal/types"
+)
+
+// raceDelay the wait for the first token of the local service provider before
+// the race policy runs the remote one too
+func raceDelay() time.Duration {
+	if env := config.GlobalOadinEnvironment; env != nil {
+		return env.RaceDelay
+	}
+	return 2 * time.Second
+}
+
+// raceRemote the remote service provider a task under the race policy races
+// its local one with, empty if it doesn't race. Only a stream races, the race
+// delay waits for its first token, a response that isn't streamed would lose
+// to it just taking longer than that
+func (st *ServiceTask) raceRemote() string {
+	if st.Request.HybridPolicy != types.HybridPolicyRace || st.Target.Location != types.ServiceSourceLocal ||
+		!st.Target.Stream || st.Target.EmbedRerank || st.Request.SpoolDir != "" {
+		return ""
+	}
+	service := &types.Service{Name: st.Request.Service}
+	if err := datastore.GetDefaultDatastore().Get(context.Background(), service); err != nil {
+		return ""
+	}
+	if service.RemoteProvider == "" || breakers.blocked(service.RemoteProvider) {
+		return ""
+	}
+	return service.RemoteProvider
+}
+
+func drain(ch chan *types.ServiceResult) {
+	go func() {
+		for range ch {
+		}
+	}()
+}
+
+// runRace runs the task on its local service provider, and on the remote one
+// too, as a task of its own, once the race delay passes with nothing back or
+// the local one fails. The first to send back a result wins and goes on to the
+// client, the other is cancelled. The breaker of the local service provider is
+// recorded here, the remote task records its own
+func (st *ServiceTask) runRace(remote string) error {
+	st.raced = true
+	localCtx, cancelLocal := context.WithCancel(st.Context())
+	defer cancelLocal()
+	localReq := *st.Request
+	localReq.HybridPolicy = types.HybridPolicyLocal
+	local := &ServiceTask{Request: &localReq, Target: st.Target, Ch: make(chan *types.ServiceResult), ctx: localCtx, cancel: cancelLocal}
+	local.Schedule.Id = st.Schedule.Id
+	localErr := make(chan error, 1)
+	go func() {
+		err := local.Run()
+		if localCtx.Err() == nil {
+			breakers.record(st.Target.ServiceProvider.ProviderName, err != nil && retryable(err))
+		} else {
+			breakers.end(st.Target.ServiceProvider.ProviderName)
+		}
+		localErr <- err
+		close(local.Ch)
+	}()
+
+	var remoteCh chan *types.ServiceResult
+	cancelRemote := func() {}
+	raced := false
+	startRemote := func(reason string) {
+		raced = true
+		ctx, cancel := context.WithCancel(st.Context())
+		cancelRemote = cancel
+		remoteReq := *st.Request
+		remoteReq.HybridPolicy = types.HybridPolicyRemote
+		remoteReq.Context = ctx
+		if remoteReq.Model != "" && !hasModel(datastore.GetDefaultDatastore(), remote, remoteReq.Model) {
+			remoteReq.Model = "" // the default one of the remote service provider
+		}
+		var id uint64
+		id, remoteCh = GetScheduler().Enqueue(&remoteReq)
+		slog.Info("[Service] Race: the remote service provider runs the task too", "taskid", st.Schedule.Id,
+			"reason", reason, "remote_taskid", id, "service_provider", remote)
+	}
+	defer func() { cancelRemote() }()
+
+	timer := time.NewTimer(raceDelay())
+	defer timer.Stop()
+	localCh := local.Ch
+	var lErr, rErr error
+	for {
+		select {
+		case <-timer.C:
+			if !raced {
+				startRemote("no first token")
+			}
+		case r, ok := <-localCh:
+			if !ok {
+				localCh, lErr = nil, <-localErr
+				if !raced && st.Context().Err() == nil {
+					startRemote("local failed")
+				}
+				if !raced || remoteCh == nil {
+					return firstError(rErr, lErr)
+				}
+				continue
+			}
+			// the local one is first
+			if raced {
+				slog.Info("[Service] Race: the local service provider wins", "taskid", st.Schedule.Id)
+				cancelRemote()
+				if remoteCh != nil {
+					drain(remoteCh)
+				}
+			}
+			st.send(r)
+			for r := range localCh {
+				st.send(r)
+			}
+			return <-localErr
+		case r, ok := <-remoteCh:
+			if !ok || r.Type == types.ServiceResultFailed {
+				if ok {
+					rErr = r.Error
+				}
+				remoteCh = nil
+				if localCh == nil {
+					return firstError(rErr, lErr)
+				}
+				continue
+			}
+			// the remote one is first
+			slog.Info("[Service] Race: the remote service provider wins", "taskid", st.Schedule.Id, "service_provider", r.ServiceProvider)
+			cancelLocal()
+			if localCh != nil {
+				drain(localCh)
+			}
+			for ; ok; r, ok = <-remoteCh {
+				if r.Type == types.ServiceResultFailed {
+					return r.Error
+				}
+				r.TaskId = st.Schedule.Id
+				st.send(r)
+			}
+			return nil
+		}
+	}
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
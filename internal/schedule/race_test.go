@@ -0,0 +1,216 @@
+package schedule
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"oadin/config"
+	"oadin/internal/datastore"
+	"oadin/internal/datastore/sqlite"
+	"oadin/internal/types"
+)
+
+// raceProvider a service provider of the race tests, which answers, in one
+// chunk if it is a stream, after its delay
+type raceProvider struct {
+	*httptest.Server
+	delay   atomic.Int64
+	fail    atomic.Bool
+	calls   atomic.Int32
+	aborted atomic.Int32
+}
+
+func newRaceProvider(content string) *raceProvider {
+	p := &raceProvider{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.calls.Add(1)
+		body, _ := io.ReadAll(r.Body) // the client going away is seen once the body is read
+		if p.fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		select {
+		case <-time.After(time.Duration(p.delay.Load())):
+		case <-r.Context().Done():
+			p.aborted.Add(1)
+			return
+		}
+		if !strings.Contains(string(body), `"stream":true`) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id":"x","object":"chat.completion","created":1,"model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"` + content + `"},"finish_reason":"stop"}]}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"id":"x","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"` + content + `"}}]}` + "\n\n"))
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	return p
+}
+
+func (p *raceProvider) reset(delay time.Duration) {
+	p.delay.Store(int64(delay))
+	p.fail.Store(false)
+	p.calls.Store(0)
+	p.aborted.Store(0)
+}
+
+// waitFor polls cond for a second, the other side of a race finishes on its own
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+// setupRaceProviders puts the chat service on a datastore of its own, with
+// race_local and race_remote as its service providers
+func setupRaceProviders(t *testing.T, localURL, remoteURL string) {
+	oldDS := datastore.GetDefaultDatastore()
+	t.Cleanup(func() { datastore.SetDefaultDatastore(oldDS) })
+	ds, err := sqlite.New(filepath.Join(t.TempDir(), "oadin.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	datastore.SetDefaultDatastore(ds)
+	ctx := context.Background()
+	service := &types.Service{Name: types.ServiceChat}
+	if err := ds.Get(ctx, service); err != nil {
+		t.Fatal(err)
+	}
+	service.LocalProvider, service.RemoteProvider = "race_local", "race_remote"
+	if err := ds.Put(ctx, service); err != nil {
+		t.Fatal(err)
+	}
+	for _, sp := range []*types.ServiceProvider{
+		{ProviderName: "race_local", ServiceSource: types.ServiceSourceLocal, URL: localURL},
+		{ProviderName: "race_remote", ServiceSource: types.ServiceSourceRemote, URL: remoteURL},
+	} {
+		sp.ServiceName, sp.Method, sp.AuthType, sp.Flavor = types.ServiceChat, http.MethodPost, types.AuthTypeNone, "openai"
+		sp.ExtraHeaders, sp.ExtraJSONBody, sp.Properties, sp.Status = "{}", "{}", "{}", 1
+		if err := ds.Add(ctx, sp); err != nil {
+			t.Fatal(err)
+		}
+		if err := ds.Add(ctx, &types.Model{ModelName: "m", ProviderName: sp.ProviderName, Status: "downloaded"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRace(t *testing.T) {
+	initTestFlavors(t)
+	env := *config.GlobalOadinEnvironment
+	oldScheduler := scheduler
+	defer func() {
+		*config.GlobalOadinEnvironment = env
+		scheduler = oldScheduler
+	}()
+	config.GlobalOadinEnvironment.RaceDelay = 100 * time.Millisecond
+	config.GlobalOadinEnvironment.FailoverAttempts = 1
+	config.GlobalOadinEnvironment.BreakerFailures = 100
+	config.GlobalOadinEnvironment.BreakerCooldown = time.Minute
+
+	local, remote := newRaceProvider("local"), newRaceProvider("remote")
+	defer local.Close()
+	defer remote.Close()
+	setupRaceProviders(t, local.URL, remote.URL)
+	ctx := context.Background()
+
+	ps := NewPriorityServiceScheduler(NewSchedulePolicy(nil))
+	ps.Start()
+	scheduler = ps
+
+	// run the request, and tell which provider served it and what came back
+	run := func(ctx context.Context, stream bool) (string, string, error) {
+		header := http.Header{}
+		header.Set("Content-Type", "application/json")
+		_, ch := ps.Enqueue(&types.ServiceRequest{FromFlavor: "openai", Service: types.ServiceChat, Model: "m",
+			HybridPolicy: types.HybridPolicyRace, AskStreamMode: stream, Context: ctx,
+			HTTP: types.HTTPContent{Header: header, Body: []byte(`{"model":"m","stream":` + strconv.FormatBool(stream) +
+				`,"messages":[{"role":"user","content":"hi"}]}`)}})
+		var provider, body string
+		var err error
+		for r := range ch {
+			if r.Error != nil {
+				err = r.Error
+				continue
+			}
+			if provider == "" {
+				provider = r.ServiceProvider
+			}
+			body += string(r.HTTP.Body)
+		}
+		return provider, body, err
+	}
+
+	t.Run("local wins", func(t *testing.T) {
+		local.reset(10 * time.Millisecond)
+		remote.reset(10 * time.Millisecond)
+		provider, body, err := run(ctx, true)
+		if err != nil || provider != "race_local" || !strings.Contains(body, "local") {
+			t.Errorf("served by %q with %q, %v, want the local provider", provider, body, err)
+		}
+		if remote.calls.Load() != 0 {
+			t.Error("the remote provider runs a local one answering within the race delay")
+		}
+	})
+	t.Run("remote wins", func(t *testing.T) {
+		local.reset(time.Second)
+		remote.reset(10 * time.Millisecond)
+		provider, body, err := run(ctx, true)
+		if err != nil || provider != "race_remote" || !strings.Contains(body, "remote") {
+			t.Errorf("served by %q with %q, %v, want the remote provider", provider, body, err)
+		}
+		if !waitFor(func() bool { return local.aborted.Load() == 1 }) {
+			t.Error("the local provider that lost is not cancelled")
+		}
+	})
+	t.Run("local fails before the delay", func(t *testing.T) {
+		local.reset(0)
+		local.fail.Store(true)
+		remote.reset(10 * time.Millisecond)
+		start := time.Now()
+		provider, _, err := run(ctx, true)
+		if err != nil || provider != "race_remote" {
+			t.Errorf("served by %q, %v, want the remote provider", provider, err)
+		}
+		if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+			t.Errorf("the remote provider is run after %s, want right when the local one failed", elapsed)
+		}
+	})
+	t.Run("client cancels", func(t *testing.T) {
+		local.reset(time.Second)
+		remote.reset(time.Second)
+		cctx, cancel := context.WithTimeout(ctx, 150*time.Millisecond)
+		defer cancel()
+		if _, body, _ := run(cctx, true); body != "" {
+			t.Errorf("a cancelled request is served %q", body)
+		}
+		if !waitFor(func() bool { return local.aborted.Load() == 1 && remote.aborted.Load() == 1 }) {
+			t.Errorf("aborted local %d remote %d, want both cancelled with the client", local.aborted.Load(), remote.aborted.Load())
+		}
+	})
+	t.Run("not a stream", func(t *testing.T) {
+		local.reset(200 * time.Millisecond)
+		remote.reset(10 * time.Millisecond)
+		provider, body, err := run(ctx, false)
+		if err != nil || provider != "race_local" || !strings.Contains(body, "local") {
+			t.Errorf("served by %q with %q, %v, want the local provider", provider, body, err)
+		}
+		if remote.calls.Load() != 0 {
+			t.Error("a request that isn't a stream races")
+		}
+	})
+}
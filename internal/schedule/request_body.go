@@ -0,0 +1,163 @@
+package schedule
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"oadin/internal/convert"
+	"oadin/internal/types"
+)
+
+// audioExtensions the providers tell the format of an audio file by its name
+var audioExtensions = map[string]string{
+	"audio/wav":    ".wav",
+	"audio/wave":   ".wav",
+	"audio/x-wav":  ".wav",
+	"audio/mpeg":   ".mp3",
+	"audio/mp3":    ".mp3",
+	"audio/mp4":    ".m4a",
+	"audio/m4a":    ".m4a",
+	"audio/x-m4a":  ".m4a",
+	"audio/aac":    ".aac",
+	"audio/ogg":    ".ogg",
+	"audio/webm":   ".webm",
+	"audio/flac":   ".flac",
+	"audio/x-flac": ".flac",
+	"audio/pcm":    ".pcm",
+}
+
+// isBinaryContentType bodies which are neither text nor a form, e.g. raw audio
+func isBinaryContentType(mediaType string) bool {
+	return mediaType == "application/octet-stream" || strings.HasPrefix(mediaType, "audio/")
+}
+
+// readRequestBody reads the body of a service request. JSON and text are read
+// as they are. A multipart form has its files spooled to a temp dir and is given
+// as the JSON of its fields, see convert.SpooledFormContentType, the same as a
+// binary body, e.g. raw audio, which becomes the "file" field of such a form.
+// Other content types are refused with 415
+func readRequestBody(request *http.Request) (body []byte, header http.Header, spoolDir string, err error) {
+	contentType := request.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case request.Method == http.MethodGet || mediaType == "" || mediaType == "application/json" || mediaType == "text/plain":
+		body, err = io.ReadAll(request.Body)
+		return body, request.Header, "", err
+	case mediaType == "multipart/form-data" || isBinaryContentType(mediaType):
+	default:
+		return nil, nil, "", httpError(http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content type: %s", contentType))
+	}
+
+	spoolDir, err = os.MkdirTemp("", "oadin-spool-*")
+	if err != nil {
+		return nil, nil, "", err
+	}
+	var fields map[string]any
+	if mediaType == "multipart/form-data" {
+		fields, err = convert.ParseMultipart(request.Body, contentType, spoolDir)
+		if err != nil {
+			err = httpError(http.StatusBadRequest, fmt.Sprintf("invalid multipart form: %s", err.Error()))
+		}
+	} else {
+		fields, err = binaryFormFields(request.Body, mediaType, request.URL.Query(), spoolDir)
+	}
+	if err == nil {
+		body, err = json.Marshal(fields)
+	}
+	if err != nil {
+		removeSpool(spoolDir)
+		return nil, nil, "", err
+	}
+	header = request.Header.Clone()
+	header.Set("Content-Type", convert.SpooledFormContentType)
+	header.Del("Content-Length")
+	return body, header, spoolDir, nil
+}
+
+// binaryFormFields the fields of the form a binary body is sent as, the query
+// parameters of the request, e.g. model, become the other fields. The file is
+// named by the query parameter filename if there is one
+func binaryFormFields(r io.Reader, mediaType string, query url.Values, spoolDir string) (map[string]any, error) {
+	fields := make(map[string]any)
+	for k, values := range query {
+		if k == "filename" || len(values) == 0 {
+			continue
+		}
+		if len(values) == 1 {
+			fields[k] = values[0]
+			continue
+		}
+		list := make([]any, len(values))
+		for i, v := range values {
+			list[i] = v
+		}
+		fields[k] = list
+	}
+	filename := query.Get("filename")
+	if filename == "" {
+		filename = "file" + audioExtensions[mediaType]
+	}
+	file, err := convert.SpoolFile(spoolDir, filename, mediaType, r)
+	if err != nil {
+		return nil, err
+	}
+	fields["file"] = file
+	return fields, nil
+}
+
+// unmarshalForm reads what the scheduler needs from the fields of a spooled
+// form, the same as from a JSON body, the values of a form are all strings
+func unmarshalForm(body []byte, req *types.ServiceRequest) error {
+	var fields map[string]any
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return err
+	}
+	if model, ok := fields["model"].(string); ok {
+		req.Model = model
+	}
+	if stream, ok := fields["stream"].(string); ok {
+		req.AskStreamMode, _ = strconv.ParseBool(stream)
+	}
+	if policy, ok := fields["hybrid_policy"].(string); ok && policy != "" {
+		req.HybridPolicy = policy
+	}
+	return nil
+}
+
+// sendableContent a spooled form is sent out as a multipart form with the files
+// read back from the spool
+func sendableContent(content types.HTTPContent, spoolDir string) (types.HTTPContent, error) {
+	mediaType, _, _ := mime.ParseMediaType(content.Header.Get("Content-Type"))
+	if mediaType != convert.SpooledFormContentType {
+		return content, nil
+	}
+	c, err := convert.NewJSONToMultipartConverter(nil)
+	if err != nil {
+		return content, err
+	}
+	return c.Convert(content, convert.ConvertContext{convert.SpoolDirKey: spoolDir})
+}
+
+func removeSpool(spoolDir string) {
+	if spoolDir == "" {
+		return
+	}
+	if err := os.RemoveAll(spoolDir); err != nil {
+		slog.Warn("[Service] Failed to remove spooled files", "dir", spoolDir, "error", err)
+	}
+}
+
+func httpError(statusCode int, message string) *types.HTTPErrorResponse {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return &types.HTTPErrorResponse{StatusCode: statusCode, Header: header, Body: body}
+}
@@ -0,0 +1,52 @@
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"oadin/internal/convert"
+	"oadin/internal/types"
+)
+
+func TestReadRequestBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/oadin/v0.2/services/speech-to-text?model=base&filename=a.wav", strings.NewReader("RIFFfake"))
+	req.Header.Set("Content-Type", "audio/wav")
+	body, header, spoolDir, err := readRequestBody(req)
+	if err != nil {
+		t.Fatalf("readRequestBody error = %v", err)
+	}
+	defer removeSpool(spoolDir)
+	if header.Get("Content-Type") != convert.SpooledFormContentType {
+		t.Errorf("content type = %s, want %s", header.Get("Content-Type"), convert.SpooledFormContentType)
+	}
+	var fields struct {
+		Model string `json:"model"`
+		File  struct {
+			Filename string `json:"filename"`
+			Path     string `json:"path"`
+		} `json:"file"`
+	}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(fields.File.Path); fields.Model != "base" || fields.File.Filename != "a.wav" || string(data) != "RIFFfake" {
+		t.Errorf("spooled form = %s", body)
+	}
+	removeSpool(spoolDir)
+	if _, err := os.Stat(spoolDir); !os.IsNotExist(err) {
+		t.Errorf("spool dir %s is expected to be removed", spoolDir)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/oadin/v0.2/services/chat", strings.NewReader("<xml/>"))
+	req.Header.Set("Content-Type", "application/xml")
+	_, _, _, err = readRequestBody(req)
+	var httpErr *types.HTTPErrorResponse
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("readRequestBody error = %v, want 415", err)
+	}
+}
@@ -0,0 +1,160 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+
+	"oadin/internal/convert"
+	"oadin/internal/datastore"
+	"oadin/internal/types"
+)
+
+// needsEmbedRerank whether a rerank task has no rerank model to go to, so it
+// is scored by the embed service instead, see runEmbedRerank
+func needsEmbedRerank(ds datastore.Datastore, providerName string) bool {
+	if providerName == "" {
+		return true
+	}
+	sp := &types.ServiceProvider{ProviderName: providerName}
+	if err := ds.Get(context.Background(), sp); err != nil {
+		return true
+	}
+	if sp.ServiceSource == types.ServiceSourceRemote {
+		return false
+	}
+	ms, err := ds.List(context.Background(), &types.Model{ProviderName: providerName}, &datastore.ListOptions{})
+	return err != nil || len(ms) == 0
+}
+
+// runEmbedRerank ranks the documents by the cosine similarity between their
+// embeddings and the embedding of the query, the embeddings come from the
+// embed service in one request
+func (st *ServiceTask) runEmbedRerank() error {
+	requestFlavor, err := GetAPIFlavor(st.Request.FromFlavor)
+	if err != nil {
+		return fmt.Errorf("[Service] Unsupported API Flavor %s for Request: %s", st.Request.FromFlavor, err.Error())
+	}
+	oadin, err := GetAPIFlavor("oadin")
+	if err != nil {
+		return err
+	}
+	content, err := ConvertBetweenFlavors(requestFlavor, oadin, types.ServiceRerank, "request", st.Request.HTTP,
+		convert.ConvertContext{"model": st.Request.Model, "stream": false})
+	if err != nil {
+		return fmt.Errorf("[Service] Failed to convert request: %s", err.Error())
+	}
+	var req types.OadinRerankRequest
+	if err := json.Unmarshal(content.Body, &req); err != nil {
+		return &types.HTTPErrorResponse{StatusCode: http.StatusBadRequest, Body: []byte(fmt.Sprintf(`{"error":%q}`, err.Error()))}
+	}
+	if req.Query == "" || len(req.Documents) == 0 {
+		return &types.HTTPErrorResponse{StatusCode: http.StatusBadRequest, Body: []byte(`{"error":"query and documents are required"}`)}
+	}
+
+	slog.Info("[Service] No rerank model installed, rerank with the embed service", "taskid", st.Schedule.Id,
+		"documents", len(req.Documents))
+	embeddings, model, err := st.embed(append([]string{req.Query}, req.Documents...))
+	if err != nil {
+		return err
+	}
+	results := make([]types.OadinRerankResult, len(req.Documents))
+	for i := range req.Documents {
+		results[i] = types.OadinRerankResult{Index: i, RelevanceScore: cosineSimilarity(embeddings[0], embeddings[i+1])}
+		if req.ReturnDocuments {
+			results[i].Document = &req.Documents[i]
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].RelevanceScore > results[j].RelevanceScore
+	})
+	if req.TopN > 0 && req.TopN < len(results) {
+		results = results[:req.TopN]
+	}
+
+	id := fmt.Sprintf("rerank-%d", st.Schedule.Id)
+	body, err := json.Marshal(types.OadinRerankResponse{ID: id, Model: model, Results: results})
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	content, err = ConvertBetweenFlavors(oadin, requestFlavor, types.ServiceRerank, "response",
+		types.HTTPContent{Body: body, Header: header}, convert.ConvertContext{"id": id})
+	if err != nil {
+		return fmt.Errorf("[Service] Failed to convert response: %s", err.Error())
+	}
+	st.send(&types.ServiceResult{
+		Type: types.ServiceResultDone, TaskId: st.Schedule.Id,
+		StatusCode: http.StatusOK,
+		HTTP:       content,
+	})
+	return nil
+}
+
+// embed gets the embeddings of inputs in their order and the model giving them
+func (st *ServiceTask) embed(inputs []string) ([][]float32, string, error) {
+	body, err := json.Marshal(map[string]any{"input": inputs})
+	if err != nil {
+		return nil, "", err
+	}
+	hybridPolicy := types.HybridPolicyDefault
+	service := &types.Service{Name: types.ServiceEmbed}
+	if err := datastore.GetDefaultDatastore().Get(context.Background(), service); err == nil && service.HybridPolicy != "" {
+		hybridPolicy = service.HybridPolicy
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	// the rerank task holds its slot while it waits on the embeddings, so they
+	// go ahead of the queue
+	_, ch := GetScheduler().Enqueue(&types.ServiceRequest{
+		Service:      types.ServiceEmbed,
+		FromFlavor:   "oadin",
+		Priority:     types.PriorityHigh,
+		HybridPolicy: hybridPolicy,
+		HTTP:         types.HTTPContent{Body: body, Header: header},
+		Context:      st.Context(),
+	})
+	result, ok := <-ch
+	if !ok {
+		return nil, "", errors.New("[Service] Embed service returns nothing")
+	}
+	if result.Type == types.ServiceResultFailed {
+		return nil, "", result.Error
+	}
+
+	var resp types.OadinEmbeddingResponse
+	if err := json.Unmarshal(result.HTTP.Body, &resp); err != nil {
+		return nil, "", fmt.Errorf("[Service] Failed to unmarshal embed response: %s", err.Error())
+	}
+	embeddings := make([][]float32, len(inputs))
+	for _, d := range resp.Data {
+		if d.Index >= 0 && d.Index < len(embeddings) {
+			embeddings[d.Index] = d.Embedding
+		}
+	}
+	for i, e := range embeddings {
+		if len(e) == 0 {
+			return nil, "", fmt.Errorf("[Service] Embed service returns no embedding for input %d", i)
+		}
+	}
+	return embeddings, resp.Model, nil
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := 0; i < len(a) && i < len(b); i++ {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
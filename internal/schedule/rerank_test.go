@@ -0,0 +1,26 @@
+package schedule
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCosineSimilarity(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float32
+		want float64
+	}{
+		{name: "same direction", a: []float32{1, 2, 3}, b: []float32{2, 4, 6}, want: 1},
+		{name: "orthogonal", a: []float32{1, 0}, b: []float32{0, 3}, want: 0},
+		{name: "opposite", a: []float32{1, -1}, b: []float32{-2, 2}, want: -1},
+		{name: "zero vector", a: []float32{0, 0}, b: []float32{1, 1}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cosineSimilarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-6 {
+				t.Errorf("cosineSimilarity() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -8,12 +8,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"oadin/config"
 	"oadin/internal/datastore"
 	"oadin/internal/event"
 	"oadin/internal/types"
@@ -26,12 +28,17 @@ const (
 	ServiceTaskEnqueue ServiceTaskEventType = iota
 	ServiceTaskFailed
 	ServiceTaskDone
+	ServiceTaskFailover // the task goes back to wait to run on the other side
+	ServiceTaskWakeup   // a failover is through its backoff
+	ServiceTaskCancel   // the context of the task is cancelled
+	ServiceTaskInspect  // runs Inspect on the schedule goroutine, e.g. to list the tasks
 )
 
 type ServiceTaskEvent struct {
-	Type  ServiceTaskEventType
-	Task  *ServiceTask
-	Error error // only for ServiceTaskFailed
+	Type    ServiceTaskEventType
+	Task    *ServiceTask
+	Error   error  // only for ServiceTaskFailed
+	Inspect func() // only for ServiceTaskInspect
 }
 
 type ServiceScheduler interface {
@@ -40,13 +47,24 @@ type ServiceScheduler interface {
 	Enqueue(*types.ServiceRequest) (uint64, chan *types.ServiceResult)
 	Start()
 	TaskComplete(*ServiceTask, error)
+	// Tasks lists the waiting and the running tasks
+	Tasks() []types.TaskInfo
+	// Cancel cancels a waiting or running task, false if there is no such task
+	Cancel(id uint64) bool
 }
 
+// BasicServiceScheduler runs the waiting tasks in the order they were
+// enqueued. The max_concurrency and max_queue of the service providers and
+// their circuit breakers still hold, the slots of the policy only if it has any
 type BasicServiceScheduler struct {
 	curID       uint64
 	WaitingList *utils.SafeList
 	RunningList *utils.SafeList
 	ChEvent     chan *ServiceTaskEvent
+	Policy      *SchedulePolicy
+
+	statsMu sync.Mutex
+	stats   map[string]*types.ProviderQueueStats // by provider name
 }
 
 func NewBasicServiceScheduler() *BasicServiceScheduler {
@@ -54,15 +72,22 @@ func NewBasicServiceScheduler() *BasicServiceScheduler {
 		WaitingList: utils.NewSafeList(),
 		RunningList: utils.NewSafeList(),
 		ChEvent:     make(chan *ServiceTaskEvent, 600),
+		Policy:      NewSchedulePolicy(nil),
+		stats:       map[string]*types.ProviderQueueStats{},
 	}
 }
 
 func (ss *BasicServiceScheduler) Enqueue(req *types.ServiceRequest) (uint64, chan *types.ServiceResult) {
 	ch := make(chan *types.ServiceResult, 600)
-	ss.curID += 1
+	id := atomic.AddUint64(&ss.curID, 1) // requests are enqueued from many goroutines
 	// we don't close ch here. It should be closed when the task is done
-	task := &ServiceTask{Request: req, Ch: ch}
-	task.Schedule.Id = ss.curID
+	parent := req.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	task := &ServiceTask{Request: req, Ch: ch, ctx: ctx, cancel: cancel}
+	task.Schedule.Id = id
 	ss.ChEvent <- &ServiceTaskEvent{Type: ServiceTaskEnqueue, Task: task}
 	return task.Schedule.Id, ch
 }
@@ -88,8 +113,16 @@ func (ss *BasicServiceScheduler) Start() {
 				ss.onTaskEnqueue(task)
 			case ServiceTaskDone:
 				ss.onTaskDone(task)
+				ss.recordRun(task)
 			case ServiceTaskFailed:
 				ss.onTaskFailed(task, taskEvent.Error)
+				ss.recordRun(task)
+			case ServiceTaskFailover:
+				ss.onTaskFailover(task, taskEvent.Error)
+			case ServiceTaskCancel:
+				ss.onTaskCancel(task)
+			case ServiceTaskInspect:
+				taskEvent.Inspect()
 			}
 			ss.schedule()
 		}
@@ -100,6 +133,11 @@ func (ss *BasicServiceScheduler) onTaskEnqueue(task *ServiceTask) {
 	slog.Info("[Schedule] Enqueue", "task", task)
 	ss.addToList(task, "waiting")
 	task.Schedule.TimeEnqueue = time.Now()
+	if task.ctx != nil {
+		task.stopCancel = context.AfterFunc(task.ctx, func() {
+			ss.ChEvent <- &ServiceTaskEvent{Type: ServiceTaskCancel, Task: task}
+		})
+	}
 }
 
 func (ss *BasicServiceScheduler) onTaskDone(task *ServiceTask) {
@@ -108,15 +146,40 @@ func (ss *BasicServiceScheduler) onTaskDone(task *ServiceTask) {
 	task.Schedule.TimeComplete = time.Now()
 	close(task.Ch)
 	ss.removeFromList(task)
+	removeSpool(task.Request.SpoolDir)
+	task.release()
 }
 
 func (ss *BasicServiceScheduler) onTaskFailed(task *ServiceTask, err error) {
-	slog.Error("[Service] Task Failed", "error", err.Error(), "since queued",
-		time.Since(task.Schedule.TimeEnqueue), "since run", time.Since(task.Schedule.TimeRun), "task", task)
+	if task.Context().Err() != nil {
+		task.Schedule.Cancelled = true
+		slog.Info("[Service] Task Cancelled", "since queued", time.Since(task.Schedule.TimeEnqueue), "task", task)
+	} else {
+		slog.Error("[Service] Task Failed", "error", err.Error(), "since queued",
+			time.Since(task.Schedule.TimeEnqueue), "since run", time.Since(task.Schedule.TimeRun), "task", task)
+	}
 	task.Error = err
 	task.Schedule.TimeComplete = time.Now()
 	close(task.Ch)
 	ss.removeFromList(task)
+	removeSpool(task.Request.SpoolDir)
+	task.release()
+}
+
+// onTaskCancel a waiting task is dropped at once, a running one is aborted
+// by its context and completes as it returns
+func (ss *BasicServiceScheduler) onTaskCancel(task *ServiceTask) {
+	if !task.Schedule.TimeComplete.IsZero() {
+		return
+	}
+	task.Schedule.Cancelled = true
+	if task.Schedule.IsRunning {
+		slog.Info("[Schedule] Task cancelled, aborting it", "taskid", task.Schedule.Id)
+		return
+	}
+	err := task.Context().Err()
+	task.Ch <- &types.ServiceResult{Type: types.ServiceResultFailed, TaskId: task.Schedule.Id, Error: err}
+	ss.onTaskFailed(task, err)
 }
 
 func (ss *BasicServiceScheduler) addToList(task *ServiceTask, list string) {
@@ -178,7 +241,7 @@ func (ss *BasicServiceScheduler) dispatch(task *ServiceTask) (*types.ServiceTarg
 	model := task.Request.Model
 	if task.Request.HybridPolicy == "always_local" {
 		location = types.ServiceSourceLocal
-	} else if task.Request.HybridPolicy == "always_remote" {
+	} else if task.Request.HybridPolicy == "always_remote" || task.Request.HybridPolicy == types.HybridPolicyRemoteThenLocal {
 		location = types.ServiceSourceRemote
 	} else if task.Request.HybridPolicy == "default" {
 		if model == "" {
@@ -195,6 +258,9 @@ func (ss *BasicServiceScheduler) dispatch(task *ServiceTask) (*types.ServiceTarg
 			}
 		}
 	}
+	if task.Schedule.Location != "" {
+		location = task.Schedule.Location
+	}
 	ds := datastore.GetDefaultDatastore()
 	service := &types.Service{
 		Name: task.Request.Service,
@@ -202,13 +268,29 @@ func (ss *BasicServiceScheduler) dispatch(task *ServiceTask) (*types.ServiceTarg
 
 	err := ds.Get(context.Background(), service)
 	if err != nil {
+		if task.Request.Service == types.ServiceRerank {
+			return &types.ServiceTarget{Location: types.ServiceSourceLocal, EmbedRerank: true}, nil
+		}
 		return nil, fmt.Errorf("service not found: %s", task.Request.Service)
 	}
 
+	if task.Request.HybridPolicy == types.HybridPolicyContextLength && task.Schedule.Location == "" {
+		location = contextLocation(ds, task, service)
+	}
+	if task.Request.HybridPolicy == types.HybridPolicyRace && service.LocalProvider == "" {
+		location = types.ServiceSourceRemote // nothing to race, it runs remote
+	}
+
 	providerName := service.LocalProvider
 	if location == types.ServiceSourceRemote && service.RemoteProvider != "" {
 		providerName = service.RemoteProvider
 	}
+	if task.Request.HybridPolicy == types.HybridPolicyFastest || task.Request.HybridPolicy == types.HybridPolicyCheapest {
+		// any service provider of the service, not only the local and the remote one of it
+		if sp := routeProvider(ds, task); sp != nil {
+			providerName, location = sp.ProviderName, sp.ServiceSource
+		}
+	}
 	if model == "" && task.Request.HybridPolicy == "default" && providerName == "" {
 		if location == types.ServiceSourceLocal {
 			providerName = service.RemoteProvider
@@ -216,6 +298,24 @@ func (ss *BasicServiceScheduler) dispatch(task *ServiceTask) (*types.ServiceTarg
 			providerName = service.LocalProvider
 		}
 	}
+	// a failover or a provider skipped by its breaker runs on the side it didn't ask for
+	switched := task.Schedule.Location != ""
+	if breakers.blocked(providerName) {
+		other, otherSide := service.RemoteProvider, types.ServiceSourceRemote
+		if providerName == service.RemoteProvider {
+			other, otherSide = service.LocalProvider, types.ServiceSourceLocal
+		}
+		pinned := task.Request.HybridPolicy == types.HybridPolicyLocal || task.Request.HybridPolicy == types.HybridPolicyRemote
+		if pinned || other == "" || other == providerName || breakers.blocked(other) {
+			return nil, breakerError(providerName)
+		}
+		slog.Warn("[Schedule] Service provider skipped, its circuit breaker is open", "taskid", task.Schedule.Id,
+			"service_provider", providerName, "instead", other)
+		providerName, location, switched = other, otherSide, true
+	}
+	if task.Request.Service == types.ServiceRerank && needsEmbedRerank(ds, providerName) {
+		return &types.ServiceTarget{Location: types.ServiceSourceLocal, EmbedRerank: true}, nil
+	}
 	sp := &types.ServiceProvider{
 		ProviderName: providerName,
 	}
@@ -228,6 +328,10 @@ func (ss *BasicServiceScheduler) dispatch(task *ServiceTask) (*types.ServiceTarg
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal service provider properties: %v", err)
 	}
+	if model != "" && switched && !hasModel(ds, sp.ProviderName, model) {
+		// the model asked for is on the other side, run the default one of this side
+		model = ""
+	}
 	// Non-query model services do not require model validation
 	if task.Request.Service != types.ServiceModels {
 		if model == "" {
@@ -329,32 +433,46 @@ func (ss *BasicServiceScheduler) dispatch(task *ServiceTask) (*types.ServiceTarg
 
 // this is invoked by schedule goroutine
 func (ss *BasicServiceScheduler) schedule() {
-	// TODO: currently, we run all of the
+	tasks := make([]*ServiceTask, 0, ss.WaitingList.Len())
 	for e := ss.WaitingList.Front(); e != nil; e = e.Next() {
-		task := e.Value.(*ServiceTask)
-		target, err := ss.dispatch(task)
+		tasks = append(tasks, e.Value.(*ServiceTask))
+	}
+	ss.scheduleTasks(tasks)
+}
+
+// start moves the task to the running list and runs it on the target
+func (ss *BasicServiceScheduler) start(task *ServiceTask, target *types.ServiceTarget) {
+	task.Target = target
+	task.dispatched = nil
+	ss.removeFromList(task)
+	ss.addToList(task, "running")
+	task.Schedule.IsRunning = true
+	task.Schedule.TimeRun = time.Now()
+	if target.ServiceProvider != nil {
+		breakers.begin(target.ServiceProvider.ProviderName)
+	}
+	slog.Info("[Schedule] Start to run the task", "taskid", task.Schedule.Id, "service", task.Request.Service,
+		"location", task.Target.Location, "service_provider", task.Target.ServiceProvider)
+	// REALLY run the task
+	go func() {
+		err := task.Run()
+		if target.ServiceProvider != nil && !task.raced {
+			if task.Context().Err() == nil {
+				breakers.record(target.ServiceProvider.ProviderName, err != nil && retryable(err))
+			} else {
+				breakers.end(target.ServiceProvider.ProviderName)
+			}
+		}
+		if err != nil && ss.canFailover(task, err) {
+			ss.ChEvent <- &ServiceTaskEvent{Type: ServiceTaskFailover, Task: task, Error: err}
+			return
+		}
+		// need to send back error to the client
 		if err != nil {
-			task.Ch <- &types.ServiceResult{Type: types.ServiceResultFailed, TaskId: task.Schedule.Id, Error: err}
-			ss.onTaskFailed(task, err)
-			continue
+			task.send(&types.ServiceResult{Type: types.ServiceResultFailed, TaskId: task.Schedule.Id, Error: err})
 		}
-		task.Target = target
-		ss.removeFromList(task)
-		ss.addToList(task, "running")
-		task.Schedule.IsRunning = true
-		task.Schedule.TimeRun = time.Now()
-		slog.Info("[Schedule] Start to run the task", "taskid", task.Schedule.Id, "service", task.Request.Service,
-			"location", task.Target.Location, "service_provider", task.Target.ServiceProvider)
-		// REALLY run the task
-		go func() {
-			err := task.Run()
-			// need to send back error to the client
-			if err != nil {
-				task.Ch <- &types.ServiceResult{Type: types.ServiceResultFailed, TaskId: task.Schedule.Id, Error: err}
-			}
-			ss.TaskComplete(task, err)
-		}()
-	}
+		ss.TaskComplete(task, err)
+	}()
 }
 
 var scheduler ServiceScheduler
@@ -367,6 +485,9 @@ func StartScheduler(s string) {
 	case "basic":
 		scheduler = NewBasicServiceScheduler()
 		scheduler.Start()
+	case "priority":
+		scheduler = NewPriorityServiceScheduler(NewSchedulePolicy(config.GlobalOadinEnvironment))
+		scheduler.Start()
 	default:
 		panic(fmt.Sprintf("Invalid scheduler type: %s", s))
 	}
@@ -382,7 +503,7 @@ func GetScheduler() ServiceScheduler {
 func InvokeService(fromFlavor string, service string, request *http.Request) (uint64, chan *types.ServiceResult, error) {
 	slog.Info("[Service] Invoking Service", "fromFlavor", fromFlavor, "service", service)
 
-	body, err := io.ReadAll(request.Body)
+	body, header, spoolDir, err := readRequestBody(request)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -400,11 +521,6 @@ func InvokeService(fromFlavor string, service string, request *http.Request) (ui
 		slog.Debug("[Service] GET Request Query Params", "params", string(queryParamsJSON))
 
 		body = queryParamsJSON
-	} // TODO: handle the case that the body is not json and not text
-	if request.Method == http.MethodPost &&
-		!strings.Contains(request.Header.Get("Content-Type"), "application/json") &&
-		!strings.Contains(request.Header.Get("Content-Type"), "text/plain") {
-		panic("TO SUPPORT non JSON or non text request")
 	}
 	hybridPolicy := "default"
 	if service != "" {
@@ -423,17 +539,33 @@ func InvokeService(fromFlavor string, service string, request *http.Request) (ui
 	serviceRequest := types.ServiceRequest{
 		FromFlavor:      fromFlavor,
 		Service:         service,
-		Priority:        0,
-		HTTP:            types.HTTPContent{Body: body, Header: request.Header},
+		Priority:        requestPriority(request),
+		HTTP:            types.HTTPContent{Body: body, Header: header},
 		OriginalRequest: request,
+		Context:         request.Context(),
 		HybridPolicy:    hybridPolicy,
+		SpoolDir:        spoolDir,
 	}
 
-	err = json.Unmarshal(body, &serviceRequest)
+	if spoolDir != "" {
+		err = unmarshalForm(body, &serviceRequest)
+	} else {
+		err = json.Unmarshal(body, &serviceRequest)
+	}
 	if err != nil {
-		slog.Error("[Service] Failed to unmarshal POST request", "error", err, "body", string(body))
+		removeSpool(spoolDir)
+		// the body may be a whole audio file or a form of them, it isn't logged
+		slog.Error("[Service] Failed to unmarshal POST request", "error", err,
+			"content_type", header.Get("Content-Type"), "body_length", len(body))
 		return 0, nil, err
 	}
+	if params, ok := endpointParamsFromRequest(request); ok {
+		// parameters carried by the endpoint path take precedence over the body
+		if params.Model != "" {
+			serviceRequest.Model = params.Model
+		}
+		serviceRequest.AskStreamMode = serviceRequest.AskStreamMode || params.Stream
+	}
 
 	taskid, ch := GetScheduler().Enqueue(&serviceRequest)
 
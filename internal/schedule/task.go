@@ -28,12 +28,88 @@ type ServiceTask struct {
 	Ch       chan *types.ServiceResult
 	Error    error
 	Schedule types.ScheduleDetails
+	sent     bool // a result has gone back to the client, the task can't fail over any more
+
+	estimatedTokens int                  // of the prompt, see promptTokens
+	raced           bool                 // run by runRace, which records the breakers itself
+	dispatched      *types.ServiceTarget // where a task waiting for a slot goes, see PriorityServiceScheduler.schedule
+
+	ctx        context.Context
+	cancel     context.CancelFunc
+	stopCancel func() bool // stops the scheduler from watching ctx
+}
+
+// Context the context of the task, cancelled when the client of the request
+// has gone or the task has completed
+func (st *ServiceTask) Context() context.Context {
+	if st.ctx == nil {
+		return context.Background()
+	}
+	return st.ctx
+}
+
+// release stops watching the context of a completed task
+func (st *ServiceTask) release() {
+	if st.stopCancel != nil {
+		st.stopCancel()
+	}
+	if st.cancel != nil {
+		st.cancel()
+	}
 }
 
 func (st *ServiceTask) String() string {
 	return fmt.Sprintf("ServiceTask{Id: %d, Request: %s, Target: %s}", st.Schedule.Id, st.Request, st.Target)
 }
 
+// send sends a result back to the client, telling the service provider it comes from
+func (st *ServiceTask) send(result *types.ServiceResult) {
+	st.sent = true
+	if result.ServiceProvider == "" && st.Target != nil && st.Target.ServiceProvider != nil {
+		result.ServiceProvider = st.Target.ServiceProvider.ProviderName
+	}
+	st.Ch <- result
+}
+
+// streamURL the url of a service provider in stream mode. Where the flavor has
+// a stream_url, it differs from the url at the end, e.g. :generateContent and
+// :streamGenerateContent?alt=sse of gemini, and that end of the url of the
+// provider is swapped, so that a proxy or a url of its own still goes
+func streamURL(providerURL string, info ServiceDefaultInfo) string {
+	if info.RequestStreamUrl == "" {
+		return providerURL
+	}
+	tplPath, _, _ := strings.Cut(info.RequestUrl, "?")
+	streamPath, streamQuery, _ := strings.Cut(info.RequestStreamUrl, "?")
+	i := 0
+	for i < len(tplPath) && i < len(streamPath) && tplPath[i] == streamPath[i] {
+		i++
+	}
+	path, query, _ := strings.Cut(providerURL, "?")
+	if !strings.HasSuffix(path, tplPath[i:]) {
+		slog.Warn("[Service] Url of the service provider doesn't end as the flavor's, it is used in stream mode as is",
+			"url", providerURL, "flavor_url", info.RequestUrl)
+		return providerURL
+	}
+	path = strings.TrimSuffix(path, tplPath[i:]) + streamPath[i:]
+	if streamQuery != "" {
+		values, err := url.ParseQuery(query)
+		streamValues, _ := url.ParseQuery(streamQuery)
+		if err == nil {
+			for k, v := range streamValues {
+				if !values.Has(k) {
+					values[k] = v
+				}
+			}
+			query = values.Encode()
+		}
+	}
+	if query == "" {
+		return path
+	}
+	return path + "?" + query
+}
+
 func NewStreamMode(header http.Header) *types.StreamMode {
 	mode := types.StreamModeNonStream
 	if contentType := header.Get("Content-Type"); contentType != "" {
@@ -48,9 +124,15 @@ func NewStreamMode(header http.Header) *types.StreamMode {
 }
 
 func (st *ServiceTask) Run() error {
+	if st.Target != nil && st.Target.EmbedRerank {
+		return st.runEmbedRerank()
+	}
 	if st.Target == nil || st.Target.ServiceProvider == nil {
 		panic("[Service] ServiceTask is not dispatched before it goes to Run() " + st.String())
 	}
+	if remote := st.raceRemote(); remote != "" {
+		return st.runRace(remote)
+	}
 	if st.Request.Model != "" && st.Target.Model != "" && st.Request.Model != st.Target.Model {
 		slog.Warn("[Service] Model Mismatch", "mode_in_request", st.Request.Model,
 			"model_to_use", st.Target.Model, "service_provider_id", st.Target.ServiceProvider.ProviderName,
@@ -65,6 +147,7 @@ func (st *ServiceTask) Run() error {
 	// ------------------------------------------------------------------
 	ds := datastore.GetDefaultDatastore()
 	sp := &types.ServiceProvider{
+		ProviderName:  st.Target.ServiceProvider.ProviderName, // a service may have more than one of a flavor
 		Flavor:        st.Target.ToFavor,
 		ServiceSource: st.Target.Location,
 		ServiceName:   st.Request.Service,
@@ -87,12 +170,24 @@ func (st *ServiceTask) Run() error {
 
 	conversionNeeded := targetFlavor.Name() != requestFlavor.Name()
 	content := st.Request.HTTP
+	requestCtx := convert.ConvertContext{"stream": st.Target.Stream}
+	if st.Target.Model != "" {
+		requestCtx["model"] = st.Target.Model
+	}
+	if st.Request.SpoolDir != "" {
+		requestCtx[convert.SpoolDirKey] = st.Request.SpoolDir
+	}
+
+	if err := checkImageInput(st, requestFlavor, content, requestCtx); err != nil {
+		return err
+	}
 
 	if conversionNeeded {
 		slog.Info("[Service] Converting Request", "taskid", st.Schedule.Id, "from flavor", requestFlavor.Name(), "to flavor", targetFlavor.Name())
-		requestCtx := convert.ConvertContext{"stream": st.Target.Stream}
-		if st.Target.Model != "" {
-			requestCtx["model"] = st.Target.Model
+		if requestFlavor.Name() != "oadin" {
+			clientRecorder := newFixtureRecorder(requestFlavor.Name(), st.Request.Service, st.Schedule.Id, requestCtx)
+			clientRecorder.request(content)
+			clientRecorder.save()
 		}
 
 		var err error
@@ -103,6 +198,8 @@ func (st *ServiceTask) Run() error {
 			return fmt.Errorf("[Service] Failed to convert request: %s", err.Error())
 		}
 	}
+	recorder := newFixtureRecorder(targetFlavor.Name(), st.Request.Service, st.Schedule.Id, requestCtx)
+	recorder.request(content)
 
 	// ------------------------------------------------------------------
 	// 2. Invoke the service provider and get response
@@ -110,6 +207,11 @@ func (st *ServiceTask) Run() error {
 
 	invokeURL := sp.URL
 	serviceDefaultInfo := GetProviderServiceDefaultInfo(st.Target.ToFavor, st.Request.Service)
+	if st.Target.Stream {
+		invokeURL = streamURL(sp.URL, serviceDefaultInfo)
+	}
+	// some apis (e.g. gemini) carry the model in the url path
+	invokeURL = strings.ReplaceAll(invokeURL, "{model}", url.PathEscape(st.Target.Model))
 	if strings.ToUpper(sp.Method) == "GET" {
 		// the body could be empty,
 		// or it is GET with parameters, but the parameters should have been
@@ -122,7 +224,7 @@ func (st *ServiceTask) Run() error {
 					st.Schedule.Id, "error", err, "body", string(content.Body))
 				return err
 			}
-			u, err := url.Parse(sp.URL)
+			u, err := url.Parse(invokeURL)
 			if err != nil {
 				slog.Error("Error parsing Service Provider's URL", "taskid",
 					st.Schedule.Id, "sp.Url", sp.URL, "error", err)
@@ -143,7 +245,12 @@ func (st *ServiceTask) Run() error {
 		}
 	}
 
-	req, err := http.NewRequest(sp.Method, invokeURL, bytes.NewReader(content.Body))
+	// a form the conversions left as it is goes out as a multipart form
+	content, err = sendableContent(content, st.Request.SpoolDir)
+	if err != nil {
+		return fmt.Errorf("[Service] Failed to read spooled files: %s", err.Error())
+	}
+	req, err := http.NewRequestWithContext(st.Context(), sp.Method, invokeURL, bytes.NewReader(content.Body))
 	if err != nil {
 		return err
 	}
@@ -189,11 +296,12 @@ func (st *ServiceTask) Run() error {
 	}
 	client := &http.Client{Transport: transport}
 	slog.Info("[Service] Request Sending to Service Provider ...", "taskid", st.Schedule.Id, "url", req.URL.String())
+	// the body may be a whole audio file or a form of them, it isn't logged
 	slog.Debug("[Service] Request Sending to Service Provider ...", "taskid", st.Schedule.Id, "method",
-		req.Method, "url", req.URL.String(), "header", fmt.Sprintf("%+v", req.Header), "body", nil)
+		req.Method, "url", req.URL.String(), "header", fmt.Sprintf("%+v", req.Header),
+		"content_type", content.Header.Get("Content-Type"), "body_length", len(content.Body))
 	event.SysEvents.NotifyHTTPRequest("invoke_service_provider", req.Method, req.URL.String(), content.Header, nil)
-	fmt.Println("[Service] Request Sending to Service Provider ...", "taskid", st.Schedule.Id, "method",
-		req.Method, "url", req.URL.String(), "header", fmt.Sprintf("%+v", req.Header), "body", string(content.Body))
+	timing := &runTiming{start: time.Now()}
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -281,7 +389,7 @@ func (st *ServiceTask) Run() error {
 		taskId := submitRespData.Output.TaskId
 		for {
 			GetResultURL := fmt.Sprintf("%s/%s", serviceDefaultInfo.RequestExtraUrl, taskId)
-			GetTaskReq, err := http.NewRequest("GET", GetResultURL, nil)
+			GetTaskReq, err := http.NewRequestWithContext(st.Context(), "GET", GetResultURL, nil)
 			if err != nil {
 				return err
 			}
@@ -329,7 +437,11 @@ func (st *ServiceTask) Run() error {
 				resp.Body = readCloser
 				break
 			}
-			time.Sleep(500 * time.Millisecond)
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-st.Context().Done():
+				return st.Context().Err()
+			}
 		}
 
 	}
@@ -357,6 +469,13 @@ func (st *ServiceTask) Run() error {
 		event.SysEvents.NotifyHTTPResponse("service_provider_response", resp.StatusCode, resp.Header, nil)
 
 		content = types.HTTPContent{Body: body, Header: resp.Header.Clone()}
+		recorder.response(content)
+		recorder.save()
+		usage := &tokenUsage{}
+		usage.observe(body)
+		timing.firstToken()
+		tokenStats.record(st, usage)
+		latencies.record(st, timing, usage)
 
 		if conversionNeeded {
 			content, err = ConvertBetweenFlavors(targetFlavor, requestFlavor, st.Request.Service, "response", content, respConvertCtx)
@@ -367,17 +486,56 @@ func (st *ServiceTask) Run() error {
 			}
 		}
 
-		st.Ch <- &types.ServiceResult{
+		st.send(&types.ServiceResult{
 			Type: types.ServiceResultDone, TaskId: st.Schedule.Id,
 			StatusCode: resp.StatusCode,
 			HTTP:       content,
-		}
+		})
 	} else {
 		isFirstTrunk := true
+		usage := &tokenUsage{} // the last chunks carry it, if the provider reports it
 		reader := bufio.NewReader(resp.Body)
 		prolog := requestFlavor.GetStreamResponseProlog(st.Request.Service)
 		epilog := requestFlavor.GetStreamResponseEpilog(st.Request.Service)
 		var sendBackConvertedStreamMode *types.StreamMode // only used if need conversion
+		var conversion *StreamConversion
+		if conversionNeeded {
+			conversion, err = NewStreamConversion(targetFlavor, requestFlavor, st.Request.Service, respConvertCtx)
+			if err != nil {
+				slog.Error("[Service] Stream: Failed to create stream conversion", "taskid", st.Schedule.Id, "error", err.Error())
+				return err
+			}
+		}
+		// sendConverted sends back a converted chunk, the prolog goes before the first one
+		sendConverted := func(content types.HTTPContent) {
+			// target stream mode maybe changed from service provider's
+			if sendBackConvertedStreamMode == nil {
+				sendBackConvertedStreamMode = NewStreamMode(content.Header) // got a most valid header to send back
+			}
+			if isFirstTrunk { // send Wrapped prolog
+				if len(prolog) > 0 {
+					slog.Info("[Service] Stream: Send Prolog", "taskid", st.Schedule.Id, "prolog", prolog)
+				}
+				for _, v := range prolog {
+					st.send(&types.ServiceResult{
+						Type: types.ServiceResultChunk, TaskId: st.Schedule.Id,
+						Error:      nil,
+						StatusCode: 200,
+						HTTP: types.HTTPContent{
+							Body:   sendBackConvertedStreamMode.WrapChunk([]byte(v)),
+							Header: sendBackConvertedStreamMode.Header,
+						},
+					})
+				} // end for prolog
+				isFirstTrunk = false
+			} // end first trunk
+			content.Body = sendBackConvertedStreamMode.WrapChunk(content.Body)
+			st.send(&types.ServiceResult{
+				Type: types.ServiceResultChunk, TaskId: st.Schedule.Id,
+				StatusCode: resp.StatusCode,
+				HTTP:       content,
+			})
+		}
 		for {
 			chunk, readChunkErr := respStreamMode.ReadChunk(reader)
 			if readChunkErr != nil && readChunkErr != io.EOF { // real error
@@ -396,81 +554,90 @@ func (st *ServiceTask) Run() error {
 			chunkStr := strings.TrimPrefix(string(chunk), "data:")
 			chunk = []byte(chunkStr)
 			content = types.HTTPContent{Body: chunk, Header: resp.Header.Clone()}
-			var convertErr error
-			if conversionNeeded { // need convert response
-				content.Body = respStreamMode.UnwrapChunk(content.Body)
-				// drop empty content
-				if len(bytes.TrimSpace(chunk)) == 0 {
-					convertErr = &types.DropAction{}
-					slog.Warn("[Service] Stream: Received Empty Content from Service Provider - Drop it", "taskid", st.Schedule.Id, "content", content)
-				} else {
-					if isFirstTrunk {
-						slog.Info("[Service] Stream: Convert Many Stream Response ...", "taskid", st.Schedule.Id, "from flavor", targetFlavor.Name(), "to flavor", requestFlavor.Name())
-					}
-					content, convertErr = ConvertBetweenFlavors(targetFlavor, requestFlavor, st.Request.Service, "stream_response", content, respConvertCtx)
-					if convertErr != nil && !types.IsDropAction(convertErr) {
-						slog.Error("[Service] Failed to convert response", "taskid", st.Schedule.Id, "from flavor", targetFlavor.Name(),
-							"to flavor", requestFlavor.Name(), "error", err, "content", content)
-						return fmt.Errorf("[Service] Failed to convert response: %s", convertErr.Error())
-					}
-				}
-				if convertErr == nil { // not drop etc.
-					// target stream mode maybe changed from service provider's
-					if sendBackConvertedStreamMode == nil {
-						sendBackConvertedStreamMode = NewStreamMode(content.Header) // got a most valid header to send back
-					}
-					content.Body = sendBackConvertedStreamMode.WrapChunk(content.Body)
-					if isFirstTrunk { // send Wrapped prolog
-						if len(prolog) > 0 {
-							slog.Info("[Service] Stream: Send Prolog", "taskid", st.Schedule.Id, "prolog", prolog)
-						}
-						for i := len(prolog) - 1; i >= 0; i-- {
-							st.Ch <- &types.ServiceResult{
-								Type: types.ServiceResultChunk, TaskId: st.Schedule.Id,
-								Error:      nil,
-								StatusCode: 200,
-								HTTP: types.HTTPContent{
-									Body:   sendBackConvertedStreamMode.WrapChunk([]byte(prolog[i])),
-									Header: sendBackConvertedStreamMode.Header,
-								},
-							}
-						} // end for prolog
-					} // end first trunk
-				} // end conversion succeed
-			} // end conversion
-			isFirstTrunk = false
-
+			unwrapped := respStreamMode.UnwrapChunk(chunk)
+			recorder.chunk(unwrapped)
+			usage.observe(unwrapped)
+			if len(bytes.TrimSpace(unwrapped)) > 0 {
+				timing.firstToken()
+			}
 			if readChunkErr == io.EOF {
-				if conversionNeeded {
-					if len(epilog) > 0 {
-						slog.Info("[Service] Stream: Send Epilog", "taskid", st.Schedule.Id, "epilog", epilog)
-					}
-					for _, v := range epilog {
-						st.Ch <- &types.ServiceResult{
-							Type: types.ServiceResultChunk, TaskId: st.Schedule.Id,
-							Error:      nil,
-							StatusCode: 200,
-							HTTP: types.HTTPContent{
-								Body:   sendBackConvertedStreamMode.WrapChunk([]byte(v)),
-								Header: sendBackConvertedStreamMode.Header,
-							},
-						}
-					} // end for epilog
-				} // end conversion
-				st.Ch <- &types.ServiceResult{
-					Type: types.ServiceResultDone, TaskId: st.Schedule.Id,
-					Error:      convertErr, // send back add / drop action etc.
+				recorder.save()
+				tokenStats.record(st, usage)
+				latencies.record(st, timing, usage)
+			}
+
+			if !conversionNeeded {
+				resultType := types.ServiceResultChunk
+				if readChunkErr == io.EOF {
+					resultType = types.ServiceResultDone
+				}
+				st.send(&types.ServiceResult{
+					Type: resultType, TaskId: st.Schedule.Id,
 					StatusCode: resp.StatusCode,
 					HTTP:       content,
+				})
+				if readChunkErr == io.EOF {
+					return nil
 				}
-				return nil
+				continue
+			}
+
+			// a chunk may be converted to no chunk, one or many
+			var converted []types.HTTPContent
+			content.Body = respStreamMode.UnwrapChunk(content.Body)
+			// drop empty content
+			if len(bytes.TrimSpace(chunk)) == 0 {
+				slog.Warn("[Service] Stream: Received Empty Content from Service Provider - Drop it", "taskid", st.Schedule.Id, "content", content)
 			} else {
-				st.Ch <- &types.ServiceResult{
-					Type: types.ServiceResultChunk, TaskId: st.Schedule.Id,
-					Error:      convertErr, // send back add / drop action etc.
-					StatusCode: resp.StatusCode,
-					HTTP:       content,
+				if isFirstTrunk {
+					slog.Info("[Service] Stream: Convert Many Stream Response ...", "taskid", st.Schedule.Id, "from flavor", targetFlavor.Name(), "to flavor", requestFlavor.Name())
 				}
+				converted, err = conversion.Convert(content)
+				if err != nil {
+					slog.Error("[Service] Failed to convert response", "taskid", st.Schedule.Id, "from flavor", targetFlavor.Name(),
+						"to flavor", requestFlavor.Name(), "error", err, "content", content)
+					return fmt.Errorf("[Service] Failed to convert response: %s", err.Error())
+				}
+			}
+			if readChunkErr == io.EOF {
+				// converters may still hold something when the stream ends
+				flushed, err := conversion.Flush()
+				if err != nil {
+					slog.Error("[Service] Failed to flush converted response", "taskid", st.Schedule.Id, "from flavor", targetFlavor.Name(),
+						"to flavor", requestFlavor.Name(), "error", err)
+					return fmt.Errorf("[Service] Failed to convert response: %s", err.Error())
+				}
+				converted = append(converted, flushed...)
+			}
+			for _, c := range converted {
+				sendConverted(c)
+			}
+
+			if readChunkErr == io.EOF {
+				if sendBackConvertedStreamMode == nil { // nothing was sent back
+					sendBackConvertedStreamMode = NewStreamMode(resp.Header)
+				}
+				if len(epilog) > 0 {
+					slog.Info("[Service] Stream: Send Epilog", "taskid", st.Schedule.Id, "epilog", epilog)
+				}
+				for _, v := range epilog {
+					st.send(&types.ServiceResult{
+						Type: types.ServiceResultChunk, TaskId: st.Schedule.Id,
+						Error:      nil,
+						StatusCode: 200,
+						HTTP: types.HTTPContent{
+							Body:   sendBackConvertedStreamMode.WrapChunk([]byte(v)),
+							Header: sendBackConvertedStreamMode.Header,
+						},
+					})
+				} // end for epilog
+				// every converted chunk has been sent, the end of the stream has nothing more
+				st.send(&types.ServiceResult{
+					Type: types.ServiceResultDone, TaskId: st.Schedule.Id,
+					StatusCode: resp.StatusCode,
+					HTTP:       types.HTTPContent{Header: sendBackConvertedStreamMode.Header},
+				})
+				return nil
 			}
 		}
 	}
@@ -0,0 +1,28 @@
+package schedule
+
+import "testing"
+
+func TestStreamURL(t *testing.T) {
+	gemini := ServiceDefaultInfo{
+		RequestUrl:       "https://generativelanguage.googleapis.com/v1beta/models/{model}:generateContent",
+		RequestStreamUrl: "https://generativelanguage.googleapis.com/v1beta/models/{model}:streamGenerateContent?alt=sse",
+	}
+	tests := []struct {
+		name, url, want string
+	}{
+		{"default", gemini.RequestUrl, gemini.RequestStreamUrl},
+		{"proxy", "https://proxy.example.com/gemini/v1beta/models/{model}:generateContent?key=k",
+			"https://proxy.example.com/gemini/v1beta/models/{model}:streamGenerateContent?alt=sse&key=k"},
+		{"model in url", "http://10.0.0.2:8080/v1beta/models/gemini-2.0-flash:generateContent",
+			"http://10.0.0.2:8080/v1beta/models/gemini-2.0-flash:streamGenerateContent?alt=sse"},
+		{"unknown", "https://proxy.example.com/chat", "https://proxy.example.com/chat"},
+	}
+	for _, tt := range tests {
+		if got := streamURL(tt.url, gemini); got != tt.want {
+			t.Errorf("streamURL(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	if got := streamURL("http://127.0.0.1:11434/api/chat", ServiceDefaultInfo{RequestUrl: "http://127.0.0.1:11434/api/chat"}); got != "http://127.0.0.1:11434/api/chat" {
+		t.Errorf("streamURL without stream_url = %s", got)
+	}
+}
@@ -0,0 +1,84 @@
+package schedule
+
+import (
+	"log/slog"
+
+	"oadin/internal/types"
+	"oadin/internal/utils"
+)
+
+// inspect runs f on the schedule goroutine, which owns the lists and the tasks
+func (ss *BasicServiceScheduler) inspect(f func()) {
+	done := make(chan struct{})
+	ss.ChEvent <- &ServiceTaskEvent{Type: ServiceTaskInspect, Inspect: func() {
+		f()
+		close(done)
+	}}
+	<-done
+}
+
+func (ss *BasicServiceScheduler) Tasks() []types.TaskInfo {
+	var tasks []types.TaskInfo
+	ss.inspect(func() {
+		tasks = make([]types.TaskInfo, 0, ss.RunningList.Len()+ss.WaitingList.Len())
+		for e := ss.RunningList.Front(); e != nil; e = e.Next() {
+			tasks = append(tasks, e.Value.(*ServiceTask).info())
+		}
+		for e := ss.WaitingList.Front(); e != nil; e = e.Next() {
+			tasks = append(tasks, e.Value.(*ServiceTask).info())
+		}
+	})
+	return tasks
+}
+
+func (ss *BasicServiceScheduler) Cancel(id uint64) bool {
+	var task *ServiceTask
+	ss.inspect(func() {
+		for _, list := range []*utils.SafeList{ss.RunningList, ss.WaitingList} {
+			for e := list.Front(); e != nil && task == nil; e = e.Next() {
+				if t := e.Value.(*ServiceTask); t.Schedule.Id == id {
+					task = t
+				}
+			}
+		}
+	})
+	if task == nil {
+		return false
+	}
+	slog.Info("[Schedule] Cancel the task on request", "taskid", id)
+	// the scheduler sees the context cancelled as if the client had gone
+	task.cancel()
+	return true
+}
+
+func (st *ServiceTask) info() types.TaskInfo {
+	info := types.TaskInfo{
+		ID:         st.Schedule.Id,
+		Service:    st.Request.Service,
+		Flavor:     st.Request.FromFlavor,
+		Model:      st.Request.Model,
+		State:      types.TaskStateWaiting,
+		Priority:   st.Request.Priority,
+		Stream:     st.Request.AskStreamMode,
+		Attempts:   st.Schedule.Attempts,
+		Cancelled:  st.Schedule.Cancelled,
+		EnqueuedAt: st.Schedule.TimeEnqueue,
+	}
+	if st.Request.OriginalRequest != nil {
+		info.UserAgent = st.Request.OriginalRequest.UserAgent()
+	}
+	if st.Schedule.IsRunning && st.Target != nil {
+		info.State = types.TaskStateRunning
+		startedAt := st.Schedule.TimeRun
+		info.StartedAt = &startedAt
+		info.Location = st.Target.Location
+		info.Stream = st.Target.Stream
+		if st.Target.Model != "" {
+			info.Model = st.Target.Model
+		}
+		if st.Target.ServiceProvider != nil {
+			info.ServiceProvider = st.Target.ServiceProvider.ProviderName
+		}
+	}
+	return info
+}
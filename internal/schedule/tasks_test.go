@@ -0,0 +1,49 @@
+package schedule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"oadin/internal/types"
+)
+
+func TestTasksAndCancel(t *testing.T) {
+	ps := NewPriorityServiceScheduler(NewSchedulePolicy(nil))
+	newTask := func(id uint64) *ServiceTask {
+		ctx, cancel := context.WithCancel(context.Background())
+		task := &ServiceTask{Request: &types.ServiceRequest{Service: types.ServiceChat, FromFlavor: types.FlavorOpenAI, Model: "qwen3"}, ctx: ctx, cancel: cancel}
+		task.Schedule.Id = id
+		task.Schedule.TimeEnqueue = time.Now()
+		return task
+	}
+	running := newTask(1)
+	running.Target = &types.ServiceTarget{Location: types.ServiceSourceLocal, Model: "qwen3:8b", Stream: true,
+		ServiceProvider: &types.ServiceProvider{ProviderName: "local_ollama_chat"}}
+	running.Schedule.IsRunning = true
+	running.Schedule.TimeRun = time.Now()
+	ps.addToList(running, "running")
+	waiting := newTask(2)
+	waiting.Schedule.NotBefore = time.Now().Add(time.Hour) // kept out of dispatch
+	ps.addToList(waiting, "waiting")
+	ps.Start()
+
+	tasks := ps.Tasks()
+	if len(tasks) != 2 {
+		t.Fatalf("tasks = %+v", tasks)
+	}
+	if got := tasks[0]; got.ID != 1 || got.State != types.TaskStateRunning || got.ServiceProvider != "local_ollama_chat" ||
+		got.Model != "qwen3:8b" || !got.Stream || got.StartedAt == nil {
+		t.Errorf("running task = %+v", got)
+	}
+	if got := tasks[1]; got.ID != 2 || got.State != types.TaskStateWaiting || got.ServiceProvider != "" || got.StartedAt != nil {
+		t.Errorf("waiting task = %+v", got)
+	}
+
+	if ps.Cancel(3) {
+		t.Error("cancelled a task that doesn't exist")
+	}
+	if !ps.Cancel(1) || running.Context().Err() == nil {
+		t.Error("running task not cancelled")
+	}
+}
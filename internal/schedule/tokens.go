@@ -0,0 +1,269 @@
+package schedule
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+
+	"oadin/config"
+	"oadin/internal/datastore"
+	"oadin/internal/types"
+)
+
+// tokenFamily how many characters a token of a model family takes, roughly.
+// Text in CJK scripts is counted by the character, the rest by the byte
+type tokenFamily struct {
+	prefixes      []string
+	bytesPerToken float64
+	tokensPerCJK  float64
+}
+
+var tokenFamilies = []tokenFamily{
+	{[]string{"qwen", "qwq"}, 3.8, 0.7},
+	{[]string{"deepseek"}, 3.8, 0.6},
+	{[]string{"glm", "chatglm"}, 4.0, 0.7},
+	{[]string{"yi"}, 3.8, 0.7},
+	{[]string{"llama", "codellama"}, 3.6, 1.0},
+	{[]string{"mistral", "mixtral"}, 3.4, 1.3},
+	{[]string{"gemma", "gemini"}, 4.0, 0.9},
+	{[]string{"phi"}, 3.6, 1.2},
+	{[]string{"gpt", "o1", "o3", "o4", "text-embedding"}, 4.0, 0.9},
+	{[]string{"claude"}, 3.5, 1.1},
+}
+
+var defaultTokenFamily = tokenFamily{bytesPerToken: 3.6, tokensPerCJK: 1.0}
+
+// tokensPerMessage what the chat template adds around each message
+const tokensPerMessage = 4
+
+func familyOf(model string) tokenFamily {
+	model = strings.ToLower(model)
+	if i := strings.LastIndex(model, "/"); i >= 0 {
+		model = model[i+1:]
+	}
+	for _, f := range tokenFamilies {
+		for _, prefix := range f.prefixes {
+			if strings.HasPrefix(model, prefix) {
+				return f
+			}
+		}
+	}
+	return defaultTokenFamily
+}
+
+// promptSkipKeys the fields of a request that aren't part of the prompt
+var promptSkipKeys = map[string]bool{
+	"model": true, "role": true, "type": true, "id": true, "tool_call_id": true, "name": true,
+	"images": true, "image_url": true, "image": true, "input_image": true, "inline_data": true,
+	"inlineData": true, "source": true, "url": true, "format": true, "stop": true,
+	"hybrid_policy": true, "remote_service_provider": true, "keep_alive": true,
+}
+
+// promptText collects the text of the prompt out of a request body of any
+// flavor, and the messages it has
+func promptText(body []byte) (string, int) {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return "", 0
+	}
+	var sb strings.Builder
+	messages := 0
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case string:
+			sb.WriteString(v)
+			sb.WriteByte('\n')
+		case []any:
+			for _, e := range v {
+				walk(e)
+			}
+		case map[string]any:
+			if _, ok := v["role"]; ok {
+				messages++
+			}
+			for k, e := range v {
+				if !promptSkipKeys[k] {
+					walk(e)
+				}
+			}
+		}
+	}
+	walk(v)
+	return sb.String(), messages
+}
+
+// estimateTokens estimates the tokens of the prompt in a request body for a
+// model. It doesn't run the tokenizer of the model, the providers report the
+// actual count once the request has run
+func estimateTokens(model string, body []byte) int {
+	text, messages := promptText(body)
+	if text == "" {
+		return 0
+	}
+	f := familyOf(model)
+	cjk, other := 0, 0
+	for _, r := range text {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			cjk++
+		} else {
+			other += len(string(r))
+		}
+	}
+	estimate := float64(cjk)*f.tokensPerCJK + float64(other)/f.bytesPerToken + float64(messages*tokensPerMessage)
+	return int(math.Ceil(estimate))
+}
+
+// contextLocation where the context_length policy runs a request. It stays
+// local unless the prompt is over the context window of the local provider or
+// over the threshold, and there is a remote provider to go to
+func contextLocation(ds datastore.Datastore, task *ServiceTask, service *types.Service) string {
+	if service.LocalProvider == "" {
+		return types.ServiceSourceRemote
+	}
+	window := 0
+	sp := &types.ServiceProvider{ProviderName: service.LocalProvider}
+	if err := ds.Get(context.Background(), sp); err == nil {
+		properties := &types.ServiceProviderProperties{}
+		if json.Unmarshal([]byte(sp.Properties), properties) == nil {
+			window = properties.MaxInputTokens
+		}
+	}
+	threshold := 0
+	if env := config.GlobalOadinEnvironment; env != nil {
+		threshold = env.ContextThreshold
+	}
+	if window <= 0 && threshold <= 0 {
+		return types.ServiceSourceLocal
+	}
+	tokens := task.promptTokens()
+	if (window <= 0 || tokens <= window) && (threshold <= 0 || tokens <= threshold) {
+		return types.ServiceSourceLocal
+	}
+	if service.RemoteProvider == "" {
+		slog.Warn("[Schedule] Prompt is over the context of the local provider, but there is no remote one", "taskid", task.Schedule.Id,
+			"estimated_tokens", tokens, "max_input_tokens", window, "threshold", threshold)
+		return types.ServiceSourceLocal
+	}
+	slog.Info("[Schedule] Prompt is over the context of the local provider, goes remote", "taskid", task.Schedule.Id,
+		"estimated_tokens", tokens, "max_input_tokens", window, "threshold", threshold)
+	return types.ServiceSourceRemote
+}
+
+// promptTokens the estimated tokens of the prompt of the task, estimated once,
+// by dispatch under the context_length policy or else once the task has run
+func (st *ServiceTask) promptTokens() int {
+	if st.estimatedTokens == 0 && len(st.Request.HTTP.Body) > 0 && st.Request.SpoolDir == "" {
+		st.estimatedTokens = max(1, estimateTokens(st.Request.Model, st.Request.HTTP.Body))
+	}
+	return st.estimatedTokens
+}
+
+// usageKeys the fields the flavors report the tokens of the prompt and of the
+// completion in
+var (
+	promptUsageKeys     = []string{"prompt_tokens", "input_tokens", "prompt_eval_count", "promptTokenCount"}
+	completionUsageKeys = []string{"completion_tokens", "output_tokens", "eval_count", "candidatesTokenCount"}
+)
+
+// tokenUsage the usage a service provider reports in its response, the last
+// one seen of a stream
+type tokenUsage struct {
+	prompt     int
+	completion int
+}
+
+func (u *tokenUsage) observe(body []byte) {
+	if !bytes.Contains(body, []byte("_count")) && !bytes.Contains(body, []byte("tokens")) && !bytes.Contains(body, []byte("TokenCount")) {
+		return
+	}
+	var v any
+	if json.Unmarshal(body, &v) != nil {
+		return
+	}
+	if n := findCount(v, promptUsageKeys); n > 0 {
+		u.prompt = n
+	}
+	if n := findCount(v, completionUsageKeys); n > 0 {
+		u.completion = n
+	}
+}
+
+// findCount the first number found under one of the keys, at any depth
+func findCount(v any, keys []string) int {
+	switch v := v.(type) {
+	case map[string]any:
+		for _, k := range keys {
+			if n, ok := v[k].(float64); ok {
+				return int(n)
+			}
+		}
+		for _, e := range v {
+			if n := findCount(e, keys); n > 0 {
+				return n
+			}
+		}
+	case []any:
+		for _, e := range v {
+			if n := findCount(e, keys); n > 0 {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// tokenStatsSet the estimated and the actual usage of the service providers
+type tokenStatsSet struct {
+	mu        sync.Mutex
+	providers map[string]*types.ProviderTokenUsage
+}
+
+var tokenStats = &tokenStatsSet{providers: map[string]*types.ProviderTokenUsage{}}
+
+// record the usage of a task that ran to the end on a provider
+func (ts *tokenStatsSet) record(task *ServiceTask, usage *tokenUsage) {
+	if task.Target == nil || task.Target.ServiceProvider == nil || usage.prompt == 0 {
+		return
+	}
+	task.promptTokens()
+	provider := task.Target.ServiceProvider.ProviderName
+	slog.Info("[Service] Token usage", "taskid", task.Schedule.Id, "service_provider", provider, "model", task.Target.Model,
+		"estimated_prompt_tokens", task.estimatedTokens, "prompt_tokens", usage.prompt, "completion_tokens", usage.completion)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	stats, ok := ts.providers[provider]
+	if !ok {
+		stats = &types.ProviderTokenUsage{}
+		ts.providers[provider] = stats
+	}
+	stats.Requests++
+	stats.PromptTokens += int64(usage.prompt)
+	stats.CompletionTokens += int64(usage.completion)
+	properties := &types.ServiceProviderProperties{}
+	if json.Unmarshal([]byte(task.Target.ServiceProvider.Properties), properties) == nil {
+		stats.Cost += properties.Cost(task.Target.Model, usage.prompt, usage.completion)
+	}
+	if task.estimatedTokens > 0 && usage.prompt > 0 {
+		stats.Estimated++
+		stats.EstimatedPromptTokens += int64(task.estimatedTokens)
+		stats.EstimatedActualTokens += int64(usage.prompt)
+	}
+}
+
+// TokenUsage the estimated and the actual usage of each service provider, by
+// provider name
+func TokenUsage() map[string]types.ProviderTokenUsage {
+	tokenStats.mu.Lock()
+	defer tokenStats.mu.Unlock()
+	usage := make(map[string]types.ProviderTokenUsage, len(tokenStats.providers))
+	for provider, u := range tokenStats.providers {
+		usage[provider] = *u
+	}
+	return usage
+}
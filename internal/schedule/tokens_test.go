@@ -0,0 +1,41 @@
+package schedule
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	english := `{"model":"qwen2.5:7b","messages":[{"role":"user","content":"` + strings.Repeat("hello world ", 100) + `"}]}`
+	if got := estimateTokens("qwen2.5:7b", []byte(english)); got < 250 || got > 400 {
+		t.Errorf("estimateTokens(english) = %d, want about 300", got)
+	}
+	chinese := `{"model":"deepseek-r1","prompt":"` + strings.Repeat("你好世界", 100) + `"}`
+	if got := estimateTokens("deepseek-r1", []byte(chinese)); got < 200 || got > 300 {
+		t.Errorf("estimateTokens(chinese) = %d, want about 240", got)
+	}
+	if got := estimateTokens("qwen2.5:7b", []byte(`{"model":"qwen2.5:7b","images":["`+strings.Repeat("A", 4000)+`"]}`)); got != 0 {
+		t.Errorf("estimateTokens(images) = %d, want 0", got)
+	}
+}
+
+func TestTokenUsageObserve(t *testing.T) {
+	tests := []struct {
+		name               string
+		body               string
+		prompt, completion int
+	}{
+		{"openai", `{"choices":[],"usage":{"prompt_tokens":12,"completion_tokens":34,"total_tokens":46}}`, 12, 34},
+		{"ollama", `{"model":"qwen2.5","done":true,"prompt_eval_count":7,"eval_count":9}`, 7, 9},
+		{"anthropic", `{"type":"message_start","message":{"usage":{"input_tokens":5,"output_tokens":1}}}`, 5, 1},
+		{"gemini", `{"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":4}}`, 3, 4},
+		{"no usage", `{"choices":[{"delta":{"content":"hi"}}]}`, 0, 0},
+	}
+	for _, tt := range tests {
+		usage := &tokenUsage{}
+		usage.observe([]byte(tt.body))
+		if usage.prompt != tt.prompt || usage.completion != tt.completion {
+			t.Errorf("observe(%s) = %d/%d, want %d/%d", tt.name, usage.prompt, usage.completion, tt.prompt, tt.completion)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package schedule
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"oadin/config"
+	"oadin/internal/convert"
+	"oadin/internal/event"
+	"oadin/internal/types"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the conversion tests")
+
+var initFlavorsOnce sync.Once
+
+func initTestFlavors(t *testing.T) {
+	t.Helper()
+	initFlavorsOnce.Do(func() {
+		if config.GlobalOadinEnvironment == nil {
+			config.GlobalOadinEnvironment = &config.OadinEnvironment{RootDir: os.TempDir()}
+		}
+		event.InitSysEvents()
+		if err := InitAPIFlavors(); err != nil {
+			t.Fatalf("InitAPIFlavors() error = %v", err)
+		}
+	})
+}
+
+// toolCallFlavors chat flavors which support function calling, and the format
+// of their fixtures in testdata/tool_calls
+var toolCallFlavors = map[string]string{
+	"openai":   "openai",
+	"deepseek": "openai",
+	"aliyun":   "openai",
+	"tencent":  "openai",
+	"ollama":   "ollama",
+}
+
+// TestConvertToolCalls converts the function calling fixtures between every pair
+// of flavors, checks nothing of the tool calls is lost on the way and compares
+// the result with the golden files. Run with -update to regenerate them
+func TestConvertToolCalls(t *testing.T) {
+	initTestFlavors(t)
+	names := make([]string, 0, len(toolCallFlavors))
+	for name := range toolCallFlavors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, from := range names {
+		for _, to := range names {
+			if from == to {
+				continue
+			}
+			for _, conv := range []string{"request", "response", "stream_response"} {
+				t.Run(fmt.Sprintf("%s_to_%s/%s", from, to, conv), func(t *testing.T) {
+					fixture := filepath.Join("testdata", "tool_calls", toolCallFlavors[from], conv)
+					var input [][]byte
+					if conv == "stream_response" {
+						input = readLines(t, fixture+".jsonl")
+					} else {
+						input = [][]byte{readFile(t, fixture+".json")}
+					}
+					output := convertChunks(t, from, to, conv, input)
+
+					// the other way round must give back the same tool calls
+					back := convertChunks(t, to, from, conv, output)
+					want := toolCallsOf(t, toolCallFlavors[from], conv, input)
+					if got := toolCallsOf(t, toolCallFlavors[to], conv, output); !reflect.DeepEqual(got, want) {
+						t.Errorf("converted tool calls = %s, want %s", got, want)
+					}
+					if got := toolCallsOf(t, toolCallFlavors[from], conv, back); !reflect.DeepEqual(got, want) {
+						t.Errorf("tool calls converted back = %s, want %s", got, want)
+					}
+
+					golden := filepath.Join("testdata", "tool_calls", "golden", fmt.Sprintf("%s_to_%s.%s.json", from, to, conv))
+					compareGolden(t, golden, output)
+				})
+			}
+		}
+	}
+}
+
+func convertChunks(t *testing.T, from, to, conv string, chunks [][]byte) [][]byte {
+	t.Helper()
+	fromFlavor, err := GetAPIFlavor(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toFlavor, err := GetAPIFlavor(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := convert.ConvertContext{"model": "test-model", "stream": conv == "stream_response", "id": "test"}
+	output, err := convertContents(fromFlavor, toFlavor, types.ServiceChat, conv, chunks, ctx)
+	if err != nil {
+		t.Fatalf("converting %s from %s to %s: %v", conv, from, to, err)
+	}
+	return output
+}
+
+// convertContents converts a request or a response, which is chunks[0], or the
+// chunks of a stream response the way a ServiceTask does
+func convertContents(from, to APIFlavor, service, conv string, chunks [][]byte, ctx convert.ConvertContext) ([][]byte, error) {
+	var output [][]byte
+	if conv != "stream_response" {
+		content := types.HTTPContent{Body: chunks[0], Header: http.Header{"Content-Type": []string{"application/json"}}}
+		content, err := ConvertBetweenFlavors(from, to, service, conv, content, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return append(output, content.Body), nil
+	}
+
+	conversion, err := NewStreamConversion(from, to, service, ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		content := types.HTTPContent{Body: chunk, Header: http.Header{"Content-Type": []string{"application/json"}}}
+		converted, err := conversion.Convert(content)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %s: %w", chunk, err)
+		}
+		for _, c := range converted {
+			output = append(output, c.Body)
+		}
+	}
+	flushed, err := conversion.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("flush: %w", err)
+	}
+	for _, c := range flushed {
+		output = append(output, c.Body)
+	}
+	return output, nil
+}
+
+// toolCall a tool call with what a model needs to know about it, ids only link
+// calls and results so they are left out
+type toolCall struct {
+	Name      string
+	Arguments any
+}
+
+type toolCallMessage struct {
+	Role    string
+	Calls   []toolCall
+	Answers string // the name of the function whose result a tool message carries
+}
+
+type toolCallSummary struct {
+	Tools        any
+	Messages     []toolCallMessage
+	FinishReason string
+}
+
+func (s toolCallSummary) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// toolCallsOf sums up the function calling in a request, a response or the
+// chunks of a stream response in the given format
+func toolCallsOf(t *testing.T, format, conv string, chunks [][]byte) toolCallSummary {
+	t.Helper()
+	var summary toolCallSummary
+	switch conv {
+	case "request":
+		var request struct {
+			Tools    any `json:"tools"`
+			Messages []struct {
+				Role       string           `json:"role"`
+				ToolCalls  []map[string]any `json:"tool_calls"`
+				ToolCallID string           `json:"tool_call_id"`
+				ToolName   string           `json:"tool_name"`
+			} `json:"messages"`
+		}
+		unmarshal(t, chunks[0], &request)
+		summary.Tools = request.Tools
+		names := map[string]string{}
+		for _, m := range request.Messages {
+			message := toolCallMessage{Role: m.Role, Calls: toolCallsFrom(m.ToolCalls)}
+			for i, call := range m.ToolCalls {
+				if id, ok := call["id"].(string); ok {
+					names[id] = message.Calls[i].Name
+				}
+			}
+			if m.Role == "tool" {
+				message.Answers = m.ToolName
+				if format == "openai" {
+					message.Answers = names[m.ToolCallID]
+				}
+			}
+			summary.Messages = append(summary.Messages, message)
+		}
+	case "response":
+		var message map[string]any
+		unmarshal(t, chunks[0], &message)
+		if format == "openai" {
+			message = message["choices"].([]any)[0].(map[string]any)["message"].(map[string]any)
+		} else {
+			message = message["message"].(map[string]any)
+		}
+		summary.Messages = []toolCallMessage{{Role: "assistant", Calls: toolCallsFrom(toMaps(message["tool_calls"]))}}
+	case "stream_response":
+		// put the pieces of the tool calls together the way a client does
+		var calls []map[string]any
+		arguments := map[int]string{}
+		for _, chunk := range chunks {
+			if string(bytes.TrimSpace(chunk)) == "[DONE]" {
+				continue
+			}
+			var c map[string]any
+			unmarshal(t, chunk, &c)
+			if format == "ollama" {
+				message, _ := c["message"].(map[string]any)
+				calls = append(calls, toMaps(message["tool_calls"])...)
+				continue
+			}
+			choice := c["choices"].([]any)[0].(map[string]any)
+			if reason, ok := choice["finish_reason"].(string); ok {
+				summary.FinishReason = reason
+			}
+			delta, _ := choice["delta"].(map[string]any)
+			for _, piece := range toMaps(delta["tool_calls"]) {
+				index := int(piece["index"].(float64))
+				for len(calls) <= index {
+					calls = append(calls, map[string]any{"function": map[string]any{}})
+				}
+				function := piece["function"].(map[string]any)
+				if name, ok := function["name"].(string); ok && name != "" {
+					calls[index]["function"].(map[string]any)["name"] = name
+				}
+				arguments[index] += function["arguments"].(string)
+			}
+		}
+		for i, args := range arguments {
+			calls[i]["function"].(map[string]any)["arguments"] = args
+		}
+		summary.Messages = []toolCallMessage{{Role: "assistant", Calls: toolCallsFrom(calls)}}
+		if format == "openai" && summary.FinishReason != "tool_calls" {
+			t.Errorf("finish_reason = %s, want tool_calls", summary.FinishReason)
+		}
+		summary.FinishReason = ""
+	}
+	return summary
+}
+
+func toolCallsFrom(calls []map[string]any) []toolCall {
+	var result []toolCall
+	for _, call := range calls {
+		function, _ := call["function"].(map[string]any)
+		name, _ := function["name"].(string)
+		arguments := function["arguments"]
+		if s, ok := arguments.(string); ok {
+			if err := json.Unmarshal([]byte(s), &arguments); err != nil {
+				arguments = s
+			}
+		}
+		result = append(result, toolCall{Name: name, Arguments: arguments})
+	}
+	return result
+}
+
+func toMaps(v any) []map[string]any {
+	items, _ := v.([]any)
+	result := make([]map[string]any, 0, len(items))
+	for _, item := range items {
+		if m, ok := item.(map[string]any); ok {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func unmarshal(t *testing.T, data []byte, v any) {
+	t.Helper()
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("failed to unmarshal %s: %v", data, err)
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func readLines(t *testing.T, path string) [][]byte {
+	t.Helper()
+	var lines [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(readFile(t, path)))
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			lines = append(lines, append([]byte(nil), line...))
+		}
+	}
+	return lines
+}
+
+// compareGolden the golden file holds the converted chunks as a JSON array
+func compareGolden(t *testing.T, path string, chunks [][]byte) {
+	t.Helper()
+	compareGoldenJSON(t, path, goldenChunks(chunks))
+}
+
+// goldenChunks chunks which aren't JSON, e.g. [DONE], are kept as strings
+func goldenChunks(chunks [][]byte) []json.RawMessage {
+	values := make([]json.RawMessage, 0, len(chunks))
+	for _, chunk := range chunks {
+		if !json.Valid(chunk) {
+			chunk, _ = json.Marshal(string(chunk))
+		}
+		values = append(values, chunk)
+	}
+	return values
+}
+
+// compareGoldenJSON compares v marshaled as indented JSON with the golden file,
+// or writes it to the file with -update
+func compareGoldenJSON(t *testing.T, path string, v any) {
+	t.Helper()
+	got, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run the test with -update to create the golden file", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("conversion differs from %s, got:\n%s", path, got)
+	}
+}
@@ -0,0 +1,76 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"oadin/internal/convert"
+	"oadin/internal/datastore"
+	"oadin/internal/types"
+)
+
+// checkImageInput refuses a chat request with images for a model which the
+// model catalog says can't see them. Models not in the catalog are let through
+// and left to the service provider
+func checkImageInput(st *ServiceTask, requestFlavor APIFlavor, content types.HTTPContent, ctx convert.ConvertContext) error {
+	if st.Request.Service != types.ServiceChat || st.Target.Model == "" {
+		return nil
+	}
+	model := catalogModel(st.Target.Model)
+	if model == nil || model.Vision {
+		return nil
+	}
+	if requestFlavor.Name() != "oadin" {
+		content.Header = content.Header.Clone()
+		var err error
+		content, err = requestFlavor.Convert(st.Request.Service, "request_to_oadin", content, ctx)
+		if err != nil {
+			// the conversion to the target flavor reports it
+			return nil
+		}
+	}
+	if hasImageInput(content.Body) {
+		slog.Warn("[Service] Image input to a model without vision", "model", st.Target.Model, "taskid", st.Schedule.Id)
+		return httpError(http.StatusBadRequest, fmt.Sprintf("model %s does not support image input", st.Target.Model))
+	}
+	return nil
+}
+
+// hasImageInput tells whether any message of an oadin chat request has an image part
+func hasImageInput(body []byte) bool {
+	var req struct {
+		Messages []types.ChatRequestMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return false
+	}
+	for _, m := range req.Messages {
+		if len(m.Images) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func catalogModel(name string) *types.SupportModel {
+	jds := datastore.GetDefaultJsonDatastore()
+	if jds == nil {
+		return nil
+	}
+	options := &datastore.ListOptions{FilterOptions: datastore.FilterOptions{
+		Queries: []datastore.FuzzyQueryOption{{Key: "name", Query: name}},
+	}}
+	models, err := jds.List(context.Background(), &types.SupportModel{}, options)
+	if err != nil {
+		return nil
+	}
+	for _, m := range models {
+		if model := m.(*types.SupportModel); model.Name == name {
+			return model
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package schedule
+
+import (
+	"encoding/json"
+	"testing"
+
+	"oadin/internal/types"
+)
+
+func TestHasImageInput(t *testing.T) {
+	png := "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+	body, err := json.Marshal(types.ChatRequest{Model: "qwen2.5vl:3b", Messages: []types.ChatRequestMessage{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "What is in this image?", Images: []string{png}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		Messages []struct {
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"type":"text","text":"What is in this image?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,` + png + `"}}]`
+	if string(req.Messages[0].Content) != `"You are a helpful assistant."` || string(req.Messages[1].Content) != want {
+		t.Errorf("marshaled request = %s", body)
+	}
+	if !hasImageInput(body) {
+		t.Errorf("hasImageInput(%s) = false", body)
+	}
+	if hasImageInput([]byte(`{"messages":[{"role":"user","content":"hi"}]}`)) {
+		t.Error("hasImageInput of a text request = true")
+	}
+}
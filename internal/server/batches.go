@@ -0,0 +1,789 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"oadin/internal/datastore"
+	"oadin/internal/schedule"
+	"oadin/internal/types"
+	"oadin/internal/utils"
+	"oadin/internal/utils/bcode"
+)
+
+const (
+	maxBatchRequests      = 50000
+	maxBatchLineSize      = 10 << 20
+	batchCompletionWindow = 24 * time.Hour
+	batchInFlight         = 4 // the requests of a batch running at a time
+)
+
+// batchEndpoints the endpoints a batch can be run against, and the services serving them
+var batchEndpoints = map[string]string{
+	"/v1/chat/completions": types.ServiceChat,
+	"/v1/embeddings":       types.ServiceEmbed,
+}
+
+// Batches the openai files and batch apis. The requests of a batch are run in
+// the background a few at a time at low priority, so a batch queues behind
+// interactive traffic rather than competing with it
+type Batches interface {
+	CreateFile(ctx context.Context, filename string, purpose string, content io.Reader) (*types.BatchFile, error)
+	ListFiles(ctx context.Context, purpose string) ([]*types.BatchFile, error)
+	GetFile(ctx context.Context, id string) (*types.BatchFile, error)
+	DeleteFile(ctx context.Context, id string) error
+	CreateBatch(ctx context.Context, request *types.CreateBatchRequest) (*types.Batch, error)
+	ListBatches(ctx context.Context, after string, limit int) ([]*types.Batch, bool, error)
+	GetBatch(ctx context.Context, id string) (*types.Batch, error)
+	CancelBatch(ctx context.Context, id string) (*types.Batch, error)
+	// Resume picks up the batches left unfinished by the last run, to be called
+	// once the scheduler has started
+	Resume(ctx context.Context)
+}
+
+type BatchesImpl struct {
+	Ds datastore.Datastore
+
+	mu   sync.Mutex
+	runs map[string]*batchRun
+}
+
+func NewBatches() Batches {
+	return &BatchesImpl{
+		Ds:   datastore.GetDefaultDatastore(),
+		runs: make(map[string]*batchRun),
+	}
+}
+
+func batchDir() (string, error) {
+	dataDir, err := utils.GetOadinDataDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(dataDir, "batches")
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func (b *BatchesImpl) CreateFile(ctx context.Context, filename string, purpose string, content io.Reader) (*types.BatchFile, error) {
+	if purpose != types.FilePurposeBatch {
+		return nil, bcode.ErrBatchesBadRequest.SetMessage(fmt.Sprintf("unsupported purpose %s, only %s is supported", purpose, types.FilePurposeBatch))
+	}
+	file, err := newBatchFile(filename, purpose)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	n, err := io.Copy(f, content)
+	if err != nil {
+		slog.Error("[Batches] Failed to write file", "id", file.ID, "error", err)
+		_ = os.Remove(file.Path)
+		return nil, err
+	}
+	file.Bytes = n
+	if err := b.Ds.Add(ctx, file); err != nil {
+		_ = os.Remove(file.Path)
+		return nil, bcode.ErrBatchSaveFailed.SetMessage(err.Error())
+	}
+	return file, nil
+}
+
+// newBatchFile a file record to be written, not saved yet
+func newBatchFile(filename string, purpose string) (*types.BatchFile, error) {
+	dir, err := batchDir()
+	if err != nil {
+		return nil, err
+	}
+	id := newID("file-")
+	return &types.BatchFile{
+		ID:        id,
+		Filename:  filename,
+		Purpose:   purpose,
+		Path:      filepath.Join(dir, id+".jsonl"),
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func (b *BatchesImpl) ListFiles(ctx context.Context, purpose string) ([]*types.BatchFile, error) {
+	options := &datastore.ListOptions{SortBy: []datastore.SortOption{{Key: "created_at", Order: datastore.SortOrderDescending}}}
+	list, err := b.Ds.List(ctx, &types.BatchFile{Purpose: purpose}, options)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*types.BatchFile, 0, len(list))
+	for _, e := range list {
+		files = append(files, e.(*types.BatchFile))
+	}
+	return files, nil
+}
+
+func (b *BatchesImpl) GetFile(ctx context.Context, id string) (*types.BatchFile, error) {
+	file := &types.BatchFile{ID: id}
+	if err := b.Ds.Get(ctx, file); err != nil {
+		return nil, bcode.ErrBatchFileNotFound.SetMessage(fmt.Sprintf("file %s not found", id))
+	}
+	return file, nil
+}
+
+func (b *BatchesImpl) DeleteFile(ctx context.Context, id string) error {
+	file, err := b.GetFile(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := b.Ds.Delete(ctx, file); err != nil {
+		return err
+	}
+	if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+		slog.Warn("[Batches] Failed to remove file", "id", id, "path", file.Path, "error", err)
+	}
+	return nil
+}
+
+func (b *BatchesImpl) CreateBatch(ctx context.Context, request *types.CreateBatchRequest) (*types.Batch, error) {
+	if _, ok := batchEndpoints[request.Endpoint]; !ok {
+		return nil, bcode.ErrBatchesBadRequest.SetMessage(fmt.Sprintf("unsupported endpoint %s", request.Endpoint))
+	}
+	if request.CompletionWindow != "24h" {
+		return nil, bcode.ErrBatchesBadRequest.SetMessage("completion_window must be 24h")
+	}
+	input, err := b.GetFile(ctx, request.InputFileID)
+	if err != nil {
+		return nil, err
+	}
+	if input.Purpose != types.FilePurposeBatch {
+		return nil, bcode.ErrBatchesBadRequest.SetMessage(fmt.Sprintf("file %s was not uploaded for purpose %s", input.ID, types.FilePurposeBatch))
+	}
+
+	now := time.Now()
+	batch := &types.Batch{
+		ID:               newID("batch_"),
+		Endpoint:         request.Endpoint,
+		InputFileID:      request.InputFileID,
+		CompletionWindow: request.CompletionWindow,
+		Status:           types.BatchStatusValidating,
+		ExpiresAt:        now.Add(batchCompletionWindow).Unix(),
+		CreatedAt:        now,
+	}
+	if len(request.Metadata) > 0 {
+		metadata, err := json.Marshal(request.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		batch.Metadata = string(metadata)
+	}
+	if err := b.Ds.Add(ctx, batch); err != nil {
+		return nil, bcode.ErrBatchSaveFailed.SetMessage(err.Error())
+	}
+	// the runner owns the batch from here on
+	created := *batch
+	b.start(batch)
+	return &created, nil
+}
+
+// ListBatches the batches newest first, paged by the id of the last batch of the previous page
+func (b *BatchesImpl) ListBatches(ctx context.Context, after string, limit int) ([]*types.Batch, bool, error) {
+	options := &datastore.ListOptions{SortBy: []datastore.SortOption{{Key: "created_at", Order: datastore.SortOrderDescending}}}
+	list, err := b.Ds.List(ctx, &types.Batch{}, options)
+	if err != nil {
+		return nil, false, err
+	}
+	batches := make([]*types.Batch, 0, limit)
+	found := after == ""
+	for _, e := range list {
+		batch := e.(*types.Batch)
+		if !found {
+			found = batch.ID == after
+			continue
+		}
+		if len(batches) == limit {
+			return batches, true, nil
+		}
+		batches = append(batches, batch)
+	}
+	return batches, false, nil
+}
+
+func (b *BatchesImpl) GetBatch(ctx context.Context, id string) (*types.Batch, error) {
+	batch := &types.Batch{ID: id}
+	if err := b.Ds.Get(ctx, batch); err != nil {
+		return nil, bcode.ErrBatchNotFound.SetMessage(fmt.Sprintf("batch %s not found", id))
+	}
+	return batch, nil
+}
+
+func (b *BatchesImpl) CancelBatch(ctx context.Context, id string) (*types.Batch, error) {
+	batch, err := b.GetBatch(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if batch.Done() || batch.Status == types.BatchStatusCancelling {
+		return nil, bcode.ErrBatchesBadRequest.SetMessage(fmt.Sprintf("cannot cancel a batch with status %s", batch.Status))
+	}
+	b.mu.Lock()
+	run := b.runs[id]
+	b.mu.Unlock()
+	if run == nil {
+		// nothing is running it, e.g. it is cancelled right before a resume
+		now := time.Now().Unix()
+		batch.Status = types.BatchStatusCancelled
+		batch.CancellingAt = now
+		batch.CancelledAt = now
+		if err := b.Ds.Put(ctx, batch); err != nil {
+			return nil, bcode.ErrBatchSaveFailed.SetMessage(err.Error())
+		}
+		return batch, nil
+	}
+	return run.cancel(), nil
+}
+
+func (b *BatchesImpl) Resume(ctx context.Context) {
+	list, err := b.Ds.List(ctx, &types.Batch{}, nil)
+	if err != nil {
+		slog.Error("[Batches] Failed to list batches to resume", "error", err)
+		return
+	}
+	for _, e := range list {
+		batch := e.(*types.Batch)
+		switch batch.Status {
+		case types.BatchStatusValidating, types.BatchStatusInProgress, types.BatchStatusFinalizing:
+			slog.Info("[Batches] Resume batch", "id", batch.ID, "status", batch.Status)
+			b.start(batch)
+		case types.BatchStatusCancelling:
+			batch.Status = types.BatchStatusCancelled
+			batch.CancelledAt = time.Now().Unix()
+			if err := b.Ds.Put(ctx, batch); err != nil {
+				slog.Error("[Batches] Failed to save batch", "id", batch.ID, "error", err)
+			}
+		}
+	}
+}
+
+func (b *BatchesImpl) start(batch *types.Batch) {
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &batchRun{ds: b.Ds, batch: batch, ctx: ctx, stop: cancel}
+	b.mu.Lock()
+	b.runs[batch.ID] = run
+	b.mu.Unlock()
+	go func() {
+		defer func() {
+			cancel()
+			b.mu.Lock()
+			delete(b.runs, batch.ID)
+			b.mu.Unlock()
+		}()
+		run.run()
+	}()
+}
+
+// batchRun a batch being run. The batch is only changed and saved under mu,
+// as it is shared with the cancellation
+type batchRun struct {
+	ds    datastore.Datastore
+	ctx   context.Context
+	stop  context.CancelFunc
+	mu    sync.Mutex
+	batch *types.Batch
+
+	output *batchResultFile
+	errors *batchResultFile
+}
+
+// update changes the batch and saves it
+func (r *batchRun) update(f func(batch *types.Batch)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f(r.batch)
+	r.batch.OutputFileID = r.output.fileID()
+	r.batch.ErrorFileID = r.errors.fileID()
+	if err := r.ds.Put(context.Background(), r.batch); err != nil {
+		slog.Error("[Batches] Failed to save batch", "id", r.batch.ID, "error", err)
+	}
+}
+
+// setStatus moves the batch on, a batch being cancelled only gets cancelled
+func (r *batchRun) setStatus(status string) {
+	r.update(func(batch *types.Batch) {
+		now := time.Now().Unix()
+		if batch.Status == types.BatchStatusCancelling {
+			status = types.BatchStatusCancelled
+		}
+		batch.Status = status
+		switch status {
+		case types.BatchStatusInProgress:
+			batch.InProgressAt = now
+		case types.BatchStatusFinalizing:
+			batch.FinalizingAt = now
+		case types.BatchStatusCompleted:
+			batch.CompletedAt = now
+		case types.BatchStatusFailed:
+			batch.FailedAt = now
+		case types.BatchStatusExpired:
+			batch.ExpiredAt = now
+		case types.BatchStatusCancelled:
+			batch.CancelledAt = now
+		}
+	})
+}
+
+func (r *batchRun) cancel() *types.Batch {
+	r.update(func(batch *types.Batch) {
+		batch.Status = types.BatchStatusCancelling
+		batch.CancellingAt = time.Now().Unix()
+	})
+	r.stop()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	batch := *r.batch
+	return &batch
+}
+
+func (r *batchRun) status() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.batch.Status
+}
+
+func (r *batchRun) expiresAt() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.batch.ExpiresAt
+}
+
+func (r *batchRun) run() {
+	id := r.batch.ID
+	lines, batchErrors, err := r.validate()
+	if err != nil {
+		slog.Error("[Batches] Failed to read the input file", "id", id, "error", err)
+		batchErrors = []types.BatchError{{Code: "invalid_file", Message: err.Error()}}
+	}
+	if len(batchErrors) > 0 {
+		data, _ := json.Marshal(&types.BatchErrors{Object: "list", Data: batchErrors})
+		r.update(func(batch *types.Batch) { batch.Errors = string(data) })
+		r.setStatus(types.BatchStatusFailed)
+		return
+	}
+
+	if err := r.openResultFiles(); err != nil {
+		slog.Error("[Batches] Failed to open the result files", "id", id, "error", err)
+		data, _ := json.Marshal(&types.BatchErrors{Object: "list", Data: []types.BatchError{{Code: "server_error", Message: err.Error()}}})
+		r.update(func(batch *types.Batch) { batch.Errors = string(data) })
+		r.setStatus(types.BatchStatusFailed)
+		return
+	}
+	defer r.closeResultFiles()
+
+	// the requests complete in any order, the results already written tell
+	// which ones a resumed batch has left to run
+	var pending []*types.BatchRequestLine
+	for _, line := range lines {
+		if !r.output.done[line.CustomID] && !r.errors.done[line.CustomID] {
+			pending = append(pending, line)
+		}
+	}
+	r.update(func(batch *types.Batch) {
+		batch.Total = len(lines)
+		batch.Completed = r.output.lines
+		batch.Failed = r.errors.lines
+	})
+	if r.status() == types.BatchStatusValidating {
+		r.setStatus(types.BatchStatusInProgress)
+	}
+	slog.Info("[Batches] Run batch", "id", id, "total", len(lines), "done", len(lines)-len(pending))
+
+	service := batchEndpoints[r.batch.Endpoint]
+	hybridPolicy := "default"
+	sp := &types.Service{Name: service, Status: 1}
+	if err := r.ds.Get(context.Background(), sp); err == nil {
+		hybridPolicy = sp.HybridPolicy
+	}
+	var wg sync.WaitGroup
+	var writeErr error
+	var writeErrOnce sync.Once
+	inFlight := make(chan struct{}, batchInFlight)
+	var expired []*types.BatchRequestLine
+	for i, line := range pending {
+		select {
+		case inFlight <- struct{}{}:
+		case <-r.ctx.Done():
+		}
+		if r.ctx.Err() != nil {
+			break
+		}
+		if time.Now().Unix() >= r.expiresAt() {
+			slog.Warn("[Batches] Batch expired", "id", id, "left", len(pending)-i, "total", len(lines))
+			expired = pending[i:]
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			result := r.invoke(service, hybridPolicy, line)
+			if result == nil {
+				// cancelled before the request could complete
+				return
+			}
+			if err := r.record(result); err != nil {
+				slog.Error("[Batches] Failed to write the result", "id", id, "custom_id", line.CustomID, "error", err)
+				writeErrOnce.Do(func() { writeErr = err })
+				r.stop()
+			}
+		}()
+	}
+	wg.Wait()
+	if writeErr != nil {
+		r.finish(types.BatchStatusFailed)
+		return
+	}
+	if expired != nil {
+		r.expire(expired)
+		return
+	}
+	if r.ctx.Err() != nil {
+		slog.Info("[Batches] Batch cancelled", "id", id, "completed", r.output.lines, "failed", r.errors.lines)
+		r.finish(types.BatchStatusCancelled)
+		return
+	}
+	r.setStatus(types.BatchStatusFinalizing)
+	r.finish(types.BatchStatusCompleted)
+}
+
+// validate reads the input file, a batch with a line that doesn't make sense fails as a whole
+func (r *batchRun) validate() ([]*types.BatchRequestLine, []types.BatchError, error) {
+	input := &types.BatchFile{ID: r.batch.InputFileID}
+	if err := r.ds.Get(context.Background(), input); err != nil {
+		return nil, nil, fmt.Errorf("input file %s not found", r.batch.InputFileID)
+	}
+	f, err := os.Open(input.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var lines []*types.BatchRequestLine
+	var batchErrors []types.BatchError
+	customIDs := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxBatchLineSize)
+	for n := 1; scanner.Scan(); n++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		line := &types.BatchRequestLine{}
+		message := ""
+		if err := json.Unmarshal(text, line); err != nil {
+			message = "invalid JSON: " + err.Error()
+		} else {
+			message = validateBatchLine(line, r.batch.Endpoint, customIDs)
+		}
+		if message != "" {
+			batchErrors = append(batchErrors, types.BatchError{Code: "invalid_request", Message: message, Line: &n})
+			continue
+		}
+		customIDs[line.CustomID] = true
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(lines)+len(batchErrors) == 0 {
+		batchErrors = append(batchErrors, types.BatchError{Code: "empty_file", Message: "the input file has no requests"})
+	}
+	if len(lines) > maxBatchRequests {
+		batchErrors = append(batchErrors, types.BatchError{Code: "too_many_requests", Message: fmt.Sprintf("a batch may have at most %d requests", maxBatchRequests)})
+	}
+	return lines, batchErrors, nil
+}
+
+func validateBatchLine(line *types.BatchRequestLine, endpoint string, customIDs map[string]bool) string {
+	switch {
+	case line.CustomID == "":
+		return "custom_id is required"
+	case customIDs[line.CustomID]:
+		return fmt.Sprintf("custom_id %s is not unique", line.CustomID)
+	case line.Method != http.MethodPost:
+		return "method must be POST"
+	case line.URL != endpoint:
+		return fmt.Sprintf("url %s doesn't match the endpoint %s of the batch", line.URL, endpoint)
+	}
+	var body struct {
+		Model  string `json:"model"`
+		Stream bool   `json:"stream"`
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(line.Body), []byte("{")) || json.Unmarshal(line.Body, &body) != nil {
+		return "body must be a JSON object"
+	}
+	if body.Stream {
+		return "stream is not supported in a batch"
+	}
+	return ""
+}
+
+// invoke runs a request of the batch through the scheduler and waits for it,
+// nil if the batch is cancelled before the request could complete
+func (r *batchRun) invoke(service string, hybridPolicy string, line *types.BatchRequestLine) *types.BatchResultLine {
+	serviceRequest := &types.ServiceRequest{
+		FromFlavor:   types.FlavorOpenAI,
+		Service:      service,
+		Priority:     types.PriorityLow,
+		HybridPolicy: hybridPolicy,
+		HTTP: types.HTTPContent{
+			Header: http.Header{"Content-Type": []string{"application/json"}},
+			Body:   line.Body,
+		},
+		Context: r.ctx,
+	}
+	// the body may pick the model and the hybrid policy, as it does for a request of its own
+	_ = json.Unmarshal(line.Body, serviceRequest)
+
+	var taskID uint64
+	var last *types.ServiceResult
+	for {
+		var ch chan *types.ServiceResult
+		taskID, ch = schedule.GetScheduler().Enqueue(serviceRequest)
+		last = nil
+		for result := range ch {
+			last = result
+		}
+		// a busy service provider refuses the request, the batch waits and asks again
+		retryAfter := busyRetryAfter(last)
+		if retryAfter == 0 || time.Now().Add(retryAfter).Unix() >= r.expiresAt() {
+			break
+		}
+		select {
+		case <-time.After(retryAfter):
+		case <-r.ctx.Done():
+			return nil
+		}
+	}
+	if r.ctx.Err() != nil && (last == nil || last.Type == types.ServiceResultFailed) {
+		// cancelled while it ran
+		return nil
+	}
+	out := &types.BatchResultLine{ID: newID("batch_req_"), CustomID: line.CustomID}
+	requestID := strconv.FormatUint(taskID, 10)
+	if last == nil {
+		out.Error = &types.BatchResultError{Code: "server_error", Message: "no result from the service"}
+		return out
+	}
+	if last.Type == types.ServiceResultFailed {
+		var httpErr *types.HTTPErrorResponse
+		if errors.As(last.Error, &httpErr) {
+			out.Response = &types.BatchResultResponse{StatusCode: httpErr.StatusCode, RequestID: requestID, Body: jsonBody(httpErr.Body)}
+			return out
+		}
+		message := "invoke service failed"
+		if last.Error != nil {
+			message = last.Error.Error()
+		}
+		out.Error = &types.BatchResultError{Code: "server_error", Message: message}
+		return out
+	}
+	statusCode := last.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	out.Response = &types.BatchResultResponse{StatusCode: statusCode, RequestID: requestID, Body: jsonBody(last.HTTP.Body)}
+	return out
+}
+
+// busyRetryAfter how long to wait before asking again when the request is
+// refused by a busy service provider, 0 if it is not
+func busyRetryAfter(result *types.ServiceResult) time.Duration {
+	if result == nil || result.Type != types.ServiceResultFailed {
+		return 0
+	}
+	var httpErr *types.HTTPErrorResponse
+	if !errors.As(result.Error, &httpErr) || httpErr.StatusCode != http.StatusTooManyRequests {
+		return 0
+	}
+	seconds, err := strconv.Atoi(httpErr.Header.Get("Retry-After"))
+	if err != nil || seconds < 1 {
+		seconds = 1
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// jsonBody a body which isn't JSON is carried as a string
+func jsonBody(body []byte) json.RawMessage {
+	body = bytes.TrimSpace(body)
+	if json.Valid(body) {
+		return body
+	}
+	data, _ := json.Marshal(string(body))
+	return data
+}
+
+// record writes the result of a request to the output or the error file, and
+// counts it in the batch
+func (r *batchRun) record(result *types.BatchResultLine) error {
+	file := r.output
+	if result.Error != nil || result.Response.StatusCode >= http.StatusBadRequest {
+		file = r.errors
+	}
+	var err error
+	r.update(func(batch *types.Batch) {
+		err = file.write(result)
+		batch.Completed = r.output.lines
+		batch.Failed = r.errors.lines
+	})
+	return err
+}
+
+// expire reports the requests which haven't been run in time in the error file
+func (r *batchRun) expire(lines []*types.BatchRequestLine) {
+	r.update(func(batch *types.Batch) {
+		for _, line := range lines {
+			result := &types.BatchResultLine{
+				ID:       newID("batch_req_"),
+				CustomID: line.CustomID,
+				Error:    &types.BatchResultError{Code: "batch_expired", Message: "this request could not be executed before the completion window expired"},
+			}
+			if err := r.errors.write(result); err != nil {
+				slog.Error("[Batches] Failed to write the result", "id", batch.ID, "custom_id", line.CustomID, "error", err)
+				break
+			}
+		}
+		batch.Failed = r.errors.lines
+	})
+	r.finish(types.BatchStatusExpired)
+}
+
+// finish closes the batch with the given status, the results so far stay available
+func (r *batchRun) finish(status string) {
+	r.closeResultFiles()
+	r.setStatus(status)
+}
+
+func (r *batchRun) openResultFiles() error {
+	var err error
+	r.output, err = openBatchResultFile(r.ds, r.batch.OutputFileID, r.batch.ID+"_output.jsonl")
+	if err != nil {
+		return err
+	}
+	r.errors, err = openBatchResultFile(r.ds, r.batch.ErrorFileID, r.batch.ID+"_error.jsonl")
+	return err
+}
+
+func (r *batchRun) closeResultFiles() {
+	for _, file := range []*batchResultFile{r.output, r.errors} {
+		if file != nil {
+			file.close()
+		}
+	}
+}
+
+// batchResultFile the output or the error file of a batch. It is only created
+// with its first line, so a batch without errors has no error file
+type batchResultFile struct {
+	ds       datastore.Datastore
+	filename string
+	record   *types.BatchFile
+	f        *os.File
+	lines    int
+	done     map[string]bool // the custom ids of the lines
+}
+
+func openBatchResultFile(ds datastore.Datastore, id string, filename string) (*batchResultFile, error) {
+	file := &batchResultFile{ds: ds, filename: filename, done: make(map[string]bool)}
+	if id == "" {
+		return file, nil
+	}
+	file.record = &types.BatchFile{ID: id}
+	if err := ds.Get(context.Background(), file.record); err != nil {
+		return nil, fmt.Errorf("result file %s not found", id)
+	}
+	data, err := os.ReadFile(file.record.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// a line cut short by a crash is dropped, its request is run again
+	if i := bytes.LastIndexByte(data, '\n'); i+1 != len(data) {
+		if err := os.Truncate(file.record.Path, int64(i+1)); err != nil {
+			return nil, err
+		}
+	}
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	for _, text := range bytes.SplitAfter(data, []byte("\n")) {
+		var line types.BatchResultLine
+		if json.Unmarshal(text, &line) == nil {
+			file.done[line.CustomID] = true
+			file.lines++
+		}
+	}
+	return file, nil
+}
+
+func (file *batchResultFile) write(line *types.BatchResultLine) error {
+	if file.f == nil {
+		if file.record == nil {
+			record, err := newBatchFile(file.filename, types.FilePurposeBatchOutput)
+			if err != nil {
+				return err
+			}
+			if err := file.ds.Add(context.Background(), record); err != nil {
+				return err
+			}
+			file.record = record
+		}
+		f, err := os.OpenFile(file.record.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+		if err != nil {
+			return err
+		}
+		file.f = f
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	if _, err := file.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	file.lines++
+	file.done[line.CustomID] = true
+	return nil
+}
+
+// fileID the id of the file, empty until it is created
+func (file *batchResultFile) fileID() string {
+	if file == nil || file.record == nil {
+		return ""
+	}
+	return file.record.ID
+}
+
+// close records the size the file has come to
+func (file *batchResultFile) close() {
+	if file.f == nil {
+		return
+	}
+	if info, err := file.f.Stat(); err == nil {
+		file.record.Bytes = info.Size()
+		if err := file.ds.Put(context.Background(), file.record); err != nil {
+			slog.Error("[Batches] Failed to save file", "id", file.record.ID, "error", err)
+		}
+	}
+	_ = file.f.Close()
+	file.f = nil
+}
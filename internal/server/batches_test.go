@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"oadin/internal/datastore/sqlite"
+	"oadin/internal/types"
+)
+
+func TestValidateBatchLine(t *testing.T) {
+	const endpoint = "/v1/chat/completions"
+	seen := map[string]bool{"dup": true}
+	tests := []struct {
+		name string
+		line string
+		ok   bool
+	}{
+		{"valid", `{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"model":"qwen3","messages":[]}}`, true},
+		{"no custom_id", `{"method":"POST","url":"/v1/chat/completions","body":{}}`, false},
+		{"duplicate custom_id", `{"custom_id":"dup","method":"POST","url":"/v1/chat/completions","body":{}}`, false},
+		{"wrong method", `{"custom_id":"a","method":"GET","url":"/v1/chat/completions","body":{}}`, false},
+		{"other endpoint", `{"custom_id":"a","method":"POST","url":"/v1/embeddings","body":{}}`, false},
+		{"stream", `{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"stream":true}}`, false},
+		{"body not an object", `{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":"hi"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var line types.BatchRequestLine
+			if err := json.Unmarshal([]byte(tt.line), &line); err != nil {
+				t.Fatal(err)
+			}
+			message := validateBatchLine(&line, endpoint, seen)
+			if (message == "") != tt.ok {
+				t.Errorf("validateBatchLine() = %q, want ok %v", message, tt.ok)
+			}
+		})
+	}
+}
+
+func TestBatchObject(t *testing.T) {
+	batch := &types.Batch{ID: "batch_1", Status: types.BatchStatusInProgress, Total: 3, Completed: 1, InProgressAt: 100}
+	data, err := json.Marshal(batch.Object())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["object"] != "batch" || got["in_progress_at"] != float64(100) {
+		t.Errorf("batch object = %s", data)
+	}
+	if v, ok := got["output_file_id"]; !ok || v != nil {
+		t.Errorf("output_file_id of a batch without output = %v, want null", v)
+	}
+	if counts := got["request_counts"].(map[string]any); counts["total"] != float64(3) || counts["completed"] != float64(1) {
+		t.Errorf("request_counts = %v", counts)
+	}
+}
+
+func TestResumeBatchResultFile(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ds, err := sqlite.New(filepath.Join(t.TempDir(), "oadin.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := openBatchResultFile(ds, "", "batch_1_output.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the requests complete out of order, and the last line is cut short by a crash
+	for _, id := range []string{"c", "a"} {
+		if err := file.write(&types.BatchResultLine{ID: "batch_req_" + id, CustomID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.f.WriteString(`{"id":"batch_req_b","custom_id":"b"`)
+	file.close()
+
+	resumed, err := openBatchResultFile(ds, file.fileID(), "batch_1_output.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.lines != 2 || !resumed.done["a"] || resumed.done["b"] || !resumed.done["c"] {
+		t.Errorf("resumed %d lines done %v, want a and c", resumed.lines, resumed.done)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"oadin/internal/api/dto"
+	"oadin/internal/convert"
+	"oadin/internal/schedule"
+	"oadin/internal/types"
+	"oadin/internal/utils/bcode"
+)
+
+type Debug interface {
+	Convert(ctx context.Context, req *dto.DebugConvertRequest) (*dto.DebugConvertResponse, error)
+}
+
+type DebugImpl struct{}
+
+func NewDebug() Debug {
+	return &DebugImpl{}
+}
+
+// Convert 按 flavor 的转换流水线逐步转换 body, 返回 Oadin 格式的中间结果以及每一步的输出
+func (d *DebugImpl) Convert(ctx context.Context, req *dto.DebugConvertRequest) (*dto.DebugConvertResponse, error) {
+	from, err := schedule.GetAPIFlavor(req.FromFlavor)
+	if err != nil {
+		return nil, bcode.ErrFlavorNotFound.SetMessage(err.Error())
+	}
+	to, err := schedule.GetAPIFlavor(req.ToFlavor)
+	if err != nil {
+		return nil, bcode.ErrFlavorNotFound.SetMessage(err.Error())
+	}
+
+	content := types.HTTPContent{Body: debugRawBody(req.Body), Header: http.Header{}}
+	for k, v := range req.Headers {
+		content.Header.Set(k, v)
+	}
+	convertCtx := convert.ConvertContext{}
+	for k, v := range req.Ctx {
+		convertCtx[k] = v
+	}
+
+	trace, err := schedule.TraceConversion(from, to, req.Service, req.Conversion, content, convertCtx)
+	if errors.Is(err, schedule.ErrServiceNotSupported) {
+		return nil, bcode.ErrFlavorServiceNotSupported.SetMessage(err.Error())
+	}
+	if trace == nil {
+		return nil, bcode.ErrFlavorBadRequest.SetMessage(err.Error())
+	}
+
+	data := dto.DebugConvertData{Steps: make([]dto.DebugConvertStep, 0, len(trace.Steps))}
+	for _, s := range trace.Steps {
+		step := dto.DebugConvertStep{
+			Flavor:     s.Flavor,
+			Conversion: s.Conversion,
+			Step:       s.Step,
+			Converter:  s.Converter,
+			Dropped:    s.Dropped,
+		}
+		if s.Err != nil {
+			step.Error = s.Err.Error()
+		} else if !s.Dropped {
+			step.Body = debugJSONBody(s.Output.Body)
+			step.Header = s.Output.Header
+		}
+		data.Steps = append(data.Steps, step)
+	}
+	if trace.Oadin != nil {
+		data.Oadin = debugJSONBody(trace.Oadin.Body)
+	}
+	if err != nil {
+		slog.Debug("[Debug] Conversion failed", "from", req.FromFlavor, "to", req.ToFlavor, "service", req.Service, "error", err)
+		data.Error = err.Error()
+	} else {
+		data.Output = debugJSONBody(trace.Output.Body)
+		data.OutputHeader = trace.Output.Header
+	}
+	return &dto.DebugConvertResponse{Bcode: *bcode.FlavorCode, Data: data}, nil
+}
+
+// debugRawBody a JSON string is taken as the raw text to convert
+func debugRawBody(body json.RawMessage) []byte {
+	var text string
+	if err := json.Unmarshal(body, &text); err == nil {
+		return []byte(text)
+	}
+	return body
+}
+
+func debugJSONBody(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, body); err == nil {
+			return buf.Bytes()
+		}
+	}
+	text, _ := json.Marshal(string(body))
+	return text
+}
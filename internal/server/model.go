@@ -49,7 +49,8 @@ func (s *ModelImpl) CreateModel(ctx context.Context, request *dto.CreateModelReq
 		// get default service provider
 		// todo Currently only chat and generate services support pulling models.
 		if request.ServiceName != types.ServiceChat && request.ServiceName != types.ServiceGenerate && request.ServiceName != types.ServiceEmbed &&
-			request.ServiceName != types.ServiceTextToImage {
+			request.ServiceName != types.ServiceTextToImage && request.ServiceName != types.ServiceRerank &&
+			request.ServiceName != types.ServiceSpeechToText && request.ServiceName != types.ServiceTextToSpeech {
 			return nil, bcode.ErrServer
 		}
 
@@ -720,6 +721,7 @@ func GetSupportModelList(ctx context.Context, request *dto.GetSupportModelReques
 				Think:           smInfo.Think,
 				ThinkSwitch:     smInfo.ThinkSwitch,
 				Tools:           smInfo.Tools,
+				Vision:          smInfo.Vision,
 				Context:         smInfo.Context,
 				CreatedAt:       smInfo.CreatedAt,
 			}
@@ -886,6 +888,7 @@ func GetSupportModelList(ctx context.Context, request *dto.GetSupportModelReques
 					Think:           jdModelInfo.Think,
 					ThinkSwitch:     jdModelInfo.ThinkSwitch,
 					Tools:           jdModelInfo.Tools,
+					Vision:          jdModelInfo.Vision,
 					CreatedAt:       jdModelInfo.CreatedAt,
 				}
 				resultList = append(resultList, modelData)
@@ -1149,6 +1152,7 @@ func GetSupportModelListCombine(ctx context.Context, request *dto.GetSupportMode
 				Think:           smInfo.Think,
 				ThinkSwitch:     smInfo.ThinkSwitch,
 				Tools:           smInfo.Tools,
+				Vision:          smInfo.Vision,
 				Context:         smInfo.Context,
 				CreatedAt:       smInfo.CreatedAt,
 			}
@@ -1315,6 +1319,7 @@ func GetSupportModelListCombine(ctx context.Context, request *dto.GetSupportMode
 					Think:           jdModelInfo.Think,
 					ThinkSwitch:     jdModelInfo.ThinkSwitch,
 					Tools:           jdModelInfo.Tools,
+					Vision:          jdModelInfo.Vision,
 					CreatedAt:       jdModelInfo.CreatedAt,
 				}
 				resultList = append(resultList, modelData)
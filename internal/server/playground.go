@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"strings"
 	"time"
 
 	"oadin/config"
@@ -29,7 +30,7 @@ type Playground interface {
 
 	SendMessageStream(ctx context.Context, request *dto.SendStreamMessageRequest) (chan *types.ChatResponse, chan error)
 	UpdateToolCall(ctx context.Context, toolMessage *types.ToolMessage) error
-	HandleToolCalls(ctx context.Context, sessionId string, messageId string) []map[string]string
+	HandleToolCalls(ctx context.Context, sessionId string, messageId string) []types.ChatRequestMessage
 	UpdateSessionTitle(ctx context.Context, sessionID string) error
 
 	UploadFile(ctx context.Context, request *dto.UploadFileRequest, fileHeader io.Reader, filename string, filesize int64) (*dto.UploadFileResponse, error)
@@ -199,15 +200,22 @@ func (p *PlaygroundImpl) SendMessage(ctx context.Context, request *dto.SendMessa
 	}
 
 	// 构建历史对话
-	history := make([]map[string]string, 0, len(messages)+1)
+	history := make([]types.ChatRequestMessage, 0, len(messages)+1)
 	for _, m := range messages {
 		msg := m.(*types.ChatMessage)
-		history = append(history, map[string]string{
-			"role":    msg.Role,
-			"content": msg.Content,
+		history = append(history, types.ChatRequestMessage{
+			Role:    msg.Role,
+			Content: msg.Content,
+			Images:  p.historyImages(ctx, msg),
 		})
 	}
 
+	images, err := p.loadImages(ctx, request.SessionId, request.ImageIds)
+	if err != nil {
+		slog.Error("Failed to load message images", "error", err)
+		return nil, err
+	}
+
 	// 检查当前会话是否有上传文件，只有有文件时才查找RAG上下文
 	fileQuery := &types.File{SessionID: request.SessionId}
 	files, err := p.Ds.List(ctx, fileQuery, nil)
@@ -235,9 +243,10 @@ func (p *PlaygroundImpl) SendMessage(ctx context.Context, request *dto.SendMessa
 	}
 
 	// 添加当前用户消息
-	userMessage := map[string]string{
-		"role":    "user",
-		"content": enhancedContent,
+	userMessage := types.ChatRequestMessage{
+		Role:    "user",
+		Content: enhancedContent,
+		Images:  images,
 	}
 	history = append(history, userMessage)
 
@@ -251,6 +260,7 @@ func (p *PlaygroundImpl) SendMessage(ctx context.Context, request *dto.SendMessa
 		CreatedAt: time.Now(),
 		ModelID:   session.ModelID,
 		ModelName: session.ModelName,
+		ImageIDs:  strings.Join(request.ImageIds, ","),
 	}
 	err = p.Ds.Add(ctx, userMsg)
 	if err != nil {
@@ -421,6 +431,11 @@ func (p *PlaygroundImpl) GetMessages(ctx context.Context, request *dto.GetMessag
 			typeStr = "thoughts"
 		}
 
+		var imageIDs []string
+		if msg.ImageIDs != "" {
+			imageIDs = strings.Split(msg.ImageIDs, ",")
+		}
+
 		var toolMessages []types.ToolMessage
 		if msg.IsToolGroupID {
 			typeStr = "mcp"
@@ -454,6 +469,7 @@ func (p *PlaygroundImpl) GetMessages(ctx context.Context, request *dto.GetMessag
 			ModelName:     msg.ModelName,
 			TotalDuration: msg.TotalDuration,
 			ToolCalls:     toolMessages,
+			ImageIds:      imageIDs,
 		})
 	}
 
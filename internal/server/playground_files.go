@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log/slog"
@@ -38,7 +39,7 @@ func (p *PlaygroundImpl) UploadFile(ctx context.Context, request *dto.UploadFile
 
 	// 验证文件类型
 	ext := strings.ToLower(filepath.Ext(filename))
-	allowedFormats := []string{".txt", ".md", ".html", ".pdf", ".xlsx", ".docx"}
+	allowedFormats := []string{".txt", ".md", ".html", ".pdf", ".xlsx", ".docx", ".png", ".jpg", ".jpeg"}
 	validFormat := false
 	for _, format := range allowedFormats {
 		if ext == format {
@@ -393,6 +394,12 @@ func (p *PlaygroundImpl) ProcessFile(ctx context.Context, request *dto.GenerateE
 		return nil, fmt.Errorf("文件记录不完整，缺少必要字段")
 	}
 
+	// 图片作为消息附件发给模型，不生成embedding
+	if fileRecord.Type == "image" {
+		slog.Info("Server: 图片文件跳过embedding", "fileID", fileRecord.ID)
+		return &dto.GenerateEmbeddingResponse{Bcode: bcode.SuccessCode}, nil
+	}
+
 	slog.Info("Server: 开始处理文件embedding", "fileID", fileRecord.ID, "sessionID", fileRecord.SessionID)
 
 	// 检查embed服务是否可用
@@ -738,6 +745,39 @@ func chunkTextFileByParagraphs(file *os.File, chunkSize int) ([]string, error) {
 	return chunks, nil
 }
 
+// 读取会话中上传的图片，返回base64编码的内容
+func (p *PlaygroundImpl) loadImages(ctx context.Context, sessionID string, imageIDs []string) ([]string, error) {
+	images := make([]string, 0, len(imageIDs))
+	for _, id := range imageIDs {
+		file := &types.File{ID: id}
+		if err := p.Ds.Get(ctx, file); err != nil {
+			return nil, fmt.Errorf("图片不存在: %s", id)
+		}
+		if file.SessionID != sessionID || file.Type != "image" {
+			return nil, fmt.Errorf("文件不是当前会话的图片: %s", id)
+		}
+		data, err := os.ReadFile(file.Path)
+		if err != nil {
+			return nil, fmt.Errorf("读取图片失败: %w", err)
+		}
+		images = append(images, base64.StdEncoding.EncodeToString(data))
+	}
+	return images, nil
+}
+
+// 历史消息的图片，读取失败时只记录日志
+func (p *PlaygroundImpl) historyImages(ctx context.Context, msg *types.ChatMessage) []string {
+	if msg.ImageIDs == "" {
+		return nil
+	}
+	images, err := p.loadImages(ctx, msg.SessionID, strings.Split(msg.ImageIDs, ","))
+	if err != nil {
+		slog.Warn("Failed to load message images", "error", err, "messageID", msg.ID)
+		return nil
+	}
+	return images
+}
+
 // 获取文件类型
 func getFileType(fileExt string) string {
 	fileExt = strings.ToLower(fileExt)
@@ -750,6 +790,8 @@ func getFileType(fileExt string) string {
 		return "word"
 	case ".xlsx":
 		return "excel"
+	case ".png", ".jpg", ".jpeg":
+		return "image"
 	default:
 		return "other"
 	}
@@ -58,7 +58,7 @@ func (p *PlaygroundImpl) SendMessageStream(ctx context.Context, request *dto.Sen
 		}
 
 		// 构建历史对话
-		history := make([]map[string]string, 0, len(messages)+1)
+		history := make([]types.ChatRequestMessage, 0, len(messages)+1)
 		for _, m := range messages {
 			msg := m.(*types.ChatMessage)
 			if msg.Role == "assistant" {
@@ -73,11 +73,20 @@ func (p *PlaygroundImpl) SendMessageStream(ctx context.Context, request *dto.Sen
 					continue
 				}
 			}
-			history = append(history, map[string]string{
-				"role":    msg.Role,
-				"content": msg.Content,
+			history = append(history, types.ChatRequestMessage{
+				Role:    msg.Role,
+				Content: msg.Content,
+				Images:  p.historyImages(ctx, msg),
 			})
 		}
+
+		images, err := p.loadImages(ctx, request.SessionID, request.ImageIds)
+		if err != nil {
+			slog.Error("Failed to load message images", "error", err)
+			sendError(err)
+			return
+		}
+
 		// 添加RAG上下文
 		enhancedContent := request.Content
 		relevantContext, err := p.findRelevantContext(ctx, session, request.Content)
@@ -96,11 +105,12 @@ func (p *PlaygroundImpl) SendMessageStream(ctx context.Context, request *dto.Sen
 
 		// 保存用户消息到数据库（保存原始消息，不含上下文）
 		var userMsg *types.ChatMessage
-		if request.Content != "" {
+		if request.Content != "" || len(images) > 0 {
 			// 添加当前用户消息
-			userMessage := map[string]string{
-				"role":    "user",
-				"content": enhancedContent,
+			userMessage := types.ChatRequestMessage{
+				Role:    "user",
+				Content: enhancedContent,
+				Images:  images,
 			}
 			history = append(history, userMessage)
 
@@ -113,6 +123,7 @@ func (p *PlaygroundImpl) SendMessageStream(ctx context.Context, request *dto.Sen
 				CreatedAt: time.Now(),
 				ModelID:   session.ModelID,
 				ModelName: session.ModelName,
+				ImageIDs:  strings.Join(request.ImageIds, ","),
 			}
 			err = p.Ds.Add(ctx, userMsg)
 			if err != nil {
@@ -398,7 +409,7 @@ func (p *PlaygroundImpl) UpdateSessionTitle(ctx context.Context, sessionID strin
 	}
 
 	// 构建历史对话
-	history := make([]map[string]string, 0, len(messages)+1)
+	history := make([]types.ChatRequestMessage, 0, len(messages)+1)
 	for _, m := range messages {
 		msg := m.(*types.ChatMessage)
 		if msg.Role == "assistant" {
@@ -413,15 +424,15 @@ func (p *PlaygroundImpl) UpdateSessionTitle(ctx context.Context, sessionID strin
 				continue
 			}
 		}
-		history = append(history, map[string]string{
-			"role":    msg.Role,
-			"content": msg.Content,
+		history = append(history, types.ChatRequestMessage{
+			Role:    msg.Role,
+			Content: msg.Content,
 		})
 	}
 	genTitlePrompt := "请用一句话为本次对话生成一个不超过10字的简洁标题，仅输出标题本身"
-	history = append(history, map[string]string{
-		"role":    "user",
-		"content": genTitlePrompt,
+	history = append(history, types.ChatRequestMessage{
+		Role:    "user",
+		Content: genTitlePrompt,
 	})
 
 	modelEngine := engine.NewEngine() // 构建聊天请求
@@ -497,7 +508,7 @@ func (p *PlaygroundImpl) AddSessionTitle(ctx context.Context, request *dto.SendS
 }
 
 // 处理工具调用，作为历史消息请求大模型
-func (p *PlaygroundImpl) HandleToolCalls(ctx context.Context, sessionId string, messageId string) []map[string]string {
+func (p *PlaygroundImpl) HandleToolCalls(ctx context.Context, sessionId string, messageId string) []types.ChatRequestMessage {
 	messageQuery := &types.ToolMessage{SessionID: sessionId, MessageId: messageId}
 	messages, err := p.Ds.List(ctx, messageQuery, &datastore.ListOptions{
 		SortBy: []datastore.SortOption{
@@ -512,7 +523,7 @@ func (p *PlaygroundImpl) HandleToolCalls(ctx context.Context, sessionId string,
 	con.ID = messageId
 	_ = p.Ds.Get(ctx, con)
 
-	history := make([]map[string]string, 0)
+	history := make([]types.ChatRequestMessage, 0)
 	for _, m := range messages {
 		msg := m.(*types.ToolMessage)
 		if msg.MessageId == messageId && msg.SessionID == sessionId {
@@ -550,13 +561,13 @@ func (p *PlaygroundImpl) HandleToolCalls(ctx context.Context, sessionId string,
 					fmt.Println(err)
 				}
 
-				history = append(history, map[string]string{
-					"role":    "assistant",
-					"content": fmt.Sprintf("<tool_use>\n  <name>%s</name>\n  <arguments>%s</arguments>\n</tool_use>\n", msg.Name, inputParams),
+				history = append(history, types.ChatRequestMessage{
+					Role:    "assistant",
+					Content: fmt.Sprintf("<tool_use>\n  <name>%s</name>\n  <arguments>%s</arguments>\n</tool_use>\n", msg.Name, inputParams),
 				})
-				history = append(history, map[string]string{
-					"role":    "user",
-					"content": outputParams,
+				history = append(history, types.ChatRequestMessage{
+					Role:    "user",
+					Content: outputParams,
 				})
 			}
 		}
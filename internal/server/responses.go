@@ -0,0 +1,592 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"oadin/internal/datastore"
+	"oadin/internal/schedule"
+	"oadin/internal/types"
+	"oadin/internal/utils/bcode"
+
+	"github.com/google/uuid"
+)
+
+// Responses the openai responses api on top of the chat service
+type Responses interface {
+	CreateResponse(ctx context.Context, request *types.ResponsesRequest) (*types.Response, error)
+	CreateResponseStream(ctx context.Context, request *types.ResponsesRequest) (<-chan *types.ResponsesStreamEvent, error)
+	GetResponse(ctx context.Context, id string) (*types.Response, error)
+	DeleteResponse(ctx context.Context, id string) error
+}
+
+type ResponsesImpl struct {
+	Ds datastore.Datastore
+}
+
+func NewResponses() Responses {
+	return &ResponsesImpl{
+		Ds: datastore.GetDefaultDatastore(),
+	}
+}
+
+// responseRun a response on its way through the chat service
+type responseRun struct {
+	request   *types.ResponsesRequest
+	history   []types.OadinChatMessage // conversation before the output, instructions excluded
+	response  *types.Response
+	messageID string
+}
+
+func newID(prefix string) string {
+	return prefix + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+func (r *ResponsesImpl) CreateResponse(ctx context.Context, request *types.ResponsesRequest) (*types.Response, error) {
+	run, serviceRequest, err := r.prepare(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	_, ch := schedule.GetScheduler().Enqueue(serviceRequest)
+	select {
+	case result := <-ch:
+		if result.Type == types.ServiceResultFailed {
+			return nil, responsesServiceError(result.Error)
+		}
+		var chunk types.OadinChatChunk
+		if err := json.Unmarshal(result.HTTP.Body, &chunk); err != nil {
+			slog.Error("[Responses] Failed to unmarshal chat response", "error", err, "body", string(result.HTTP.Body))
+			return nil, bcode.ErrResponsesInvokeService.SetMessage(err.Error())
+		}
+		run.complete(&chunk)
+		if err := r.save(ctx, run); err != nil {
+			return nil, err
+		}
+		return run.response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *ResponsesImpl) CreateResponseStream(ctx context.Context, request *types.ResponsesRequest) (<-chan *types.ResponsesStreamEvent, error) {
+	run, serviceRequest, err := r.prepare(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	_, ch := schedule.GetScheduler().Enqueue(serviceRequest)
+
+	events := make(chan *types.ResponsesStreamEvent)
+	go func() {
+		defer close(events)
+		s := &responseStream{ctx: ctx, run: run, events: events}
+		s.emit(&types.ResponsesStreamEvent{Type: "response.created", Response: run.response})
+		s.emit(&types.ResponsesStreamEvent{Type: "response.in_progress", Response: run.response})
+
+		failed := false
+		// the channel must be exhausted even if the client has gone
+		for result := range ch {
+			if failed || ctx.Err() != nil {
+				continue
+			}
+			if result.Type == types.ServiceResultFailed {
+				s.fail(responsesServiceError(result.Error))
+				failed = true
+				continue
+			}
+			if types.IsDropAction(result.Error) {
+				continue
+			}
+			body := bytes.TrimSpace(schedule.NewStreamMode(result.HTTP.Header).UnwrapChunk(bytes.TrimSpace(result.HTTP.Body)))
+			if len(body) == 0 {
+				continue
+			}
+			var chunk types.OadinChatChunk
+			if err := json.Unmarshal(body, &chunk); err != nil {
+				slog.Error("[Responses] Failed to unmarshal chat chunk", "error", err, "chunk", string(body))
+				s.fail(bcode.ErrResponsesInvokeService.SetMessage(err.Error()))
+				failed = true
+				continue
+			}
+			s.add(&chunk)
+		}
+		if failed || ctx.Err() != nil {
+			return
+		}
+		s.finish()
+		if err := r.save(context.Background(), run); err != nil {
+			slog.Error("[Responses] Failed to save response", "id", run.response.ID, "error", err)
+		}
+	}()
+	return events, nil
+}
+
+func (r *ResponsesImpl) GetResponse(ctx context.Context, id string) (*types.Response, error) {
+	state := &types.ResponseState{ID: id}
+	if err := r.Ds.Get(ctx, state); err != nil {
+		return nil, bcode.ErrResponseNotFound.SetMessage(fmt.Sprintf("response %s not found", id))
+	}
+	var response types.Response
+	if err := json.Unmarshal([]byte(state.Response), &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (r *ResponsesImpl) DeleteResponse(ctx context.Context, id string) error {
+	state := &types.ResponseState{ID: id}
+	if err := r.Ds.Get(ctx, state); err != nil {
+		return bcode.ErrResponseNotFound.SetMessage(fmt.Sprintf("response %s not found", id))
+	}
+	return r.Ds.Delete(ctx, state)
+}
+
+// prepare builds the chat service request from the conversation of the
+// previous response followed by the new input
+func (r *ResponsesImpl) prepare(ctx context.Context, request *types.ResponsesRequest) (*responseRun, *types.ServiceRequest, error) {
+	var history []types.OadinChatMessage
+	if request.PreviousResponseID != "" {
+		previous := &types.ResponseState{ID: request.PreviousResponseID}
+		if err := r.Ds.Get(ctx, previous); err != nil {
+			return nil, nil, bcode.ErrResponseNotFound.SetMessage(fmt.Sprintf("previous response %s not found", request.PreviousResponseID))
+		}
+		if err := json.Unmarshal([]byte(previous.Messages), &history); err != nil {
+			return nil, nil, err
+		}
+	}
+	input, err := responsesInputMessages(request.Input)
+	if err != nil {
+		return nil, nil, bcode.ErrResponsesBadRequest.SetMessage(err.Error())
+	}
+	history = append(history, input...)
+
+	chatRequest := types.OadinChatRequest{
+		Model:       request.Model,
+		Stream:      request.Stream,
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		MaxTokens:   request.MaxOutputTokens,
+	}
+	// instructions only apply to this response, they are not carried over by previous_response_id
+	if request.Instructions != "" {
+		chatRequest.Messages = append(chatRequest.Messages, types.OadinChatMessage{Role: "system", Content: request.Instructions})
+	}
+	chatRequest.Messages = append(chatRequest.Messages, history...)
+	for _, tool := range request.Tools {
+		if tool.Type != "function" {
+			return nil, nil, bcode.ErrResponsesBadRequest.SetMessage(fmt.Sprintf("unsupported tool type %s", tool.Type))
+		}
+		t := types.OadinTool{Type: "function"}
+		t.Function.Name = tool.Name
+		t.Function.Description = tool.Description
+		t.Function.Parameters = tool.Parameters
+		chatRequest.Tools = append(chatRequest.Tools, t)
+	}
+	body, err := json.Marshal(chatRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hybridPolicy := "default"
+	service := &types.Service{Name: types.ServiceChat, Status: 1}
+	if err := r.Ds.Get(ctx, service); err == nil {
+		hybridPolicy = service.HybridPolicy
+	}
+	serviceRequest := &types.ServiceRequest{
+		Service:       types.ServiceChat,
+		Model:         request.Model,
+		FromFlavor:    "oadin",
+		HybridPolicy:  hybridPolicy,
+		AskStreamMode: request.Stream,
+		HTTP: types.HTTPContent{
+			Header: http.Header{"Content-Type": []string{"application/json"}},
+			Body:   body,
+		},
+		Context: ctx,
+	}
+
+	response := &types.Response{
+		ID:          newID("resp_"),
+		Object:      "response",
+		CreatedAt:   time.Now().Unix(),
+		Status:      "in_progress",
+		Model:       request.Model,
+		Output:      []any{},
+		Tools:       request.Tools,
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		Store:       request.Store == nil || *request.Store,
+		Metadata:    request.Metadata,
+	}
+	if response.Tools == nil {
+		response.Tools = []types.ResponsesTool{}
+	}
+	if response.Metadata == nil {
+		response.Metadata = map[string]string{}
+	}
+	response.MaxOutputTokens = request.MaxOutputTokens
+	if request.Instructions != "" {
+		response.Instructions = &request.Instructions
+	}
+	if request.PreviousResponseID != "" {
+		response.PreviousResponseID = &request.PreviousResponseID
+	}
+	run := &responseRun{
+		request:   request,
+		history:   history,
+		response:  response,
+		messageID: newID("msg_"),
+	}
+	return run, serviceRequest, nil
+}
+
+// complete fills in the output of the response from the final chat message
+func (run *responseRun) complete(chunk *types.OadinChatChunk) {
+	response := run.response
+	if chunk.Model != "" {
+		response.Model = chunk.Model
+	}
+	response.Status = "completed"
+	if chunk.FinishReason == "length" {
+		response.Status = "incomplete"
+		response.IncompleteDetails = map[string]string{"reason": "max_output_tokens"}
+	}
+	if chunk.Usage != nil {
+		response.Usage = &types.ResponsesUsage{
+			InputTokens:         chunk.Usage.PromptTokens,
+			InputTokensDetails:  map[string]int{"cached_tokens": 0},
+			OutputTokens:        chunk.Usage.CompletionTokens,
+			OutputTokensDetails: map[string]int{"reasoning_tokens": 0},
+			TotalTokens:         chunk.Usage.TotalTokens,
+		}
+	}
+
+	output := []any{}
+	message := types.OadinChatMessage{Role: "assistant", Content: chunk.Message.Content}
+	if chunk.Message.Content != "" {
+		output = append(output, &types.ResponsesMessageItem{
+			Type:    "message",
+			ID:      run.messageID,
+			Status:  "completed",
+			Role:    "assistant",
+			Content: []types.ResponsesContentPart{{Type: "output_text", Text: chunk.Message.Content, Annotations: []any{}}},
+		})
+	}
+	for _, call := range chunk.Message.ToolCalls {
+		if call.ID == "" {
+			call.ID = newID("call_")
+		}
+		call.Type = "function"
+		call.Index = nil
+		output = append(output, &types.ResponsesFunctionCallItem{
+			Type:      "function_call",
+			ID:        newID("fc_"),
+			Status:    "completed",
+			CallID:    call.ID,
+			Name:      call.Function.Name,
+			Arguments: toolCallArgumentsString(call.Function.Arguments),
+		})
+		call.Function.Arguments = toolCallArguments(toolCallArgumentsString(call.Function.Arguments))
+		message.ToolCalls = append(message.ToolCalls, call)
+	}
+	response.Output = output
+	run.history = append(run.history, message)
+}
+
+func (r *ResponsesImpl) save(ctx context.Context, run *responseRun) error {
+	if !run.response.Store {
+		return nil
+	}
+	messages, err := json.Marshal(run.history)
+	if err != nil {
+		return err
+	}
+	response, err := json.Marshal(run.response)
+	if err != nil {
+		return err
+	}
+	state := &types.ResponseState{
+		ID:                 run.response.ID,
+		PreviousResponseID: run.request.PreviousResponseID,
+		Model:              run.response.Model,
+		Messages:           string(messages),
+		Response:           string(response),
+	}
+	if err := r.Ds.Add(ctx, state); err != nil {
+		slog.Error("[Responses] Failed to save response", "id", state.ID, "error", err)
+		return bcode.ErrResponseSaveFailed.SetMessage(err.Error())
+	}
+	return nil
+}
+
+// responseStream turns the chunks of the chat service into typed stream events
+type responseStream struct {
+	ctx    context.Context
+	run    *responseRun
+	events chan<- *types.ResponsesStreamEvent
+	seq    int
+
+	text         strings.Builder
+	textStarted  bool
+	calls        []*types.OadinToolCall
+	callArgs     []*strings.Builder
+	model        string
+	finishReason string
+	usage        *types.OadinUsage
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func (s *responseStream) emit(event *types.ResponsesStreamEvent) {
+	event.SequenceNumber = s.seq
+	s.seq++
+	select {
+	case s.events <- event:
+	case <-s.ctx.Done():
+	}
+}
+
+func (s *responseStream) add(chunk *types.OadinChatChunk) {
+	if chunk.Model != "" {
+		s.model = chunk.Model
+	}
+	if chunk.FinishReason != "" {
+		s.finishReason = chunk.FinishReason
+	}
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+	if delta := chunk.Message.Content; delta != "" {
+		if !s.textStarted {
+			s.textStarted = true
+			s.emit(&types.ResponsesStreamEvent{
+				Type:        "response.output_item.added",
+				OutputIndex: intPtr(0),
+				Item: &types.ResponsesMessageItem{
+					Type: "message", ID: s.run.messageID, Status: "in_progress", Role: "assistant",
+					Content: []types.ResponsesContentPart{},
+				},
+			})
+			s.emit(&types.ResponsesStreamEvent{
+				Type:         "response.content_part.added",
+				ItemID:       s.run.messageID,
+				OutputIndex:  intPtr(0),
+				ContentIndex: intPtr(0),
+				Part:         &types.ResponsesContentPart{Type: "output_text", Annotations: []any{}},
+			})
+		}
+		s.text.WriteString(delta)
+		s.emit(&types.ResponsesStreamEvent{
+			Type:         "response.output_text.delta",
+			ItemID:       s.run.messageID,
+			OutputIndex:  intPtr(0),
+			ContentIndex: intPtr(0),
+			Delta:        delta,
+		})
+	}
+	s.addToolCalls(chunk.Message.ToolCalls)
+}
+
+// addToolCalls merges tool calls coming as a whole or as incremental fragments
+// of the arguments, matched by index or id
+func (s *responseStream) addToolCalls(calls []types.OadinToolCall) {
+	for _, call := range calls {
+		i := -1
+		for j, c := range s.calls {
+			if (call.Index != nil && c.Index != nil && *call.Index == *c.Index) || (call.Index == nil && call.ID != "" && call.ID == c.ID) {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			c := call
+			s.calls = append(s.calls, &c)
+			s.callArgs = append(s.callArgs, &strings.Builder{})
+			i = len(s.calls) - 1
+		} else {
+			if call.ID != "" {
+				s.calls[i].ID = call.ID
+			}
+			if call.Function.Name != "" {
+				s.calls[i].Function.Name = call.Function.Name
+			}
+		}
+		var fragment string
+		if err := json.Unmarshal(call.Function.Arguments, &fragment); err == nil {
+			s.callArgs[i].WriteString(fragment)
+		} else if len(call.Function.Arguments) > 0 {
+			s.callArgs[i].Reset()
+			s.callArgs[i].Write(call.Function.Arguments)
+		}
+	}
+}
+
+func (s *responseStream) finish() {
+	chunk := &types.OadinChatChunk{
+		Model:        s.model,
+		FinishReason: s.finishReason,
+		Usage:        s.usage,
+		Message:      types.OadinChatMessage{Role: "assistant", Content: s.text.String()},
+	}
+	for i, call := range s.calls {
+		c := *call
+		arguments, _ := json.Marshal(s.callArgs[i].String())
+		c.Function.Arguments = arguments
+		chunk.Message.ToolCalls = append(chunk.Message.ToolCalls, c)
+	}
+	s.run.complete(chunk)
+
+	for i, item := range s.run.response.Output {
+		switch item := item.(type) {
+		case *types.ResponsesMessageItem:
+			text := item.Content[0].Text
+			s.emit(&types.ResponsesStreamEvent{
+				Type: "response.output_text.done", ItemID: item.ID,
+				OutputIndex: intPtr(i), ContentIndex: intPtr(0), Text: &text,
+			})
+			s.emit(&types.ResponsesStreamEvent{
+				Type: "response.content_part.done", ItemID: item.ID,
+				OutputIndex: intPtr(i), ContentIndex: intPtr(0), Part: &item.Content[0],
+			})
+			s.emit(&types.ResponsesStreamEvent{Type: "response.output_item.done", OutputIndex: intPtr(i), Item: item})
+		case *types.ResponsesFunctionCallItem:
+			added := *item
+			added.Status = "in_progress"
+			added.Arguments = ""
+			s.emit(&types.ResponsesStreamEvent{Type: "response.output_item.added", OutputIndex: intPtr(i), Item: &added})
+			s.emit(&types.ResponsesStreamEvent{
+				Type: "response.function_call_arguments.delta", ItemID: item.ID,
+				OutputIndex: intPtr(i), Delta: item.Arguments,
+			})
+			s.emit(&types.ResponsesStreamEvent{
+				Type: "response.function_call_arguments.done", ItemID: item.ID,
+				OutputIndex: intPtr(i), Arguments: &item.Arguments,
+			})
+			s.emit(&types.ResponsesStreamEvent{Type: "response.output_item.done", OutputIndex: intPtr(i), Item: item})
+		}
+	}
+	eventType := "response.completed"
+	if s.run.response.Status == "incomplete" {
+		eventType = "response.incomplete"
+	}
+	s.emit(&types.ResponsesStreamEvent{Type: eventType, Response: s.run.response})
+}
+
+func (s *responseStream) fail(err error) {
+	response := s.run.response
+	response.Status = "failed"
+	response.Error = &types.ResponsesError{Code: "server_error", Message: err.Error()}
+	s.emit(&types.ResponsesStreamEvent{Type: "response.failed", Response: response})
+}
+
+// responsesInputMessages input is either a text or a list of input items
+func responsesInputMessages(input json.RawMessage) ([]types.OadinChatMessage, error) {
+	if len(input) == 0 {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(input, &text); err == nil {
+		return []types.OadinChatMessage{{Role: "user", Content: text}}, nil
+	}
+	var items []types.ResponsesInputItem
+	if err := json.Unmarshal(input, &items); err != nil {
+		return nil, fmt.Errorf("input should be a string or a list of input items: %s", err.Error())
+	}
+
+	var messages []types.OadinChatMessage
+	for _, item := range items {
+		switch item.Type {
+		case "", "message":
+			content, err := responsesContentText(item.Content)
+			if err != nil {
+				return nil, err
+			}
+			role := item.Role
+			if role == "developer" {
+				role = "system"
+			}
+			messages = append(messages, types.OadinChatMessage{Role: role, Content: content})
+		case "function_call":
+			call := types.OadinToolCall{ID: item.CallID, Type: "function"}
+			call.Function.Name = item.Name
+			call.Function.Arguments = toolCallArguments(item.Arguments)
+			// calls following each other were made in one assistant turn
+			if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+				messages[n-1].ToolCalls = append(messages[n-1].ToolCalls, call)
+			} else {
+				messages = append(messages, types.OadinChatMessage{Role: "assistant", ToolCalls: []types.OadinToolCall{call}})
+			}
+		case "function_call_output":
+			messages = append(messages, types.OadinChatMessage{Role: "tool", ToolCallID: item.CallID, Content: item.Output})
+		case "reasoning":
+			// reasoning of previous turns is not sent back to the model
+		default:
+			return nil, fmt.Errorf("unsupported input item type %s", item.Type)
+		}
+	}
+	return messages, nil
+}
+
+func responsesContentText(content json.RawMessage) (string, error) {
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return text, nil
+	}
+	var parts []types.ResponsesContentPart
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return "", fmt.Errorf("content should be a string or a list of content parts: %s", err.Error())
+	}
+	var sb strings.Builder
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text":
+			sb.WriteString(part.Text)
+		default:
+			return "", fmt.Errorf("unsupported content part type %s", part.Type)
+		}
+	}
+	return sb.String(), nil
+}
+
+// toolCallArguments oadin carries tool call arguments as an object while the
+// responses api has them as JSON encoded string
+func toolCallArguments(arguments string) json.RawMessage {
+	if strings.HasPrefix(strings.TrimSpace(arguments), "{") && json.Valid([]byte(arguments)) {
+		return json.RawMessage(arguments)
+	}
+	return json.RawMessage("{}")
+}
+
+func toolCallArgumentsString(arguments json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(arguments, &s); err == nil {
+		return s
+	}
+	if len(arguments) == 0 {
+		return "{}"
+	}
+	return string(arguments)
+}
+
+func responsesServiceError(err error) error {
+	var httpErr *types.HTTPErrorResponse
+	if errors.As(err, &httpErr) {
+		return &bcode.Bcode{
+			HTTPCode:     int32(httpErr.StatusCode),
+			BusinessCode: bcode.ErrResponsesInvokeService.BusinessCode,
+			Message:      string(httpErr.Body),
+		}
+	}
+	if err == nil {
+		return bcode.ErrResponsesInvokeService
+	}
+	return bcode.ErrResponsesInvokeService.SetMessage(err.Error())
+}
@@ -75,6 +75,13 @@ func (s *AIGCServiceImpl) CreateAIGCService(ctx context.Context, request *dto.Cr
 
 		m.ModelName = providerServiceInfo.DefaultModel
 	} else {
+		if request.ServiceName == types.ServiceRerank {
+			// no local engine serves rerank, it falls back to the embed service
+			return nil, bcode.ErrUnSupportAIGCService.SetMessage("rerank has no local engine, install it as a remote service or rely on the embed service")
+		}
+		if request.ServiceName == types.ServiceTextToSpeech {
+			return nil, bcode.ErrUnSupportAIGCService.SetMessage("text_to_speech has no local engine, install it as a remote service")
+		}
 		recommendConfig := getRecommendConfig(request.ServiceName)
 		// Check if ollama is installed locally and if it is available.
 		// If it is available, proceed to the next step. Otherwise, prompt that ollama is not installed.
@@ -373,7 +380,8 @@ func (s *AIGCServiceImpl) ImportService(ctx context.Context, request *dto.Import
 	}
 
 	for providerName, p := range request.ServiceProviders {
-		if !utils.Contains(types.SupportFlavor, p.APIFlavor) {
+		// user defined flavors are supported as well as the builtin ones
+		if _, err := schedule.GetAPIFlavor(p.APIFlavor); err != nil {
 			return nil, bcode.ErrUnSupportFlavor
 		}
 		if !utils.Contains(types.SupportAuthType, p.AuthType) {
@@ -716,6 +724,11 @@ func getRecommendConfig(service string) types.RecommendConfig {
 		}
 	case types.ServiceModels:
 		return types.RecommendConfig{}
+	case types.ServiceSpeechToText:
+		return types.RecommendConfig{
+			ModelEngine: "whisper",
+			ModelName:   "base",
+		}
 	case types.ServiceGenerate:
 		return types.RecommendConfig{
 			ModelEngine:       "ollama",
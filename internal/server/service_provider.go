@@ -5,17 +5,20 @@ import (
 	"strconv"
 
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"oadin/internal/api/dto"
+	"oadin/internal/convert"
 	"oadin/internal/datastore"
 	"oadin/internal/provider"
 	"oadin/internal/schedule"
@@ -30,6 +33,7 @@ type ServiceProvider interface {
 	UpdateServiceProvider(ctx context.Context, request *dto.UpdateServiceProviderRequest) (*dto.UpdateServiceProviderResponse, error)
 	GetServiceProvider(ctx context.Context, request *dto.GetServiceProviderRequest) (*dto.GetServiceProviderResponse, error)
 	GetServiceProviders(ctx context.Context, request *dto.GetServiceProvidersRequest) (*dto.GetServiceProvidersResponse, error)
+	GetServiceProvidersHealth(ctx context.Context) (*dto.GetServiceProvidersHealthResponse, error)
 }
 
 type ServiceProviderImpl struct {
@@ -184,39 +188,35 @@ func (s *ServiceProviderImpl) CreateServiceProvider(ctx context.Context, request
 	if err != nil {
 		return nil, err
 	}
-	if request.ServiceName == types.ServiceChat {
+	// the generate service of the same provider, if its flavor has one
+	generateProviderServiceInfo := schedule.GetProviderServiceDefaultInfo(request.ApiFlavor, types.ServiceGenerate)
+	if request.ServiceName == types.ServiceChat && generateProviderServiceInfo.RequestUrl != "" {
 		generateSp := &types.ServiceProvider{}
-		generateSp.ProviderName = request.ProviderName
+		generateSp.ProviderName = strings.Replace(request.ProviderName, "chat", "generate", -1)
 
 		generateSpIsExist, err := ds.IsExist(ctx, generateSp)
 		if err != nil {
 			return nil, err
 		}
-		if !generateSpIsExist {
-			generateProviderServiceInfo := schedule.GetProviderServiceDefaultInfo(request.ApiFlavor, strings.Replace(request.ServiceName, "chat", "generate", -1))
-
-			generateSp.ServiceName = strings.Replace(request.ServiceName, "chat", "generate", -1)
+		if !generateSpIsExist && generateSp.ProviderName != request.ProviderName {
+			generateSp.ServiceName = types.ServiceGenerate
 			generateSp.ServiceSource = request.ServiceSource
 			generateSp.Flavor = request.ApiFlavor
 			generateSp.AuthType = request.AuthType
-			generateSp.AuthType = request.AuthType
-			if request.AuthType != types.AuthTypeNone && request.AuthKey == "" {
-				return nil, bcode.ErrProviderAuthInfoLost
-			}
 			generateSp.AuthKey = request.AuthKey
-			generateSp.Desc = request.Desc
-			generateSp.Method = request.Method
+			generateSp.Desc = strings.Replace(request.Desc, "chat", "generate", -1)
+			generateSp.Method = sp.Method
 			generateSp.URL = generateProviderServiceInfo.RequestUrl
-			generateSp.ExtraHeaders = request.ExtraHeaders
-			if request.ExtraHeaders == "" {
-				generateSp.ExtraHeaders = providerServiceInfo.ExtraHeaders
-			}
-			generateSp.ExtraJSONBody = request.ExtraJsonBody
-			generateSp.Properties = request.Properties
+			generateSp.ExtraHeaders = sp.ExtraHeaders
+			generateSp.ExtraJSONBody = sp.ExtraJSONBody
+			generateSp.Properties = sp.Properties
+			generateSp.Status = sp.Status
 			generateSp.CreatedAt = time.Now()
 			generateSp.UpdatedAt = time.Now()
+			if err := ds.Add(ctx, generateSp); err != nil {
+				return nil, err
+			}
 		}
-
 	}
 
 	return &dto.CreateServiceProviderResponse{
@@ -641,6 +641,10 @@ func (s *ServiceProviderImpl) GetServiceProviders(ctx context.Context, request *
 		return nil, err
 	}
 
+	queueStats := schedule.QueueStats()
+	breakerStates := schedule.BreakerStates()
+	tokenUsage := schedule.TokenUsage()
+	latencies := schedule.Latencies()
 	respData := make([]dto.ServiceProvider, 0)
 	for _, v := range list {
 		dsProvider := v.(*types.ServiceProvider)
@@ -721,6 +725,16 @@ func (s *ServiceProviderImpl) GetServiceProviders(ctx context.Context, request *
 			UpdatedAt:     dsProvider.UpdatedAt,
 			Models:        mNameList,
 		}
+		if stats, ok := queueStats[dsProvider.ProviderName]; ok {
+			tmp.Queue = &stats
+		}
+		tmp.Breaker = breakerState(breakerStates, dsProvider.ProviderName)
+		if usage, ok := tokenUsage[dsProvider.ProviderName]; ok {
+			tmp.Usage = &usage
+		}
+		if latency, ok := latencies[dsProvider.ProviderName]; ok {
+			tmp.Latency = &latency
+		}
 		respData = append(respData, *tmp)
 	}
 
@@ -756,6 +770,21 @@ type CheckTextToImageServer struct {
 	ModelName       string
 }
 
+type CheckRerankServer struct {
+	ServiceProvider types.ServiceProvider
+	ModelName       string
+}
+
+type CheckSpeechToTextServer struct {
+	ServiceProvider types.ServiceProvider
+	ModelName       string
+}
+
+type CheckTextToSpeechServer struct {
+	ServiceProvider types.ServiceProvider
+	ModelName       string
+}
+
 func (m *CheckModelsServer) CheckServer() bool {
 	req, err := http.NewRequest(m.ServiceProvider.Method, m.ServiceProvider.URL, nil)
 	if err != nil {
@@ -772,9 +801,10 @@ func (c *CheckChatServer) CheckServer() bool {
 		Content string `json:"content"`
 	}
 	type RequestBody struct {
-		Model    string    `json:"model"`
-		Messages []Message `json:"messages"`
-		Stream   bool      `json:"stream"`
+		Model     string    `json:"model"`
+		Messages  []Message `json:"messages"`
+		Stream    bool      `json:"stream"`
+		MaxTokens int       `json:"max_tokens,omitempty"`
 	}
 
 	requestBody := RequestBody{
@@ -787,12 +817,19 @@ func (c *CheckChatServer) CheckServer() bool {
 			},
 		},
 	}
+	if c.ServiceProvider.Flavor == types.FlavorAnthropic {
+		// max_tokens is required by the anthropic messages api
+		requestBody.MaxTokens = 16
+	}
 	jsonData, err := json.Marshal(requestBody)
+	if c.ServiceProvider.Flavor == types.FlavorGemini {
+		jsonData, err = json.Marshal(geminiCheckContent(requestBody.Messages[0].Content))
+	}
 	if err != nil {
 		slog.Error("[Schedule] Failed to marshal request body", "error", err)
 		return false
 	}
-	req, err := http.NewRequest(c.ServiceProvider.Method, c.ServiceProvider.URL, bytes.NewReader(jsonData))
+	req, err := http.NewRequest(c.ServiceProvider.Method, checkServerURL(c.ServiceProvider, c.ModelName), bytes.NewReader(jsonData))
 	if err != nil {
 		slog.Error("[Schedule] Failed to prepare request", "error", err)
 		return false
@@ -806,7 +843,18 @@ func (c *CheckChatServer) CheckServer() bool {
 }
 
 func (g *CheckGenerateServer) CheckServer() bool {
-	return false
+	jsonData, err := json.Marshal(map[string]any{
+		"model":   g.ModelName,
+		"prompt":  "Hello",
+		"options": map[string]any{"max_tokens": 8},
+	})
+	if err != nil {
+		slog.Error("[Schedule] Failed to marshal request body", "error", err)
+		return false
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return checkServerFromOadin(g.ServiceProvider, g.ModelName, types.HTTPContent{Body: jsonData, Header: header})
 }
 
 func (e *CheckEmbeddingServer) CheckServer() bool {
@@ -825,11 +873,17 @@ func (e *CheckEmbeddingServer) CheckServer() bool {
 		EncodingFormat: "float",
 	}
 	jsonData, err := json.Marshal(requestBody)
+	if e.ServiceProvider.Flavor == types.FlavorGemini {
+		content := geminiCheckContent(requestBody.Input[0])
+		jsonData, err = json.Marshal(map[string]any{
+			"requests": []any{map[string]any{"model": "models/" + e.ModelName, "content": content["contents"][0]}},
+		})
+	}
 	if err != nil {
 		slog.Error("[Schedule] Failed to marshal request body", "error", err)
 		return false
 	}
-	req, err := http.NewRequest(e.ServiceProvider.Method, e.ServiceProvider.URL, bytes.NewReader(jsonData))
+	req, err := http.NewRequest(e.ServiceProvider.Method, checkServerURL(e.ServiceProvider, e.ModelName), bytes.NewReader(jsonData))
 	if err != nil {
 		slog.Error("[Schedule] Failed to prepare request", "error", err)
 		return false
@@ -914,6 +968,128 @@ func (e *CheckTextToImageServer) CheckServer() bool {
 	return status
 }
 
+func (r *CheckRerankServer) CheckServer() bool {
+	query := "什么是熊猫？"
+	documents := []string{"熊猫是一种生活在中国的熊科动物", "今天天气很好"}
+	var jsonData []byte
+	var err error
+	switch r.ServiceProvider.Flavor {
+	case types.FlavorAliYun:
+		jsonData, err = json.Marshal(map[string]any{
+			"model":      r.ModelName,
+			"input":      map[string]any{"query": query, "documents": documents},
+			"parameters": map[string]any{"top_n": 1},
+		})
+	default:
+		jsonData, err = json.Marshal(types.OadinRerankRequest{
+			Model:     r.ModelName,
+			Query:     query,
+			Documents: documents,
+			TopN:      1,
+		})
+	}
+	if err != nil {
+		slog.Error("[Schedule] Failed to marshal request body", "error", err)
+		return false
+	}
+	req, err := http.NewRequest(r.ServiceProvider.Method, r.ServiceProvider.URL, bytes.NewReader(jsonData))
+	if err != nil {
+		slog.Error("[Schedule] Failed to prepare request", "error", err)
+		return false
+	}
+	content := types.HTTPContent{
+		Body:   jsonData,
+		Header: req.Header,
+	}
+	return CheckServerRequest(req, r.ServiceProvider, content)
+}
+
+func (s *CheckSpeechToTextServer) CheckServer() bool {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	_ = writer.WriteField("model", s.ModelName)
+	part, err := writer.CreateFormFile("file", "check.wav")
+	if err != nil {
+		return false
+	}
+	_, _ = part.Write(silentWav(16000, 500*time.Millisecond))
+	if err := writer.Close(); err != nil {
+		return false
+	}
+	header := http.Header{}
+	header.Set("Content-Type", writer.FormDataContentType())
+	return checkServerFromOadin(s.ServiceProvider, s.ModelName, types.HTTPContent{Body: buf.Bytes(), Header: header})
+}
+
+func (s *CheckTextToSpeechServer) CheckServer() bool {
+	jsonData, err := json.Marshal(map[string]any{
+		"model": s.ModelName,
+		"input": "你好",
+	})
+	if err != nil {
+		slog.Error("[Schedule] Failed to marshal request body", "error", err)
+		return false
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return checkServerFromOadin(s.ServiceProvider, s.ModelName, types.HTTPContent{Body: jsonData, Header: header})
+}
+
+// checkServerFromOadin sends the request given in the oadin flavor, converted
+// to the flavor of the provider, for the services whose bodies are not plain JSON
+func checkServerFromOadin(sp types.ServiceProvider, modelName string, content types.HTTPContent) bool {
+	oadin, err := schedule.GetAPIFlavor("oadin")
+	if err != nil {
+		return false
+	}
+	flavor, err := schedule.GetAPIFlavor(sp.Flavor)
+	if err != nil {
+		slog.Error("[Schedule] Unsupported API flavor", "flavor", sp.Flavor)
+		return false
+	}
+	content, err = schedule.ConvertBetweenFlavors(oadin, flavor, sp.ServiceName, "request", content,
+		convert.ConvertContext{"model": modelName, "stream": false})
+	if err != nil {
+		slog.Error("[Schedule] Failed to convert request", "error", err)
+		return false
+	}
+	req, err := http.NewRequest(sp.Method, checkServerURL(sp, modelName), bytes.NewReader(content.Body))
+	if err != nil {
+		slog.Error("[Schedule] Failed to prepare request", "error", err)
+		return false
+	}
+	req.Header.Set("Content-Type", content.Header.Get("Content-Type"))
+	return CheckServerRequest(req, sp, types.HTTPContent{Body: content.Body, Header: req.Header})
+}
+
+// silentWav a mono 16 bit PCM wav of silence
+func silentWav(sampleRate int, d time.Duration) []byte {
+	dataLen := int(d.Seconds()*float64(sampleRate)) * 2
+	buf := bytes.NewBuffer(make([]byte, 0, 44+dataLen))
+	buf.WriteString("RIFF")
+	_ = binary.Write(buf, binary.LittleEndian, uint32(36+dataLen))
+	buf.WriteString("WAVEfmt ")
+	for _, v := range []any{uint32(16), uint16(1), uint16(1), uint32(sampleRate), uint32(sampleRate * 2), uint16(2), uint16(16)} {
+		_ = binary.Write(buf, binary.LittleEndian, v)
+	}
+	buf.WriteString("data")
+	_ = binary.Write(buf, binary.LittleEndian, uint32(dataLen))
+	buf.Write(make([]byte, dataLen))
+	return buf.Bytes()
+}
+
+// checkServerURL some providers (e.g. gemini) carry the model in the url path
+func checkServerURL(sp types.ServiceProvider, modelName string) string {
+	return strings.ReplaceAll(sp.URL, "{model}", url.PathEscape(modelName))
+}
+
+// geminiCheckContent gemini takes a list of contents made of parts instead of messages
+func geminiCheckContent(text string) map[string][]map[string]any {
+	return map[string][]map[string]any{
+		"contents": {{"role": "user", "parts": []map[string]string{{"text": text}}}},
+	}
+}
+
 func ChooseCheckServer(sp types.ServiceProvider, modelName string) ModelServiceManager {
 	var server ModelServiceManager
 	switch sp.ServiceName {
@@ -927,6 +1103,12 @@ func ChooseCheckServer(sp types.ServiceProvider, modelName string) ModelServiceM
 		server = &CheckEmbeddingServer{ServiceProvider: sp, ModelName: modelName}
 	case types.ServiceTextToImage:
 		server = &CheckTextToImageServer{ServiceProvider: sp, ModelName: modelName}
+	case types.ServiceRerank:
+		server = &CheckRerankServer{ServiceProvider: sp, ModelName: modelName}
+	case types.ServiceSpeechToText:
+		server = &CheckSpeechToTextServer{ServiceProvider: sp, ModelName: modelName}
+	case types.ServiceTextToSpeech:
+		server = &CheckTextToSpeechServer{ServiceProvider: sp, ModelName: modelName}
 	default:
 		slog.Error("[Schedule] Unknown service name", "error", sp.ServiceName)
 		return nil
@@ -953,7 +1135,9 @@ func CheckServerRequest(req *http.Request, serviceProvider types.ServiceProvider
 
 	}
 	client := &http.Client{Transport: transport}
-	req.Header.Set("Content-Type", "application/json")
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	if serviceProvider.AuthType != "none" {
 		authParams := &schedule.AuthenticatorParams{
 			Request:      req,
@@ -1001,3 +1185,36 @@ func CheckServerRequest(req *http.Request, serviceProvider types.ServiceProvider
 	}
 	return true
 }
+
+// GetServiceProvidersHealth tells the service providers whose circuit breaker is open
+func (s *ServiceProviderImpl) GetServiceProvidersHealth(ctx context.Context) (*dto.GetServiceProvidersHealthResponse, error) {
+	list, err := s.Ds.List(ctx, &types.ServiceProvider{}, &datastore.ListOptions{Page: 0, PageSize: 100})
+	if err != nil {
+		return nil, err
+	}
+	breakerStates := schedule.BreakerStates()
+	respData := make([]dto.ServiceProviderHealth, 0, len(list))
+	for _, v := range list {
+		dsProvider := v.(*types.ServiceProvider)
+		state := breakerState(breakerStates, dsProvider.ProviderName)
+		respData = append(respData, dto.ServiceProviderHealth{
+			ProviderName:  dsProvider.ProviderName,
+			ServiceName:   dsProvider.ServiceName,
+			ServiceSource: dsProvider.ServiceSource,
+			Healthy:       state.State != types.BreakerOpen,
+			Breaker:       state,
+		})
+	}
+	return &dto.GetServiceProvidersHealthResponse{
+		Bcode: *bcode.ServiceProviderCode,
+		Data:  respData,
+	}, nil
+}
+
+// breakerState the breaker of a provider that hasn't run any task is closed
+func breakerState(states map[string]types.ProviderBreakerState, providerName string) types.ProviderBreakerState {
+	if state, ok := states[providerName]; ok {
+		return state
+	}
+	return types.ProviderBreakerState{State: types.BreakerClosed}
+}
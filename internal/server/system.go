@@ -6,6 +6,7 @@ import (
 	"oadin/internal/api/dto"
 	"oadin/internal/cache"
 	"oadin/internal/provider"
+	"oadin/internal/schedule"
 	"oadin/internal/utils/bcode"
 )
 
@@ -16,6 +17,7 @@ type System interface {
 	GetSystemSettings(ctx context.Context) (*cache.SystemSettings, error)
 	GetOllamaRegistry() (string, error)
 	RestartOllama(ctx context.Context) error
+	ReloadFlavors(ctx context.Context) (*dto.ReloadFlavorsResponse, error)
 }
 
 type SystemImpl struct {
@@ -201,3 +203,13 @@ func (s *SystemImpl) GetOllamaRegistry() (string, error) {
 	}
 	return settings.OllamaRegistry, nil
 }
+
+// ReloadFlavors 重新加载 API flavor 定义
+func (s *SystemImpl) ReloadFlavors(ctx context.Context) (*dto.ReloadFlavorsResponse, error) {
+	results := schedule.ReloadAPIFlavors()
+	resp := &dto.ReloadFlavorsResponse{Bcode: *bcode.FlavorCode, Data: make([]dto.FlavorReloadResult, 0, len(results))}
+	for _, r := range results {
+		resp.Data = append(resp.Data, dto.FlavorReloadResult{Flavor: r.Flavor, Status: r.Status, Error: r.Error})
+	}
+	return resp, nil
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"oadin/internal/api/dto"
+	"oadin/internal/schedule"
+	"oadin/internal/utils/bcode"
+)
+
+// Tasks the service tasks waiting and running in the scheduler
+type Tasks interface {
+	ListTasks(ctx context.Context) (*dto.ListTasksResponse, error)
+	CancelTask(ctx context.Context, id uint64) (*dto.CancelTaskResponse, error)
+}
+
+type TasksImpl struct{}
+
+func NewTasks() Tasks {
+	return &TasksImpl{}
+}
+
+func (t *TasksImpl) ListTasks(ctx context.Context) (*dto.ListTasksResponse, error) {
+	return &dto.ListTasksResponse{
+		Bcode: *bcode.TasksCode,
+		Data:  schedule.GetScheduler().Tasks(),
+	}, nil
+}
+
+// CancelTask cancels the task as if its client had gone, it completes with an
+// error once the scheduler has stopped it
+func (t *TasksImpl) CancelTask(ctx context.Context, id uint64) (*dto.CancelTaskResponse, error) {
+	if !schedule.GetScheduler().Cancel(id) {
+		return nil, bcode.ErrTaskNotFound.SetMessage(fmt.Sprintf("task %d not found", id))
+	}
+	return &dto.CancelTaskResponse{Bcode: *bcode.TasksCode}, nil
+}
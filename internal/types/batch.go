@@ -0,0 +1,235 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	BatchStatusValidating = "validating"
+	BatchStatusInProgress = "in_progress"
+	BatchStatusFinalizing = "finalizing"
+	BatchStatusCompleted  = "completed"
+	BatchStatusFailed     = "failed"
+	BatchStatusExpired    = "expired"
+	BatchStatusCancelling = "cancelling"
+	BatchStatusCancelled  = "cancelled"
+)
+
+const (
+	FilePurposeBatch       = "batch"
+	FilePurposeBatchOutput = "batch_output"
+)
+
+// BatchFile a file of the openai files api, uploaded as the input of a batch
+// or written as its output. The content is kept on disk at Path
+type BatchFile struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Purpose   string    `json:"purpose"`
+	Bytes     int64     `json:"bytes"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (f *BatchFile) SetCreateTime(t time.Time) { f.CreatedAt = t }
+func (f *BatchFile) SetUpdateTime(t time.Time) { f.UpdatedAt = t }
+func (f *BatchFile) PrimaryKey() string        { return "id" }
+func (f *BatchFile) TableName() string         { return "batch_files" }
+func (f *BatchFile) Index() map[string]interface{} {
+	index := make(map[string]interface{})
+	if f.ID != "" {
+		index["id"] = f.ID
+	}
+	if f.Purpose != "" {
+		index["purpose"] = f.Purpose
+	}
+	return index
+}
+
+// Object the file as the openai files api sends it back
+func (f *BatchFile) Object() *FileObject {
+	return &FileObject{
+		ID:        f.ID,
+		Object:    "file",
+		Bytes:     f.Bytes,
+		CreatedAt: f.CreatedAt.Unix(),
+		Filename:  f.Filename,
+		Purpose:   f.Purpose,
+	}
+}
+
+type FileObject struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+}
+
+// Batch a batch of the openai batch api. The *At fields are unix seconds,
+// zero until the batch gets there
+type Batch struct {
+	ID               string    `json:"id"`
+	Endpoint         string    `json:"endpoint"`
+	InputFileID      string    `json:"input_file_id"`
+	CompletionWindow string    `json:"completion_window"`
+	Status           string    `json:"status"`
+	OutputFileID     string    `json:"output_file_id"`
+	ErrorFileID      string    `json:"error_file_id"`
+	Errors           string    `json:"errors"`   // BatchErrors as JSON
+	Metadata         string    `json:"metadata"` // map[string]string as JSON
+	Total            int       `json:"total"`
+	Completed        int       `json:"completed"`
+	Failed           int       `json:"failed"`
+	InProgressAt     int64     `json:"in_progress_at"`
+	ExpiresAt        int64     `json:"expires_at"`
+	FinalizingAt     int64     `json:"finalizing_at"`
+	CompletedAt      int64     `json:"completed_at"`
+	FailedAt         int64     `json:"failed_at"`
+	ExpiredAt        int64     `json:"expired_at"`
+	CancellingAt     int64     `json:"cancelling_at"`
+	CancelledAt      int64     `json:"cancelled_at"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+func (b *Batch) SetCreateTime(t time.Time) { b.CreatedAt = t }
+func (b *Batch) SetUpdateTime(t time.Time) { b.UpdatedAt = t }
+func (b *Batch) PrimaryKey() string        { return "id" }
+func (b *Batch) TableName() string         { return "batches" }
+func (b *Batch) Index() map[string]interface{} {
+	index := make(map[string]interface{})
+	if b.ID != "" {
+		index["id"] = b.ID
+	}
+	return index
+}
+
+// Done tells whether the batch has come to an end, it won't change any more
+func (b *Batch) Done() bool {
+	switch b.Status {
+	case BatchStatusCompleted, BatchStatusFailed, BatchStatusExpired, BatchStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// Object the batch as the openai batch api sends it back
+func (b *Batch) Object() *BatchObject {
+	o := &BatchObject{
+		ID:               b.ID,
+		Object:           "batch",
+		Endpoint:         b.Endpoint,
+		InputFileID:      b.InputFileID,
+		CompletionWindow: b.CompletionWindow,
+		Status:           b.Status,
+		OutputFileID:     optional(b.OutputFileID),
+		ErrorFileID:      optional(b.ErrorFileID),
+		CreatedAt:        b.CreatedAt.Unix(),
+		InProgressAt:     optional(b.InProgressAt),
+		ExpiresAt:        optional(b.ExpiresAt),
+		FinalizingAt:     optional(b.FinalizingAt),
+		CompletedAt:      optional(b.CompletedAt),
+		FailedAt:         optional(b.FailedAt),
+		ExpiredAt:        optional(b.ExpiredAt),
+		CancellingAt:     optional(b.CancellingAt),
+		CancelledAt:      optional(b.CancelledAt),
+		RequestCounts:    BatchRequestCounts{Total: b.Total, Completed: b.Completed, Failed: b.Failed},
+		Metadata:         map[string]string{},
+	}
+	if b.Errors != "" {
+		o.Errors = &BatchErrors{}
+		_ = json.Unmarshal([]byte(b.Errors), o.Errors)
+	}
+	if b.Metadata != "" {
+		_ = json.Unmarshal([]byte(b.Metadata), &o.Metadata)
+	}
+	return o
+}
+
+// optional the zero value is sent back as null
+func optional[T comparable](v T) *T {
+	var zero T
+	if v == zero {
+		return nil
+	}
+	return &v
+}
+
+type BatchObject struct {
+	ID               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	Errors           *BatchErrors       `json:"errors"`
+	InputFileID      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileID     *string            `json:"output_file_id"`
+	ErrorFileID      *string            `json:"error_file_id"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     *int64             `json:"in_progress_at"`
+	ExpiresAt        *int64             `json:"expires_at"`
+	FinalizingAt     *int64             `json:"finalizing_at"`
+	CompletedAt      *int64             `json:"completed_at"`
+	FailedAt         *int64             `json:"failed_at"`
+	ExpiredAt        *int64             `json:"expired_at"`
+	CancellingAt     *int64             `json:"cancelling_at"`
+	CancelledAt      *int64             `json:"cancelled_at"`
+	RequestCounts    BatchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata"`
+}
+
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+type BatchErrors struct {
+	Object string       `json:"object"`
+	Data   []BatchError `json:"data"`
+}
+
+type BatchError struct {
+	Code    string  `json:"code"`
+	Message string  `json:"message"`
+	Param   *string `json:"param"`
+	Line    *int    `json:"line"`
+}
+
+type CreateBatchRequest struct {
+	InputFileID      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// BatchRequestLine a line of the input file of a batch
+type BatchRequestLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// BatchResultLine a line of the output or the error file of a batch
+type BatchResultLine struct {
+	ID       string               `json:"id"`
+	CustomID string               `json:"custom_id"`
+	Response *BatchResultResponse `json:"response"`
+	Error    *BatchResultError    `json:"error"`
+}
+
+type BatchResultResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type BatchResultError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
@@ -15,31 +15,44 @@ const (
 	FlavorBaidu       = "baidu"
 	FlavorAliYun      = "aliyun"
 	FlavorSmartVision = "smartvision"
+	FlavorAnthropic   = "anthropic"
+	FlavorGemini      = "gemini"
+	FlavorWhisper     = "whisper"
 
 	AuthTypeNone        = "none"
 	AuthTypeApiKey      = "apikey"
 	AuthTypeToken       = "token"
 	AuthTypeCredentials = "credentials"
 
-	ServiceChat        = "chat"
-	ServiceModels      = "models"
-	ServiceGenerate    = "generate"
-	ServiceEmbed       = "embed"
-	ServiceTextToImage = "text_to_image"
+	ServiceChat         = "chat"
+	ServiceModels       = "models"
+	ServiceGenerate     = "generate"
+	ServiceEmbed        = "embed"
+	ServiceTextToImage  = "text_to_image"
+	ServiceRerank       = "rerank"
+	ServiceSpeechToText = "speech_to_text"
+	ServiceTextToSpeech = "text_to_speech"
 
 	HybridPolicyDefault = "default"
 	HybridPolicyLocal   = "always_local"
 	HybridPolicyRemote  = "always_remote"
+	// runs on one side and fails over to the other when the provider can't be reached
+	HybridPolicyLocalThenRemote = "local_then_remote"
+	HybridPolicyRemoteThenLocal = "remote_then_local"
+	HybridPolicyContextLength   = "context_length"
+	HybridPolicyFastest         = "fastest"
+	HybridPolicyCheapest        = "cheapest"
+	HybridPolicyRace            = "race"
 
 	VersionRecordStatusInstalled = 1
 	VersionRecordStatusUpdated   = 2
 )
 
 var (
-	SupportService      = []string{ServiceEmbed, ServiceModels, ServiceChat, ServiceGenerate, ServiceTextToImage}
-	SupportHybridPolicy = []string{HybridPolicyDefault, HybridPolicyLocal, HybridPolicyRemote}
+	SupportService      = []string{ServiceEmbed, ServiceModels, ServiceChat, ServiceGenerate, ServiceTextToImage, ServiceRerank, ServiceSpeechToText, ServiceTextToSpeech}
+	SupportHybridPolicy = []string{HybridPolicyDefault, HybridPolicyLocal, HybridPolicyRemote, HybridPolicyLocalThenRemote, HybridPolicyRemoteThenLocal, HybridPolicyContextLength, HybridPolicyFastest, HybridPolicyCheapest, HybridPolicyRace}
 	SupportAuthType     = []string{AuthTypeNone, AuthTypeApiKey, AuthTypeToken, AuthTypeCredentials}
-	SupportFlavor       = []string{FlavorDeepSeek, FlavorOpenAI, FlavorTencent, FlavorOllama, FlavorBaidu, FlavorAliYun, FlavorSmartVision}
+	SupportFlavor       = []string{FlavorDeepSeek, FlavorOpenAI, FlavorTencent, FlavorOllama, FlavorBaidu, FlavorAliYun, FlavorSmartVision, FlavorAnthropic, FlavorGemini, FlavorWhisper}
 )
 
 // Service  table structure
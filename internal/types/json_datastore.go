@@ -24,6 +24,7 @@ type SupportModel struct {
 	ThinkSwitch   bool      `json:"think_switch"`
 	Tools         bool      `json:"tools"`   // 是否支持工具调用
 	Context       float32   `json:"context"` // 上下文长度
+	Vision        bool      `json:"vision"`  // 是否支持图片输入
 }
 
 func (s *SupportModel) TableName() string {
@@ -56,3 +56,25 @@ type OadinEmbeddingResponse struct {
 	Model string         `json:"model"`
 	Usage map[string]int `json:"usage"`
 }
+
+type OadinRerankRequest struct {
+	Model           string   `json:"model"`
+	Query           string   `json:"query"`
+	Documents       []string `json:"documents"`
+	TopN            int      `json:"top_n,omitempty"`
+	ReturnDocuments bool     `json:"return_documents,omitempty"`
+}
+
+type OadinRerankResult struct {
+	Index          int     `json:"index"`
+	RelevanceScore float64 `json:"relevance_score"`
+	Document       *string `json:"document,omitempty"`
+}
+
+// OadinRerankResponse results are sorted by relevance_score, the most relevant first
+type OadinRerankResponse struct {
+	ID      string              `json:"id"`
+	Model   string              `json:"model"`
+	Results []OadinRerankResult `json:"results"`
+	Usage   map[string]int      `json:"usage,omitempty"`
+}
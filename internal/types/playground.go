@@ -1,6 +1,8 @@
 package types
 
 import (
+	"encoding/json"
+	"strings"
 	"time"
 )
 
@@ -45,6 +47,7 @@ type ChatMessage struct {
 	ModelName     string    `json:"model_name,omitempty"`       // 新增字段，模型名称
 	TotalDuration int64     `json:"total_duration,omitempty"`   // 总耗时，单位秒
 	IsToolGroupID bool      `json:"is_tool_group_id,omitempty"` // 是否是工具组ID
+	ImageIDs      string    `json:"image_ids,omitempty"`        // 附带图片的文件ID，逗号分隔
 }
 
 func (m *ChatMessage) SetCreateTime(t time.Time) { m.CreatedAt = t }
@@ -106,13 +109,114 @@ func (m *ToolMessage) Index() map[string]interface{} {
 
 // 聊天请求模型
 type ChatRequest struct {
-	Model       string              `json:"model"`
-	Messages    []map[string]string `json:"messages"`
-	Temperature float32             `json:"temperature,omitempty"`
-	MaxTokens   int                 `json:"max_tokens,omitempty"`
-	Stream      bool                `json:"stream,omitempty"`
-	Think       bool                `json:"think"`
-	Tools       []Tool              `json:"tools,omitempty"` // 新增，支持Ollama工具调用
+	Model       string               `json:"model"`
+	Messages    []ChatRequestMessage `json:"messages"`
+	Temperature float32              `json:"temperature,omitempty"`
+	MaxTokens   int                  `json:"max_tokens,omitempty"`
+	Stream      bool                 `json:"stream,omitempty"`
+	Think       bool                 `json:"think"`
+	Tools       []Tool               `json:"tools,omitempty"` // 新增，支持Ollama工具调用
+}
+
+// ChatRequestMessage 聊天请求中的一条消息，Images 为附带的图片，
+// 可以是 http(s) URL、data URL 或 base64
+type ChatRequestMessage struct {
+	Role    string
+	Content string
+	Images  []string
+}
+
+// ChatContentPart 多模态消息的内容片段，与 openai 的 content parts 一致
+type ChatContentPart struct {
+	Type     string        `json:"type"`
+	Text     string        `json:"text,omitempty"`
+	ImageURL *ChatImageURL `json:"image_url,omitempty"`
+}
+
+type ChatImageURL struct {
+	URL string `json:"url"`
+}
+
+// MarshalJSON 没有图片时 content 为字符串，有图片时为 text 和 image_url 片段
+func (m ChatRequestMessage) MarshalJSON() ([]byte, error) {
+	if len(m.Images) == 0 {
+		return json.Marshal(map[string]string{"role": m.Role, "content": m.Content})
+	}
+	parts := make([]ChatContentPart, 0, len(m.Images)+1)
+	if m.Content != "" {
+		parts = append(parts, ChatContentPart{Type: "text", Text: m.Content})
+	}
+	for _, image := range m.Images {
+		parts = append(parts, ChatContentPart{Type: "image_url", ImageURL: &ChatImageURL{URL: ImageDataURL(image)}})
+	}
+	return json.Marshal(map[string]any{"role": m.Role, "content": parts})
+}
+
+func (m *ChatRequestMessage) UnmarshalJSON(data []byte) error {
+	var msg struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+		Images  []string        `json:"images"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	*m = ChatRequestMessage{Role: msg.Role, Images: msg.Images}
+	if len(msg.Content) == 0 || msg.Content[0] != '[' {
+		_ = json.Unmarshal(msg.Content, &m.Content)
+		return nil
+	}
+	var parts []ChatContentPart
+	if err := json.Unmarshal(msg.Content, &parts); err != nil {
+		return err
+	}
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		switch {
+		case part.Type == "text":
+			texts = append(texts, part.Text)
+		case part.Type == "image_url" && part.ImageURL != nil:
+			m.Images = append(m.Images, part.ImageURL.URL)
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// imageSignatures base64 编码后的图片文件头
+var imageSignatures = []struct{ prefix, mediaType string }{
+	{"iVBORw0KGgo", "image/png"},
+	{"/9j/", "image/jpeg"},
+	{"R0lGOD", "image/gif"},
+	{"UklGR", "image/webp"},
+	{"Qk", "image/bmp"},
+}
+
+// ImageMediaType 由 base64 数据的文件头判断图片类型，无法判断时为 image/jpeg
+func ImageMediaType(data string) string {
+	for _, sig := range imageSignatures {
+		if strings.HasPrefix(data, sig.prefix) {
+			return sig.mediaType
+		}
+	}
+	return "image/jpeg"
+}
+
+// ImageDataURL 把 base64 图片转为 data URL，URL 原样返回
+func ImageDataURL(image string) string {
+	if IsImageURL(image) {
+		return image
+	}
+	return "data:" + ImageMediaType(image) + ";base64," + image
+}
+
+func IsImageURL(image string) bool {
+	for _, scheme := range []string{"data:", "http://", "https://"} {
+		if strings.HasPrefix(image, scheme) {
+			return true
+		}
+	}
+	return false
 }
 
 // 聊天响应模型
@@ -0,0 +1,193 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ResponseState server side state of a response created through the openai
+// responses api, so later requests can continue from it with previous_response_id
+type ResponseState struct {
+	ID                 string    `json:"id"`
+	PreviousResponseID string    `json:"previous_response_id"`
+	Model              string    `json:"model"`
+	Messages           string    `json:"messages"` // the conversation so far as oadin chat messages, output included
+	Response           string    `json:"response"` // the response object sent back to the client
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+func (r *ResponseState) SetCreateTime(t time.Time) { r.CreatedAt = t }
+func (r *ResponseState) SetUpdateTime(t time.Time) { r.UpdatedAt = t }
+func (r *ResponseState) PrimaryKey() string        { return "id" }
+func (r *ResponseState) TableName() string         { return "response_states" }
+func (r *ResponseState) Index() map[string]interface{} {
+	index := make(map[string]interface{})
+	if r.ID != "" {
+		index["id"] = r.ID
+	}
+	return index
+}
+
+// OadinChatMessage message of the oadin chat service
+type OadinChatMessage struct {
+	Role       string          `json:"role"`
+	Content    string          `json:"content"`
+	Thinking   string          `json:"thinking,omitempty"`
+	ToolCalls  []OadinToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string          `json:"tool_call_id,omitempty"`
+}
+
+// OadinToolCall the arguments are an object, but flavors passing openai
+// messages through may still carry them as a JSON encoded string
+type OadinToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string          `json:"name,omitempty"`
+		Arguments json.RawMessage `json:"arguments,omitempty"`
+	} `json:"function"`
+}
+
+type OadinTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string `json:"name"`
+		Description string `json:"description,omitempty"`
+		Parameters  any    `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type OadinChatRequest struct {
+	Model       string             `json:"model,omitempty"`
+	Stream      bool               `json:"stream"`
+	Messages    []OadinChatMessage `json:"messages"`
+	Tools       []OadinTool        `json:"tools,omitempty"`
+	Temperature *float64           `json:"temperature,omitempty"`
+	TopP        *float64           `json:"top_p,omitempty"`
+	MaxTokens   *int               `json:"max_tokens,omitempty"`
+}
+
+type OadinUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// OadinChatChunk response, or a chunk of a stream response, of the oadin chat service
+type OadinChatChunk struct {
+	ID           string           `json:"id"`
+	Model        string           `json:"model"`
+	Message      OadinChatMessage `json:"message"`
+	Finished     bool             `json:"finished"`
+	FinishReason string           `json:"finish_reason"`
+	Usage        *OadinUsage      `json:"usage,omitempty"`
+}
+
+// ------------------------------------------------------------
+// openai responses api
+
+type ResponsesRequest struct {
+	Model              string            `json:"model"`
+	Input              json.RawMessage   `json:"input"` // a string or a list of input items
+	Instructions       string            `json:"instructions,omitempty"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	Stream             bool              `json:"stream,omitempty"`
+	Store              *bool             `json:"store,omitempty"`
+	Tools              []ResponsesTool   `json:"tools,omitempty"`
+	Temperature        *float64          `json:"temperature,omitempty"`
+	TopP               *float64          `json:"top_p,omitempty"`
+	MaxOutputTokens    *int              `json:"max_output_tokens,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// ResponsesInputItem a message, a function call made by the model or the output of one
+type ResponsesInputItem struct {
+	Type      string          `json:"type,omitempty"` // message if empty
+	Role      string          `json:"role,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"` // a string or a list of content parts
+	CallID    string          `json:"call_id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Arguments string          `json:"arguments,omitempty"`
+	Output    string          `json:"output,omitempty"`
+}
+
+type ResponsesContentPart struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+type ResponsesTool struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters,omitempty"`
+}
+
+type ResponsesMessageItem struct {
+	Type    string                 `json:"type"`
+	ID      string                 `json:"id"`
+	Status  string                 `json:"status"`
+	Role    string                 `json:"role"`
+	Content []ResponsesContentPart `json:"content"`
+}
+
+type ResponsesFunctionCallItem struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type ResponsesUsage struct {
+	InputTokens         int            `json:"input_tokens"`
+	InputTokensDetails  map[string]int `json:"input_tokens_details"`
+	OutputTokens        int            `json:"output_tokens"`
+	OutputTokensDetails map[string]int `json:"output_tokens_details"`
+	TotalTokens         int            `json:"total_tokens"`
+}
+
+type ResponsesError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Response the response object of the responses api
+type Response struct {
+	ID                 string            `json:"id"`
+	Object             string            `json:"object"`
+	CreatedAt          int64             `json:"created_at"`
+	Status             string            `json:"status"`
+	Error              *ResponsesError   `json:"error"`
+	IncompleteDetails  map[string]string `json:"incomplete_details"`
+	Model              string            `json:"model"`
+	Instructions       *string           `json:"instructions"`
+	PreviousResponseID *string           `json:"previous_response_id"`
+	Output             []any             `json:"output"`
+	Tools              []ResponsesTool   `json:"tools"`
+	Temperature        *float64          `json:"temperature"`
+	TopP               *float64          `json:"top_p"`
+	MaxOutputTokens    *int              `json:"max_output_tokens"`
+	Store              bool              `json:"store"`
+	Usage              *ResponsesUsage   `json:"usage"`
+	Metadata           map[string]string `json:"metadata"`
+}
+
+// ResponsesStreamEvent typed event of a streamed response, e.g. response.output_text.delta
+type ResponsesStreamEvent struct {
+	Type           string                `json:"type"`
+	SequenceNumber int                   `json:"sequence_number"`
+	Response       *Response             `json:"response,omitempty"`
+	OutputIndex    *int                  `json:"output_index,omitempty"`
+	ContentIndex   *int                  `json:"content_index,omitempty"`
+	ItemID         string                `json:"item_id,omitempty"`
+	Item           any                   `json:"item,omitempty"`
+	Part           *ResponsesContentPart `json:"part,omitempty"`
+	Delta          string                `json:"delta,omitempty"`
+	Text           *string               `json:"text,omitempty"`
+	Arguments      *string               `json:"arguments,omitempty"`
+}
@@ -3,10 +3,12 @@ package types
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 )
 
 type ServiceResultType int
@@ -23,8 +25,14 @@ type ServiceResult struct {
 	Error      error
 	StatusCode int
 	HTTP       HTTPContent
+	// ServiceProvider the provider that served the request, the last one tried
+	// if it failed over
+	ServiceProvider string
 }
 
+// ServiceProviderHeader tells the client which service provider served the request
+const ServiceProviderHeader = "X-Oadin-Service-Provider"
+
 func IsDropAction(err error) bool {
 	if err == nil {
 		return false
@@ -41,10 +49,13 @@ func (sr *ServiceResult) WriteBack(w http.ResponseWriter) {
 	if sr.Type == ServiceResultFailed {
 		if httpError, ok := sr.Error.(*HTTPErrorResponse); ok {
 			clear(w.Header())
-			w.WriteHeader(httpError.StatusCode)
 			for k, v := range httpError.Header {
 				w.Header().Set(k, v[0])
 			}
+			if sr.ServiceProvider != "" {
+				w.Header().Set(ServiceProviderHeader, sr.ServiceProvider)
+			}
+			w.WriteHeader(httpError.StatusCode)
 			_, _ = w.Write(httpError.Body)
 			// event.SysEvents.NotifyHTTPResponse("send_back_response", httpError.StatusCode, w.Header(), httpError.Body)
 			return
@@ -63,6 +74,9 @@ func (sr *ServiceResult) WriteBack(w http.ResponseWriter) {
 		for k, v := range sr.HTTP.Header {
 			w.Header().Set(k, v[0])
 		}
+		if sr.ServiceProvider != "" {
+			w.Header().Set(ServiceProviderHeader, sr.ServiceProvider)
+		}
 		// event.SysEvents.NotifyHTTPResponse("send_back_response", sr.StatusCode, w.Header(), sr.HTTP.Body)
 		_, _ = w.Write(sr.HTTP.Body)
 	}
@@ -82,6 +96,89 @@ func (sr *ServiceResult) String() string {
 		stype, sr.StatusCode, sr.TaskId, sr.Error, sr.HTTP.Header, string(sr.HTTP.Body))
 }
 
+// Priority of a ServiceRequest, a higher one runs first
+const (
+	PriorityLow    = -10 // background work such as batches, queues behind interactive traffic
+	PriorityNormal = 0
+	PriorityHigh   = 10
+)
+
+// ProviderQueueStats the tasks of a service provider in the scheduler
+type ProviderQueueStats struct {
+	Running        int   `json:"running"`
+	Queued         int   `json:"queued"`
+	Rejected       int   `json:"rejected"` // refused with a full queue since the start
+	MaxConcurrency int   `json:"max_concurrency"`
+	MaxQueue       int   `json:"max_queue"`
+	AvgWaitMs      int64 `json:"avg_wait_ms"` // moving average of the time waited for a slot
+	AvgRunMs       int64 `json:"avg_run_ms"`  // moving average of the time run
+}
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open" // lets a probe through to tell whether to close again
+)
+
+// ProviderBreakerState the circuit breaker of a service provider
+type ProviderBreakerState struct {
+	State               string  `json:"state"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+	ErrorRate           float64 `json:"error_rate"` // of the recent requests
+	Requests            int     `json:"requests"`   // the recent requests counted in the error rate
+	OpenedAt            int64   `json:"opened_at,omitempty"`
+	RetryAt             int64   `json:"retry_at,omitempty"` // when an open breaker lets a probe through
+}
+
+// ProviderTokenUsage the tokens of the requests a service provider has run, as
+// it reported them, and how close the estimates of the prompts came
+type ProviderTokenUsage struct {
+	Requests              int64   `json:"requests"` // that reported their usage
+	PromptTokens          int64   `json:"prompt_tokens"`
+	CompletionTokens      int64   `json:"completion_tokens"`
+	Estimated             int64   `json:"estimated"` // requests whose prompt was estimated
+	EstimatedPromptTokens int64   `json:"estimated_prompt_tokens"`
+	EstimatedActualTokens int64   `json:"estimated_actual_tokens"` // the actual prompt tokens of the estimated requests
+	Cost                  float64 `json:"cost"`                    // of the tokens, by the prices in the properties
+}
+
+// LatencyStats how fast the requests run, averaged with more weight on the
+// recent ones
+type LatencyStats struct {
+	Requests        int64   `json:"requests"`
+	TTFTMs          float64 `json:"ttft_ms"`           // time to the first token
+	TokensPerSecond float64 `json:"tokens_per_second"` // of the completion, after the first token
+}
+
+// ProviderLatency the latency of a service provider, and of each of its models
+type ProviderLatency struct {
+	LatencyStats
+	Models map[string]LatencyStats `json:"models,omitempty"`
+}
+
+const (
+	TaskStateWaiting = "waiting"
+	TaskStateRunning = "running"
+)
+
+// TaskInfo a task in the scheduler, as the tasks api lists it
+type TaskInfo struct {
+	ID              uint64     `json:"id"`
+	Service         string     `json:"service"`
+	Flavor          string     `json:"flavor"` // of the request
+	ServiceProvider string     `json:"service_provider,omitempty"`
+	Location        string     `json:"location,omitempty"`
+	Model           string     `json:"model,omitempty"`
+	State           string     `json:"state"`
+	Priority        int        `json:"priority"`
+	Stream          bool       `json:"stream"`
+	Attempts        int        `json:"attempts"` // runs failed over so far
+	Cancelled       bool       `json:"cancelled"`
+	UserAgent       string     `json:"user_agent,omitempty"` // of the client, tells which app sent it
+	EnqueuedAt      time.Time  `json:"enqueued_at"`
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+}
+
 // ServiceRequest The body of the OriginalRequest has been read out so need to placed here
 type ServiceRequest struct {
 	AskStreamMode         bool          `json:"stream"`
@@ -96,6 +193,9 @@ type ServiceRequest struct {
 	HTTP                  HTTPContent   `json:"-"`
 	OriginalRequest       *http.Request `json:"-"`
 	Think                 bool          `json:"think"`
+	SpoolDir              string        `json:"-"` // where the files of a form are spooled, removed once the task completes
+	// Context cancels the task, e.g. once the client has gone, nil for none
+	Context context.Context `json:"-"`
 }
 
 func (sr *ServiceRequest) String() string {
@@ -110,9 +210,15 @@ type ServiceTarget struct {
 	ToFavor         string
 	XPU             string
 	ServiceProvider *ServiceProvider
+	// EmbedRerank a rerank task without a rerank model, it is scored by the
+	// embed service and has no ServiceProvider
+	EmbedRerank bool
 }
 
 func (sr *ServiceTarget) String() string {
+	if sr.EmbedRerank {
+		return fmt.Sprintf("ServiceDispatch{Location: %s, Provider: <embed>}", sr.Location)
+	}
 	return fmt.Sprintf("ServiceDispatch{Location: %s, Provider: %s}", sr.Location, sr.ServiceProvider.ProviderName)
 }
 
@@ -178,18 +284,29 @@ func (sm *StreamMode) ReadChunk(reader *bufio.Reader) ([]byte, error) {
 }
 
 // UnwrapChunk Get real data
-// event-stream is started with "data: " which need to be removed
-// TODO: event-stream may contain multiple fields, and we only need to pick
-// the data: fields. Need to handle it in the future. Currently we assume there
-// is only a data: field.
+// event-stream is started with "data: " which need to be removed.
+// event-stream may also contain other fields, e.g. the "event: " line used by
+// typed event streams such as anthropic. In that case only the data: fields are
+// picked and joined by "\n" as the spec requires
 func (sm *StreamMode) UnwrapChunk(chunk []byte) []byte {
+	if sm.Mode != StreamModeEventStream {
+		return chunk
+	}
 	// remove "data: " at the beginning of the chunk
-	if sm.Mode == StreamModeEventStream {
-		if len(chunk) >= 6 && bytes.HasPrefix(chunk, []byte("data: ")) {
-			return chunk[6:]
+	if len(chunk) >= 6 && bytes.HasPrefix(chunk, []byte("data: ")) {
+		return chunk[6:]
+	}
+	var data [][]byte
+	for _, line := range bytes.Split(chunk, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if value, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = append(data, bytes.TrimPrefix(value, []byte(" ")))
 		}
 	}
-	return chunk
+	if len(data) == 0 {
+		return chunk
+	}
+	return bytes.Join(data, []byte("\n"))
 }
 
 func (sm *StreamMode) WrapChunk(chunk []byte) []byte {
@@ -218,7 +335,8 @@ func (sm *StreamMode) WrapChunk(chunk []byte) []byte {
 		}
 	}
 
-	if sm.Mode == StreamModeEventStream && !bytes.HasPrefix(chunk, []byte("data: ")) {
+	// chunks starting with "event: " are already framed by the converter, e.g. typed events
+	if sm.Mode == StreamModeEventStream && !bytes.HasPrefix(chunk, []byte("data: ")) && !bytes.HasPrefix(chunk, []byte("event: ")) {
 		chunk = append([]byte("data: "), chunk...)
 	}
 	return chunk
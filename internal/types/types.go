@@ -51,6 +51,11 @@ type ScheduleDetails struct {
 	TimeEnqueue  time.Time
 	TimeRun      time.Time
 	TimeComplete time.Time
+	Queued       bool      // admitted to wait for a slot of its service provider
+	Attempts     int       // runs failed over so far
+	Location     string    // the side a failover runs on, empty to let the hybrid policy decide
+	NotBefore    time.Time // a failover waits here for its backoff
+	Cancelled    bool      // its context was cancelled before it completed
 }
 
 type DropAction struct{}
@@ -65,6 +70,31 @@ type ServiceProviderProperties struct {
 	ModeIsChangeable      bool     `json:"mode_is_changeable"`
 	Models                []string `json:"models"`
 	XPU                   []string `json:"xpu"`
+	MaxConcurrency        int      `json:"max_concurrency"` // tasks run at once, 0 to go by the scheduler flags
+	MaxQueue              int      `json:"max_queue"`       // tasks waiting for a slot before new ones are refused, 0 for no limit
+
+	Price       TokenPrice            `json:"price"`        // of the tokens of any model, 0 for free
+	ModelPrices map[string]TokenPrice `json:"model_prices"` // of the tokens of a model, over Price
+}
+
+// TokenPrice the price of a million tokens
+type TokenPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// PriceOf the price of the tokens of a model of the service provider
+func (p *ServiceProviderProperties) PriceOf(model string) TokenPrice {
+	if price, ok := p.ModelPrices[model]; ok {
+		return price
+	}
+	return p.Price
+}
+
+// Cost of a request to a model of the service provider
+func (p *ServiceProviderProperties) Cost(model string, promptTokens, completionTokens int) float64 {
+	price := p.PriceOf(model)
+	return (price.Input*float64(promptTokens) + price.Output*float64(completionTokens)) / 1e6
 }
 
 type RecommendConfig struct {
@@ -0,0 +1,15 @@
+package bcode
+
+import "net/http"
+
+var (
+	ResponsesCode = NewBcode(http.StatusOK, 50000, "responses interface call success")
+
+	ErrResponsesBadRequest = NewBcode(http.StatusBadRequest, 50001, "bad request")
+
+	ErrResponseNotFound = NewBcode(http.StatusNotFound, 50002, "response not found")
+
+	ErrResponsesInvokeService = NewBcode(http.StatusInternalServerError, 50003, "invoke chat service failed")
+
+	ErrResponseSaveFailed = NewBcode(http.StatusInternalServerError, 50004, "response save failed")
+)
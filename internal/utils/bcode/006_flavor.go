@@ -0,0 +1,13 @@
+package bcode
+
+import "net/http"
+
+var (
+	FlavorCode = NewBcode(http.StatusOK, 60000, "flavor interface call success")
+
+	ErrFlavorBadRequest = NewBcode(http.StatusBadRequest, 60001, "bad request")
+
+	ErrFlavorNotFound = NewBcode(http.StatusBadRequest, 60002, "flavor not found")
+
+	ErrFlavorServiceNotSupported = NewBcode(http.StatusBadRequest, 60003, "service not supported by flavor")
+)
@@ -0,0 +1,15 @@
+package bcode
+
+import "net/http"
+
+var (
+	BatchesCode = NewBcode(http.StatusOK, 70000, "batches interface call success")
+
+	ErrBatchesBadRequest = NewBcode(http.StatusBadRequest, 70001, "bad request")
+
+	ErrBatchFileNotFound = NewBcode(http.StatusNotFound, 70002, "file not found")
+
+	ErrBatchNotFound = NewBcode(http.StatusNotFound, 70003, "batch not found")
+
+	ErrBatchSaveFailed = NewBcode(http.StatusInternalServerError, 70004, "batch save failed")
+)
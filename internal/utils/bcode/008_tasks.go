@@ -0,0 +1,11 @@
+package bcode
+
+import "net/http"
+
+var (
+	TasksCode = NewBcode(http.StatusOK, 80000, "tasks interface call success")
+
+	ErrTaskBadRequest = NewBcode(http.StatusBadRequest, 80001, "bad request")
+
+	ErrTaskNotFound = NewBcode(http.StatusNotFound, 80002, "task not found")
+)
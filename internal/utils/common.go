@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bufio"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -101,6 +102,12 @@ func Contains(slice []string, target string) bool {
 }
 
 func DownloadFile(downloadURL string, saveDir string) (string, error) {
+	return DownloadFileContext(context.Background(), downloadURL, saveDir)
+}
+
+// DownloadFileContext is DownloadFile that gives up when ctx is done. The file
+// is only put in place once it is complete, a download cut short leaves nothing
+func DownloadFileContext(ctx context.Context, downloadURL string, saveDir string) (string, error) {
 	parsedURL, err := url.Parse(downloadURL)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse URL: %v", err)
@@ -133,7 +140,11 @@ func DownloadFile(downloadURL string, saveDir string) (string, error) {
 		Transport: transport,
 	}
 
-	resp, err := client.Get(downloadURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to download file: %v", err)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to download file: %v", err)
 	}
@@ -143,14 +154,22 @@ func DownloadFile(downloadURL string, saveDir string) (string, error) {
 		return "", fmt.Errorf("failed to download file: HTTP status %s", resp.Status)
 	}
 
-	file, err := os.Create(savePath)
+	partPath := savePath + ".part"
+	file, err := os.Create(partPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to create file: %v", err)
 	}
-	defer file.Close()
 
 	_, err = io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(partPath)
+		return "", fmt.Errorf("failed to save file: %v", err)
+	}
+	if err := os.Rename(partPath, savePath); err != nil {
+		os.Remove(partPath)
 		return "", fmt.Errorf("failed to save file: %v", err)
 	}
 
@@ -1,15 +1,18 @@
 package utils
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 )
 
 func TestIsHTTPText(t *testing.T) {
@@ -115,3 +118,32 @@ func TestHmacSha256(t *testing.T) {
 		t.Errorf("HmacSha256(%s, %s) = %s; want %s", s, key, result, expected)
 	}
 }
+
+func TestDownloadFileContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("part of the model"))
+		if r.URL.Path == "/stalled.bin" {
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := DownloadFileContext(ctx, server.URL+"/stalled.bin", dir); err == nil {
+		t.Fatal("a download cut short succeeds")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("a download cut short leaves %s", entries[0].Name())
+	}
+
+	path, err := DownloadFileContext(context.Background(), server.URL+"/model.bin", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "part of the model" {
+		t.Errorf("downloaded %q", data)
+	}
+}